@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/g0dsCookie/asn2ip/pkg/asn2ip"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// adminAuth only lets requests pass which carry token as bearer token.
+func adminAuth(token string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		auth := c.GetHeader("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") ||
+			subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) != 1 {
+			c.Header("WWW-Authenticate", "Bearer")
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		c.Next()
+	}
+}
+
+func (r *router) registerAdmin(admin *gin.RouterGroup) {
+	admin.GET("/cache/stats", func(c *gin.Context) {
+		stats, err := r.storage.Stats()
+		if err != nil {
+			requestLog(c).WithFields(logrus.Fields{"error": err}).Errorln("failed to read cache stats")
+			c.String(http.StatusInternalServerError, "failed to read cache stats")
+			return
+		}
+		ages := make(map[string]float64, len(stats.Ages))
+		for as, age := range stats.Ages {
+			ages[as] = age.Seconds()
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"entries":   stats.Entries,
+			"hits":      stats.Hits,
+			"misses":    stats.Misses,
+			"evictions": stats.Evictions,
+			"expired":   stats.Expired,
+			"ages":      ages,
+		})
+	})
+	admin.DELETE("/cache", func(c *gin.Context) {
+		if err := r.storage.Clear(); err != nil {
+			requestLog(c).WithFields(logrus.Fields{"error": err}).Errorln("failed to clear cache")
+			c.String(http.StatusInternalServerError, "failed to clear cache")
+			return
+		}
+		requestLog(c).Infoln("cleared cache")
+		c.Status(http.StatusNoContent)
+	})
+	admin.POST("/reload", r.reloadHandler)
+	admin.GET("/stats/top", r.topHandler)
+	admin.DELETE("/cache/:asn", func(c *gin.Context) {
+		// cache keys are normalized like the AS numbers and as-sets of lookups
+		asn, err := asn2ip.Normalize(c.Param("asn"))
+		if err != nil {
+			c.String(http.StatusBadRequest, "%s", err)
+			return
+		}
+		if err := r.storage.Delete(asn); err != nil {
+			requestLog(c).WithFields(logrus.Fields{"asn": asn, "error": err}).Errorln("failed to delete asn from cache")
+			c.String(http.StatusInternalServerError, "failed to delete AS %s from cache", asn)
+			return
+		}
+		requestLog(c).WithFields(logrus.Fields{"asn": asn}).Infoln("deleted asn from cache")
+		c.Status(http.StatusNoContent)
+	})
+}
+
+// newAdminEngine returns the handler of the separate admin listener serving metrics, health
+// checks, the admin endpoints and optionally profiling endpoints. The token is only required
+// if set, as the admin listener is expected to be reachable by operators only.
+func (r *router) newAdminEngine(token string, pprof bool) *gin.Engine {
+	engine := gin.New()
+	engine.Use(requestID)
+	engine.Use(requestLogger)
+	engine.Use(gin.Recovery())
+	engine.Use(r.useUpstreams)
+
+	engine.GET("/healthz", func(c *gin.Context) {
+		c.String(http.StatusOK, "ok\n")
+	})
+	engine.GET("/metrics", r.metricsHandler)
+	protected := engine.Group("")
+	if token != "" {
+		protected.Use(adminAuth(token))
+	}
+	r.registerAdmin(protected.Group("/admin"))
+	if pprof {
+		registerPprof(protected)
+	}
+	return engine
+}
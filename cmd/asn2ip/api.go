@@ -0,0 +1,671 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/g0dsCookie/asn2ip/pkg/asn2ip"
+	"github.com/g0dsCookie/asn2ip/pkg/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+type lookupRequest struct {
+	ASNs []string `json:"asns" binding:"required"`
+	IPv4 *bool    `json:"ipv4"`
+	IPv6 *bool    `json:"ipv6"`
+	// Family narrows ipv4 and ipv6 down to 4, 6 or all like the family query parameter.
+	Family string `json:"family"`
+}
+
+type lookupResult struct {
+	ASN   string   `json:"asn"`
+	IPv4  []string `json:"ipv4,omitempty"`
+	IPv6  []string `json:"ipv6,omitempty"`
+	Error string   `json:"error,omitempty"`
+}
+
+type routeResult struct {
+	Prefix string `json:"prefix"`
+	Origin string `json:"origin"`
+	Source string `json:"source,omitempty"`
+}
+
+type lookupIPRequest struct {
+	Addresses []string `json:"addresses" binding:"required"`
+}
+
+type lookupIPResult struct {
+	Address string        `json:"address"`
+	Routes  []routeResult `json:"routes,omitempty"`
+	Error   string        `json:"error,omitempty"`
+}
+
+// asnResponse is the stable schema of /api/v1/asn/:asn, as-sets list a result for each member.
+type asnResponse struct {
+	Query   string      `json:"query"`
+	Results []asnResult `json:"results"`
+	// Errors holds the error of each AS which failed while others were fetched.
+	Errors map[string]string `json:"errors,omitempty"`
+}
+
+type asnResult struct {
+	ASN string `json:"asn"`
+	// Name and Description are only set if requested with the names query parameter.
+	Name        string   `json:"name,omitempty"`
+	Description string   `json:"description,omitempty"`
+	IPv4        []string `json:"ipv4"`
+	IPv6        []string `json:"ipv6"`
+	// Geo locates the networks, only set if requested with enrich=geo.
+	Geo map[string]geoResult `json:"geo,omitempty"`
+	// Source and FetchedAt tell where the networks came from and when.
+	Source    string     `json:"source,omitempty"`
+	FetchedAt *time.Time `json:"fetched_at,omitempty"`
+}
+
+// ipResponse is the stable schema of /api/v1/ip/:ip.
+type ipResponse struct {
+	Address string        `json:"address"`
+	Routes  []routeResult `json:"routes"`
+}
+
+// diffResponse is the stable schema of /api/v1/asn/:asn/diff. From is the time of the
+// snapshot in effect at since, null if the AS was first seen after since or no snapshot
+// that old is kept.
+type diffResponse struct {
+	ASN     string     `json:"asn"`
+	Since   time.Time  `json:"since"`
+	From    *time.Time `json:"from"`
+	To      time.Time  `json:"to"`
+	Added   []string   `json:"added"`
+	Removed []string   `json:"removed"`
+}
+
+// historyResponse is the stable schema of /api/v1/asn/:asn/history.
+type historyResponse struct {
+	ASN      string          `json:"asn"`
+	Prefixes []prefixHistory `json:"prefixes"`
+}
+
+type prefixHistory struct {
+	Prefix    string    `json:"prefix"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// apiError is the body of all failed /api/v1 responses.
+type apiError struct {
+	Error string `json:"error"`
+}
+
+func routeResults(routes []asn2ip.Route) []routeResult {
+	results := make([]routeResult, len(routes))
+	for i, route := range routes {
+		results[i] = routeResult{Prefix: route.Prefix.String(), Origin: route.Origin, Source: route.Source}
+	}
+	return results
+}
+
+// resultOf returns the stable schema of the networks of res.
+func resultOf(res *asn2ip.ASResult) asnResult {
+	result := asnResult{
+		ASN:    res.ASN,
+		IPv4:   networkStrings(res.IPv4),
+		IPv6:   networkStrings(res.IPv6),
+		Source: res.Source,
+	}
+	if !res.FetchedAt.IsZero() {
+		fetchedAt := res.FetchedAt.UTC()
+		result.FetchedAt = &fetchedAt
+	}
+	return result
+}
+
+func networkStrings(nets []netip.Prefix) []string {
+	out := make([]string, len(nets))
+	for i, n := range nets {
+		out[i] = n.String()
+	}
+	return out
+}
+
+func (r *router) registerAPI(api *gin.RouterGroup) {
+	api.GET("/asn", r.getASN)
+	api.GET("/asn/:asn", r.getASN)
+	api.GET("/asn/:asn/summary", r.getASNSummary)
+	api.GET("/asn/:asn/diff", r.getASNDiff)
+	api.GET("/asn/:asn/history", r.getASNHistory)
+	api.GET("/asn/:asn/events", r.getASNEvents)
+	api.GET("/events", r.getEvents)
+	api.GET("/ip/*address", r.getIP)
+	api.POST("/lookup", r.lookup)
+	api.POST("/lookup-ip", r.lookupIPs)
+}
+
+func apiErrorf(c *gin.Context, code int, format string, args ...interface{}) {
+	c.JSON(code, apiError{Error: fmt.Sprintf(format, args...)})
+}
+
+// apiRequestDone is requestDone for the JSON API, timed out requests get a JSON error.
+func apiRequestDone(c *gin.Context) bool {
+	if c.Request.Context().Err() == context.DeadlineExceeded {
+		apiErrorf(c, http.StatusGatewayTimeout, "request timed out")
+		return true
+	}
+	return requestDone(c)
+}
+
+// apiFetch holds the networks fetched for a request of the JSON API, see fetchAPI.
+type apiFetch struct {
+	query  string
+	ctx    context.Context
+	ips    asn2ip.Result
+	failed map[string]error
+	expiry *asn2ip.CacheExpiry
+}
+
+// fetchAPI fetches the networks of the AS numbers or as-sets requested by c, see requestedASNs,
+// and applies the filters of its query. Failures are answered with an error, reported by ok.
+func (r *router) fetchAPI(c *gin.Context) (f apiFetch, ok bool) {
+	asn := requestedASNs(c)
+	if len(asn) == 0 {
+		apiErrorf(c, http.StatusBadRequest, "no AS number given")
+		return f, false
+	}
+	f.query = strings.Join(asn, ":")
+	for i, as := range asn {
+		normalized, err := asn2ip.Normalize(as)
+		if err != nil {
+			apiErrorf(c, http.StatusBadRequest, "%s", err)
+			return f, false
+		}
+		asn[i] = normalized
+	}
+	r.requested(c, asn...)
+	ipv4, ipv6, err := familiesFromQuery(c)
+	if err != nil {
+		apiErrorf(c, http.StatusBadRequest, "%s", err)
+		return f, false
+	}
+	ctx, err := requestContext(c)
+	if err != nil {
+		apiErrorf(c, http.StatusBadRequest, "%s", err)
+		return f, false
+	}
+	filters, err := r.filters.fromQuery(c)
+	if err != nil {
+		apiErrorf(c, http.StatusBadRequest, "%s", err)
+		return f, false
+	}
+
+	f.ctx, f.expiry = asn2ip.ContextWithCacheExpiry(ctx)
+	ips, err := r.upstreams(c).fetcher.FetchContext(f.ctx, ipv4, ipv6, asn...)
+	f.failed, err = partialResult(len(ips.ASNs()), err)
+	if err != nil {
+		if apiRequestDone(c) {
+			return f, false
+		}
+		if errors.Is(err, asn2ip.ErrASNotFound) {
+			apiErrorf(c, http.StatusNotFound, "%s", err)
+			return f, false
+		}
+		if errors.Is(err, asn2ip.ErrTimeout) {
+			apiErrorf(c, http.StatusGatewayTimeout, "timed out fetching ip addresses for AS %s", strings.Join(asn, ":"))
+			return f, false
+		}
+		requestLog(c).WithFields(logrus.Fields{"error": err}).Warnln("failed to fetch networks")
+		apiErrorf(c, http.StatusBadGateway, "failed to fetch ip addresses for AS %s", strings.Join(asn, ":"))
+		return f, false
+	}
+	logFailed(c, f.failed)
+	filters.applyAll(ips)
+	auditOf(c).returnedResult(ips)
+	f.ips = ips
+	return f, true
+}
+
+// writeAPI responds with resp as JSON, cached as long as the networks it was built from.
+func (r *router) writeAPI(c *gin.Context, f apiFetch, resp interface{}) {
+	data, err := json.Marshal(resp)
+	if err != nil {
+		apiErrorf(c, http.StatusInternalServerError, "failed to encode response")
+		return
+	}
+	r.setCacheControl(c, f.expiry)
+	writePartial(c, "application/json; charset=utf-8", data, f.failed)
+}
+
+// getASN returns the networks of one or more AS numbers or as-sets, see requestedASNs.
+// Unlike /:asn the response is always JSON and does not change with the Accept header.
+// With the since query parameter only the changes of a single AS are returned, see getASNDelta.
+func (r *router) getASN(c *gin.Context) {
+	if _, ok := c.GetQuery("since"); ok {
+		r.getASNDelta(c)
+		return
+	}
+	names, err := namesFromQuery(c)
+	if err != nil {
+		apiErrorf(c, http.StatusBadRequest, "%s", err)
+		return
+	}
+	geo, err := enrichFromQuery(c)
+	if err != nil {
+		apiErrorf(c, http.StatusBadRequest, "%s", err)
+		return
+	}
+	up := r.upstreams(c)
+	if geo && up.geo == nil {
+		apiErrorf(c, http.StatusNotImplemented, "no geoip database configured")
+		return
+	}
+	f, ok := r.fetchAPI(c)
+	if !ok {
+		return
+	}
+	var infos map[string]asn2ip.ASInfo
+	if names {
+		infos = r.lookupNames(c, f.ctx, f.ips.ASNs())
+	}
+
+	resp := asnResponse{Query: f.query, Results: make([]asnResult, 0, len(f.ips)), Errors: errorStrings(f.failed)}
+	for _, as := range f.ips.ASNs() {
+		result := resultOf(f.ips[as])
+		result.Name, result.Description = infos[as].Name, infos[as].Description
+		if geo {
+			result.Geo = locate(c, up.geo, f.ips[as].IPv4, f.ips[as].IPv6)
+		}
+		resp.Results = append(resp.Results, result)
+	}
+	r.writeAPI(c, f, resp)
+}
+
+// getASNSummary returns statistics of the networks of one or more AS numbers or as-sets
+// instead of the networks themselves.
+func (r *router) getASNSummary(c *gin.Context) {
+	f, ok := r.fetchAPI(c)
+	if !ok {
+		return
+	}
+	r.writeAPI(c, f, summarize(f.query, f.ips, time.Now()))
+}
+
+// getASNDiff returns the networks added and removed since the time given by the since
+// query parameter, as recorded by the storage snapshots.
+func (r *router) getASNDiff(c *gin.Context) {
+	snapshots, ok := r.storage.(storage.SnapshotStorage)
+	if !ok {
+		apiErrorf(c, http.StatusNotImplemented, "storage does not support snapshots")
+		return
+	}
+	as, err := asn2ip.NormalizeASN(c.Param("asn"))
+	if err != nil {
+		apiErrorf(c, http.StatusBadRequest, "%s", err)
+		return
+	}
+	since, err := parseSince(c.Query("since"))
+	if err != nil {
+		apiErrorf(c, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	var snaps []storage.Snapshot
+	if !r.fetchRecorded(c, as, "snapshots", func() (n int, err error) {
+		snaps, err = snapshots.Snapshots(as, since)
+		return len(snaps), err
+	}) {
+		return
+	}
+
+	resp := diffResponse{ASN: as, Since: since, To: snaps[len(snaps)-1].Time}
+	var previous []netip.Prefix
+	if !snaps[0].Time.After(since) {
+		resp.From = &snaps[0].Time
+		previous = snaps[0].IPAddresses()
+	}
+	change := asn2ip.Diff(as, previous, snaps[len(snaps)-1].IPAddresses())
+	resp.Added, resp.Removed = networkStrings(change.Added), networkStrings(change.Removed)
+	c.JSON(http.StatusOK, resp)
+}
+
+// getASNDelta returns the networks added and removed since the time given by the since query
+// parameter like getASNDiff, but taken from the prefix change log, which unlike snapshots is
+// kept for good.
+func (r *router) getASNDelta(c *gin.Context) {
+	historyStorage, ok := r.storage.(storage.HistoryStorage)
+	if !ok {
+		apiErrorf(c, http.StatusNotImplemented, "storage does not record prefix history")
+		return
+	}
+	asn := requestedASNs(c)
+	if len(asn) != 1 {
+		apiErrorf(c, http.StatusBadRequest, "since requires a single AS number")
+		return
+	}
+	as, err := asn2ip.NormalizeASN(asn[0])
+	if err != nil {
+		apiErrorf(c, http.StatusBadRequest, "%s", err)
+		return
+	}
+	r.requested(c, as)
+	since, err := parseSince(c.Query("since"))
+	if err != nil {
+		apiErrorf(c, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	var log storage.ChangeLog
+	if !r.fetchRecorded(c, as, "prefix history", func() (n int, err error) {
+		log, err = historyStorage.Changes(as)
+		return len(log.Changes) + len(log.Present), err
+	}) {
+		return
+	}
+
+	resp := diffResponse{ASN: as, Since: since, To: log.Start}
+	if len(log.Changes) > 0 {
+		resp.To = log.Changes[len(log.Changes)-1].Time
+	}
+	added, removed, from, ok := log.Since(since)
+	if ok {
+		resp.From = &from
+	}
+	resp.Added, resp.Removed = networkStrings(added), networkStrings(removed)
+	c.JSON(http.StatusOK, resp)
+}
+
+// getASNHistory returns when each prefix ever seen for an AS was first and last seen.
+func (r *router) getASNHistory(c *gin.Context) {
+	historyStorage, ok := r.storage.(storage.HistoryStorage)
+	if !ok {
+		apiErrorf(c, http.StatusNotImplemented, "storage does not record prefix history")
+		return
+	}
+	as, err := asn2ip.NormalizeASN(c.Param("asn"))
+	if err != nil {
+		apiErrorf(c, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	var history []storage.PrefixHistory
+	if !r.fetchRecorded(c, as, "prefix history", func() (n int, err error) {
+		history, err = historyStorage.History(as)
+		return len(history), err
+	}) {
+		return
+	}
+
+	resp := historyResponse{ASN: as, Prefixes: make([]prefixHistory, len(history))}
+	for i, h := range history {
+		resp.Prefixes[i] = prefixHistory{Prefix: h.Prefix.String(), FirstSeen: h.FirstSeen, LastSeen: h.LastSeen}
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// fetchRecorded brings the cache of as and thereby what the storage records about it up to
+// date, unknown ASNs are recorded as empty. It then calls read, which returns the number of
+// records of as read from the storage. Failures and an empty record are answered and false is
+// returned.
+func (r *router) fetchRecorded(c *gin.Context, as, what string, read func() (int, error)) bool {
+	if _, err := r.upstreams(c).fetcher.FetchContext(c.Request.Context(), true, true, as); err != nil && !errors.Is(err, asn2ip.ErrASNotFound) {
+		if apiRequestDone(c) {
+			return false
+		}
+		requestLog(c).WithFields(logrus.Fields{"error": err}).Warnln("failed to fetch networks")
+		apiErrorf(c, http.StatusBadGateway, "failed to fetch ip addresses for AS %s", as)
+		return false
+	}
+	n, err := read()
+	if errors.Is(err, storage.ErrSnapshotsDisabled) || errors.Is(err, storage.ErrHistoryDisabled) {
+		apiErrorf(c, http.StatusNotImplemented, "%s", err)
+		return false
+	} else if err != nil {
+		requestLog(c).WithFields(logrus.Fields{"asn": as, "error": err}).Errorln("failed to read " + what)
+		apiErrorf(c, http.StatusInternalServerError, "failed to read %s of AS %s", what, as)
+		return false
+	}
+	if n == 0 {
+		apiErrorf(c, http.StatusNotFound, "no %s of AS %s", what, as)
+		return false
+	}
+	return true
+}
+
+// parseSince parses a RFC 3339 timestamp, unix timestamp or a duration relative to now.
+func parseSince(v string) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, errors.New("since query parameter is required")
+	}
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	if unix, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Unix(unix, 0), nil
+	}
+	if d, err := time.ParseDuration(v); err == nil && d >= 0 {
+		return time.Now().Add(-d), nil
+	}
+	return time.Time{}, errors.Errorf("invalid since %q, expected a RFC 3339 or unix timestamp or a duration", v)
+}
+
+// getIP returns the originating AS numbers and route objects of an ip address or network.
+func (r *router) getIP(c *gin.Context) {
+	address := strings.TrimPrefix(c.Param("address"), "/")
+	if _, err := asn2ip.ParseAddress(address); err != nil {
+		apiErrorf(c, http.StatusBadRequest, "%s", err)
+		return
+	}
+	ctx, err := requestContext(c)
+	if err != nil {
+		apiErrorf(c, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	routes, err := r.upstreams(c).resolver.LookupIP(ctx, address)
+	if err != nil {
+		if apiRequestDone(c) {
+			return
+		}
+		if errors.Is(err, asn2ip.ErrRouteNotFound) {
+			apiErrorf(c, http.StatusNotFound, "no route found for %s", address)
+			return
+		}
+		if errors.Is(err, asn2ip.ErrTimeout) {
+			apiErrorf(c, http.StatusGatewayTimeout, "timed out looking up routes for %s", address)
+			return
+		}
+		requestLog(c).WithFields(logrus.Fields{"error": err}).Warnln("failed to lookup routes")
+		apiErrorf(c, http.StatusBadGateway, "failed to lookup routes for %s", address)
+		return
+	}
+	c.JSON(http.StatusOK, ipResponse{Address: address, Routes: routeResults(routes)})
+}
+
+// bindLookup decodes the JSON body of a bulk lookup into req. Bodies larger than maxBodyBytes
+// are answered with 413, invalid requests with 400.
+func (r *router) bindLookup(c *gin.Context, req interface{}) bool {
+	body := io.Reader(c.Request.Body)
+	if r.maxBodyBytes > 0 {
+		body = io.LimitReader(body, r.maxBodyBytes+1)
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		apiErrorf(c, http.StatusBadRequest, "failed to read lookup request: %s", err)
+		return false
+	}
+	if r.maxBodyBytes > 0 && int64(len(data)) > r.maxBodyBytes {
+		apiErrorf(c, http.StatusRequestEntityTooLarge, "lookup request exceeds the maximum of %d bytes", r.maxBodyBytes)
+		return false
+	}
+	if err := binding.JSON.BindBody(data, req); err != nil {
+		apiErrorf(c, http.StatusBadRequest, "invalid lookup request: %s", err)
+		return false
+	}
+	return true
+}
+
+// tooManyLookups answers bulk lookups of more than maxLookups AS numbers or addresses with 413.
+func (r *router) tooManyLookups(c *gin.Context, n int) bool {
+	if r.maxLookups <= 0 || n <= r.maxLookups {
+		return false
+	}
+	apiErrorf(c, http.StatusRequestEntityTooLarge, "lookup request of %d entries exceeds the maximum of %d", n, r.maxLookups)
+	return true
+}
+
+// lookup fetches each requested AS on its own so a failing AS doesn't fail the others.
+func (r *router) lookup(c *gin.Context) {
+	req := lookupRequest{}
+	if !r.bindLookup(c, &req) || r.tooManyLookups(c, len(req.ASNs)) {
+		return
+	}
+	ipv4, ipv6, err := selectFamilies(req.Family, req.IPv4 == nil || *req.IPv4, req.IPv6 == nil || *req.IPv6)
+	if err != nil {
+		apiErrorf(c, http.StatusBadRequest, "%s", err)
+		return
+	}
+	ctx, err := requestContext(c)
+	if err != nil {
+		apiErrorf(c, http.StatusBadRequest, "%s", err)
+		return
+	}
+	filters, err := r.filters.fromQuery(c)
+	if err != nil {
+		apiErrorf(c, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	results := make([]lookupResult, len(req.ASNs))
+	sem := make(chan struct{}, r.maxConcurrency)
+	wg := sync.WaitGroup{}
+	for i, as := range req.ASNs {
+		results[i].ASN = as
+		normalized, err := asn2ip.Normalize(as)
+		if err != nil {
+			results[i].Error = err.Error()
+			continue
+		}
+		results[i].ASN = normalized
+		r.requested(c, normalized)
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(res *lookupResult) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			ips, err := r.upstreams(c).fetcher.FetchContext(ctx, ipv4, ipv6, res.ASN)
+			if err != nil {
+				res.Error = err.Error()
+			}
+			// failed members of as-sets are reported along with the networks of the others
+			if _, err := partialResult(len(ips.ASNs()), err); err != nil {
+				return
+			}
+			// as-sets return results for each member, merge them
+			res.IPv4, res.IPv6 = []string{}, []string{}
+			for _, as := range ips.ASNs() {
+				ipv4, ipv6 := filters.apply(ips[as].IPv4), filters.apply(ips[as].IPv6)
+				res.IPv4 = append(res.IPv4, networkStrings(ipv4)...)
+				res.IPv6 = append(res.IPv6, networkStrings(ipv6)...)
+				auditOf(c).returned(len(ipv4)+len(ipv6), ips[as].Source)
+			}
+		}(&results[i])
+	}
+	wg.Wait()
+
+	c.JSON(http.StatusOK, gin.H{"results": results})
+}
+
+// lookupIP returns the originating AS numbers and route objects of an ip address or network.
+func (r *router) lookupIP(c *gin.Context) {
+	address := strings.TrimPrefix(c.Param("address"), "/")
+	if _, err := asn2ip.ParseAddress(address); err != nil {
+		c.String(http.StatusBadRequest, "%s", err)
+		return
+	}
+	ctx, err := requestContext(c)
+	if err != nil {
+		c.String(http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	routes, err := r.upstreams(c).resolver.LookupIP(ctx, address)
+	if err != nil {
+		if requestDone(c) {
+			return
+		}
+		if errors.Is(err, asn2ip.ErrRouteNotFound) {
+			c.String(http.StatusNotFound, "no route found for %s", address)
+			return
+		}
+		requestLog(c).WithFields(logrus.Fields{"error": err}).Warnln("failed to lookup routes")
+		c.String(http.StatusBadGateway, "failed to lookup routes for %s", address)
+		return
+	}
+
+	if wantJson(c) {
+		c.JSON(http.StatusOK, gin.H{"address": address, "routes": routeResults(routes)})
+		return
+	}
+
+	lines := make([]string, len(routes))
+	for i, route := range routes {
+		lines[i] = fmt.Sprintf("AS%s %s", route.Origin, route.Prefix)
+	}
+	c.String(http.StatusOK, strings.Join(lines, "\n")+"\n")
+}
+
+// lookupIPs resolves multiple addresses at once, using a single bulk query if the resolver supports it.
+func (r *router) lookupIPs(c *gin.Context) {
+	req := lookupIPRequest{}
+	if !r.bindLookup(c, &req) || r.tooManyLookups(c, len(req.Addresses)) {
+		return
+	}
+	ctx, err := requestContext(c)
+	if err != nil {
+		apiErrorf(c, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	results := make([]lookupIPResult, len(req.Addresses))
+	valid := make([]string, 0, len(req.Addresses))
+	for i, address := range req.Addresses {
+		results[i].Address = address
+		if _, err := asn2ip.ParseAddress(address); err != nil {
+			results[i].Error = err.Error()
+			continue
+		}
+		valid = append(valid, address)
+	}
+
+	routes, err := asn2ip.LookupIPs(ctx, r.upstreams(c).resolver, valid)
+	if err != nil {
+		if apiRequestDone(c) {
+			return
+		}
+		requestLog(c).WithFields(logrus.Fields{"error": err}).Warnln("failed to lookup routes")
+		apiErrorf(c, http.StatusBadGateway, "failed to lookup routes")
+		return
+	}
+	for i := range results {
+		if results[i].Error != "" {
+			continue
+		}
+		if found, ok := routes[results[i].Address]; ok && len(found) > 0 {
+			results[i].Routes = routeResults(found)
+		} else {
+			results[i].Error = "no route found"
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"results": results})
+}
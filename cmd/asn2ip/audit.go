@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/g0dsCookie/asn2ip/pkg/asn2ip"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// auditKey is the gin context key of the auditRecord of a request.
+const auditKey = "audit"
+
+// auditEntry is a line of the audit log.
+type auditEntry struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id"`
+	ClientIP  string    `json:"client_ip"`
+	// APIKey is the name of the api key used, never the key itself.
+	APIKey string   `json:"api_key,omitempty"`
+	Method string   `json:"method"`
+	Path   string   `json:"path"`
+	Status int      `json:"status"`
+	ASNs   []string `json:"asns"`
+	// Prefixes is the number of networks returned, Cache whether they were served from the
+	// cache: hit, miss or partial if only some were.
+	Prefixes int    `json:"prefixes"`
+	Cache    string `json:"cache,omitempty"`
+}
+
+// auditLog writes a JSON line per lookup request to a file, or to stdout if the path is "-".
+// It is always installed, so it can be enabled by reloading.
+type auditLog struct {
+	mu  sync.Mutex
+	out io.WriteCloser
+}
+
+func newAuditLog(path string) (*auditLog, error) {
+	a := &auditLog{}
+	return a, a.set(path)
+}
+
+// set writes to path from now on, disables the audit log if path is empty. The file is opened
+// again even if path did not change, so reloading picks up rotated files.
+func (a *auditLog) set(path string) error {
+	var out io.WriteCloser
+	switch path {
+	case "":
+	case "-":
+		out = nopCloser{os.Stdout}
+	default:
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+		if err != nil {
+			return errors.Wrap(err, "failed to open audit log")
+		}
+		out = f
+	}
+	a.mu.Lock()
+	prev := a.out
+	a.out = out
+	a.mu.Unlock()
+	if prev != nil {
+		return prev.Close()
+	}
+	return nil
+}
+
+func (a *auditLog) Close() error {
+	return a.set("")
+}
+
+type nopCloser struct{ io.Writer }
+
+func (nopCloser) Close() error { return nil }
+
+// record is a middleware writing the audit entry of a request once it has been served.
+func (a *auditLog) record(c *gin.Context) {
+	a.mu.Lock()
+	enabled := a.out != nil
+	a.mu.Unlock()
+	if !enabled {
+		return
+	}
+	audit := &auditRecord{}
+	c.Set(auditKey, audit)
+	c.Next()
+
+	entry := auditEntry{
+		Time:      time.Now().UTC(),
+		RequestID: c.GetString("requestID"),
+		ClientIP:  c.ClientIP(),
+		APIKey:    c.GetString("apiKey"),
+		Method:    c.Request.Method,
+		Path:      c.Request.URL.Path,
+		Status:    c.Writer.Status(),
+	}
+	audit.fill(&entry)
+	line, err := json.Marshal(entry)
+	if err != nil {
+		requestLog(c).WithFields(logrus.Fields{"error": err}).Errorln("failed to encode audit entry")
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.out == nil {
+		return
+	}
+	if _, err := a.out.Write(append(line, '\n')); err != nil {
+		requestLog(c).WithFields(logrus.Fields{"error": err}).Errorln("failed to write audit log")
+	}
+}
+
+// auditRecord collects the AS numbers requested and the networks returned by a request. A nil
+// auditRecord records nothing.
+type auditRecord struct {
+	mu       sync.Mutex
+	asns     []string
+	prefixes int
+	cached   int
+	fetched  int
+}
+
+// auditOf returns the auditRecord of c, nil if the audit log is disabled.
+func auditOf(c *gin.Context) *auditRecord {
+	v, _ := c.Get(auditKey)
+	audit, _ := v.(*auditRecord)
+	return audit
+}
+
+func (a *auditRecord) requested(asn ...string) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.asns = append(a.asns, asn...)
+}
+
+// returned records the networks of an AS, fetched from source.
+func (a *auditRecord) returned(prefixes int, source string) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.prefixes += prefixes
+	if source == asn2ip.SourceCache {
+		a.cached++
+	} else {
+		a.fetched++
+	}
+}
+
+// returnedResult records the networks of all ASNs of ips.
+func (a *auditRecord) returnedResult(ips asn2ip.Result) {
+	for _, as := range ips.ASNs() {
+		a.returned(len(ips[as].IPv4)+len(ips[as].IPv6), ips[as].Source)
+	}
+}
+
+func (a *auditRecord) fill(entry *auditEntry) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	entry.ASNs, entry.Prefixes = a.asns, a.prefixes
+	if entry.ASNs == nil {
+		entry.ASNs = []string{}
+	}
+	switch {
+	case a.cached > 0 && a.fetched > 0:
+		entry.Cache = "partial"
+	case a.cached > 0:
+		entry.Cache = "hit"
+	case a.fetched > 0:
+		entry.Cache = "miss"
+	}
+}
+
+// requested counts the AS numbers or as-sets asn requested by c and records them in its audit entry.
+func (r *router) requested(c *gin.Context, asn ...string) {
+	r.queries.count(asn...)
+	auditOf(c).requested(asn...)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto/sha256"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"golang.org/x/time/rate"
+	"gopkg.in/yaml.v2"
+)
+
+// apiKey is a client allowed to query the daemon.
+type apiKey struct {
+	Name string `yaml:"name"`
+	Key  string `yaml:"key"`
+	// Rate limits the requests per second, unlimited if zero.
+	Rate float64 `yaml:"rate"`
+	// Burst is the number of requests allowed at once, defaults to the rate.
+	Burst int `yaml:"burst"`
+	// Endpoints lists the allowed routes like /:asn or /api/v1/*, a trailing * matches
+	// any route with that prefix. All endpoints are allowed if empty.
+	Endpoints []string `yaml:"endpoints"`
+}
+
+type authOptions struct {
+	Keys []apiKey
+	// AnonymousLookups allows read-only lookups without an api key.
+	AnonymousLookups bool
+}
+
+// parseAPIKeys parses keys given as name=key.
+func parseAPIKeys(values []string) ([]apiKey, error) {
+	keys := make([]apiKey, 0, len(values))
+	for _, v := range values {
+		i := strings.Index(v, "=")
+		if i < 1 || i == len(v)-1 {
+			return nil, errors.Errorf("invalid api key %q, expected name=key", v)
+		}
+		keys = append(keys, apiKey{Name: v[:i], Key: v[i+1:]})
+	}
+	return keys, nil
+}
+
+// loadAPIKeys reads keys from a yaml file with a list of keys below "keys".
+func loadAPIKeys(path string) ([]apiKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read api keys from %s", path)
+	}
+	file := struct {
+		Keys []apiKey `yaml:"keys"`
+	}{}
+	if err := yaml.UnmarshalStrict(data, &file); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse api keys from %s", path)
+	}
+	return file.Keys, nil
+}
+
+type authKey struct {
+	apiKey
+	limiter *rate.Limiter
+}
+
+func (k *authKey) allowed(route string) bool {
+	if len(k.Endpoints) == 0 {
+		return true
+	}
+	for _, e := range k.Endpoints {
+		if e == route || (strings.HasSuffix(e, "*") && strings.HasPrefix(route, strings.TrimSuffix(e, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticator checks the api keys of requests. Keys are looked up by their hash to not
+// leak them through timing.
+type authenticator struct {
+	keys             map[[sha256.Size]byte]*authKey
+	anonymousLookups bool
+}
+
+func newAuthenticator(opts authOptions) (*authenticator, error) {
+	a := &authenticator{keys: map[[sha256.Size]byte]*authKey{}, anonymousLookups: opts.AnonymousLookups}
+	for _, k := range opts.Keys {
+		if k.Key == "" {
+			return nil, errors.Errorf("api key %s is empty", k.Name)
+		}
+		hash := sha256.Sum256([]byte(k.Key))
+		if _, ok := a.keys[hash]; ok {
+			return nil, errors.Errorf("api key %s is defined twice", k.Name)
+		}
+		key := &authKey{apiKey: k}
+		if k.Rate > 0 {
+			burst := k.Burst
+			if burst < 1 {
+				burst = int(math.Max(1, k.Rate))
+			}
+			key.limiter = rate.NewLimiter(rate.Limit(k.Rate), burst)
+		}
+		a.keys[hash] = key
+	}
+	return a, nil
+}
+
+// requestKey returns the api key sent as bearer token or X-API-Key header.
+func requestKey(c *gin.Context) string {
+	if key := c.GetHeader("X-API-Key"); key != "" {
+		return key
+	}
+	if auth := c.GetHeader("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return ""
+}
+
+// lookups authenticates read-only lookup endpoints.
+func (a *authenticator) lookups(c *gin.Context) {
+	sent := requestKey(c)
+	if sent == "" {
+		if a.anonymousLookups {
+			c.Next()
+			return
+		}
+		c.Header("WWW-Authenticate", "Bearer")
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+
+	key, ok := a.keys[sha256.Sum256([]byte(sent))]
+	if !ok {
+		c.Header("WWW-Authenticate", "Bearer")
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+	c.Set("apiKey", key.Name)
+	if !key.allowed(c.FullPath()) {
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+	if key.limiter != nil {
+		// the key limit replaces the per client limit
+		c.Set("apiKeyLimited", true)
+		if delay := reserve(key.limiter); delay > 0 {
+			tooManyRequests(c, delay)
+			return
+		}
+	}
+	c.Next()
+}
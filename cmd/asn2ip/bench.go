@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/g0dsCookie/asn2ip/internal/config"
+	"github.com/g0dsCookie/asn2ip/pkg/asn2ip"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+// benchResult holds the measurements of a single whois server.
+type benchResult struct {
+	server   string
+	connect  time.Duration
+	query    time.Duration
+	prefixes int
+	err      error
+}
+
+// benchHandler queries a sample AS from each server and prints their average latencies and
+// how many of the networks known to any of the servers they returned.
+func benchHandler(c *cli.Context) error {
+	conf, err := setup(c)
+	if err != nil {
+		return err
+	}
+	bench := config.NewBenchConfig()
+	bench.UpdateFromCLIContext(c)
+
+	as, err := asn2ip.NormalizeASN(bench.GetString("bench.asn"))
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"error": err}).Errorln("invalid as number")
+		return cli.Exit("", exitInput)
+	}
+	rounds := bench.GetInt("bench.rounds")
+	if rounds < 1 {
+		logrus.WithFields(logrus.Fields{"rounds": rounds}).Errorln("rounds must be positive")
+		return cli.Exit("", exitInput)
+	}
+	servers := []string{}
+	for _, server := range strings.Split(bench.GetString("bench.servers"), ",") {
+		if server = strings.TrimSpace(server); server != "" {
+			servers = append(servers, server)
+		}
+	}
+	if len(servers) == 0 {
+		servers = []string{conf.GetString("whois.host")}
+	}
+	sources, err := irrSources(conf)
+	if err != nil {
+		return err
+	}
+	source, err := sourceOptionsFromConfig(conf)
+	if err != nil {
+		return err
+	}
+
+	results := make([]benchResult, len(servers))
+	most, failed := 0, 0
+	for i, server := range servers {
+		results[i] = benchServer(c.Context, server, conf.GetInt("whois.port"), as, rounds, source.Timeouts, sources)
+		if results[i].err != nil {
+			logrus.WithFields(logrus.Fields{"server": server, "error": results[i].err}).Errorln("failed to benchmark whois server")
+			failed++
+		} else if results[i].prefixes > most {
+			most = results[i].prefixes
+		}
+	}
+
+	fmt.Printf("%-30s %-10s %-10s %-9s %s\n", "SERVER", "CONNECT", "QUERY", "PREFIXES", "COMPLETE")
+	for _, r := range results {
+		if r.err != nil {
+			fmt.Printf("%-30s %-10s %-10s %-9s %s\n", r.server, "-", "-", "-", "failed")
+			continue
+		}
+		complete := 100.0
+		if most > 0 {
+			complete = float64(r.prefixes) * 100 / float64(most)
+		}
+		fmt.Printf("%-30s %-10s %-10s %-9d %.0f%%\n", r.server, r.connect.Round(100*time.Microsecond),
+			r.query.Round(100*time.Microsecond), r.prefixes, complete)
+	}
+	if failed == len(servers) {
+		return cli.Exit("", exitUnreachable)
+	}
+	return nil
+}
+
+// benchServer measures the average time to connect to server and to fetch both ip versions
+// of as over an established connection. Retries are disabled, so a slow server isn't hidden.
+func benchServer(ctx context.Context, server string, defaultPort int, as string, rounds int, timeouts asn2ip.TimeoutOptions, sources []string) benchResult {
+	res := benchResult{server: server}
+	host, port, err := splitServer(server, defaultPort)
+	if err != nil {
+		res.err = err
+		return res
+	}
+	address := net.JoinHostPort(host, strconv.Itoa(port))
+
+	dialer := &net.Dialer{Timeout: timeouts.Connect}
+	for i := 0; i < rounds; i++ {
+		start := time.Now()
+		c, err := dialer.DialContext(ctx, "tcp", address)
+		if err != nil {
+			res.err = err
+			return res
+		}
+		res.connect += time.Since(start)
+		c.Close()
+	}
+	res.connect /= time.Duration(rounds)
+
+	fetcher := asn2ip.NewFetcher(host, port, asn2ip.WithTimeouts(timeouts), asn2ip.WithSources(sources...),
+		asn2ip.WithPool(asn2ip.PoolOptions{MaxIdle: 1, IdleTimeout: time.Minute}))
+	defer fetcher.Close()
+	// the first fetch opens the connection reused by the measured ones
+	for i := 0; i <= rounds; i++ {
+		start := time.Now()
+		ips, err := fetcher.FetchContext(ctx, true, true, as)
+		// a server not knowing the AS is as incomplete as it gets, but still measured
+		if err != nil && !errors.Is(err, asn2ip.ErrASNotFound) {
+			res.err = err
+			return res
+		}
+		if i > 0 {
+			res.query += time.Since(start)
+		}
+		res.prefixes = 0
+		if err == nil {
+			res.prefixes = len(ips[as].IPv4) + len(ips[as].IPv6)
+		}
+	}
+	res.query /= time.Duration(rounds)
+	return res
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"time"
+
+	"github.com/g0dsCookie/asn2ip/internal/config"
+	"github.com/g0dsCookie/asn2ip/pkg/asn2ip"
+	"github.com/g0dsCookie/asn2ip/pkg/storage"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+// cacheEntry is a cached AS as written by cache export and read by cache import.
+type cacheEntry struct {
+	ASN         string         `json:"asn"`
+	IPv4        []netip.Prefix `json:"ipv4"`
+	IPv6        []netip.Prefix `json:"ipv6"`
+	FetchedIPv4 bool           `json:"fetched_ipv4"`
+	FetchedIPv6 bool           `json:"fetched_ipv6"`
+	NotFound    bool           `json:"not_found,omitempty"`
+	Stored      time.Time      `json:"stored"`
+	Expires     time.Time      `json:"expires"`
+}
+
+// openCache sets up the command and opens the storage backend configured by its flags.
+func openCache(c *cli.Context) (storage.Storage, error) {
+	if _, err := setup(c); err != nil {
+		return nil, err
+	}
+	return openStorage(c)
+}
+
+// openStorage opens the storage backend configured by the flags of c, the memory backend is
+// refused as it is always empty.
+func openStorage(c *cli.Context) (storage.Storage, error) {
+	stor := config.NewStorageConfig()
+	stor.UpdateFromCLIContext(c)
+	opts, err := storageOptionsFromConfig(stor)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Name == "" {
+		logrus.WithFields(logrus.Fields{"command": c.Command.Name}).Errorln("command requires a storage backend set with --storage-name")
+		return nil, cli.Exit("", exitConfig)
+	}
+	cache, err := storage.NewStorage(opts)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"error": err}).Errorln("failed to initialize storage")
+		return nil, cli.Exit("", exitConfig)
+	}
+	return cache, nil
+}
+
+// listCache returns all cached entries of cache.
+func listCache(cache storage.Storage) ([]storage.ASStorage, error) {
+	lister, ok := cache.(storage.ListStorage)
+	if !ok {
+		logrus.Errorln("storage can not list cached AS numbers")
+		return nil, cli.Exit("", exitConfig)
+	}
+	entries, err := lister.List()
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"error": err}).Errorln("failed to list cached AS numbers")
+		return nil, cli.Exit("", exitError)
+	}
+	return entries, nil
+}
+
+func cacheListHandler(c *cli.Context) error {
+	cache, err := openCache(c)
+	if err != nil {
+		return err
+	}
+	defer cache.Close()
+	entries, err := listCache(cache)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%-12s %-6s %-6s %-25s %s\n", "ASN", "IPV4", "IPV6", "STORED", "EXPIRES")
+	for _, e := range entries {
+		ipv4, ipv6 := familyCount(e.FetchedIPv4, e.IPv4), familyCount(e.FetchedIPv6, e.IPv6)
+		if e.NotFound {
+			ipv4, ipv6 = "-", "-"
+		}
+		fmt.Printf("%-12s %-6s %-6s %-25s %s\n", "AS"+e.AS, ipv4, ipv6, e.Stored.Format(time.RFC3339), e.Expires.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// familyCount returns the number of cached networks of a family, empty if it wasn't fetched.
+func familyCount(fetched bool, nets []netip.Prefix) string {
+	if !fetched {
+		return ""
+	}
+	return fmt.Sprint(len(nets))
+}
+
+func cacheShowHandler(c *cli.Context) error {
+	if c.NArg() != 1 {
+		logrus.Errorln("cache show requires exactly one AS number")
+		return cli.Exit("", exitInput)
+	}
+	as, err := asn2ip.NormalizeASN(c.Args().First())
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"error": err}).Errorln("invalid as number")
+		return cli.Exit("", exitInput)
+	}
+	cache, err := openCache(c)
+	if err != nil {
+		return err
+	}
+	defer cache.Close()
+
+	e, err := cache.Get(as)
+	if errors.Is(err, storage.ErrASNotCached) {
+		logrus.WithFields(logrus.Fields{"asn": as}).Errorln("as number not cached")
+		return cli.Exit("", exitNotFound)
+	} else if err != nil {
+		logrus.WithFields(logrus.Fields{"asn": as, "error": err}).Errorln("failed to read cache")
+		return cli.Exit("", exitError)
+	}
+	fmt.Printf("AS%s stored %s, expires %s\n", as, e.Stored.Format(time.RFC3339), e.Expires.Format(time.RFC3339))
+	if e.NotFound {
+		fmt.Println("  not found")
+		return nil
+	}
+	for _, family := range []struct {
+		name    string
+		fetched bool
+		nets    []netip.Prefix
+	}{{"ipv4", e.FetchedIPv4, e.IPv4}, {"ipv6", e.FetchedIPv6, e.IPv6}} {
+		if !family.fetched {
+			fmt.Printf("  %s not fetched\n", family.name)
+			continue
+		}
+		for _, n := range family.nets {
+			fmt.Printf("  %s\n", n)
+		}
+	}
+	return nil
+}
+
+func cacheClearHandler(c *cli.Context) error {
+	asn := c.Args().Slice()
+	for i, as := range asn {
+		normalized, err := asn2ip.NormalizeASN(as)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{"error": err}).Errorln("invalid as number")
+			return cli.Exit("", exitInput)
+		}
+		asn[i] = normalized
+	}
+	cache, err := openCache(c)
+	if err != nil {
+		return err
+	}
+	defer cache.Close()
+
+	if len(asn) == 0 {
+		if err := cache.Clear(); err != nil {
+			logrus.WithFields(logrus.Fields{"error": err}).Errorln("failed to clear cache")
+			return cli.Exit("", exitError)
+		}
+		logrus.Infoln("cleared cache")
+		return nil
+	}
+	for _, as := range asn {
+		if err := cache.Delete(as); err != nil {
+			logrus.WithFields(logrus.Fields{"asn": as, "error": err}).Errorln("failed to remove as number from cache")
+			return cli.Exit("", exitError)
+		}
+	}
+	logrus.WithFields(logrus.Fields{"asns": asn}).Infoln("removed as numbers from cache")
+	return nil
+}
+
+func cacheExportHandler(c *cli.Context) (err error) {
+	if c.NArg() > 1 {
+		logrus.Errorln("cache export accepts at most one file")
+		return cli.Exit("", exitInput)
+	}
+	cache, err := openCache(c)
+	if err != nil {
+		return err
+	}
+	defer cache.Close()
+	entries, err := listCache(cache)
+	if err != nil {
+		return err
+	}
+
+	out, err := openOutput(c.Args().First())
+	if err != nil {
+		return err
+	}
+	defer func() { err = out.close(err) }()
+	exported := make([]cacheEntry, len(entries))
+	for i, e := range entries {
+		exported[i] = cacheEntry{
+			ASN:         e.AS,
+			IPv4:        e.IPv4,
+			IPv6:        e.IPv6,
+			FetchedIPv4: e.FetchedIPv4,
+			FetchedIPv6: e.FetchedIPv6,
+			NotFound:    e.NotFound,
+			Stored:      e.Stored,
+			Expires:     e.Expires,
+		}
+	}
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(exported); err != nil {
+		logrus.WithFields(logrus.Fields{"error": err}).Errorln("failed to write cache")
+		return cli.Exit("", exitError)
+	}
+	return nil
+}
+
+func cacheImportHandler(c *cli.Context) error {
+	if c.NArg() != 1 {
+		logrus.Errorln("cache import requires exactly one file")
+		return cli.Exit("", exitInput)
+	}
+	path := c.Args().First()
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{"path": path, "error": err}).Errorln("failed to open cache export")
+			return cli.Exit("", exitInput)
+		}
+		defer f.Close()
+		r = f
+	}
+	entries := []cacheEntry{}
+	if err := json.NewDecoder(r).Decode(&entries); err != nil {
+		logrus.WithFields(logrus.Fields{"path": path, "error": err}).Errorln("invalid cache export")
+		return cli.Exit("", exitInput)
+	}
+	for i := range entries {
+		as, err := asn2ip.NormalizeASN(entries[i].ASN)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{"path": path, "error": err}).Errorln("invalid as number in cache export")
+			return cli.Exit("", exitInput)
+		}
+		entries[i].ASN = as
+	}
+
+	cache, err := openCache(c)
+	if err != nil {
+		return err
+	}
+	defer cache.Close()
+	for _, e := range entries {
+		err := cache.Set(storage.ASStorage{
+			AS:          e.ASN,
+			IPv4:        e.IPv4,
+			IPv6:        e.IPv6,
+			FetchedIPv4: e.FetchedIPv4,
+			FetchedIPv6: e.FetchedIPv6,
+			NotFound:    e.NotFound,
+		})
+		if err != nil {
+			logrus.WithFields(logrus.Fields{"asn": e.ASN, "error": err}).Errorln("failed to store as number")
+			return cli.Exit("", exitError)
+		}
+	}
+	logrus.WithFields(logrus.Fields{"asns": len(entries)}).Infoln("imported cache")
+	return nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// compressOptions configure gzip compression of responses.
+type compressOptions struct {
+	Enabled bool
+	// MinSize is the minimum response size in bytes to compress, smaller responses are
+	// sent as is. Streamed responses are always compressed.
+	MinSize int
+}
+
+// gzipMiddleware compresses responses for clients accepting gzip encoding.
+func gzipMiddleware(opts compressOptions) gin.HandlerFunc {
+	writers := sync.Pool{New: func() interface{} { return gzip.NewWriter(io.Discard) }}
+	return func(c *gin.Context) {
+		c.Writer.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(c.GetHeader("Accept-Encoding")) {
+			c.Next()
+			return
+		}
+
+		w := &gzipWriter{ResponseWriter: c.Writer, minSize: opts.MinSize, writers: &writers}
+		c.Writer = w
+		defer w.close()
+		c.Next()
+	}
+}
+
+// acceptsGzip reports whether the Accept-Encoding header allows gzip.
+func acceptsGzip(acceptEncoding string) bool {
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		params := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(params[0]))
+		if coding != "gzip" && coding != "*" {
+			continue
+		}
+		q := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if q > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// gzipWriter buffers the response until it reaches the minimum size and compresses it
+// from then on. Responses completed while still buffered are sent uncompressed.
+type gzipWriter struct {
+	gin.ResponseWriter
+	minSize int
+	writers *sync.Pool
+
+	buf     bytes.Buffer
+	decided bool
+	gz      *gzip.Writer
+}
+
+// start decides whether to compress and writes out the buffered response.
+func (w *gzipWriter) start(compress bool) error {
+	w.decided = true
+	status := w.ResponseWriter.Status()
+	if compress && !w.ResponseWriter.Written() && w.Header().Get("Content-Encoding") == "" &&
+		status != http.StatusNoContent && status != http.StatusNotModified {
+		w.Header().Del("Content-Length")
+		w.Header().Set("Content-Encoding", "gzip")
+		// the compressed body is not byte-for-byte identical to the one the etag was computed over
+		if etag := w.Header().Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			w.Header().Set("ETag", "W/"+etag)
+		}
+		w.gz = w.writers.Get().(*gzip.Writer)
+		w.gz.Reset(w.ResponseWriter)
+	}
+	if w.buf.Len() == 0 {
+		return nil
+	}
+	_, err := w.write(w.buf.Bytes())
+	w.buf.Reset()
+	return err
+}
+
+func (w *gzipWriter) write(b []byte) (int, error) {
+	if w.gz != nil {
+		return w.gz.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *gzipWriter) Write(b []byte) (int, error) {
+	if w.decided {
+		return w.write(b)
+	}
+	w.buf.Write(b)
+	if w.buf.Len() >= w.minSize {
+		if err := w.start(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+func (w *gzipWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// Written reports buffered responses as written, so handlers do not write a second response.
+func (w *gzipWriter) Written() bool {
+	return w.buf.Len() > 0 || w.ResponseWriter.Written()
+}
+
+func (w *gzipWriter) Flush() {
+	if !w.decided {
+		w.start(true)
+	}
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	w.ResponseWriter.Flush()
+}
+
+func (w *gzipWriter) close() {
+	if !w.decided {
+		w.start(w.buf.Len() >= w.minSize)
+	}
+	if w.gz != nil {
+		w.gz.Close()
+		w.writers.Put(w.gz)
+		w.gz = nil
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/g0dsCookie/asn2ip/internal/config"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+// The config commands keep the default logging, they must work with a broken config.
+
+func configInitHandler(c *cli.Context) error {
+	if c.NArg() > 1 {
+		logrus.Errorln("config init accepts at most one file")
+		return cli.Exit("", exitInput)
+	}
+	if c.NArg() == 0 {
+		return writeSample(os.Stdout)
+	}
+
+	path := c.Args().First()
+	// never overwrite an existing config
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"path": path, "error": err}).Errorln("failed to create config file")
+		return cli.Exit("", exitError)
+	}
+	defer f.Close()
+	if err := writeSample(f); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		logrus.WithFields(logrus.Fields{"path": path, "error": err}).Errorln("failed to write config file")
+		return cli.Exit("", exitError)
+	}
+	return nil
+}
+
+func writeSample(f *os.File) error {
+	if err := config.WriteSample(f); err != nil {
+		logrus.WithFields(logrus.Fields{"error": err}).Errorln("failed to write config file")
+		return cli.Exit("", exitError)
+	}
+	return nil
+}
+
+func configValidateHandler(c *cli.Context) error {
+	if c.NArg() > 1 {
+		logrus.Errorln("config validate accepts at most one file")
+		return cli.Exit("", exitInput)
+	}
+	path := c.Args().First()
+	if path == "" {
+		if path = config.FindFile(); path == "" {
+			logrus.Errorln("no config file found")
+			return cli.Exit("", exitConfig)
+		}
+	}
+
+	problems, err := config.Validate(path)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"error": err}).Errorln("invalid config file")
+		return cli.Exit("", exitConfig)
+	}
+	for _, problem := range problems {
+		fmt.Printf("%s: %s\n", path, problem)
+	}
+	if len(problems) > 0 {
+		return cli.Exit("", exitConfig)
+	}
+	fmt.Printf("%s: ok\n", path)
+	return nil
+}
+
+func configShowHandler(c *cli.Context) error {
+	if path := config.FindFile(); path != "" {
+		fmt.Printf("# read from %s\n", path)
+	}
+	if err := config.WriteEffective(os.Stdout, rootContext(c)); err != nil {
+		logrus.WithFields(logrus.Fields{"error": err}).Errorln("failed to write config")
+		return cli.Exit("", exitError)
+	}
+	return nil
+}
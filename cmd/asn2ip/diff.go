@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+	"time"
+
+	"github.com/g0dsCookie/asn2ip/internal/config"
+	"github.com/g0dsCookie/asn2ip/pkg/asn2ip"
+	"github.com/g0dsCookie/asn2ip/pkg/format"
+	"github.com/g0dsCookie/asn2ip/pkg/storage"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+// diffState holds the networks fetched networks are compared against.
+type diffState interface {
+	// asns returns the AS numbers known to the state, nil if they can't be listed.
+	asns() []string
+	// previous returns the networks of as, empty if as is unknown.
+	previous(as string) ([]netip.Prefix, error)
+	// update replaces the networks of all ASNs in ips.
+	update(ips asn2ip.Result) error
+	Close() error
+}
+
+func diffHandler(c *cli.Context) error {
+	conf, err := setup(c)
+	if err != nil {
+		return err
+	}
+	diff := config.NewDiffConfig()
+	diff.UpdateFromCLIContext(c)
+	stor := config.NewStorageConfig()
+	stor.UpdateFromCLIContext(c)
+	filters, err := filterOptionsFromConfig(conf)
+	if err != nil {
+		return err
+	}
+
+	state, err := openDiffState(diff.GetString("diff.against"), stor)
+	if err != nil {
+		return err
+	}
+	defer state.Close()
+
+	asn := c.Args().Slice()
+	if len(asn) == 0 {
+		asn = state.asns()
+	}
+	if len(asn) == 0 {
+		logrus.Errorln("diff requires at least one AS number")
+		return cli.Exit("", exitInput)
+	}
+	for i, as := range asn {
+		normalized, err := asn2ip.Normalize(as)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{"error": err}).Errorln("invalid as number")
+			return cli.Exit("", exitInput)
+		}
+		asn[i] = normalized
+	}
+	sources, err := irrSources(conf)
+	if err != nil {
+		return err
+	}
+	source, err := sourceOptionsFromConfig(conf)
+	if err != nil {
+		return err
+	}
+	fetcher, err := fetcherFromConfig(conf, source, sources)
+	if err != nil {
+		return err
+	}
+	defer fetcher.Close()
+
+	ips, err := fetcher.FetchContext(c.Context, true, true, asn...)
+	failed, err := partialResult(len(ips.ASNs()), err)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"error": err}).Errorln("failed to fetch networks")
+		return cli.Exit("", fetchExitCode(err))
+	}
+	filters.applyAll(ips)
+
+	changed := false
+	for _, as := range ips.ASNs() {
+		previous, err := state.previous(as)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{"asn": as, "error": err}).Errorln("failed to read previous networks")
+			return cli.Exit("", exitError)
+		}
+		change := asn2ip.Diff(as, previous, append(append([]netip.Prefix{}, ips[as].IPv4...), ips[as].IPv6...))
+		if len(change.Added) == 0 && len(change.Removed) == 0 {
+			continue
+		}
+		changed = true
+		fmt.Printf("AS%s\n", as)
+		for _, n := range change.Added {
+			fmt.Printf("+ %s\n", n)
+		}
+		for _, n := range change.Removed {
+			fmt.Printf("- %s\n", n)
+		}
+	}
+	if err := reportFailed(failed); err != nil {
+		// a failed AS would look like all its networks were removed, so the state is kept
+		return err
+	}
+
+	if diff.GetBool("diff.update") && changed {
+		if err := state.update(ips); err != nil {
+			logrus.WithFields(logrus.Fields{"error": err}).Errorln("failed to update previous networks")
+			return cli.Exit("", exitError)
+		}
+	}
+	if changed {
+		return cli.Exit("", exitChanged)
+	}
+	return nil
+}
+
+func openDiffState(path string, stor *config.Config) (diffState, error) {
+	if path != "" {
+		state, err := readFileState(path)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{"path": path, "error": err}).Errorln("failed to read previous networks")
+			return nil, cli.Exit("", exitError)
+		}
+		return state, nil
+	}
+	opts, err := storageOptionsFromConfig(stor)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Name == "" {
+		logrus.Errorln("diff requires --against or a storage backend set with --storage-name")
+		return nil, cli.Exit("", exitConfig)
+	}
+	cache, err := storage.NewStorage(opts)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"error": err}).Errorln("failed to initialize storage")
+		return nil, cli.Exit("", exitConfig)
+	}
+	return storageState{cache}, nil
+}
+
+// fileState compares against a file written by fetch --format json.
+type fileState struct {
+	path string
+	ips  map[string]map[string][]netip.Prefix
+}
+
+// readFileState reads the networks of path, a missing file is an empty state.
+func readFileState(path string) (*fileState, error) {
+	state := &fileState{path: path, ips: map[string]map[string][]netip.Prefix{}}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &state.ips); err != nil {
+		return nil, errors.Wrap(err, "expected networks written by fetch --format json")
+	}
+	return state, nil
+}
+
+func (s *fileState) asns() []string { return format.SortedASNs(s.ips) }
+
+func (s *fileState) previous(as string) ([]netip.Prefix, error) {
+	return append(append([]netip.Prefix{}, s.ips[as]["ipv4"]...), s.ips[as]["ipv6"]...), nil
+}
+
+// update rewrites the file with the networks of ips, keeping ASNs not in ips.
+func (s *fileState) update(ips asn2ip.Result) (err error) {
+	for as, families := range ips.Networks() {
+		s.ips[as] = families
+	}
+	formatter, err := format.Lookup("json")
+	if err != nil {
+		return err
+	}
+	out, err := openOutput(s.path)
+	if err != nil {
+		return err
+	}
+	defer func() { err = out.close(err) }()
+	return formatter.Write(out, s.ips, format.Options{})
+}
+
+func (s *fileState) Close() error { return nil }
+
+// storageState compares against the last snapshot of an AS, or its cached networks if the
+// storage keeps no snapshots.
+type storageState struct {
+	storage.Storage
+}
+
+func (s storageState) asns() []string { return nil }
+
+func (s storageState) previous(as string) ([]netip.Prefix, error) {
+	if snapshots, ok := s.Storage.(storage.SnapshotStorage); ok {
+		snaps, err := snapshots.Snapshots(as, time.Now())
+		if err == nil {
+			if len(snaps) == 0 {
+				return nil, nil
+			}
+			return snaps[len(snaps)-1].IPAddresses(), nil
+		} else if !errors.Is(err, storage.ErrSnapshotsDisabled) {
+			return nil, err
+		}
+	}
+	cached, err := s.Get(as)
+	if errors.Is(err, storage.ErrASNotCached) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return cached.IPAddresses(), nil
+}
+
+func (s storageState) update(ips asn2ip.Result) error {
+	for _, as := range ips.ASNs() {
+		res := ips[as]
+		if err := s.Set(storage.ASStorage{AS: as, IPv4: res.IPv4, IPv6: res.IPv6, FetchedIPv4: true, FetchedIPv6: true}); err != nil {
+			return errors.Wrapf(err, "failed to store networks of asn %s", as)
+		}
+	}
+	return nil
+}
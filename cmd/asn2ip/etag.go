@@ -0,0 +1,56 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/g0dsCookie/asn2ip/pkg/asn2ip"
+	"github.com/gin-gonic/gin"
+)
+
+// writeWithETag responds with data and its etag, or with 304 Not Modified if the client
+// already has it.
+func writeWithETag(c *gin.Context, contentType string, data []byte) {
+	sum := sha256.Sum256(data)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	c.Header("ETag", etag)
+	if etagMatches(c.GetHeader("If-None-Match"), etag) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	c.Data(http.StatusOK, contentType, data)
+}
+
+// etagMatches reports whether the If-None-Match header lists etag, using the weak comparison.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// setCacheControl lets clients cache the response until the first cached entry it was
+// built from expires, or for the cache ttl if everything was freshly fetched. Responses
+// for explicitly selected sources or servers bypass the cache and are not cacheable.
+func (r *router) setCacheControl(c *gin.Context, expiry *asn2ip.CacheExpiry) {
+	_, sources := c.GetQuery("sources")
+	if _, server := c.GetQuery("server"); sources || server {
+		c.Header("Cache-Control", "no-cache")
+		return
+	}
+	maxAge := r.upstreams(c).cacheTTL
+	if expires := expiry.Time(); !expires.IsZero() && time.Until(expires) < maxAge {
+		maxAge = time.Until(expires)
+	}
+	if maxAge < 0 {
+		maxAge = 0
+	}
+	c.Header("Cache-Control", fmt.Sprintf("max-age=%d", int(maxAge.Seconds())))
+}
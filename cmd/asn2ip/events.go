@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/g0dsCookie/asn2ip/pkg/asn2ip"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const eventsKeepalive = 30 * time.Second
+
+// changeBroker fans out the changes detected by the refresher to event stream subscribers.
+type changeBroker struct {
+	mu          sync.Mutex
+	subscribers map[string]map[chan asn2ip.Change]struct{}
+	// done is closed on shutdown to end all streams
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newChangeBroker() *changeBroker {
+	return &changeBroker{subscribers: map[string]map[chan asn2ip.Change]struct{}{}, done: make(chan struct{})}
+}
+
+// close ends all streams, which would otherwise hold up a graceful shutdown.
+func (b *changeBroker) close() {
+	b.closeOnce.Do(func() { close(b.done) })
+}
+
+// subscribe returns a channel receiving the changes of each of asn until cancel is called.
+func (b *changeBroker) subscribe(asn ...string) (changes <-chan asn2ip.Change, cancel func()) {
+	ch := make(chan asn2ip.Change, 16)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, as := range asn {
+		if b.subscribers[as] == nil {
+			b.subscribers[as] = map[chan asn2ip.Change]struct{}{}
+		}
+		b.subscribers[as][ch] = struct{}{}
+	}
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		for _, as := range asn {
+			delete(b.subscribers[as], ch)
+			if len(b.subscribers[as]) == 0 {
+				delete(b.subscribers, as)
+			}
+		}
+	}
+}
+
+// publish sends change to all subscribers of its AS. Subscribers not keeping up miss it
+// rather than delaying the refresher.
+func (b *changeBroker) publish(change asn2ip.Change) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subscribers[change.AS] {
+		select {
+		case ch <- change:
+		default:
+		}
+	}
+}
+
+// getASNEvents streams server-sent events for an AS refreshed in background, see streamEvents.
+func (r *router) getASNEvents(c *gin.Context) {
+	up := r.upstreams(c)
+	if up.refresher == nil {
+		apiErrorf(c, http.StatusNotImplemented, "change events require ASNs to refresh in background")
+		return
+	}
+	as, err := asn2ip.NormalizeASN(c.Param("asn"))
+	if err != nil {
+		apiErrorf(c, http.StatusBadRequest, "%s", err)
+		return
+	}
+	if !up.refresher.Tracks(as) {
+		apiErrorf(c, http.StatusNotFound, "AS %s is not refreshed in background", as)
+		return
+	}
+	r.streamEvents(c, up, as)
+}
+
+// getEvents streams server-sent events for the ASNs of the asn query parameter, comma separated
+// or repeated, or for all ASNs refreshed in background if there is none.
+func (r *router) getEvents(c *gin.Context) {
+	up := r.upstreams(c)
+	if up.refresher == nil {
+		apiErrorf(c, http.StatusNotImplemented, "change events require ASNs to refresh in background")
+		return
+	}
+	asn := requestedASNs(c)
+	if len(asn) == 0 {
+		asn = up.refresher.ASNs()
+	}
+	if len(asn) == 0 {
+		apiErrorf(c, http.StatusNotFound, "no AS numbers are refreshed in background")
+		return
+	}
+	for i, as := range asn {
+		normalized, err := asn2ip.NormalizeASN(as)
+		if err != nil {
+			apiErrorf(c, http.StatusBadRequest, "%s", err)
+			return
+		}
+		if !up.refresher.Tracks(normalized) {
+			apiErrorf(c, http.StatusNotFound, "AS %s is not refreshed in background", normalized)
+			return
+		}
+		asn[i] = normalized
+	}
+	r.streamEvents(c, up, asn...)
+}
+
+// streamEvents streams server-sent events for ASNs refreshed in background. The current
+// networks of each AS are sent as prefixes event, followed by a change event whenever they
+// change.
+func (r *router) streamEvents(c *gin.Context, up *upstreams, asn ...string) {
+	// subscribe first to not miss changes while fetching the current networks
+	changes, cancel := r.changes.subscribe(asn...)
+	defer cancel()
+	ips, err := up.fetcher.FetchContext(c.Request.Context(), true, true, asn...)
+	if err != nil && !errors.Is(err, asn2ip.ErrASNotFound) {
+		if apiRequestDone(c) {
+			return
+		}
+		requestLog(c).WithFields(logrus.Fields{"error": err}).Warnln("failed to fetch networks")
+		apiErrorf(c, http.StatusBadGateway, "failed to fetch ip addresses for AS %s", strings.Join(asn, ", "))
+		return
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	// keep reverse proxies from buffering the stream
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	for _, as := range asn {
+		if res, ok := ips[as]; ok {
+			writeEvent(c.Writer, "prefixes", resultOf(res))
+		}
+	}
+	c.Writer.Flush()
+
+	ctx := untimedContext(c)
+	keepalive := time.NewTicker(eventsKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.changes.done:
+			return
+		case change := <-changes:
+			writeEvent(c.Writer, "change", newChangePayload(change))
+		case <-keepalive.C:
+			io.WriteString(c.Writer, ": keepalive\n\n")
+		}
+		c.Writer.Flush()
+	}
+}
+
+func writeEvent(w io.Writer, event string, data interface{}) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, b)
+	return err
+}
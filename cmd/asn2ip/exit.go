@@ -0,0 +1,33 @@
+package main
+
+import (
+	"github.com/g0dsCookie/asn2ip/pkg/asn2ip"
+	"github.com/pkg/errors"
+)
+
+// Exit codes of the commands, so scripts can tell the outcomes apart.
+const (
+	// exitError is any failure not covered below, e.g. failing to write the output.
+	exitError = 1
+	// exitChanged is returned by diff if networks were added or removed.
+	exitChanged = 2
+	// exitConfig is an invalid configuration, e.g. an unknown format or storage backend.
+	exitConfig = 3
+	// exitInput is an invalid argument or flag, e.g. a malformed AS number.
+	exitInput = 4
+	// exitNotFound means nothing requested was found, e.g. an unknown AS number.
+	exitNotFound = 5
+	// exitUnreachable means the whois server or another upstream failed to answer.
+	exitUnreachable = 6
+	// exitPartial means some of the requested ASNs or addresses failed while the others were
+	// written. It is kept at 10, the exit code of every fetch failure in earlier versions.
+	exitPartial = 10
+)
+
+// fetchExitCode returns the exit code of a fetch failing with err.
+func fetchExitCode(err error) int {
+	if errors.Is(err, asn2ip.ErrASNotFound) || errors.Is(err, asn2ip.ErrRouteNotFound) {
+		return exitNotFound
+	}
+	return exitUnreachable
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/g0dsCookie/asn2ip/internal/config"
+	"github.com/g0dsCookie/asn2ip/pkg/asn2ip"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+// expandHandler prints the member AS numbers of as-sets without fetching their networks. Sets
+// referencing each other are expanded once, so loops end the recursion.
+func expandHandler(c *cli.Context) error {
+	conf, err := setup(c)
+	if err != nil {
+		return err
+	}
+	expand := config.NewExpandConfig()
+	expand.UpdateFromCLIContext(c)
+	if c.NArg() < 1 {
+		logrus.Errorln("expand requires at least one as-set")
+		return cli.Exit("", exitInput)
+	}
+	sets := c.Args().Slice()
+	for i, set := range sets {
+		if !asn2ip.IsASSet(set) {
+			logrus.WithFields(logrus.Fields{"set": set}).Errorln("not an as-set")
+			return cli.Exit("", exitInput)
+		}
+		sets[i], _ = asn2ip.Normalize(set)
+	}
+	maxDepth := expand.GetInt("expand.max-depth")
+	if maxDepth < 0 {
+		logrus.WithFields(logrus.Fields{"max-depth": maxDepth}).Errorln("max-depth must not be negative")
+		return cli.Exit("", exitInput)
+	}
+
+	sources, err := irrSources(conf)
+	if err != nil {
+		return err
+	}
+	source, err := sourceOptionsFromConfig(conf)
+	if err != nil {
+		return err
+	}
+	fetcher, err := fetcherFromConfig(conf, source, sources)
+	if err != nil {
+		return err
+	}
+	defer fetcher.Close()
+	expander, ok := fetcher.(asn2ip.Expander)
+	if !ok {
+		logrus.WithFields(logrus.Fields{"source": source.Name}).Errorln("source does not support as-set expansion")
+		return cli.Exit("", exitConfig)
+	}
+
+	seen := map[string]bool{}
+	members := []string{}
+	for _, set := range sets {
+		asn, err := expander.Expand(c.Context, set, maxDepth)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{"set": set, "error": err}).Errorln("failed to expand as-set")
+			return cli.Exit("", fetchExitCode(err))
+		}
+		logrus.WithFields(logrus.Fields{"set": set, "members": len(asn)}).Infoln("expanded as-set")
+		for _, as := range asn {
+			if !seen[as] {
+				seen[as] = true
+				members = append(members, as)
+			}
+		}
+	}
+	sort.Slice(members, func(i, j int) bool {
+		a, _ := strconv.ParseUint(members[i], 10, 32)
+		b, _ := strconv.ParseUint(members[j], 10, 32)
+		return a < b
+	})
+	for _, as := range members {
+		fmt.Printf("AS%s\n", as)
+	}
+	return nil
+}
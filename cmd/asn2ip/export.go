@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/g0dsCookie/asn2ip/internal/config"
+	"github.com/g0dsCookie/asn2ip/pkg/format"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+// exportHandler writes the cached networks of each AS to DIR/AS<asn>.<format>. Files are
+// replaced atomically, so consumers never read a partially written export.
+func exportHandler(c *cli.Context) error {
+	conf, err := setup(c)
+	if err != nil {
+		return err
+	}
+	export := config.NewExportConfig()
+	export.UpdateFromCLIContext(c)
+
+	dir := export.GetString("export.dir")
+	if dir == "" {
+		logrus.Errorln("export requires a directory set with --dir")
+		return cli.Exit("", exitInput)
+	}
+	formats := map[string]format.Formatter{}
+	names := []string{}
+	for _, name := range strings.Split(export.GetString("export.formats"), ",") {
+		name = strings.TrimSpace(name)
+		if name == "" || formats[name] != nil {
+			continue
+		}
+		formatter, err := format.Lookup(name)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{"format": name, "error": err}).Errorln("unknown output format")
+			return cli.Exit("", exitConfig)
+		}
+		formats[name] = formatter
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		logrus.Errorln("export requires at least one format set with --format")
+		return cli.Exit("", exitInput)
+	}
+
+	cache, err := openStorage(c)
+	if err != nil {
+		return err
+	}
+	defer cache.Close()
+	entries, err := listCache(cache)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		logrus.WithFields(logrus.Fields{"dir": dir, "error": err}).Errorln("failed to create export directory")
+		return cli.Exit("", exitError)
+	}
+
+	opts, err := formatOptionsFromConfig(conf)
+	if err != nil {
+		return err
+	}
+	exported, written := 0, 0
+	for _, e := range entries {
+		if e.NotFound {
+			continue
+		}
+		// families never fetched are left out instead of being exported as empty
+		families := map[string][]netip.Prefix{}
+		if e.FetchedIPv4 {
+			families["ipv4"] = e.IPv4
+		}
+		if e.FetchedIPv6 {
+			families["ipv6"] = e.IPv6
+		}
+		ips := map[string]map[string][]netip.Prefix{e.AS: families}
+		exported++
+		for _, name := range names {
+			path := filepath.Join(dir, "AS"+e.AS+"."+name)
+			if err := writeExport(path, formats[name], ips, opts); err != nil {
+				return err
+			}
+			written++
+		}
+	}
+	logrus.WithFields(logrus.Fields{"dir": dir, "asns": exported, "files": written}).Infoln("exported cache")
+	return nil
+}
+
+func writeExport(path string, f format.Formatter, ips map[string]map[string][]netip.Prefix, opts format.Options) (err error) {
+	out, err := openOutput(path)
+	if err != nil {
+		return err
+	}
+	defer func() { err = out.close(err) }()
+	return writeCLIFormat(out, f, ips, opts)
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// selectFamilies narrows the address families enabled by the ipv4 and ipv6 switches down to
+// family, which is 4, 6 or all. An empty family is the same as all.
+func selectFamilies(family string, ipv4, ipv6 bool) (bool, bool, error) {
+	switch strings.ToLower(family) {
+	case "", "all":
+	case "4", "ipv4":
+		ipv6 = false
+	case "6", "ipv6":
+		ipv4 = false
+	default:
+		return false, false, errors.Errorf("invalid family %q, expected 4, 6 or all", family)
+	}
+	return ipv4, ipv6, nil
+}
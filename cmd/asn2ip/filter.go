@@ -0,0 +1,145 @@
+package main
+
+import (
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/g0dsCookie/asn2ip/internal/config"
+	"github.com/g0dsCookie/asn2ip/pkg/asn2ip"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+// filterOptions are applied to fetched networks before they are returned.
+type filterOptions struct {
+	FilterBogons bool
+	// Within keeps only the addresses inside these networks, all if empty.
+	Within []netip.Prefix
+	// Exclude removes the addresses of these networks.
+	Exclude   []netip.Prefix
+	Aggregate bool
+}
+
+func filterOptionsFromConfig(conf *config.Config) (filterOptions, error) {
+	within, err := parseNetworks(splitCommas(conf.GetStringSlice("filter.within")))
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"error": err}).Errorln("invalid --within network")
+		return filterOptions{}, cli.Exit("", exitConfig)
+	}
+	exclude, err := parseNetworks(splitCommas(conf.GetStringSlice("filter.exclude")))
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"error": err}).Errorln("invalid --exclude network")
+		return filterOptions{}, cli.Exit("", exitConfig)
+	}
+	return filterOptions{
+		FilterBogons: conf.GetBool("filter.bogons"),
+		Within:       within,
+		Exclude:      exclude,
+		Aggregate:    conf.GetBool("filter.aggregate"),
+	}, nil
+}
+
+// splitCommas splits each of values at commas, dropping empty parts.
+func splitCommas(values []string) []string {
+	parts := []string{}
+	for _, v := range values {
+		for _, part := range strings.Split(v, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				parts = append(parts, part)
+			}
+		}
+	}
+	return parts
+}
+
+// fromQuery overrides the options with query parameters of c.
+func (o filterOptions) fromQuery(c *gin.Context) (filterOptions, error) {
+	if v, ok := c.GetQuery("filter-bogons"); ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return o, errors.New("filter-bogons query parameter must be a boolean")
+		}
+		o.FilterBogons = b
+	}
+	if v, ok := c.GetQueryArray("within"); ok {
+		within, err := parseNetworks(splitCommas(v))
+		if err != nil {
+			return o, errors.Wrap(err, "within query parameter")
+		}
+		o.Within = within
+	}
+	if v, ok := c.GetQueryArray("exclude"); ok {
+		exclude, err := parseNetworks(splitCommas(v))
+		if err != nil {
+			return o, errors.Wrap(err, "exclude query parameter")
+		}
+		o.Exclude = exclude
+	}
+	if v, ok := c.GetQuery("aggregate"); ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return o, errors.New("aggregate query parameter must be a boolean")
+		}
+		o.Aggregate = b
+	}
+	return o, nil
+}
+
+func (o filterOptions) apply(nets []netip.Prefix) []netip.Prefix {
+	if o.FilterBogons {
+		nets = asn2ip.FilterBogons(nets)
+	}
+	if len(o.Within) > 0 {
+		nets = asn2ip.Within(nets, o.Within)
+	}
+	if len(o.Exclude) > 0 {
+		nets = asn2ip.Exclude(nets, o.Exclude)
+	}
+	if o.Aggregate {
+		nets = asn2ip.Aggregate(nets)
+	}
+	return nets
+}
+
+// applyAll filters the networks of all ASNs and ip versions in place.
+func (o filterOptions) applyAll(result asn2ip.Result) {
+	for _, res := range result {
+		res.IPv4 = o.apply(res.IPv4)
+		res.IPv6 = o.apply(res.IPv6)
+	}
+}
+
+// applyMerged filters merged networks of all ASNs and ip versions in place. Aggregated
+// networks are seen in all sources of the networks they cover, parts of split networks in
+// the sources of the whole.
+func (o filterOptions) applyMerged(merged map[string]map[string][]asn2ip.SourcedPrefix) {
+	for _, versions := range merged {
+		for ver, prefixes := range versions {
+			nets := make([]netip.Prefix, len(prefixes))
+			for i, p := range prefixes {
+				nets[i] = p.Prefix
+			}
+			filtered := []asn2ip.SourcedPrefix{}
+			for _, n := range o.apply(nets) {
+				sp := asn2ip.SourcedPrefix{Prefix: n, Sources: []string{}}
+				seen := map[string]bool{}
+				for _, p := range prefixes {
+					if !n.Overlaps(p.Prefix) {
+						continue
+					}
+					for _, source := range p.Sources {
+						if !seen[source] {
+							seen[source] = true
+							sp.Sources = append(sp.Sources, source)
+						}
+					}
+				}
+				filtered = append(filtered, sp)
+			}
+			versions[ver] = filtered
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"github.com/g0dsCookie/asn2ip/internal/config"
+	"github.com/g0dsCookie/asn2ip/pkg/format"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+func formatOptionsFromConfig(conf *config.Config) (format.Options, error) {
+	group := conf.GetString("output.group")
+	if group != "" && group != format.GroupASN {
+		logrus.WithFields(logrus.Fields{"group": group}).Errorln("invalid output grouping, expected asn")
+		return format.Options{}, cli.Exit("", exitConfig)
+	}
+	return format.Options{
+		SetName:      conf.GetString("output.set-name"),
+		ListName:     conf.GetString("output.list-name"),
+		SeqStep:      conf.GetInt("output.seq-step"),
+		TableName:    conf.GetString("output.table-name"),
+		TableFile:    conf.GetString("output.table-file"),
+		ResourceName: conf.GetString("output.resource-name"),
+		RuleSize:     conf.GetInt("output.rule-size"),
+		Separator:    format.ParseSeparator(conf.GetString("output.separator")),
+		Sort:         conf.GetBool("output.sort"),
+		Dedup:        conf.GetBool("output.dedup"),
+		Group:        group,
+	}, nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/netip"
+
+	"github.com/g0dsCookie/asn2ip/pkg/geoip"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// geoResult is the location of a network, see geoip.Location.
+type geoResult struct {
+	Country  string `json:"country,omitempty"`
+	Registry string `json:"registry,omitempty"`
+}
+
+// enrichFromQuery reports whether the enrich query parameters of c, repeated or comma separated,
+// request the location of networks.
+func enrichFromQuery(c *gin.Context) (geo bool, err error) {
+	for _, v := range splitCommas(c.QueryArray("enrich")) {
+		if v != "geo" {
+			return false, errors.Errorf("unknown enrich value %q, expected geo", v)
+		}
+		geo = true
+	}
+	return geo, nil
+}
+
+// locate returns the locations of nets keyed by network, networks without known location are
+// left out. Failing lookups are only logged, as locations are informational.
+func locate(c *gin.Context, db *geoip.DB, nets ...[]netip.Prefix) map[string]geoResult {
+	result := map[string]geoResult{}
+	for _, family := range nets {
+		for _, n := range family {
+			loc, err := db.Lookup(n)
+			if err != nil {
+				requestLog(c).WithFields(logrus.Fields{"network": n, "error": err}).Warnln("failed to locate network")
+				continue
+			}
+			if loc != (geoip.Location{}) {
+				result[n.String()] = geoResult{Country: loc.Country, Registry: loc.Registry}
+			}
+		}
+	}
+	return result
+}
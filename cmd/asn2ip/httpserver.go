@@ -1,14 +1,18 @@
 package main
 
 import (
+	"context"
 	_ "embed"
 	"html/template"
 	"net/http"
+	"net/netip"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/g0dsCookie/asn2ip/pkg/asn2ip"
+	"github.com/g0dsCookie/asn2ip/pkg/format"
 	"github.com/g0dsCookie/asn2ip/pkg/storage"
 	"github.com/gin-gonic/gin"
 	"github.com/pkg/errors"
@@ -19,96 +23,554 @@ import (
 var index string
 
 type serverOptions struct {
-	WhoisHost string
-	WhoisPort int
-	Url       string
-	Storage   storage.StorageOptions
+	Source         sourceOptions
+	WhoisHost      string
+	WhoisPort      int
+	MaxConcurrency int
+	MaxDepth       int
+	Sources        []string
+	MergeSources   bool
+	// AllowedServers are the whois servers requests may select with ?server=.
+	AllowedServers []string
+	Filters        filterOptions
+	Format         format.Options
+	// GeoIPDB is the path of the MaxMind DB locating networks requested with ?enrich=geo.
+	GeoIPDB    string
+	Url        string
+	AdminToken string
+	// AdminListen is the address of the separate listener for metrics and admin endpoints,
+	// admin endpoints are served on the lookup listener if empty.
+	AdminListen string
+	// Pprof serves profiling endpoints on the admin listener, or with the admin token on the
+	// lookup listener.
+	Pprof          bool
+	Compress       compressOptions
+	CORS           corsOptions
+	Auth           authOptions
+	RateLimit      rateLimitOptions
+	IPFilter       ipFilterOptions
+	TrustedProxies []string
+	// RequestTimeout limits the time handlers may take to respond, unlimited if zero.
+	RequestTimeout time.Duration
+	Pool           asn2ip.PoolOptions
+	Storage        storage.StorageOptions
+	Refresh        asn2ip.RefresherOptions
+	Webhooks       webhookOptions
+	// AuditLog is the file lookups are recorded in as JSON lines, "-" for stdout.
+	AuditLog string
+	// MaxLookups limits the AS numbers or addresses of a bulk lookup, unlimited if zero.
+	MaxLookups int
+	// MaxBodyBytes limits the request body of bulk lookups, unlimited if zero.
+	MaxBodyBytes int64
+	// Reload returns the options applied on SIGHUP or a reload request, nil to not support it.
+	Reload func() (serverOptions, error)
 }
 
 type router struct {
-	fetcher asn2ip.Fetcher
+	maxConcurrency int
+	maxLookups     int
+	maxBodyBytes   int64
+	mergeSources   bool
+	filters        filterOptions
+	format         format.Options
+	storage        storage.Storage
+	webhooks       *webhookNotifier
+	changes        *changeBroker
+	metrics        *httpMetrics
+	whoisMetrics   *whoisMetrics
+	queries        *queryStats
+	audit          *auditLog
+	rateLimiter    *rateLimiter
+	// admin serves metrics and admin endpoints on adminListen, nil if disabled.
+	admin       *gin.Engine
+	adminListen string
+
+	// mu guards current, the upstreams used by new requests
+	mu      sync.RWMutex
+	current *upstreams
+	// reload returns the options reloaded on SIGHUP, reloadMu serializes reloads
+	reload   func() (serverOptions, error)
+	reloadMu sync.Mutex
+
 	*gin.Engine
 }
 
 func newRouter(opts serverOptions) (*router, error) {
+	if opts.Pprof && opts.AdminListen == "" && opts.AdminToken == "" {
+		return nil, errors.New("profiling endpoints require an admin listener or admin token")
+	}
+	auth, err := newAuthenticator(opts.Auth)
+	if err != nil {
+		return nil, err
+	}
+	spec, err := openapiDocument(opts.Url)
+	if err != nil {
+		return nil, err
+	}
+
+	gin.SetMode(gin.ReleaseMode)
+
+	engine := gin.New()
+	if err := engine.SetTrustedProxies(opts.TrustedProxies); err != nil {
+		return nil, errors.Wrap(err, "invalid trusted proxies")
+	}
+
+	// options are validated before opening anything that has to be closed again on errors
 	stor, err := storage.NewStorage(opts.Storage)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to initialize storage")
 	}
 
+	audit, err := newAuditLog(opts.AuditLog)
+	if err != nil {
+		stor.Close()
+		return nil, err
+	}
+	whois := &whoisMetrics{}
+	up, err := newUpstreams(opts, stor, whois)
+	if err != nil {
+		audit.Close()
+		stor.Close()
+		return nil, err
+	}
 	router := &router{
-		fetcher: asn2ip.NewCachedFetcher(opts.WhoisHost, opts.WhoisPort, stor),
+		maxConcurrency: opts.MaxConcurrency,
+		maxLookups:     opts.MaxLookups,
+		maxBodyBytes:   opts.MaxBodyBytes,
+		mergeSources:   opts.MergeSources,
+		filters:        opts.Filters,
+		format:         opts.Format,
+		storage:        stor,
+		changes:        newChangeBroker(),
+		metrics:        newHTTPMetrics(),
+		whoisMetrics:   whois,
+		queries:        newQueryStats(),
+		audit:          audit,
+		rateLimiter:    newRateLimiter(opts.RateLimit),
+		adminListen:    opts.AdminListen,
+		current:        up,
+		reload:         opts.Reload,
 	}
+	if router.maxConcurrency < 1 {
+		router.maxConcurrency = 1
+	}
+	if len(opts.Webhooks.URLs) > 0 {
+		router.webhooks = newWebhookNotifier(opts.Webhooks)
+	}
+	router.startRefresher(up)
 
-	gin.SetMode(gin.ReleaseMode)
-
-	engine := gin.New()
 	router.Engine = engine
-	engine.SetHTMLTemplate(template.Must(template.New("index").Parse(index)))
+	templates := template.Must(template.New("index").Parse(index))
+	template.Must(templates.New("docs").Parse(docs))
+	engine.SetHTMLTemplate(templates)
+	engine.Use(requestID)
 	engine.Use(requestLogger)
 	engine.Use(gin.Recovery())
+	engine.Use(router.metrics.record)
+	engine.Use(router.useUpstreams)
+	if opts.RequestTimeout > 0 {
+		engine.Use(requestTimeout(opts.RequestTimeout))
+	}
+	if len(opts.IPFilter.Allow) > 0 || len(opts.IPFilter.Deny) > 0 {
+		engine.Use(ipFilter(opts.IPFilter))
+	}
+	if opts.Compress.Enabled {
+		engine.Use(gzipMiddleware(opts.Compress))
+	}
+	if len(opts.CORS.AllowedOrigins) > 0 {
+		engine.Use(corsMiddleware(opts.CORS))
+	}
+
+	if opts.AdminListen != "" {
+		router.admin = router.newAdminEngine(opts.AdminToken, opts.Pprof)
+	} else if opts.AdminToken != "" {
+		router.registerAdmin(engine.Group("/admin", adminAuth(opts.AdminToken)))
+		if opts.Pprof {
+			registerPprof(engine.Group("", adminAuth(opts.AdminToken)))
+		}
+	}
 
-	engine.GET("/", func(c *gin.Context) {
+	// the audit log comes first to record rejected requests as well
+	lookupMiddleware := []gin.HandlerFunc{router.audit.record}
+	if len(opts.Auth.Keys) > 0 {
+		lookupMiddleware = append(lookupMiddleware, auth.lookups)
+	}
+	// always installed, so rate limits can be enabled by reloading
+	lookupMiddleware = append(lookupMiddleware, router.rateLimiter.limit, router.selectServer)
+	lookups := engine.Group("", lookupMiddleware...)
+
+	// the index doubles as lookup of the AS numbers given with ?asn=
+	root := []gin.HandlerFunc{}
+	for _, m := range lookupMiddleware {
+		root = append(root, withASNQuery(m))
+	}
+	engine.GET("/", append(root, func(c *gin.Context) {
+		if _, ok := c.GetQuery("asn"); ok {
+			router.getNetworks(c)
+			return
+		}
 		c.HTML(http.StatusOK, "index", gin.H{"BASE_URL": opts.Url})
+	})...)
+	router.registerAPI(lookups.Group("/api/v1"))
+
+	lookups.GET("/ip/*address", router.lookupIP)
+
+	engine.GET("/openapi.json", func(c *gin.Context) {
+		c.Data(http.StatusOK, "application/json", spec)
 	})
-	engine.GET("/:asn", func(c *gin.Context) {
-		asn := strings.Split(c.Param("asn"), ":")
+	engine.GET("/asn2ip.proto", func(c *gin.Context) {
+		c.Data(http.StatusOK, "text/plain; charset=utf-8", format.ProtoSchema)
+	})
+	engine.GET("/docs", func(c *gin.Context) {
+		c.HTML(http.StatusOK, "docs", gin.H{"BASE_URL": opts.Url})
+	})
+	lookups.GET("/:asn", router.getNetworks)
+
+	return router, nil
+}
+
+// requestedASNs returns the AS numbers or as-sets of a request, separated by colons, commas
+// or plus signs in the asn path parameter and given by repeated asn query parameters.
+func requestedASNs(c *gin.Context) []string {
+	asn := []string{}
+	for _, list := range append([]string{c.Param("asn")}, c.QueryArray("asn")...) {
+		asn = append(asn, strings.FieldsFunc(list, func(r rune) bool {
+			return r == ':' || r == ',' || r == '+' || r == ' '
+		})...)
+	}
+	return asn
+}
+
+// withASNQuery runs h only for requests with an asn query parameter.
+func withASNQuery(h gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := c.GetQuery("asn"); ok {
+			h(c)
+		}
+	}
+}
 
-		ipv4, err := strconv.ParseBool(c.DefaultQuery("ipv4", "true"))
+// getNetworks responds with the networks of the AS numbers or as-sets of the request, see
+// requestedASNs, in the format selected by the format query parameter or the Accept header.
+func (r *router) getNetworks(c *gin.Context) {
+	asn := requestedASNs(c)
+	if len(asn) == 0 {
+		c.String(http.StatusBadRequest, "no AS number given")
+		return
+	}
+	for i, as := range asn {
+		normalized, err := asn2ip.Normalize(as)
 		if err != nil {
-			c.String(http.StatusBadRequest, "ipv4 query parameter must be a boolean")
+			c.String(http.StatusBadRequest, "%s", err)
 			return
 		}
-		ipv6, err := strconv.ParseBool(c.DefaultQuery("ipv6", "true"))
-		if err != nil {
-			c.String(http.StatusBadRequest, "ipv6 query parameter must be a boolean")
+		asn[i] = normalized
+	}
+	r.requested(c, asn...)
+	ctx, err := requestContext(c)
+	if err != nil {
+		c.String(http.StatusBadRequest, "%s", err)
+		return
+	}
+	filters, err := r.filters.fromQuery(c)
+	if err != nil {
+		c.String(http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	ipv4, ipv6, err := familiesFromQuery(c)
+	if err != nil {
+		c.String(http.StatusBadRequest, "%s", err)
+		return
+	}
+	name := c.Query("format")
+	if name == "" {
+		name = negotiateFormat(c.GetHeader("Accept"), "text")
+	}
+	formatter, err := format.Lookup(name)
+	if err != nil {
+		c.String(http.StatusBadRequest, "%s", err)
+		return
+	}
+	merge, err := strconv.ParseBool(c.DefaultQuery("merge", strconv.FormatBool(r.mergeSources)))
+	if err != nil {
+		c.String(http.StatusBadRequest, "merge query parameter must be a boolean")
+		return
+	}
+	if merge {
+		r.fetchMerged(c, ctx, filters, name, formatter, ipv4, ipv6, asn)
+		return
+	}
+	if sf, ok := formatter.(format.StreamFormatter); ok {
+		r.streamFormat(c, ctx, sf, filters, ipv4, ipv6, asn)
+		return
+	}
+
+	ctx, expiry := asn2ip.ContextWithCacheExpiry(ctx)
+	ips, err := r.upstreams(c).fetcher.FetchContext(ctx, ipv4, ipv6, asn...)
+	failed, err := partialResult(len(ips.ASNs()), err)
+	if err != nil {
+		if requestDone(c) {
+			return
+		}
+		if errors.Is(err, asn2ip.ErrASNotFound) {
+			c.String(http.StatusNotFound, "%s", err)
+			return
+		}
+		if errors.Is(err, asn2ip.ErrTimeout) {
+			c.String(http.StatusGatewayTimeout, "timed out fetching ip addresses for AS %s", strings.Join(asn, ":"))
 			return
 		}
-		separator := c.DefaultQuery("separator", " ")
-		json := wantJson(c)
+		requestLog(c).WithFields(logrus.Fields{"error": err}).Warnln("failed to fetch networks")
+		c.String(http.StatusBadGateway, "failed to fetch ip addresses for AS %s", strings.Join(asn, ":"))
+		return
+	}
+	logFailed(c, failed)
+	filters.applyAll(ips)
+	auditOf(c).returnedResult(ips)
+	r.setCacheControl(c, expiry)
+	r.writeFormat(c, formatter, ips.Networks(), failed)
+}
+
+// Close stops background refreshes, closes all upstream connections and flushes the storage.
+func (r *router) Close() error {
+	r.reloadMu.Lock()
+	defer r.reloadMu.Unlock()
+	if r.current.refresher != nil {
+		r.current.refresher.Stop()
+	}
+	if r.webhooks != nil {
+		r.webhooks.Close()
+	}
+	var errs []string
+	if err := r.current.close(); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if err := r.storage.Close(); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if err := r.audit.Close(); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if len(errs) > 0 {
+		return errors.Errorf("failed to close router: %s", strings.Join(errs, ", "))
+	}
+	return nil
+}
 
-		ips, err := router.fetcher.Fetch(ipv4, ipv6, asn...)
+// writeFormat responds with ips rendered by f, with 207 Multi-Status if the ASNs of failed
+// are missing.
+func (r *router) writeFormat(c *gin.Context, f format.Formatter, ips map[string]map[string][]netip.Prefix, failed map[string]error) {
+	opts, err := r.formatOptions(c)
+	if err != nil {
+		c.String(http.StatusBadRequest, "%s", err)
+		return
+	}
+	names, err := namesFromQuery(c)
+	if err != nil {
+		c.String(http.StatusBadRequest, "%s", err)
+		return
+	}
+	if names {
+		opts.Names = nameStrings(r.lookupNames(c, c.Request.Context(), format.SortedASNs(ips)))
+	}
+	data, err := format.Format(f, ips, opts)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "failed to format networks")
+		return
+	}
+	writePartial(c, f.ContentType(), data, failed)
+}
+
+// streamFormat responds with the networks of asn rendered by f, writing each AS as soon as
+// it has been fetched.
+func (r *router) streamFormat(c *gin.Context, ctx context.Context, f format.StreamFormatter, filters filterOptions, ipv4, ipv6 bool, asn []string) {
+	opts, err := r.formatOptions(c)
+	if err != nil {
+		c.String(http.StatusBadRequest, "%s", err)
+		return
+	}
+	names, err := namesFromQuery(c)
+	if err != nil {
+		c.String(http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	err = asn2ip.FetchStream(ctx, r.upstreams(c).fetcher, ipv4, ipv6, func(res *asn2ip.ASResult) error {
+		ips := asn2ip.Result{res.ASN: res}
+		filters.applyAll(ips)
+		auditOf(c).returnedResult(ips)
+		opts := opts
+		if names {
+			opts.Names = nameStrings(r.lookupNames(c, ctx, []string{res.ASN}))
+		}
+		if !c.Writer.Written() {
+			c.Header("Content-Type", f.ContentType())
+			c.Status(http.StatusOK)
+		}
+		if err := f.Write(c.Writer, ips.Networks(), opts); err != nil {
+			return err
+		}
+		c.Writer.Flush()
+		return nil
+	}, asn...)
+	if !c.Writer.Written() {
+		// nothing was fetched, fail with the error of a single AS
+		_, err = partialResult(0, err)
+	}
+	switch {
+	case err == nil:
+		if !c.Writer.Written() {
+			c.Data(http.StatusOK, f.ContentType(), nil)
+		}
+	case c.Request.Context().Err() == context.Canceled:
+		c.Abort()
+	case c.Writer.Written():
+		// the status is already sent, report the error within the stream
+		requestLog(c).WithFields(logrus.Fields{"asn": asn, "error": err}).Warnln("failed to stream networks")
+		f.WriteError(c.Writer, err)
+		c.Abort()
+	case requestDone(c):
+	case errors.Is(err, asn2ip.ErrASNotFound):
+		c.String(http.StatusNotFound, "%s", err)
+	case errors.Is(err, asn2ip.ErrTimeout):
+		c.String(http.StatusGatewayTimeout, "timed out fetching ip addresses for AS %s", strings.Join(asn, ":"))
+	default:
+		requestLog(c).WithFields(logrus.Fields{"error": err}).Warnln("failed to fetch networks")
+		c.String(http.StatusBadGateway, "failed to fetch ip addresses for AS %s", strings.Join(asn, ":"))
+	}
+}
+
+// formatOptions returns the configured format options overridden by query parameters of c.
+func (r *router) formatOptions(c *gin.Context) (format.Options, error) {
+	opts := r.format
+	if v := c.Query("set-name"); v != "" {
+		opts.SetName = v
+	}
+	if v := c.Query("list-name"); v != "" {
+		opts.ListName = v
+	}
+	if v := c.Query("table-name"); v != "" {
+		opts.TableName = v
+	}
+	if v := c.Query("resource-name"); v != "" {
+		opts.ResourceName = v
+	}
+	if v, ok := c.GetQuery("table-file"); ok {
+		opts.TableFile = v
+	}
+	if v, ok := c.GetQuery("separator"); ok {
+		opts.Separator = format.ParseSeparator(v)
+	}
+	if v, ok := c.GetQuery("sort"); ok {
+		sort, err := strconv.ParseBool(v)
 		if err != nil {
-			c.String(http.StatusInternalServerError, "failed to fetch ip addresses for AS %s", strings.Join(asn, ":"))
-			return
+			return opts, errors.New("sort query parameter must be a boolean")
+		}
+		opts.Sort = sort
+	}
+	if v, ok := c.GetQuery("group"); ok {
+		if v != "" && v != format.GroupASN {
+			return opts, errors.New("group query parameter must be asn or empty")
+		}
+		opts.Group = v
+	}
+	if v, ok := c.GetQuery("dedup"); ok {
+		dedup, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, errors.New("dedup query parameter must be a boolean")
 		}
+		opts.Dedup = dedup
+	}
+	if v := c.Query("seq-step"); v != "" {
+		step, err := strconv.Atoi(v)
+		if err != nil || step < 1 {
+			return opts, errors.New("seq-step query parameter must be a positive number")
+		}
+		opts.SeqStep = step
+	}
+	if v := c.Query("rule-size"); v != "" {
+		size, err := strconv.Atoi(v)
+		if err != nil || size < 1 {
+			return opts, errors.New("rule-size query parameter must be a positive number")
+		}
+		opts.RuleSize = size
+	}
+	return opts, nil
+}
+
+// requestTimeout limits the time handlers may take to respond. Long-lived streams use
+// untimedContext instead.
+func requestTimeout(timeout time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set("untimedContext", c.Request.Context())
+		ctx, cancel := context.WithTimeout(c.Request.Context(), timeout)
+		defer cancel()
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+	}
+}
 
-		if json {
-			normalized := map[string]map[string][]string{}
-			for as, ipversions := range ips {
-				normalized[as] = map[string][]string{}
-				for ver, nets := range ipversions {
-					normalizedNets := make([]string, len(nets))
-					for i, net := range nets {
-						normalizedNets[i] = net.String()
-					}
-					normalized[as][ver] = normalizedNets
-				}
-			}
-			c.JSON(http.StatusOK, normalized)
-		} else {
-			allIP4, allIP6 := []string{}, []string{}
-			for _, ipversions := range ips {
-				for ver, nets := range ipversions {
-					for _, net := range nets {
-						if ver == "ipv4" {
-							allIP4 = append(allIP4, net.String())
-						} else if ver == "ipv6" {
-							allIP6 = append(allIP6, net.String())
-						}
-					}
-				}
-			}
-			c.String(http.StatusOK, strings.Join(append(allIP4, allIP6...), separator))
+// untimedContext returns the request context without the request timeout, which is still
+// canceled when the client goes away.
+func untimedContext(c *gin.Context) context.Context {
+	if v, ok := c.Get("untimedContext"); ok {
+		return v.(context.Context)
+	}
+	return c.Request.Context()
+}
+
+// requestDone responds to requests whose context has ended and reports whether it did.
+// Requests exceeding the request timeout get 504 Gateway Timeout, requests of clients that
+// went away are aborted as nobody is listening for a response.
+func requestDone(c *gin.Context) bool {
+	switch c.Request.Context().Err() {
+	case nil:
+		return false
+	case context.DeadlineExceeded:
+		c.String(http.StatusGatewayTimeout, "request timed out")
+	default:
+		c.Abort()
+	}
+	return true
+}
+
+// requestContext applies per request fetch options from query parameters to the request context.
+func requestContext(c *gin.Context) (context.Context, error) {
+	ctx := c.Request.Context()
+	if v, ok := c.GetQuery("depth"); ok {
+		depth, err := strconv.Atoi(v)
+		if err != nil || depth < 0 {
+			return nil, errors.New("depth query parameter must be a non-negative number")
 		}
-	})
+		ctx = asn2ip.ContextWithMaxDepth(ctx, depth)
+	}
+	if v, ok := c.GetQuery("sources"); ok {
+		sources, err := asn2ip.ParseSources(v)
+		if err != nil {
+			return nil, err
+		}
+		ctx = asn2ip.ContextWithSources(ctx, sources...)
+	}
+	return ctx, nil
+}
 
-	return router, nil
+// familiesFromQuery returns the address families selected by the ipv4 and ipv6 query parameters,
+// both default to true, narrowed down by the family query parameter (4, 6 or all).
+func familiesFromQuery(c *gin.Context) (ipv4, ipv6 bool, err error) {
+	ipv4, err = strconv.ParseBool(c.DefaultQuery("ipv4", "true"))
+	if err != nil {
+		return false, false, errors.New("ipv4 query parameter must be a boolean")
+	}
+	ipv6, err = strconv.ParseBool(c.DefaultQuery("ipv6", "true"))
+	if err != nil {
+		return false, false, errors.New("ipv6 query parameter must be a boolean")
+	}
+	return selectFamilies(c.Query("family"), ipv4, ipv6)
 }
 
 func wantJson(c *gin.Context) bool {
-	accept := c.GetHeader("Accept")
-	return strings.EqualFold(accept, "application/json")
+	return negotiateFormat(c.GetHeader("Accept"), "text") == "json"
 }
 
 func requestLogger(c *gin.Context) {
@@ -135,6 +597,8 @@ func requestLogger(c *gin.Context) {
 		"ErrorMessage": c.Errors.ByType(gin.ErrorTypePrivate).String(),
 		"BodySize":     c.Writer.Size(),
 		"Path":         path,
+		"APIKey":       c.GetString("apiKey"),
+		"RequestID":    c.GetString("requestID"),
 	}
 	logrus.WithFields(param).Info("processed http request")
 }
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/g0dsCookie/asn2ip/pkg/asn2ip/asn2iptest"
+	"github.com/g0dsCookie/asn2ip/pkg/storage"
+	"github.com/sirupsen/logrus"
+)
+
+// newTestRouter returns a router querying a mock whois server answering from data.
+func newTestRouter(t *testing.T, data asn2iptest.Data) (*router, *asn2iptest.Server) {
+	t.Helper()
+	logrus.SetOutput(io.Discard)
+	srv, err := asn2iptest.NewServer(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { srv.Close() })
+	r, err := newRouter(serverOptions{
+		WhoisHost:      srv.Host,
+		WhoisPort:      srv.Port,
+		MaxConcurrency: 1,
+		Storage:        storage.StorageOptions{Name: "memory"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { r.Close() })
+	return r, srv
+}
+
+func TestGetASN(t *testing.T) {
+	r, _ := newTestRouter(t, asn2iptest.Data{Networks: map[string][]string{"1": {"192.0.2.0/24"}}})
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/asn/1", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("got status %d, expected %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+}
+
+func TestGetASNUpstreamFailure(t *testing.T) {
+	r, srv := newTestRouter(t, asn2iptest.Data{Networks: map[string][]string{"1": {"192.0.2.0/24"}}})
+	srv.Drop("!gAS1")
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/asn/1", nil))
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("got status %d, expected %d: %s", w.Code, http.StatusBadGateway, w.Body)
+	}
+}
+
+func TestNewRouterInvalidOptions(t *testing.T) {
+	logrus.SetOutput(io.Discard)
+	opts := storage.StorageOptions{Name: "bolt", Path: filepath.Join(t.TempDir(), "asn2ip.db")}
+	if _, err := newRouter(serverOptions{Storage: opts, TrustedProxies: []string{"invalid"}}); err == nil {
+		t.Fatal("newRouter succeeded with invalid trusted proxies, expected an error")
+	}
+	// the storage must not have been left open, bolt locks its database file
+	stor, err := storage.NewStorage(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stor.Close()
+}
+
+func TestLookupIPsUpstreamFailure(t *testing.T) {
+	r, srv := newTestRouter(t, asn2iptest.Data{Networks: map[string][]string{"1": {"192.0.2.0/24"}}})
+	srv.Drop("!r")
+
+	w := httptest.NewRecorder()
+	body := strings.NewReader(`{"addresses": ["192.0.2.1"]}`)
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/v1/lookup-ip", body))
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("got status %d, expected %d: %s", w.Code, http.StatusBadGateway, w.Body)
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+		t.Errorf("got content type %q, expected a JSON error", ct)
+	}
+}
+
+func TestLookupLimits(t *testing.T) {
+	r, _ := newTestRouter(t, asn2iptest.Data{Networks: map[string][]string{"1": {"192.0.2.0/24"}}})
+	r.maxLookups, r.maxBodyBytes = 2, 64
+
+	for _, tt := range []struct {
+		path, body string
+		code       int
+	}{
+		{"/api/v1/lookup", `{"asns": ["1", "2"]}`, http.StatusOK},
+		{"/api/v1/lookup", `{"asns": ["1", "2", "3"]}`, http.StatusRequestEntityTooLarge},
+		{"/api/v1/lookup-ip", `{"addresses": ["192.0.2.1", "192.0.2.2", "192.0.2.3"]}`, http.StatusRequestEntityTooLarge},
+		{"/api/v1/lookup", `{"asns": ["1"], "family": "` + strings.Repeat("4", 64) + `"}`, http.StatusRequestEntityTooLarge},
+		{"/api/v1/lookup", `{"asns": `, http.StatusBadRequest},
+	} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader(tt.body)))
+		if w.Code != tt.code {
+			t.Errorf("got status %d for %s, expected %d: %s", w.Code, tt.body, tt.code, w.Body)
+		}
+	}
+}
+
+func TestAdminDeleteCache(t *testing.T) {
+	logrus.SetOutput(io.Discard)
+	srv, err := asn2iptest.NewServer(asn2iptest.Data{Networks: map[string][]string{"1": {"192.0.2.0/24"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	r, err := newRouter(serverOptions{
+		WhoisHost:      srv.Host,
+		WhoisPort:      srv.Port,
+		MaxConcurrency: 1,
+		AdminToken:     "secret",
+		Storage:        storage.StorageOptions{Name: "memory", TTL: time.Hour},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/asn/1", nil))
+	if _, err := r.storage.Get("1"); err != nil {
+		t.Fatalf("AS1 was not cached: %s", err)
+	}
+
+	for _, tt := range []struct {
+		asn  string
+		code int
+	}{
+		{"invalid", http.StatusBadRequest},
+		{"AS1", http.StatusNoContent},
+	} {
+		req := httptest.NewRequest(http.MethodDelete, "/admin/cache/"+tt.asn, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != tt.code {
+			t.Errorf("got status %d deleting %s, expected %d: %s", w.Code, tt.asn, tt.code, w.Body)
+		}
+	}
+	if _, err := r.storage.Get("1"); err != storage.ErrASNotCached {
+		t.Errorf("got %v reading AS1 after deleting AS1, expected %v", err, storage.ErrASNotCached)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"net/netip"
+
+	"github.com/g0dsCookie/asn2ip/pkg/asn2ip"
+	"github.com/gin-gonic/gin"
+)
+
+// ipFilterOptions restrict which clients may access the daemon.
+type ipFilterOptions struct {
+	// Allow lists the networks allowed to connect, all clients are allowed if empty.
+	Allow []netip.Prefix
+	// Deny lists networks rejected even if allowed.
+	Deny []netip.Prefix
+}
+
+// parseNetworks parses networks or single ip addresses.
+func parseNetworks(values []string) ([]netip.Prefix, error) {
+	nets := make([]netip.Prefix, len(values))
+	for i, v := range values {
+		n, err := asn2ip.ParseAddress(v)
+		if err != nil {
+			return nil, err
+		}
+		nets[i] = n
+	}
+	return nets, nil
+}
+
+func containsIP(nets []netip.Prefix, ip netip.Addr) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ipFilter rejects clients outside the allowed or inside the denied networks with 403 Forbidden.
+func ipFilter(opts ipFilterOptions) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ip, err := netip.ParseAddr(c.ClientIP())
+		ip = ip.Unmap()
+		if err != nil || containsIP(opts.Deny, ip) || (len(opts.Allow) > 0 && !containsIP(opts.Allow, ip)) {
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+		c.Next()
+	}
+}
@@ -1,13 +1,20 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"net/netip"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/g0dsCookie/asn2ip/internal/config"
 	"github.com/g0dsCookie/asn2ip/pkg/asn2ip"
+	"github.com/g0dsCookie/asn2ip/pkg/format"
+	"github.com/g0dsCookie/asn2ip/pkg/importer"
 	"github.com/g0dsCookie/asn2ip/pkg/storage"
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
 )
@@ -40,86 +47,837 @@ func main() {
 			{
 				Name:    "fetch",
 				Aliases: []string{"get", "g", "f"},
-				Usage:   "fetch specified AS number(s) and exit",
+				Usage:   "fetch specified AS number(s) or as-set(s) and exit",
+				Flags:   append(config.CLIFetchFlags, config.CLIWatchFlags...),
 				Action:  fetchHandler,
 			},
+			{
+				Name:      "lookup-ip",
+				Aliases:   []string{"ip"},
+				Usage:     "lookup originating AS number(s) of ip addresses or networks and exit",
+				ArgsUsage: "ADDRESS...",
+				Action:    lookupIPHandler,
+			},
+			{
+				Name:      "import",
+				Usage:     "import announced prefixes per origin AS from a MRT RIB dump into storage and exit",
+				ArgsUsage: "FILE|URL",
+				Action:    importHandler,
+				Flags:     config.CLIStorageFlags,
+			},
+			{
+				Name:      "diff",
+				Usage:     "show networks added and removed since the last stored state, exits with 2 on changes",
+				ArgsUsage: "ASN...",
+				Action:    diffHandler,
+				Flags:     append(config.CLIDiffFlags, config.CLIStorageFlags...),
+			},
+			{
+				Name:  "config",
+				Usage: "manage the config file",
+				Subcommands: []*cli.Command{
+					{
+						Name:      "init",
+						Usage:     "write a sample config file with the default value of every key",
+						ArgsUsage: "[FILE]",
+						Action:    configInitHandler,
+					},
+					{
+						Name:      "validate",
+						Usage:     "check the config file for unknown keys and invalid values",
+						ArgsUsage: "[FILE]",
+						Action:    configValidateHandler,
+					},
+					{
+						Name:   "show",
+						Usage:  "print the effective config merged from defaults, config file, environment and flags",
+						Action: configShowHandler,
+					},
+				},
+			},
+			{
+				Name:  "cache",
+				Usage: "inspect and manipulate the cache of the configured storage backend",
+				Subcommands: []*cli.Command{
+					{
+						Name:   "list",
+						Usage:  "list all cached AS numbers",
+						Flags:  config.CLIStorageFlags,
+						Action: cacheListHandler,
+					},
+					{
+						Name:      "show",
+						Usage:     "print the cached networks of an AS number",
+						ArgsUsage: "ASN",
+						Flags:     config.CLIStorageFlags,
+						Action:    cacheShowHandler,
+					},
+					{
+						Name:      "clear",
+						Usage:     "remove the given AS numbers or everything from cache, snapshots and history are kept",
+						ArgsUsage: "[ASN...]",
+						Flags:     config.CLIStorageFlags,
+						Action:    cacheClearHandler,
+					},
+					{
+						Name:      "export",
+						Usage:     "write all cached AS numbers as json to a file or stdout",
+						ArgsUsage: "[FILE]",
+						Flags:     config.CLIStorageFlags,
+						Action:    cacheExportHandler,
+					},
+					{
+						Name:      "import",
+						Usage:     "store the AS numbers of a file written by cache export, - reads stdin",
+						ArgsUsage: "FILE",
+						Flags:     config.CLIStorageFlags,
+						Action:    cacheImportHandler,
+					},
+				},
+			},
+			{
+				Name:      "expand",
+				Usage:     "print the member AS numbers of as-set(s), expanding nested as-sets, and exit",
+				ArgsUsage: "AS-SET...",
+				Flags:     config.CLIExpandFlags,
+				Action:    expandHandler,
+			},
+			{
+				Name:   "export",
+				Usage:  "write the cached networks of each AS number to its own file per format and exit",
+				Flags:  append(config.CLIExportFlags, config.CLIStorageFlags...),
+				Action: exportHandler,
+			},
+			{
+				Name:      "prefetch",
+				Usage:     "fetch AS number(s) into the storage backend to warm its cache and exit",
+				ArgsUsage: "[ASN...]",
+				Flags:     append(config.CLIPrefetchFlags, config.CLIStorageFlags...),
+				Action:    prefetchHandler,
+			},
+			{
+				Name:   "bench",
+				Usage:  "measure connect and query latency and completeness of whois servers and exit",
+				Flags:  config.CLIBenchFlags,
+				Action: benchHandler,
+			},
+			{
+				Name:   "whois-proxy",
+				Usage:  "run asn2ip as caching whois proxy answering IRRd !g, !6 and !i queries",
+				Flags:  append(config.CLIWhoisProxyFlags, config.CLIStorageFlags...),
+				Action: whoisProxyHandler,
+			},
+			{
+				Name:      "history",
+				Usage:     "show when the prefixes of an AS number were first and last seen and exit",
+				ArgsUsage: "ASN",
+				Action:    historyHandler,
+				Flags:     config.CLIStorageFlags,
+			},
 		},
 		Flags: config.CLIFlags,
+		Before: func(c *cli.Context) error {
+			config.SetFile(c.String(config.ConfigFileFlag.Name), c.String(config.ConfigFormatFlag.Name))
+			return nil
+		},
+	}
+	if err := app.Run(os.Args); err != nil {
+		// errors of cli.Exit already exited, what is left are usage errors like unknown flags
+		os.Exit(exitInput)
 	}
-	app.Run(os.Args)
 }
 
-func setupLogging(format string, level int) {
-	fields := logrus.Fields{"format": format}
-
-	logrus.SetOutput(os.Stdout)
-	logrus.SetLevel(logrus.Level(level))
+func setupLogging(format string, level int) error {
+	if level < int(logrus.PanicLevel) || level > int(logrus.TraceLevel) {
+		return errors.Errorf("invalid log-level %d, expected 0 to 6", level)
+	}
 
+	var formatter logrus.Formatter
 	switch format {
 	case "plain":
-		logrus.SetFormatter(&logrus.TextFormatter{})
+		formatter = &logrus.TextFormatter{}
 	case "json":
-		logrus.SetFormatter(&logrus.JSONFormatter{})
+		formatter = &logrus.JSONFormatter{}
 	default:
-		logrus.WithFields(fields).Panicln("unknown log-format")
+		return errors.Errorf("unknown log-format %q, expected plain or json", format)
 	}
+
+	logrus.SetOutput(os.Stdout)
+	logrus.SetLevel(logrus.Level(level))
+	logrus.SetFormatter(formatter)
+	return nil
+}
+
+// rootContext returns the context of the app, which alone knows the global flags and their
+// environment variables once a command has subcommands, those run as an app of their own.
+func rootContext(c *cli.Context) *cli.Context {
+	root := c
+	for _, ctx := range c.Lineage() {
+		if ctx.App != nil {
+			root = ctx
+		}
+	}
+	return root
 }
 
-func setup(c *cli.Context) *config.Config {
+func setup(c *cli.Context) (*config.Config, error) {
 	conf := config.NewConfig()
-	conf.UpdateFromCLIContext(c)
-	setupLogging(conf.GetString("log.format"), conf.GetInt("log.level"))
+	conf.UpdateFromCLIContext(rootContext(c))
+	if err := setupLogging(conf.GetString("log.format"), conf.GetInt("log.level")); err != nil {
+		logrus.WithFields(logrus.Fields{"error": err}).Errorln("failed to set up logging")
+		return nil, cli.Exit("", exitConfig)
+	}
+	if path := config.FindFile(); path != "" {
+		problems, err := config.Validate(path)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{"error": err}).Errorln("invalid config file")
+			return nil, cli.Exit("", exitConfig)
+		}
+		for _, problem := range problems {
+			logrus.WithFields(logrus.Fields{"path": path, "error": problem}).Warnln("problem in config file, check it with config validate")
+		}
+	}
 	logrus.Info("loaded config and set up logging")
-	return conf
+	return conf, nil
+}
+
+func irrSources(conf *config.Config) ([]string, error) {
+	sources, err := asn2ip.ParseSources(conf.GetString("whois.sources"))
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"error": err}).Errorln("invalid irr sources")
+		return nil, cli.Exit("", exitConfig)
+	}
+	return sources, nil
+}
+
+func storageOptionsFromConfig(stor *config.Config) (storage.StorageOptions, error) {
+	options, err := storage.ParseOptions(stor.GetStringSlice("storage.options"))
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"error": err}).Errorln("invalid storage options")
+		return storage.StorageOptions{}, cli.Exit("", exitConfig)
+	}
+	return storage.StorageOptions{
+		Name:             stor.GetString("storage.name"),
+		TTL:              stor.GetDuration("storage.ttl"),
+		NegativeTTL:      stor.GetDuration("storage.negative-ttl"),
+		MaxEntries:       stor.GetInt("storage.max-entries"),
+		SweepInterval:    stor.GetDuration("storage.sweep-interval"),
+		Snapshots:        stor.GetInt("storage.snapshots"),
+		History:          stor.GetBool("storage.history"),
+		HistoryRetention: stor.GetDuration("storage.history-retention"),
+		Path:             stor.GetString("storage.path"),
+		DSN:              stor.GetString("storage.dsn"),
+		Options:          options,
+	}, nil
+}
+
+func authOptionsFromConfig(daemon *config.Config) (authOptions, error) {
+	keys, err := parseAPIKeys(daemon.GetStringSlice("auth.keys"))
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"error": err}).Errorln("invalid api keys")
+		return authOptions{}, cli.Exit("", exitConfig)
+	}
+	if path := daemon.GetString("auth.keys-file"); path != "" {
+		fileKeys, err := loadAPIKeys(path)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{"error": err}).Errorln("invalid api keys file")
+			return authOptions{}, cli.Exit("", exitConfig)
+		}
+		keys = append(keys, fileKeys...)
+	}
+	return authOptions{Keys: keys, AnonymousLookups: daemon.GetBool("auth.anonymous-lookups")}, nil
+}
+
+func ipFilterOptionsFromConfig(daemon *config.Config) (ipFilterOptions, error) {
+	allow, err := parseNetworks(daemon.GetStringSlice("access.allow"))
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"error": err}).Errorln("invalid allowed networks")
+		return ipFilterOptions{}, cli.Exit("", exitConfig)
+	}
+	deny, err := parseNetworks(daemon.GetStringSlice("access.deny"))
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"error": err}).Errorln("invalid denied networks")
+		return ipFilterOptions{}, cli.Exit("", exitConfig)
+	}
+	return ipFilterOptions{Allow: allow, Deny: deny}, nil
 }
 
 func runHandler(c *cli.Context) error {
-	conf := setup(c)
+	opts, httpOpts, err := daemonOptions(c)
+	if err != nil {
+		return err
+	}
+	opts.Reload = func() (serverOptions, error) {
+		opts, _, err := daemonOptions(c)
+		if err != nil {
+			// the problem has been logged already
+			return serverOptions{}, errors.New("invalid configuration")
+		}
+		return opts, nil
+	}
+	router, err := newRouter(opts)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"error": err}).Errorln("failed to initialize http router")
+		return cli.Exit("", exitConfig)
+	}
+	return serve(c.Context, router, httpOpts)
+}
+
+// daemonOptions sets up the daemon and returns its options read from flags, environment and
+// config file, once on start and again on each reload.
+func daemonOptions(c *cli.Context) (serverOptions, httpOptions, error) {
+	conf, err := setup(c)
+	if err != nil {
+		return serverOptions{}, httpOptions{}, err
+	}
 	daemon := config.NewDaemonConfig()
 	daemon.UpdateFromCLIContext(c)
 	stor := config.NewStorageConfig()
 	stor.UpdateFromCLIContext(c)
 
-	router, err := newRouter(serverOptions{
-		WhoisHost: conf.GetString("whois.host"),
-		WhoisPort: conf.GetInt("whois.port"),
-		Url:       daemon.GetString("listen.url"),
-		Storage: storage.StorageOptions{
-			Name: stor.GetString("storage.name"),
-			TTL:  stor.GetDuration("storage.ttl"),
-		},
-	})
+	sources, err := irrSources(conf)
+	if err != nil {
+		return serverOptions{}, httpOptions{}, err
+	}
+	storageOptions, err := storageOptionsFromConfig(stor)
+	if err != nil {
+		return serverOptions{}, httpOptions{}, err
+	}
+	filters, err := filterOptionsFromConfig(conf)
+	if err != nil {
+		return serverOptions{}, httpOptions{}, err
+	}
+	formatOpts, err := formatOptionsFromConfig(conf)
+	if err != nil {
+		return serverOptions{}, httpOptions{}, err
+	}
 
+	auth, err := authOptionsFromConfig(daemon)
+	if err != nil {
+		return serverOptions{}, httpOptions{}, err
+	}
+	ipFilter, err := ipFilterOptionsFromConfig(daemon)
 	if err != nil {
-		logrus.WithFields(logrus.Fields{"error": err}).Panicln("failed to initialize http router")
+		return serverOptions{}, httpOptions{}, err
+	}
+	source, err := sourceOptionsFromConfig(conf)
+	if err != nil {
+		return serverOptions{}, httpOptions{}, err
 	}
 
-	router.Run(fmt.Sprintf("%s:%d", daemon.GetString("listen.address"), daemon.GetInt("listen.port")))
-	return nil
+	opts := serverOptions{
+		Source:         source,
+		WhoisHost:      conf.GetString("whois.host"),
+		WhoisPort:      conf.GetInt("whois.port"),
+		MaxConcurrency: conf.GetInt("whois.max-concurrency"),
+		MaxDepth:       conf.GetInt("whois.as-set-depth"),
+		Sources:        sources,
+		MergeSources:   conf.GetBool("whois.merge-sources"),
+		AllowedServers: daemon.GetStringSlice("whois.allowed-servers"),
+		GeoIPDB:        daemon.GetString("geoip.db"),
+		Filters:        filters,
+		Format:         formatOpts,
+		Url:            daemon.GetString("listen.url"),
+		AdminToken:     daemon.GetString("admin.token"),
+		AdminListen:    daemon.GetString("admin.listen"),
+		Pprof:          daemon.GetBool("admin.pprof"),
+		Compress: compressOptions{
+			Enabled: daemon.GetBool("compress.gzip"),
+			MinSize: daemon.GetInt("compress.min-size"),
+		},
+		CORS: corsOptions{
+			AllowedOrigins: daemon.GetStringSlice("cors.allowed-origins"),
+			AllowedMethods: daemon.GetStringSlice("cors.allowed-methods"),
+			AllowedHeaders: daemon.GetStringSlice("cors.allowed-headers"),
+			MaxAge:         daemon.GetDuration("cors.max-age"),
+		},
+		Auth: auth,
+		RateLimit: rateLimitOptions{
+			Rate:  daemon.GetFloat64("ratelimit.rate"),
+			Burst: daemon.GetInt("ratelimit.burst"),
+		},
+		IPFilter:       ipFilter,
+		TrustedProxies: daemon.GetStringSlice("listen.trusted-proxies"),
+		RequestTimeout: daemon.GetDuration("listen.request-timeout"),
+		MaxLookups:     daemon.GetInt("listen.max-lookups"),
+		MaxBodyBytes:   daemon.GetInt64("listen.max-body-bytes"),
+		Pool: asn2ip.PoolOptions{
+			MinIdle:     daemon.GetInt("whois.pool.min-idle"),
+			MaxIdle:     daemon.GetInt("whois.pool.max-idle"),
+			IdleTimeout: daemon.GetDuration("whois.pool.idle-timeout"),
+			KeepAlive:   daemon.GetDuration("whois.pool.keepalive"),
+		},
+		Storage: storageOptions,
+		Refresh: asn2ip.RefresherOptions{
+			ASNs:        daemon.GetStringSlice("refresh.asns"),
+			Interval:    daemon.GetDuration("refresh.interval"),
+			Jitter:      daemon.GetDuration("refresh.jitter"),
+			Concurrency: daemon.GetInt("refresh.concurrency"),
+		},
+		Webhooks: webhookOptions{
+			URLs:    daemon.GetStringSlice("webhook.urls"),
+			Secret:  daemon.GetString("webhook.secret"),
+			Timeout: daemon.GetDuration("webhook.timeout"),
+		},
+		AuditLog: daemon.GetString("audit.file"),
+	}
+	return opts, httpOptions{
+		Address:           fmt.Sprintf("%s:%d", daemon.GetString("listen.address"), daemon.GetInt("listen.port")),
+		ReadTimeout:       daemon.GetDuration("listen.read-timeout"),
+		ReadHeaderTimeout: daemon.GetDuration("listen.read-header-timeout"),
+		WriteTimeout:      daemon.GetDuration("listen.write-timeout"),
+		IdleTimeout:       daemon.GetDuration("listen.idle-timeout"),
+		MaxHeaderBytes:    daemon.GetInt("listen.max-header-bytes"),
+		ShutdownTimeout:   daemon.GetDuration("listen.shutdown-timeout"),
+	}, nil
 }
 
-func fetchHandler(c *cli.Context) error {
-	conf := setup(c)
+func fetchHandler(c *cli.Context) (err error) {
+	conf, err := setup(c)
+	if err != nil {
+		return err
+	}
 	fetch := config.NewFetchConfig()
 	fetch.UpdateFromCLIContext(c)
+	ipv4, ipv6, err := familiesFromConfig(fetch)
+	if err != nil {
+		return err
+	}
 
-	fetcher := asn2ip.NewFetcher(conf.GetString("whois.host"), conf.GetInt("whois.port"))
-	ips, err := fetcher.Fetch(fetch.GetBool("fetch.ipv4"), fetch.GetBool("fetch.ipv6"), c.Args().Slice()...)
+	asn := c.Args().Slice()
+	for i, as := range asn {
+		normalized, err := asn2ip.Normalize(as)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{"error": err}).Errorln("invalid as number")
+			return cli.Exit("", exitInput)
+		}
+		asn[i] = normalized
+	}
+	if err := applyFetchOverrides(fetch, conf); err != nil {
+		return err
+	}
+	sources, err := irrSources(conf)
 	if err != nil {
-		logrus.WithFields(logrus.Fields{"ipv4": fetch.GetBool("fetch.ipv4"), "ipv6": fetch.GetBool("fetch.ipv6"), "error": err}).Errorln("failed to fetch networks")
-		return cli.Exit("", 10)
+		return err
+	}
+	source, err := sourceOptionsFromConfig(conf)
+	if err != nil {
+		return err
+	}
+	if timeout := fetch.GetDuration("fetch.timeout"); timeout > 0 {
+		source.RIPEstat.Timeout, source.BGPView.Timeout = timeout, timeout
+	}
+	// sources given with --irr-source are input of this run rather than configuration
+	unknownSources := exitConfig
+	if fetch.GetString("fetch.irr-source") != "" {
+		unknownSources = exitInput
+	}
+	if err := validateSources(c.Context, source, conf.GetString("whois.host"), conf.GetInt("whois.port"), sources, unknownSources); err != nil {
+		return err
 	}
 
-	for as, ipversions := range ips {
-		fmt.Printf("AS%s\n", as)
-		for _, net := range ipversions {
-			arr := make([]string, len(net))
-			for k, v := range net {
-				arr[k] = v.String()
+	fetcher, err := fetcherFromConfig(conf, source, sources)
+	if err != nil {
+		return err
+	}
+	defer fetcher.Close()
+	var names *nameLookup
+	if conf.GetBool("output.names") {
+		resolver, err := newNameResolver(source, conf.GetString("whois.host"), conf.GetInt("whois.port"),
+			asn2ip.WithSources(sources...))
+		if err != nil {
+			logrus.WithFields(logrus.Fields{"error": err}).Errorln("failed to create name resolver")
+			return cli.Exit("", exitConfig)
+		}
+		names = &nameLookup{resolver: resolver}
+		defer names.Close()
+	}
+	filters, err := filterOptionsFromConfig(conf)
+	if err != nil {
+		return err
+	}
+	formatOpts, err := formatOptionsFromConfig(conf)
+	if err != nil {
+		return err
+	}
+	var formatter format.Formatter
+	if name := conf.GetString("output.format"); name != "" {
+		f, err := format.Lookup(name)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{"error": err}).Errorln("invalid output format")
+			return cli.Exit("", exitConfig)
+		}
+		formatter = f
+	}
+	run := &fetchRun{
+		fetcher:    fetcher,
+		ipv4:       ipv4,
+		ipv6:       ipv6,
+		filters:    filters,
+		formatter:  formatter,
+		formatOpts: formatOpts,
+		names:      names,
+		sources:    sources,
+		asn:        asn,
+		merge:      conf.GetBool("whois.merge-sources"),
+		ordered:    fetch.GetInt("fetch.parallel") > 1,
+	}
+	watch := config.NewWatchConfig()
+	watch.UpdateFromCLIContext(c)
+	if watch.GetBool("watch.enabled") {
+		return watchFetch(c.Context, run, conf.GetString("output.file"), watchOptions{
+			Interval: watch.GetDuration("watch.interval"),
+			Exec:     watch.GetString("watch.exec"),
+		})
+	}
+
+	out, err := openOutput(conf.GetString("output.file"))
+	if err != nil {
+		return err
+	}
+	defer func() { err = out.close(err) }()
+	return run.write(c.Context, out)
+}
+
+// familiesFromConfig returns the address families to fetch, narrowing --ipv4 and --ipv6 down
+// by --family or its shorthands -4 and -6.
+func familiesFromConfig(fetch *config.Config) (ipv4, ipv6 bool, err error) {
+	family := fetch.GetString("fetch.family")
+	switch only4, only6 := fetch.GetBool("fetch.ipv4-only"), fetch.GetBool("fetch.ipv6-only"); {
+	case only4 && !only6:
+		family = "4"
+	case only6 && !only4:
+		family = "6"
+	}
+	ipv4, ipv6, err = selectFamilies(family, fetch.GetBool("fetch.ipv4"), fetch.GetBool("fetch.ipv6"))
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"error": err}).Errorln("invalid address family")
+		return false, false, cli.Exit("", exitInput)
+	}
+	return ipv4, ipv6, nil
+}
+
+// applyFetchOverrides sets the global flags overridden by flags of the fetch command in conf,
+// so batch jobs can tune parallelism, irr sources, timeouts and retries without the global
+// flags of the source in use.
+func applyFetchOverrides(fetch, conf *config.Config) error {
+	parallel := fetch.GetInt("fetch.parallel")
+	timeout := fetch.GetDuration("fetch.timeout")
+	retries := fetch.GetInt("fetch.retries")
+	delay := fetch.GetDuration("fetch.retry-delay")
+	switch {
+	case parallel < 0:
+		logrus.WithFields(logrus.Fields{"parallel": parallel}).Errorln("invalid number of parallel fetches")
+		return cli.Exit("", exitInput)
+	case timeout < 0:
+		logrus.WithFields(logrus.Fields{"timeout": timeout}).Errorln("invalid timeout")
+		return cli.Exit("", exitInput)
+	case retries < -1:
+		logrus.WithFields(logrus.Fields{"retries": retries}).Errorln("invalid number of retries")
+		return cli.Exit("", exitInput)
+	case delay < 0:
+		logrus.WithFields(logrus.Fields{"retry-delay": delay}).Errorln("invalid retry delay")
+		return cli.Exit("", exitInput)
+	}
+	if parallel > 0 {
+		conf.Set("whois.max-concurrency", parallel)
+	}
+	if sources := fetch.GetString("fetch.irr-source"); sources != "" {
+		if _, err := asn2ip.ParseSources(sources); err != nil {
+			logrus.WithFields(logrus.Fields{"error": err}).Errorln("invalid irr sources")
+			return cli.Exit("", exitInput)
+		}
+		conf.Set("whois.sources", sources)
+	}
+	if timeout > 0 {
+		conf.Set("whois.timeout", timeout)
+	}
+	if retries >= 0 {
+		conf.Set("whois.max-retries", retries)
+		conf.Set("bgpview.max-retries", retries)
+	}
+	if delay > 0 {
+		conf.Set("whois.retry-delay", delay)
+		conf.Set("bgpview.retry-delay", delay)
+	}
+	return nil
+}
+
+// fetcherFromConfig creates the fetcher of the commands fetching networks.
+func fetcherFromConfig(conf *config.Config, source sourceOptions, sources []string) (asn2ip.Fetcher, error) {
+	fetcher, err := newUpstream(source, conf.GetString("whois.host"), conf.GetInt("whois.port"),
+		asn2ip.WithMaxConcurrency(conf.GetInt("whois.max-concurrency")), asn2ip.WithMaxDepth(conf.GetInt("whois.as-set-depth")),
+		asn2ip.WithSources(sources...))
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"error": err}).Errorln("failed to create fetcher")
+		return nil, cli.Exit("", exitConfig)
+	}
+	return fetcher, nil
+}
+
+// fetchRun fetches the networks requested on the command line and writes them, once or
+// repeatedly in watch mode.
+type fetchRun struct {
+	fetcher    asn2ip.Fetcher
+	ipv4       bool
+	ipv6       bool
+	filters    filterOptions
+	formatter  format.Formatter
+	formatOpts format.Options
+	names      *nameLookup
+	sources    []string
+	asn        []string
+	merge      bool
+	// ordered collects all networks before writing them in numerical order of their AS numbers,
+	// instead of streaming them in the order parallel fetches complete.
+	ordered bool
+}
+
+func (r *fetchRun) write(ctx context.Context, out io.Writer) error {
+	if r.merge {
+		return r.writeMerged(ctx, out)
+	}
+	ipv4, ipv6 := r.ipv4, r.ipv6
+	formatter := r.formatter
+	if formatter == nil {
+		formatter, _ = format.Lookup("plain")
+	}
+	if sf, ok := formatter.(format.StreamFormatter); ok && !r.ordered {
+		written := 0
+		err := asn2ip.FetchStream(ctx, r.fetcher, ipv4, ipv6, func(res *asn2ip.ASResult) error {
+			ips := asn2ip.Result{res.ASN: res}
+			r.filters.applyAll(ips)
+			opts := r.formatOpts
+			opts.Names = r.names.lookup(ctx, []string{res.ASN})
+			if res.Error == nil {
+				written++
+			}
+			return sf.Write(out, ips.Networks(), opts)
+		}, r.asn...)
+		failed, err := partialResult(written, err)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{"ipv4": ipv4, "ipv6": ipv6, "error": err}).Errorln("failed to fetch networks")
+			return cli.Exit("", fetchExitCode(err))
+		}
+		return reportFailed(failed)
+	}
+	ips, err := r.fetcher.FetchContext(ctx, ipv4, ipv6, r.asn...)
+	failed, err := partialResult(len(ips.ASNs()), err)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"ipv4": ipv4, "ipv6": ipv6, "error": err}).Errorln("failed to fetch networks")
+		return cli.Exit("", fetchExitCode(err))
+	}
+	r.filters.applyAll(ips)
+	opts := r.formatOpts
+	opts.Names = r.names.lookup(ctx, ips.ASNs())
+	if err := writeCLIFormat(out, formatter, ips.Networks(), opts); err != nil {
+		return err
+	}
+	return reportFailed(failed)
+}
+
+// reportFailed logs each AS which failed while the others were fetched and fails the command
+// if there is any.
+func reportFailed(failed map[string]error) error {
+	if len(failed) == 0 {
+		return nil
+	}
+	for _, as := range failedASNs(failed) {
+		logrus.WithFields(logrus.Fields{"asn": as, "error": failed[as]}).Errorln("failed to fetch networks")
+	}
+	return cli.Exit("", exitPartial)
+}
+
+func (r *fetchRun) writeMerged(ctx context.Context, out io.Writer) error {
+	if len(r.sources) == 0 {
+		logrus.Errorln("merging requires irr sources, set them with --irr-sources")
+		return cli.Exit("", exitConfig)
+	}
+	merger, ok := r.fetcher.(asn2ip.Merger)
+	if !ok {
+		logrus.Errorln("merging irr sources requires the whois source")
+		return cli.Exit("", exitConfig)
+	}
+	merged, err := merger.FetchMerged(ctx, r.ipv4, r.ipv6, r.sources, r.asn...)
+	failed, err := partialResult(len(merged), err)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"sources": r.sources, "error": err}).Errorln("failed to fetch networks")
+		return cli.Exit("", fetchExitCode(err))
+	}
+	r.filters.applyMerged(merged)
+	ips := mergedNetworks(merged)
+	opts := r.formatOpts
+	opts.Names = r.names.lookup(ctx, format.SortedASNs(ips))
+	if r.formatter != nil {
+		if err := writeCLIFormat(out, r.formatter, ips, opts); err != nil {
+			return err
+		}
+		return reportFailed(failed)
+	}
+
+	for as, families := range merged {
+		fmt.Fprintf(out, "%s\n", asLabel(as, opts.Names))
+		for _, family := range []string{"ipv4", "ipv6"} {
+			for _, p := range families[family] {
+				fmt.Fprintf(out, "  %s %s\n", p.Prefix, strings.Join(p.Sources, ","))
 			}
-			fmt.Printf("  %s\n", strings.Join(arr, ","))
 		}
 	}
+	return reportFailed(failed)
+}
 
+func writeCLIFormat(w io.Writer, f format.Formatter, ips map[string]map[string][]netip.Prefix, opts format.Options) error {
+	if err := f.Write(w, ips, opts); err != nil {
+		logrus.WithFields(logrus.Fields{"error": err}).Errorln("failed to write networks")
+		return cli.Exit("", exitError)
+	}
+	return nil
+}
+
+func lookupIPHandler(c *cli.Context) error {
+	conf, err := setup(c)
+	if err != nil {
+		return err
+	}
+	if c.NArg() < 1 {
+		logrus.Errorln("lookup-ip requires at least one ip address or network")
+		return cli.Exit("", exitInput)
+	}
+	addresses := c.Args().Slice()
+	sources, err := irrSources(conf)
+	if err != nil {
+		return err
+	}
+	source, err := sourceOptionsFromConfig(conf)
+	if err != nil {
+		return err
+	}
+
+	resolver, err := newResolver(source, conf.GetString("whois.host"), conf.GetInt("whois.port"),
+		asn2ip.WithSources(sources...))
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"error": err}).Errorln("failed to create resolver")
+		return cli.Exit("", exitConfig)
+	}
+	defer resolver.Close()
+	routes, err := asn2ip.LookupIPs(c.Context, resolver, addresses)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"addresses": addresses, "error": err}).Errorln("failed to lookup routes")
+		return cli.Exit("", fetchExitCode(err))
+	}
+
+	missing := 0
+	for _, address := range addresses {
+		if len(routes[address]) == 0 {
+			logrus.WithFields(logrus.Fields{"address": address}).Errorln("no route found")
+			missing++
+			continue
+		}
+		for _, route := range routes[address] {
+			if len(addresses) > 1 {
+				fmt.Printf("%s ", address)
+			}
+			fmt.Printf("AS%s %s (%s)\n", route.Origin, route.Prefix, route.Source)
+		}
+	}
+	switch {
+	case missing == len(addresses):
+		return cli.Exit("", exitNotFound)
+	case missing > 0:
+		return cli.Exit("", exitPartial)
+	}
+	return nil
+}
+
+func importHandler(c *cli.Context) error {
+	if _, err := setup(c); err != nil {
+		return err
+	}
+	stor := config.NewStorageConfig()
+	stor.UpdateFromCLIContext(c)
+	if c.NArg() != 1 {
+		logrus.Errorln("import requires exactly one mrt dump file or url")
+		return cli.Exit("", exitInput)
+	}
+	source := c.Args().First()
+
+	storageOptions, err := storageOptionsFromConfig(stor)
+	if err != nil {
+		return err
+	}
+	cache, err := storage.NewStorage(storageOptions)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"error": err}).Errorln("failed to initialize storage")
+		return cli.Exit("", exitConfig)
+	}
+	defer cache.Close()
+
+	dump, err := importer.Open(c.Context, source)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"source": source, "error": err}).Errorln("failed to open rib dump")
+		return cli.Exit("", exitUnreachable)
+	}
+	defer dump.Close()
+
+	start := time.Now()
+	result, err := importer.Import(c.Context, dump, cache)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"source": source, "error": err}).Errorln("failed to import rib dump")
+		return cli.Exit("", exitError)
+	}
+	logrus.WithFields(logrus.Fields{
+		"source":   source,
+		"prefixes": result.Prefixes,
+		"asns":     result.ASNs,
+		"duration": time.Since(start),
+	}).Infoln("imported rib dump")
+	return nil
+}
+
+func historyHandler(c *cli.Context) error {
+	if _, err := setup(c); err != nil {
+		return err
+	}
+	stor := config.NewStorageConfig()
+	stor.UpdateFromCLIContext(c)
+	if c.NArg() != 1 {
+		logrus.Errorln("history requires exactly one AS number")
+		return cli.Exit("", exitInput)
+	}
+	as, err := asn2ip.NormalizeASN(c.Args().First())
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"error": err}).Errorln("invalid as number")
+		return cli.Exit("", exitInput)
+	}
+
+	storageOptions, err := storageOptionsFromConfig(stor)
+	if err != nil {
+		return err
+	}
+	cache, err := storage.NewStorage(storageOptions)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"error": err}).Errorln("failed to initialize storage")
+		return cli.Exit("", exitConfig)
+	}
+	defer cache.Close()
+	historyStorage, ok := cache.(storage.HistoryStorage)
+	if !ok {
+		logrus.WithFields(logrus.Fields{"storage": storageOptions.Name}).Errorln("storage does not record prefix history")
+		return cli.Exit("", exitConfig)
+	}
+
+	history, err := historyStorage.History(as)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"asn": as, "error": err}).Errorln("failed to read prefix history")
+		return cli.Exit("", exitError)
+	}
+	if len(history) == 0 {
+		logrus.WithFields(logrus.Fields{"asn": as}).Errorln("no prefix history recorded")
+		return cli.Exit("", exitNotFound)
+	}
+	fmt.Printf("%-43s %-25s %s\n", "PREFIX", "FIRST SEEN", "LAST SEEN")
+	for _, h := range history {
+		fmt.Printf("%-43s %-25s %s\n", h.Prefix, h.FirstSeen.Format(time.RFC3339), h.LastSeen.Format(time.RFC3339))
+	}
 	return nil
 }
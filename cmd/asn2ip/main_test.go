@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/g0dsCookie/asn2ip/pkg/asn2ip/asn2iptest"
+	"github.com/g0dsCookie/asn2ip/pkg/format"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+func TestSetupLoggingInvalid(t *testing.T) {
+	for _, tt := range []struct {
+		format string
+		level  int
+	}{
+		{"xml", 4},
+		{"", 4},
+		{"plain", -1},
+		{"json", 7},
+	} {
+		if err := setupLogging(tt.format, tt.level); err == nil {
+			t.Errorf("setupLogging(%q, %d) succeeded, expected an error", tt.format, tt.level)
+		}
+	}
+}
+
+func TestFetchRunExitCode(t *testing.T) {
+	logrus.SetOutput(io.Discard)
+	srv, err := asn2iptest.NewServer(asn2iptest.Data{Networks: map[string][]string{"1": {"192.0.2.0/24"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	f := srv.Fetcher()
+	defer f.Close()
+
+	for _, tt := range []struct {
+		format string
+		asn    []string
+		code   int
+	}{
+		{"plain", []string{"2", "3"}, exitNotFound},
+		{"jsonl", []string{"2", "3"}, exitNotFound},
+		{"plain", []string{"1", "2"}, exitPartial},
+		{"jsonl", []string{"1", "2"}, exitPartial},
+		{"jsonl", []string{"1"}, 0},
+	} {
+		formatter, err := format.Lookup(tt.format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		run := &fetchRun{fetcher: f, ipv4: true, formatter: formatter, asn: tt.asn}
+		code := 0
+		if err := run.write(context.Background(), io.Discard); err != nil {
+			exit, ok := err.(cli.ExitCoder)
+			if !ok {
+				t.Fatalf("fetching %v as %s failed with %v, expected an exit code", tt.asn, tt.format, err)
+			}
+			code = exit.ExitCode()
+		}
+		if code != tt.code {
+			t.Errorf("fetching %v as %s exited with %d, expected %d", tt.asn, tt.format, code, tt.code)
+		}
+	}
+}
+
+func TestValidateSources(t *testing.T) {
+	logrus.SetOutput(io.Discard)
+	srv, err := asn2iptest.NewServer(asn2iptest.Data{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	if err := validateSources(context.Background(), sourceOptions{}, srv.Host, srv.Port, []string{asn2iptest.Source}, exitInput); err != nil {
+		t.Errorf("validating the mirrored source failed: %s", err)
+	}
+	err = validateSources(context.Background(), sourceOptions{}, srv.Host, srv.Port, []string{"UNKNOWN"}, exitInput)
+	if exit, ok := err.(cli.ExitCoder); !ok || exit.ExitCode() != exitInput {
+		t.Errorf("got %v for an unknown source, expected exit code %d", err, exitInput)
+	}
+}
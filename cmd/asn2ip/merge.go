@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/g0dsCookie/asn2ip/pkg/asn2ip"
+	"github.com/g0dsCookie/asn2ip/pkg/format"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+type sourcedPrefix struct {
+	Prefix  string   `json:"prefix"`
+	Sources []string `json:"sources"`
+}
+
+// fetchMerged responds with the networks of asn merged from all requested irr sources.
+// JSON output lists the sources of each network, other formats drop them.
+func (r *router) fetchMerged(c *gin.Context, ctx context.Context, filters filterOptions, name string, formatter format.Formatter, ipv4, ipv6 bool, asn []string) {
+	up := r.upstreams(c)
+	sources := up.sources
+	if v, ok := c.GetQuery("sources"); ok {
+		// already validated by requestContext
+		sources, _ = asn2ip.ParseSources(v)
+	}
+	if len(sources) == 0 {
+		c.String(http.StatusBadRequest, "merging requires irr sources")
+		return
+	}
+	merger, ok := up.fetcher.(asn2ip.Merger)
+	if !ok {
+		c.String(http.StatusNotImplemented, "merging irr sources is not supported")
+		return
+	}
+
+	merged, err := merger.FetchMerged(ctx, ipv4, ipv6, sources, asn...)
+	failed, err := partialResult(len(merged), err)
+	if err != nil {
+		if requestDone(c) {
+			return
+		}
+		if errors.Is(err, asn2ip.ErrASNotFound) {
+			c.String(http.StatusNotFound, "%s", err)
+			return
+		}
+		if errors.Is(err, asn2ip.ErrTimeout) {
+			c.String(http.StatusGatewayTimeout, "timed out fetching ip addresses for AS %s", strings.Join(asn, ":"))
+			return
+		}
+		requestLog(c).WithFields(logrus.Fields{"error": err}).Warnln("failed to fetch networks")
+		c.String(http.StatusBadGateway, "failed to fetch ip addresses for AS %s", strings.Join(asn, ":"))
+		return
+	}
+	logFailed(c, failed)
+	filters.applyMerged(merged)
+	for _, families := range merged {
+		// merged networks are always fetched from the sources
+		auditOf(c).returned(len(families["ipv4"])+len(families["ipv6"]), "")
+	}
+
+	if name != "json" {
+		r.writeFormat(c, formatter, mergedNetworks(merged), failed)
+		return
+	}
+
+	result := map[string]map[string][]sourcedPrefix{}
+	for as, families := range merged {
+		result[as] = map[string][]sourcedPrefix{}
+		for family, prefixes := range families {
+			result[as][family] = make([]sourcedPrefix, len(prefixes))
+			for i, p := range prefixes {
+				result[as][family][i] = sourcedPrefix{Prefix: p.Prefix.String(), Sources: p.Sources}
+			}
+		}
+	}
+	status := http.StatusOK
+	if len(failed) > 0 {
+		status = http.StatusMultiStatus
+	}
+	c.JSON(status, result)
+}
+
+// mergedNetworks drops the sources of merged networks.
+func mergedNetworks(merged map[string]map[string][]asn2ip.SourcedPrefix) map[string]map[string][]netip.Prefix {
+	ips := map[string]map[string][]netip.Prefix{}
+	for as, families := range merged {
+		ips[as] = map[string][]netip.Prefix{}
+		for family, prefixes := range families {
+			nets := make([]netip.Prefix, len(prefixes))
+			for i, p := range prefixes {
+				nets[i] = p.Prefix
+			}
+			ips[as][family] = nets
+		}
+	}
+	return ips
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/g0dsCookie/asn2ip/pkg/asn2ip"
+	"github.com/g0dsCookie/asn2ip/pkg/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+type requestLabels struct {
+	Method string
+	Route  string
+	Code   int
+}
+
+type requestStats struct {
+	count    uint64
+	duration time.Duration
+}
+
+// httpMetrics counts the requests served by the lookup listener.
+type httpMetrics struct {
+	mu       sync.Mutex
+	requests map[requestLabels]*requestStats
+}
+
+func newHTTPMetrics() *httpMetrics {
+	return &httpMetrics{requests: map[requestLabels]*requestStats{}}
+}
+
+// record is a middleware counting requests by method, route and status code.
+func (m *httpMetrics) record(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+
+	labels := requestLabels{Method: c.Request.Method, Route: c.FullPath(), Code: c.Writer.Status()}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stats, ok := m.requests[labels]
+	if !ok {
+		stats = &requestStats{}
+		m.requests[labels] = stats
+	}
+	stats.count++
+	stats.duration += time.Since(start)
+}
+
+// write writes the request counters in the prometheus text format.
+func (m *httpMetrics) write(w io.Writer) {
+	m.mu.Lock()
+	labels := make([]requestLabels, 0, len(m.requests))
+	stats := make(map[requestLabels]requestStats, len(m.requests))
+	for l, s := range m.requests {
+		labels = append(labels, l)
+		stats[l] = *s
+	}
+	m.mu.Unlock()
+	sort.Slice(labels, func(i, j int) bool {
+		if labels[i].Route != labels[j].Route {
+			return labels[i].Route < labels[j].Route
+		}
+		if labels[i].Method != labels[j].Method {
+			return labels[i].Method < labels[j].Method
+		}
+		return labels[i].Code < labels[j].Code
+	})
+
+	fmt.Fprintln(w, "# HELP asn2ip_http_requests_total Number of http requests served.")
+	fmt.Fprintln(w, "# TYPE asn2ip_http_requests_total counter")
+	for _, l := range labels {
+		fmt.Fprintf(w, "asn2ip_http_requests_total{%s} %d\n", l, stats[l].count)
+	}
+	fmt.Fprintln(w, "# HELP asn2ip_http_request_duration_seconds_total Time spent serving http requests.")
+	fmt.Fprintln(w, "# TYPE asn2ip_http_request_duration_seconds_total counter")
+	for _, l := range labels {
+		fmt.Fprintf(w, "asn2ip_http_request_duration_seconds_total{%s} %g\n", l, stats[l].duration.Seconds())
+	}
+}
+
+func (l requestLabels) String() string {
+	route := l.Route
+	if route == "" {
+		route = "unmatched"
+	}
+	return fmt.Sprintf("method=%s,route=%s,code=\"%d\"", strconv.Quote(l.Method), strconv.Quote(route), l.Code)
+}
+
+// whoisMetrics counts events of the whois connections.
+type whoisMetrics struct {
+	retries uint64
+}
+
+// retry counts a retried whois query, it is called as asn2ip.RetryOptions.OnRetry.
+func (m *whoisMetrics) retry(attempt int, err error) {
+	atomic.AddUint64(&m.retries, 1)
+}
+
+// write writes the whois counters and the usage of limiter in the prometheus text format.
+func (m *whoisMetrics) write(w io.Writer, limiter *asn2ip.Limiter) {
+	fmt.Fprintln(w, "# HELP asn2ip_whois_retries_total Number of whois queries retried after a transient failure.")
+	fmt.Fprintln(w, "# TYPE asn2ip_whois_retries_total counter")
+	fmt.Fprintf(w, "asn2ip_whois_retries_total %d\n", atomic.LoadUint64(&m.retries))
+	if limiter == nil {
+		return
+	}
+
+	stats := limiter.Stats()
+	metrics := []struct {
+		name, typ, help string
+		value           uint64
+	}{
+		{"asn2ip_whois_connections_in_use", "gauge", "Number of whois connections in use.", uint64(stats.Conns)},
+		{"asn2ip_whois_connections_waiting", "gauge", "Number of fetches waiting for a whois connection.", uint64(stats.Waiting)},
+		{"asn2ip_whois_queries_total", "counter", "Number of whois queries issued.", stats.Queries},
+		{"asn2ip_whois_queries_throttled_total", "counter", "Number of whois queries delayed by the rate limit.", stats.Throttled},
+	}
+	for _, m := range metrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", m.name, m.help, m.name, m.typ, m.name, m.value)
+	}
+}
+
+// writeCacheMetrics writes the storage statistics in the prometheus text format.
+func writeCacheMetrics(w io.Writer, stats storage.Stats) {
+	metrics := []struct {
+		name, typ, help string
+		value           uint64
+	}{
+		{"asn2ip_cache_entries", "gauge", "Number of cached ASNs, including expired ones not yet purged.", uint64(stats.Entries)},
+		{"asn2ip_cache_hits_total", "counter", "Number of lookups answered from cache.", stats.Hits},
+		{"asn2ip_cache_misses_total", "counter", "Number of lookups not answered from cache.", stats.Misses},
+		{"asn2ip_cache_evictions_total", "counter", "Number of entries dropped to stay within the cache size.", stats.Evictions},
+		{"asn2ip_cache_expired_total", "counter", "Number of entries removed after their ttl expired.", stats.Expired},
+	}
+	for _, m := range metrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", m.name, m.help, m.name, m.typ, m.name, m.value)
+	}
+}
+
+// writeRefreshMetrics writes the number of networks of each AS refreshed in background in the
+// prometheus text format, so alerts can catch an AS suddenly announcing much less or more.
+func writeRefreshMetrics(w io.Writer, refresher *asn2ip.Refresher) {
+	status := refresher.Status()
+	asns := make([]string, 0, len(status))
+	for as := range status {
+		asns = append(asns, as)
+	}
+	sort.Strings(asns)
+	fmt.Fprintln(w, "# HELP asn2ip_prefixes Number of networks announced by an AS refreshed in background.")
+	fmt.Fprintln(w, "# TYPE asn2ip_prefixes gauge")
+	for _, as := range asns {
+		fmt.Fprintf(w, "asn2ip_prefixes{asn=%s,family=\"ipv4\"} %d\n", strconv.Quote(as), status[as].IPv4)
+		fmt.Fprintf(w, "asn2ip_prefixes{asn=%s,family=\"ipv6\"} %d\n", strconv.Quote(as), status[as].IPv6)
+	}
+	fmt.Fprintln(w, "# HELP asn2ip_refresh_timestamp_seconds Time of the last successful refresh of an AS.")
+	fmt.Fprintln(w, "# TYPE asn2ip_refresh_timestamp_seconds gauge")
+	for _, as := range asns {
+		fmt.Fprintf(w, "asn2ip_refresh_timestamp_seconds{asn=%s} %d\n", strconv.Quote(as), status[as].RefreshedAt.Unix())
+	}
+}
+
+// metricsHandler serves the daemon metrics in the prometheus text format.
+func (r *router) metricsHandler(c *gin.Context) {
+	c.Header("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	c.Status(http.StatusOK)
+	r.metrics.write(c.Writer)
+	up := r.upstreams(c)
+	r.whoisMetrics.write(c.Writer, up.limiter)
+	if up.refresher != nil {
+		writeRefreshMetrics(c.Writer, up.refresher)
+	}
+	r.queries.write(c.Writer)
+	if stats, err := r.storage.Stats(); err != nil {
+		requestLog(c).WithFields(logrus.Fields{"error": err}).Warnln("failed to read cache stats")
+	} else {
+		writeCacheMetrics(c.Writer, stats)
+	}
+	fmt.Fprintf(c.Writer, "# HELP go_goroutines Number of goroutines that currently exist.\n# TYPE go_goroutines gauge\ngo_goroutines %d\n", runtime.NumGoroutine())
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/g0dsCookie/asn2ip/pkg/asn2ip"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// nameLookup resolves AS names for fetch output, a nil nameLookup resolves nothing.
+type nameLookup struct {
+	resolver asn2ip.NameResolver
+}
+
+// lookup returns the names of asn. Failing lookups are only logged, as names are informational.
+func (n *nameLookup) lookup(ctx context.Context, asn []string) map[string]string {
+	if n == nil {
+		return nil
+	}
+	infos, err := asn2ip.LookupNames(ctx, n.resolver, asn)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"asns": asn, "error": err}).Warnln("failed to resolve as names")
+		return map[string]string{}
+	}
+	return nameStrings(infos)
+}
+
+func (n *nameLookup) Close() error {
+	if n == nil {
+		return nil
+	}
+	return n.resolver.Close()
+}
+
+// asLabel returns "AS<n>" followed by the name of the AS if known.
+func asLabel(as string, names map[string]string) string {
+	if name := names[as]; name != "" {
+		return "AS" + as + " " + name
+	}
+	return "AS" + as
+}
+
+// namesFromQuery reports whether AS names are requested by the names query parameter of c.
+func namesFromQuery(c *gin.Context) (bool, error) {
+	v, ok := c.GetQuery("names")
+	if !ok {
+		return false, nil
+	}
+	enabled, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, errors.New("names query parameter must be a boolean")
+	}
+	return enabled, nil
+}
+
+// lookupNames resolves the names of asn. Failing lookups are only logged and leave the
+// names missing, as they are informational.
+func (r *router) lookupNames(c *gin.Context, ctx context.Context, asn []string) map[string]asn2ip.ASInfo {
+	infos, err := asn2ip.LookupNames(ctx, r.upstreams(c).names, asn)
+	if err != nil {
+		requestLog(c).WithFields(logrus.Fields{"asns": asn, "error": err}).Warnln("failed to resolve as names")
+		return map[string]asn2ip.ASInfo{}
+	}
+	return infos
+}
+
+// nameStrings reduces infos to the names passed to formatters.
+func nameStrings(infos map[string]asn2ip.ASInfo) map[string]string {
+	names := make(map[string]string, len(infos))
+	for as, info := range infos {
+		names[as] = info.Name
+	}
+	return names
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// mediaTypes maps media types of the Accept header to output formats.
+var mediaTypes = map[string]string{
+	"text/plain":             "text",
+	"application/json":       "json",
+	"text/csv":               "csv",
+	"application/yaml":       "yaml",
+	"application/x-yaml":     "yaml",
+	"text/yaml":              "yaml",
+	"application/x-ndjson":   "jsonl",
+	"application/x-protobuf": "protobuf",
+	"application/protobuf":   "protobuf",
+	"application/msgpack":    "msgpack",
+	"application/x-msgpack":  "msgpack",
+}
+
+// negotiateFormat returns the output format preferred by the Accept header. Media types are
+// weighted by their quality values, wildcards and unknown media types select def.
+func negotiateFormat(accept, def string) string {
+	format, best := def, 0.0
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		mediaType := strings.ToLower(strings.TrimSpace(params[0]))
+		if mediaType == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if !strings.HasPrefix(param, "q=") {
+				continue
+			}
+			if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+				q = v
+			}
+		}
+
+		f, ok := mediaTypes[mediaType]
+		if !ok {
+			if !strings.HasSuffix(mediaType, "/*") {
+				continue
+			}
+			f = def
+		}
+		// the first of equally weighted media types wins
+		if q > best {
+			format, best = f, q
+		}
+	}
+	return format
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+
+	"github.com/pkg/errors"
+)
+
+//go:embed openapi.json
+var openapiSpec []byte
+
+//go:embed docs.html
+var docs string
+
+// openapiDocument returns the OpenAPI specification with url as server.
+func openapiDocument(url string) ([]byte, error) {
+	spec := map[string]interface{}{}
+	if err := json.Unmarshal(openapiSpec, &spec); err != nil {
+		return nil, errors.Wrap(err, "failed to parse openapi specification")
+	}
+	spec["servers"] = []map[string]string{{"url": url}}
+	return json.Marshal(spec)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+// output is where fetched networks are written to, stdout or a file replaced atomically
+// once everything was written.
+type output struct {
+	io.Writer
+	// file is the temporary file replacing path, nil when writing to stdout
+	file *os.File
+	path string
+}
+
+// openOutput writes to a temporary file next to path, or to stdout if path is empty.
+func openOutput(path string) (*output, error) {
+	if path == "" {
+		return &output{Writer: os.Stdout}, nil
+	}
+	file, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"path": path, "error": err}).Errorln("failed to create output file")
+		return nil, cli.Exit("", exitError)
+	}
+	return &output{Writer: file, file: file, path: path}, nil
+}
+
+// close replaces the output file with everything written if err is nil. A failed or partial
+// fetch keeps the previous file, so readers like firewalls never see an incomplete list.
+func (o *output) close(err error) error {
+	if o.file == nil {
+		return err
+	}
+	if err != nil {
+		o.file.Close()
+		os.Remove(o.file.Name())
+		logrus.WithFields(logrus.Fields{"path": o.path}).Warnln("fetch failed, keeping previous output file")
+		return err
+	}
+	if err := o.commit(); err != nil {
+		os.Remove(o.file.Name())
+		logrus.WithFields(logrus.Fields{"path": o.path, "error": err}).Errorln("failed to write output file")
+		return cli.Exit("", exitError)
+	}
+	return nil
+}
+
+func (o *output) commit() error {
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(o.path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	if err := o.file.Chmod(mode); err != nil {
+		o.file.Close()
+		return errors.Wrap(err, "failed to set permissions")
+	}
+	if err := o.file.Sync(); err != nil {
+		o.file.Close()
+		return errors.Wrap(err, "failed to sync")
+	}
+	if err := o.file.Close(); err != nil {
+		return errors.Wrap(err, "failed to close")
+	}
+	return errors.Wrap(os.Rename(o.file.Name(), o.path), "failed to replace output file")
+}
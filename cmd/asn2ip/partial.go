@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/g0dsCookie/asn2ip/pkg/asn2ip"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// partialResult splits the error of a fetch returning fetched ASNs into the errors of single
+// ASNs and an error failing the whole fetch. If no AS was fetched at all, the fetch fails
+// with the error of the lowest failed AS.
+func partialResult(fetched int, err error) (map[string]error, error) {
+	partial := (*asn2ip.FetchError)(nil)
+	if !errors.As(err, &partial) {
+		return nil, err
+	}
+	if fetched == 0 {
+		return nil, partial.Errors[failedASNs(partial.Errors)[0]]
+	}
+	return partial.Errors, nil
+}
+
+// failedASNs returns the ASNs of errs in numerical order.
+func failedASNs(errs map[string]error) []string {
+	asn := make([]string, 0, len(errs))
+	for as := range errs {
+		asn = append(asn, as)
+	}
+	sort.Slice(asn, func(i, j int) bool {
+		a, _ := strconv.ParseUint(asn[i], 10, 32)
+		b, _ := strconv.ParseUint(asn[j], 10, 32)
+		return a < b
+	})
+	return asn
+}
+
+func errorStrings(errs map[string]error) map[string]string {
+	if len(errs) == 0 {
+		return nil
+	}
+	out := make(map[string]string, len(errs))
+	for as, err := range errs {
+		out[as] = err.Error()
+	}
+	return out
+}
+
+// logFailed logs the ASNs which failed while the others were fetched.
+func logFailed(c *gin.Context, failed map[string]error) {
+	if len(failed) > 0 {
+		requestLog(c).WithFields(logrus.Fields{"errors": errorStrings(failed)}).Warnln("failed to fetch networks of some ASNs")
+	}
+}
+
+// writePartial responds like writeWithETag, or with 207 Multi-Status if some ASNs failed.
+// Partial responses are not cacheable.
+func writePartial(c *gin.Context, contentType string, data []byte, failed map[string]error) {
+	if len(failed) == 0 {
+		writeWithETag(c, contentType, data)
+		return
+	}
+	c.Header("Cache-Control", "no-cache")
+	c.Data(http.StatusMultiStatus, contentType, data)
+}
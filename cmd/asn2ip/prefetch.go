@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/g0dsCookie/asn2ip/internal/config"
+	"github.com/g0dsCookie/asn2ip/pkg/asn2ip"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+// prefetchHandler fetches the given ASNs and stores them, replacing cached entries whether
+// they expired or not. It runs a single refresh cycle, so it can warm a shared storage from cron.
+func prefetchHandler(c *cli.Context) error {
+	conf, err := setup(c)
+	if err != nil {
+		return err
+	}
+	prefetch := config.NewPrefetchConfig()
+	prefetch.UpdateFromCLIContext(c)
+
+	asn := c.Args().Slice()
+	if path := prefetch.GetString("prefetch.file"); path != "" {
+		listed, err := readASNFile(path)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{"path": path, "error": err}).Errorln("failed to read AS numbers")
+			return cli.Exit("", exitInput)
+		}
+		asn = append(asn, listed...)
+	}
+	if len(asn) == 0 {
+		logrus.Errorln("prefetch requires AS numbers as arguments or in a file set with --file")
+		return cli.Exit("", exitInput)
+	}
+	seen := map[string]bool{}
+	unique := make([]string, 0, len(asn))
+	for _, as := range asn {
+		normalized, err := asn2ip.NormalizeASN(as)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{"error": err}).Errorln("invalid as number")
+			return cli.Exit("", exitInput)
+		}
+		if !seen[normalized] {
+			seen[normalized] = true
+			unique = append(unique, normalized)
+		}
+	}
+	asn = unique
+
+	sources, err := irrSources(conf)
+	if err != nil {
+		return err
+	}
+	source, err := sourceOptionsFromConfig(conf)
+	if err != nil {
+		return err
+	}
+	cache, err := openStorage(c)
+	if err != nil {
+		return err
+	}
+	defer cache.Close()
+	upstream, err := fetcherFromConfig(conf, source, sources)
+	if err != nil {
+		return err
+	}
+	defer upstream.Close()
+
+	refresher := asn2ip.NewRefresher(upstream, cache, asn2ip.RefresherOptions{
+		ASNs:        asn,
+		Concurrency: prefetch.GetInt("prefetch.concurrency"),
+	})
+	err = refresher.Refresh(c.Context)
+	// failed ASNs were logged by the refresher
+	failed, err := partialResult(len(asn)-failedCount(err), err)
+	if err != nil {
+		return cli.Exit("", fetchExitCode(err))
+	} else if len(failed) > 0 {
+		return cli.Exit("", exitPartial)
+	}
+	return nil
+}
+
+// failedCount returns the number of ASNs failed by the error of a fetch.
+func failedCount(err error) int {
+	partial := (*asn2ip.FetchError)(nil)
+	if errors.As(err, &partial) {
+		return len(partial.Errors)
+	}
+	return 0
+}
+
+// readASNFile reads the AS numbers listed in path, - for stdin. Lines may hold several
+// AS numbers separated by spaces or commas, everything after # is ignored.
+func readASNFile(path string) ([]string, error) {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+	asn := []string{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		asn = append(asn, strings.FieldsFunc(line, func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t'
+		})...)
+	}
+	return asn, scanner.Err()
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// rateLimitIdle is the time after which limiters of idle clients are dropped.
+	rateLimitIdle = 10 * time.Minute
+)
+
+type rateLimitOptions struct {
+	// Rate limits the requests per second of each client, unlimited if zero.
+	Rate float64
+	// Burst is the number of requests allowed at once, defaults to the rate.
+	Burst int
+}
+
+// reserve takes a token from l, returning how long to wait if none is available.
+func reserve(l *rate.Limiter) time.Duration {
+	r := l.Reserve()
+	if delay := r.Delay(); delay > 0 {
+		r.Cancel()
+		return delay
+	}
+	return 0
+}
+
+func tooManyRequests(c *gin.Context, delay time.Duration) {
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+	c.AbortWithStatus(http.StatusTooManyRequests)
+}
+
+type clientLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// rateLimiter keeps a token bucket per client, identified by api key or ip address.
+type rateLimiter struct {
+	mu        sync.Mutex
+	rate      rate.Limit
+	burst     int
+	clients   map[string]*clientLimiter
+	lastSweep time.Time
+}
+
+func newRateLimiter(opts rateLimitOptions) *rateLimiter {
+	l := &rateLimiter{}
+	l.set(opts)
+	return l
+}
+
+// set replaces the limits, the buckets of all clients start full again.
+func (l *rateLimiter) set(opts rateLimitOptions) {
+	burst := opts.Burst
+	if burst < 1 {
+		burst = int(math.Max(1, opts.Rate))
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate = rate.Limit(opts.Rate)
+	l.burst = burst
+	l.clients = map[string]*clientLimiter{}
+	l.lastSweep = time.Now()
+}
+
+// get returns the bucket of client id, nil if clients are not limited.
+func (l *rateLimiter) get(id string) *rate.Limiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate <= 0 {
+		return nil
+	}
+
+	now := time.Now()
+	if now.Sub(l.lastSweep) > time.Minute {
+		for id, c := range l.clients {
+			if now.Sub(c.lastSeen) > rateLimitIdle {
+				delete(l.clients, id)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	c, ok := l.clients[id]
+	if !ok {
+		c = &clientLimiter{limiter: rate.NewLimiter(l.rate, l.burst)}
+		l.clients[id] = c
+	}
+	c.lastSeen = now
+	return c.limiter
+}
+
+// limit rejects requests of clients exceeding their rate with 429 Too Many Requests.
+// Authenticated clients share the bucket of their api key.
+func (l *rateLimiter) limit(c *gin.Context) {
+	if c.GetBool("apiKeyLimited") {
+		c.Next()
+		return
+	}
+	id := "ip:" + c.ClientIP()
+	if key := c.GetString("apiKey"); key != "" {
+		id = "key:" + key
+	}
+	if limiter := l.get(id); limiter != nil {
+		if delay := reserve(limiter); delay > 0 {
+			tooManyRequests(c, delay)
+			return
+		}
+	}
+	c.Next()
+}
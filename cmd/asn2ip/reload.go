@@ -0,0 +1,264 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/g0dsCookie/asn2ip/pkg/asn2ip"
+	"github.com/g0dsCookie/asn2ip/pkg/geoip"
+	"github.com/g0dsCookie/asn2ip/pkg/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// upstreamsKey is the gin context key of the upstreams used by a request.
+const upstreamsKey = "upstreams"
+
+// upstreams are the parts of the router replaced when the configuration is reloaded. Each
+// request keeps using the upstreams it started with, they are closed once all such requests
+// finished.
+type upstreams struct {
+	fetcher   asn2ip.Fetcher
+	resolver  asn2ip.Resolver
+	names     asn2ip.NameResolver
+	refresher *asn2ip.Refresher
+	// geo locates networks, nil without a geoip database
+	geo *geoip.DB
+	// limiter is shared by all whois fetchers and resolvers
+	limiter *asn2ip.Limiter
+	sources []string
+	// cacheTTL is the max-age of responses built from freshly fetched networks.
+	cacheTTL time.Duration
+
+	// opts and whois create the upstreams of the servers selected with ?server=, see server.
+	opts      serverOptions
+	whois     *whoisMetrics
+	serversMu sync.Mutex
+	servers   map[string]*upstreams
+
+	inUse sync.WaitGroup
+}
+
+// newUpstreams creates the upstreams for opts, caching fetched networks in stor. Nothing is
+// cached without stor.
+func newUpstreams(opts serverOptions, stor storage.Storage, whois *whoisMetrics) (*upstreams, error) {
+	var geo *geoip.DB
+	if opts.GeoIPDB != "" {
+		var err error
+		if geo, err = geoip.Open(opts.GeoIPDB); err != nil {
+			return nil, err
+		}
+	}
+	opts.Source.Retry.OnRetry = whois.retry
+	upstream, err := newUpstream(opts.Source, opts.WhoisHost, opts.WhoisPort,
+		asn2ip.WithPool(opts.Pool), asn2ip.WithMaxConcurrency(opts.MaxConcurrency), asn2ip.WithMaxDepth(opts.MaxDepth),
+		asn2ip.WithSources(opts.Sources...))
+	if err != nil {
+		return nil, err
+	}
+	resolver, err := newResolver(opts.Source, opts.WhoisHost, opts.WhoisPort, asn2ip.WithPool(opts.Pool), asn2ip.WithSources(opts.Sources...))
+	if err != nil {
+		upstream.Close()
+		return nil, err
+	}
+	names, err := newNameResolver(opts.Source, opts.WhoisHost, opts.WhoisPort, asn2ip.WithPool(opts.Pool), asn2ip.WithSources(opts.Sources...))
+	if err != nil {
+		resolver.Close()
+		upstream.Close()
+		return nil, err
+	}
+	up := &upstreams{
+		fetcher:  upstream,
+		resolver: resolver,
+		names:    names,
+		geo:      geo,
+		limiter:  opts.Source.Limiter,
+		sources:  opts.Sources,
+		cacheTTL: opts.Storage.TTL,
+		opts:     opts,
+		whois:    whois,
+		servers:  map[string]*upstreams{},
+	}
+	if stor == nil {
+		return up, nil
+	}
+	up.fetcher = asn2ip.NewCache(upstream, stor)
+	up.names = asn2ip.NewNameCache(names, opts.Storage.TTL)
+	if len(opts.Refresh.ASNs) > 0 {
+		up.refresher = asn2ip.NewRefresher(upstream, stor, opts.Refresh)
+	}
+	return up, nil
+}
+
+// server returns the upstreams querying the whois server name instead of the configured one,
+// created on first use. They cache nothing, like requests for explicitly selected sources.
+func (up *upstreams) server(name string) (*upstreams, error) {
+	up.serversMu.Lock()
+	defer up.serversMu.Unlock()
+	if server, ok := up.servers[name]; ok {
+		return server, nil
+	}
+	host, port, err := splitServer(name, up.opts.WhoisPort)
+	if err != nil {
+		return nil, err
+	}
+	opts := up.opts
+	opts.WhoisHost, opts.WhoisPort = host, port
+	// the geoip database is shared instead of read again
+	opts.GeoIPDB = ""
+	server, err := newUpstreams(opts, nil, up.whois)
+	if err != nil {
+		return nil, err
+	}
+	server.geo = up.geo
+	up.servers[name] = server
+	return server, nil
+}
+
+// allows returns whether requests may select the whois server name.
+func (up *upstreams) allows(name string) bool {
+	for _, allowed := range up.opts.AllowedServers {
+		if strings.EqualFold(allowed, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// close closes all upstream connections, the refresher has to be stopped before.
+func (up *upstreams) close() error {
+	var errs []string
+	up.serversMu.Lock()
+	for _, server := range up.servers {
+		if err := server.close(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	up.serversMu.Unlock()
+	if err := up.fetcher.Close(); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if err := up.resolver.Close(); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if err := up.names.Close(); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// startRefresher starts refreshing the ASNs of up in background, publishing their changes.
+func (r *router) startRefresher(up *upstreams) {
+	if up.refresher == nil {
+		return
+	}
+	up.refresher.OnChange(r.changes.publish)
+	if r.webhooks != nil {
+		up.refresher.OnChange(r.webhooks.notify)
+	}
+	up.refresher.Start()
+}
+
+// useUpstreams passes the current upstreams to the handlers of a request, see upstreams.
+func (r *router) useUpstreams(c *gin.Context) {
+	r.mu.RLock()
+	up := r.current
+	up.inUse.Add(1)
+	r.mu.RUnlock()
+	defer up.inUse.Done()
+	c.Set(upstreamsKey, up)
+	c.Next()
+}
+
+// upstreams returns the upstreams of the request c.
+func (r *router) upstreams(c *gin.Context) *upstreams {
+	return c.MustGet(upstreamsKey).(*upstreams)
+}
+
+// selectServer makes a request query the whois server selected with ?server=, which has to be
+// allowed by the configuration.
+func (r *router) selectServer(c *gin.Context) {
+	name, ok := c.GetQuery("server")
+	if !ok {
+		return
+	}
+	up := r.upstreams(c)
+	if up.opts.Source.Name != "" && up.opts.Source.Name != "whois" {
+		c.String(http.StatusBadRequest, "server query parameter requires the whois source")
+		c.Abort()
+		return
+	}
+	if !up.allows(name) {
+		c.String(http.StatusForbidden, "whois server %s is not allowed", name)
+		c.Abort()
+		return
+	}
+	server, err := up.server(name)
+	if err != nil {
+		c.String(http.StatusBadRequest, "%s", err)
+		c.Abort()
+		return
+	}
+	c.Set(upstreamsKey, server)
+}
+
+// Reload reads the configuration again and replaces the upstreams, the ttls of the cache,
+// the rate limits and the audit log file. The listeners and the cache are kept. If the configuration is invalid,
+// the previous one stays in use.
+func (r *router) Reload() error {
+	if r.reload == nil {
+		return errors.New("reloading the configuration is not supported")
+	}
+	r.reloadMu.Lock()
+	defer r.reloadMu.Unlock()
+
+	opts, err := r.reload()
+	if err != nil {
+		return err
+	}
+	next, err := newUpstreams(opts, r.storage, r.whoisMetrics)
+	if err != nil {
+		return err
+	}
+	if err := r.audit.set(opts.AuditLog); err != nil {
+		next.close()
+		return err
+	}
+	r.mu.Lock()
+	prev := r.current
+	r.current = next
+	r.mu.Unlock()
+
+	if prev.refresher != nil {
+		prev.refresher.Stop()
+	}
+	r.startRefresher(next)
+	if ttls, ok := r.storage.(storage.TTLStorage); ok {
+		ttls.SetTTL(opts.Storage.TTL, opts.Storage.NegativeTTL)
+	}
+	r.rateLimiter.set(opts.RateLimit)
+	go func() {
+		prev.inUse.Wait()
+		if err := prev.close(); err != nil {
+			logrus.WithFields(logrus.Fields{"error": err}).Warnln("failed to close previous upstreams")
+		}
+	}()
+	logrus.Infoln("reloaded configuration")
+	return nil
+}
+
+// reloadHandler reloads the configuration like SIGHUP.
+func (r *router) reloadHandler(c *gin.Context) {
+	if err := r.Reload(); err != nil {
+		requestLog(c).WithFields(logrus.Fields{"error": err}).Errorln("failed to reload configuration, keeping the previous one")
+		c.String(http.StatusInternalServerError, "failed to reload configuration")
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
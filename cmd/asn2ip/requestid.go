@@ -0,0 +1,57 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+
+	"github.com/g0dsCookie/asn2ip/pkg/asn2ip"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	requestIDHeader = "X-Request-ID"
+	// maxRequestIDLength limits the length of request ids supplied by clients.
+	maxRequestIDLength = 128
+)
+
+// requestID tags each request with the id passed in the X-Request-ID header or a random one.
+// The id is returned in the response headers and attached to all messages logged on behalf
+// of the request, including those of the whois layer.
+func requestID(c *gin.Context) {
+	id := c.GetHeader(requestIDHeader)
+	if !validRequestID(id) {
+		id = newRequestID()
+	}
+	c.Set("requestID", id)
+	c.Header(requestIDHeader, id)
+	c.Request = c.Request.WithContext(asn2ip.ContextWithLogFields(c.Request.Context(), logrus.Fields{"request_id": id}))
+	c.Next()
+}
+
+// validRequestID reports whether id may be used as request id, which keeps arbitrary client
+// input out of the logs and response headers.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, r := range id {
+		if r < 0x21 || r > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		logrus.WithFields(logrus.Fields{"error": err}).Warnln("failed to generate request id")
+	}
+	return hex.EncodeToString(b)
+}
+
+// requestLog returns the log entry for messages logged on behalf of the request.
+func requestLog(c *gin.Context) *logrus.Entry {
+	return logrus.WithFields(logrus.Fields{"request_id": c.GetString("requestID")})
+}
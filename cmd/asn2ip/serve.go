@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+// httpOptions configure the http server.
+type httpOptions struct {
+	Address           string
+	ReadTimeout       time.Duration
+	ReadHeaderTimeout time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	MaxHeaderBytes    int
+	// ShutdownTimeout is the grace period for in-flight requests on shutdown.
+	ShutdownTimeout time.Duration
+}
+
+// serve runs the http servers until SIGINT or SIGTERM is received, SIGHUP reloads the
+// configuration. In-flight requests are given the grace period to complete before the router
+// is closed.
+func serve(ctx context.Context, router *router, opts httpOptions) error {
+	ctx, stop := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	grace := opts.ShutdownTimeout
+	servers := []*http.Server{newHTTPServer(opts.Address, router, opts)}
+	if router.changes != nil {
+		servers[0].RegisterOnShutdown(router.changes.close)
+	}
+	if router.admin != nil {
+		servers = append(servers, newHTTPServer(router.adminListen, router.admin, opts))
+	}
+	errs := make(chan error, len(servers))
+	for _, server := range servers {
+		go func(server *http.Server) { errs <- server.ListenAndServe() }(server)
+		logrus.WithFields(logrus.Fields{"address": server.Addr}).Infoln("listening for http requests")
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for ctx.Err() == nil {
+		select {
+		case err := <-errs:
+			for _, server := range servers {
+				server.Close()
+			}
+			router.Close()
+			logrus.WithFields(logrus.Fields{"error": err}).Errorln("failed to serve http")
+			return cli.Exit("", exitError)
+		case <-hup:
+			if err := router.Reload(); err != nil {
+				logrus.WithFields(logrus.Fields{"error": err}).Errorln("failed to reload configuration, keeping the previous one")
+			}
+		case <-ctx.Done():
+		}
+	}
+	// a second signal terminates immediately
+	stop()
+
+	logrus.WithFields(logrus.Fields{"grace": grace}).Infoln("shutting down, waiting for in-flight requests")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	for _, server := range servers {
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			logrus.WithFields(logrus.Fields{"address": server.Addr, "error": err}).Warnln("grace period exceeded, closing remaining connections")
+			server.Close()
+		}
+	}
+	if err := router.Close(); err != nil {
+		logrus.WithFields(logrus.Fields{"error": err}).Errorln("failed to shut down cleanly")
+		return cli.Exit("", exitError)
+	}
+	logrus.Infoln("shut down")
+	return nil
+}
+
+func newHTTPServer(address string, handler http.Handler, opts httpOptions) *http.Server {
+	return &http.Server{
+		Addr:              address,
+		Handler:           handler,
+		ReadTimeout:       opts.ReadTimeout,
+		ReadHeaderTimeout: opts.ReadHeaderTimeout,
+		WriteTimeout:      opts.WriteTimeout,
+		IdleTimeout:       opts.IdleTimeout,
+		MaxHeaderBytes:    opts.MaxHeaderBytes,
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/g0dsCookie/asn2ip/internal/config"
+	"github.com/g0dsCookie/asn2ip/pkg/asn2ip"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+type sourceOptions struct {
+	Name     string
+	Timeouts asn2ip.TimeoutOptions
+	Retry    asn2ip.RetryOptions
+	// Proxy of whois connections, nil to connect directly
+	Proxy *url.URL
+	// Limiter is shared by all whois fetchers and resolvers
+	Limiter  *asn2ip.Limiter
+	RIPEstat asn2ip.RIPEstatOptions
+	BGPView  asn2ip.BGPViewOptions
+
+	// Reverse is the source of reverse ip lookups
+	Reverse string
+	Cymru   asn2ip.CymruOptions
+}
+
+func sourceOptionsFromConfig(conf *config.Config) (sourceOptions, error) {
+	var proxy *url.URL
+	if raw := conf.GetString("whois.proxy"); raw != "" {
+		var err error
+		if proxy, err = asn2ip.ParseProxy(raw); err != nil {
+			logrus.WithFields(logrus.Fields{"error": err}).Errorln("invalid whois proxy")
+			return sourceOptions{}, cli.Exit("", exitConfig)
+		}
+	}
+	return sourceOptions{
+		Name: conf.GetString("source"),
+		Timeouts: asn2ip.TimeoutOptions{
+			Connect: conf.GetDuration("whois.connect-timeout"),
+			Read:    conf.GetDuration("whois.read-timeout"),
+			Query:   conf.GetDuration("whois.timeout"),
+		},
+		Retry: asn2ip.RetryOptions{
+			MaxRetries: conf.GetInt("whois.max-retries"),
+			Delay:      conf.GetDuration("whois.retry-delay"),
+			Jitter:     conf.GetFloat64("whois.retry-jitter"),
+		},
+		Proxy: proxy,
+		Limiter: asn2ip.NewLimiter(asn2ip.LimitOptions{
+			MaxConns:         conf.GetInt("whois.max-conns"),
+			QueriesPerSecond: conf.GetFloat64("whois.rate"),
+			Burst:            conf.GetInt("whois.burst"),
+		}),
+		RIPEstat: asn2ip.RIPEstatOptions{
+			URL:            conf.GetString("ripestat.url"),
+			MaxConcurrency: conf.GetInt("whois.max-concurrency"),
+		},
+		BGPView: asn2ip.BGPViewOptions{
+			URL:            conf.GetString("bgpview.url"),
+			MaxConcurrency: conf.GetInt("whois.max-concurrency"),
+			MaxRetries:     conf.GetInt("bgpview.max-retries"),
+			RetryDelay:     conf.GetDuration("bgpview.retry-delay"),
+		},
+		Reverse: conf.GetString("reverse.source"),
+		Cymru: asn2ip.CymruOptions{
+			Host:  conf.GetString("cymru.host"),
+			Port:  conf.GetInt("cymru.port"),
+			Proxy: proxy,
+		},
+	}, nil
+}
+
+// whoisOptions prepends the configured timeouts, retries, limits and proxy to opts.
+func (source sourceOptions) whoisOptions(opts []asn2ip.Option) []asn2ip.Option {
+	whois := []asn2ip.Option{asn2ip.WithTimeouts(source.Timeouts), asn2ip.WithRetry(source.Retry), asn2ip.WithLimiter(source.Limiter)}
+	if source.Proxy != nil {
+		whois = append(whois, asn2ip.WithProxy(source.Proxy))
+	}
+	return append(whois, opts...)
+}
+
+// newUpstream creates the fetcher for the selected data source, opts only apply to whois.
+func newUpstream(source sourceOptions, host string, port int, opts ...asn2ip.Option) (asn2ip.Fetcher, error) {
+	switch source.Name {
+	case "", "whois":
+		return asn2ip.NewFetcher(host, port, source.whoisOptions(opts)...), nil
+	case "ripestat":
+		return asn2ip.NewRIPEstatFetcher(source.RIPEstat), nil
+	case "bgpview":
+		return asn2ip.NewBGPViewFetcher(source.BGPView), nil
+	}
+	return nil, errors.Errorf("unknown source %s", source.Name)
+}
+
+// validateSources fails with exit code unknownCode if any of sources is not mirrored by the
+// whois server, as listed by !s-lc. Servers not listing their sources are trusted, other data
+// sources ignore sources.
+func validateSources(ctx context.Context, source sourceOptions, host string, port int, sources []string, unknownCode int) error {
+	if len(sources) == 0 {
+		return nil
+	}
+	// a fetcher without sources lists all sources of the server, not just the selected ones
+	upstream, err := newUpstream(source, host, port)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"error": err}).Errorln("failed to create fetcher")
+		return cli.Exit("", exitConfig)
+	}
+	defer upstream.Close()
+	lister, ok := upstream.(asn2ip.SourceLister)
+	if !ok {
+		return nil
+	}
+	available, err := lister.ListSources(ctx)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"error": err}).Warnln("failed to list irr sources of whois server, not validating sources")
+		return nil
+	}
+	known := map[string]bool{}
+	for _, s := range available {
+		known[s] = true
+	}
+	unknown := []string{}
+	for _, s := range sources {
+		if !known[s] {
+			unknown = append(unknown, s)
+		}
+	}
+	if len(unknown) > 0 {
+		logrus.WithFields(logrus.Fields{"unknown": strings.Join(unknown, ","), "available": strings.Join(available, ",")}).
+			Errorln("irr sources not mirrored by whois server")
+		return cli.Exit("", unknownCode)
+	}
+	return nil
+}
+
+// splitServer splits a whois server given as host or host:port, using defaultPort for the former.
+func splitServer(server string, defaultPort int) (string, int, error) {
+	host, p, err := net.SplitHostPort(server)
+	if err != nil {
+		return server, defaultPort, nil
+	}
+	port, err := strconv.Atoi(p)
+	if err != nil || port < 1 || port > 65535 {
+		return "", 0, errors.Errorf("invalid port of %s", server)
+	}
+	return host, port, nil
+}
+
+// newResolver creates the resolver for the selected reverse lookup source, opts only apply to whois.
+func newResolver(source sourceOptions, host string, port int, opts ...asn2ip.Option) (asn2ip.Resolver, error) {
+	switch source.Reverse {
+	case "", "whois":
+		return asn2ip.NewResolver(host, port, source.whoisOptions(opts)...), nil
+	case "cymru":
+		return asn2ip.NewCymruResolver(source.Cymru), nil
+	}
+	return nil, errors.Errorf("unknown reverse source %s", source.Reverse)
+}
+
+// newNameResolver creates the AS name resolver for the selected data source, opts only apply to whois.
+func newNameResolver(source sourceOptions, host string, port int, opts ...asn2ip.Option) (asn2ip.NameResolver, error) {
+	switch source.Name {
+	case "", "whois":
+		return asn2ip.NewNameResolver(host, port, source.whoisOptions(opts)...), nil
+	case "ripestat":
+		return asn2ip.NewRIPEstatFetcher(source.RIPEstat).(asn2ip.NameResolver), nil
+	case "bgpview":
+		return asn2ip.NewBGPViewFetcher(source.BGPView).(asn2ip.NameResolver), nil
+	}
+	return nil, errors.Errorf("unknown source %s", source.Name)
+}
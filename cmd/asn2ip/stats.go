@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxTrackedASNs bounds the AS numbers counted on their own, further ones are counted as other
+// to keep memory and metric cardinality in check.
+const maxTrackedASNs = 10000
+
+// queryStats counts how often each AS number or as-set was requested, telling operators which
+// ones to prefetch.
+type queryStats struct {
+	mu     sync.Mutex
+	counts map[string]uint64
+	other  uint64
+}
+
+func newQueryStats() *queryStats {
+	return &queryStats{counts: map[string]uint64{}}
+}
+
+// count counts a request of each of asn, normalized AS numbers or as-sets.
+func (s *queryStats) count(asn ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, as := range asn {
+		if _, ok := s.counts[as]; !ok && len(s.counts) >= maxTrackedASNs {
+			s.other++
+			continue
+		}
+		s.counts[as]++
+	}
+}
+
+type asnCount struct {
+	ASN     string `json:"asn"`
+	Queries uint64 `json:"queries"`
+}
+
+// top returns the limit most requested AS numbers, most requested first, all of them if limit
+// is not positive.
+func (s *queryStats) top(limit int) ([]asnCount, uint64) {
+	s.mu.Lock()
+	counts := make([]asnCount, 0, len(s.counts))
+	for as, n := range s.counts {
+		counts = append(counts, asnCount{ASN: as, Queries: n})
+	}
+	other := s.other
+	s.mu.Unlock()
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Queries != counts[j].Queries {
+			return counts[i].Queries > counts[j].Queries
+		}
+		return counts[i].ASN < counts[j].ASN
+	})
+	if limit > 0 && len(counts) > limit {
+		counts = counts[:limit]
+	}
+	return counts, other
+}
+
+// write writes the query counters in the prometheus text format.
+func (s *queryStats) write(w io.Writer) {
+	counts, other := s.top(0)
+	sort.Slice(counts, func(i, j int) bool { return counts[i].ASN < counts[j].ASN })
+	fmt.Fprintln(w, "# HELP asn2ip_asn_queries_total Number of requests for each AS number or as-set.")
+	fmt.Fprintln(w, "# TYPE asn2ip_asn_queries_total counter")
+	for _, c := range counts {
+		fmt.Fprintf(w, "asn2ip_asn_queries_total{asn=%s} %d\n", strconv.Quote(c.ASN), c.Queries)
+	}
+	if other > 0 {
+		fmt.Fprintf(w, "asn2ip_asn_queries_total{asn=\"other\"} %d\n", other)
+	}
+}
+
+// topHandler responds with the AS numbers requested most, as many as the limit query parameter
+// asks for, 20 by default. Requests for AS numbers beyond maxTrackedASNs are summed up in other.
+func (r *router) topHandler(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	if err != nil || limit < 1 {
+		c.String(http.StatusBadRequest, "limit query parameter must be a positive integer")
+		return
+	}
+	counts, other := r.queries.top(limit)
+	c.JSON(http.StatusOK, gin.H{"asns": counts, "other": other})
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"math"
+	"net/netip"
+	"time"
+
+	"github.com/g0dsCookie/asn2ip/pkg/asn2ip"
+)
+
+// summaryResponse is the stable schema of /api/v1/asn/:asn/summary.
+type summaryResponse struct {
+	Query string `json:"query"`
+	// ASNs is the number of AS numbers summarized, as-sets count each member.
+	ASNs int         `json:"asns"`
+	IPv4 ipv4Summary `json:"ipv4"`
+	IPv6 ipv6Summary `json:"ipv6"`
+	// FetchedAt is the time the oldest networks were fetched, CacheAge their age in seconds.
+	FetchedAt *time.Time `json:"fetched_at,omitempty"`
+	CacheAge  int64      `json:"cache_age"`
+	// Errors holds the error of each AS which failed while others were fetched.
+	Errors map[string]string `json:"errors,omitempty"`
+}
+
+type prefixSummary struct {
+	Prefixes int `json:"prefixes"`
+	// Smallest and Largest are the first networks of the longest and shortest prefix length.
+	Smallest string `json:"smallest,omitempty"`
+	Largest  string `json:"largest,omitempty"`
+}
+
+type ipv4Summary struct {
+	prefixSummary
+	Addresses uint64 `json:"addresses"`
+}
+
+type ipv6Summary struct {
+	prefixSummary
+	// Slash48s is the address space in /48 networks, networks longer than /48 count as fractions.
+	Slash48s float64 `json:"slash48s"`
+}
+
+// summarize returns the statistics of ips at now. Overlapping networks are counted once in the
+// address space, but each in the prefix counts.
+func summarize(query string, ips asn2ip.Result, now time.Time) summaryResponse {
+	resp := summaryResponse{Query: query}
+	var ipv4, ipv6 []netip.Prefix
+	for _, as := range ips.ASNs() {
+		res := ips[as]
+		resp.ASNs++
+		ipv4 = append(ipv4, res.IPv4...)
+		ipv6 = append(ipv6, res.IPv6...)
+		if fetchedAt := res.FetchedAt.UTC(); !res.FetchedAt.IsZero() && (resp.FetchedAt == nil || fetchedAt.Before(*resp.FetchedAt)) {
+			resp.FetchedAt = &fetchedAt
+		}
+	}
+	if resp.FetchedAt != nil {
+		resp.CacheAge = int64(now.Sub(*resp.FetchedAt).Seconds())
+	}
+
+	resp.IPv4.prefixSummary = summarizePrefixes(ipv4)
+	for _, n := range asn2ip.Aggregate(ipv4) {
+		resp.IPv4.Addresses += 1 << (32 - n.Bits())
+	}
+	resp.IPv6.prefixSummary = summarizePrefixes(ipv6)
+	for _, n := range asn2ip.Aggregate(ipv6) {
+		resp.IPv6.Slash48s += math.Ldexp(1, 48-n.Bits())
+	}
+	return resp
+}
+
+func summarizePrefixes(nets []netip.Prefix) prefixSummary {
+	summary := prefixSummary{Prefixes: len(nets)}
+	smallest, largest := -1, -1
+	for i, n := range nets {
+		if smallest < 0 || n.Bits() > nets[smallest].Bits() {
+			smallest = i
+		}
+		if largest < 0 || n.Bits() < nets[largest].Bits() {
+			largest = i
+		}
+	}
+	if len(nets) > 0 {
+		summary.Smallest, summary.Largest = nets[smallest].String(), nets[largest].String()
+	}
+	return summary
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+type watchOptions struct {
+	// Interval between fetches.
+	Interval time.Duration
+	// Exec is a shell command run after the output changed.
+	Exec string
+}
+
+// watchFetch refetches the networks every interval until interrupted. The output is only
+// rewritten and the hook only run if the networks changed, a failed fetch keeps the previous output.
+func watchFetch(ctx context.Context, run *fetchRun, path string, opts watchOptions) error {
+	if opts.Interval <= 0 {
+		logrus.WithFields(logrus.Fields{"interval": opts.Interval}).Errorln("watch interval must be positive")
+		return cli.Exit("", exitConfig)
+	}
+	ctx, stop := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	var last []byte
+	if path != "" {
+		// an unchanged file left by a previous run is neither rewritten nor reloaded
+		last, _ = os.ReadFile(path)
+	}
+	ticker := time.NewTicker(opts.Interval)
+	defer ticker.Stop()
+	for {
+		if current, ok := refreshOutput(ctx, run, path, last); ok {
+			last = current
+			if opts.Exec != "" {
+				runHook(ctx, opts.Exec, path)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// refreshOutput fetches the networks and writes them if they differ from last. It returns the
+// networks written and true if the output was changed.
+func refreshOutput(ctx context.Context, run *fetchRun, path string, last []byte) ([]byte, bool) {
+	var buf bytes.Buffer
+	if err := run.write(ctx, &buf); err != nil {
+		if ctx.Err() == nil {
+			logrus.WithFields(logrus.Fields{"path": path}).Warnln("fetch failed, keeping previous output")
+		}
+		return nil, false
+	}
+	if last != nil && bytes.Equal(buf.Bytes(), last) {
+		logrus.WithFields(logrus.Fields{"path": path}).Debugln("networks unchanged")
+		return nil, false
+	}
+	out, err := openOutput(path)
+	if err != nil {
+		return nil, false
+	}
+	_, err = out.Write(buf.Bytes())
+	if err := out.close(err); err != nil {
+		return nil, false
+	}
+	logrus.WithFields(logrus.Fields{"path": path}).Infoln("networks changed, output updated")
+	return append([]byte{}, buf.Bytes()...), true
+}
+
+// runHook runs command with sh, passing the output file as ASN2IP_OUTPUT. A failing hook is
+// only logged, the watch continues.
+func runHook(ctx context.Context, command, path string) {
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), "ASN2IP_OUTPUT="+path)
+	if err := cmd.Run(); err != nil {
+		logrus.WithFields(logrus.Fields{"command": command, "error": err}).Errorln("failed to run exec hook")
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/g0dsCookie/asn2ip/pkg/asn2ip"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const webhookSignatureHeader = "X-Asn2ip-Signature"
+
+type webhookOptions struct {
+	URLs []string
+	// Secret signs the payloads with HMAC-SHA256, payloads are unsigned if empty.
+	Secret  string
+	Timeout time.Duration
+}
+
+// changePayload describes a change in webhooks and change events.
+type changePayload struct {
+	ASN       string    `json:"asn"`
+	Added     []string  `json:"added"`
+	Removed   []string  `json:"removed"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+func newChangePayload(change asn2ip.Change) changePayload {
+	return changePayload{
+		ASN:       change.AS,
+		Added:     networkStrings(change.Added),
+		Removed:   networkStrings(change.Removed),
+		Timestamp: time.Now().UTC(),
+	}
+}
+
+// webhookNotifier posts the changes detected by the refresher to the configured urls.
+type webhookNotifier struct {
+	opts   webhookOptions
+	client *http.Client
+	wg     sync.WaitGroup
+}
+
+func newWebhookNotifier(opts webhookOptions) *webhookNotifier {
+	if opts.Timeout <= 0 {
+		opts.Timeout = 10 * time.Second
+	}
+	return &webhookNotifier{opts: opts, client: &http.Client{Timeout: opts.Timeout}}
+}
+
+// notify sends change to all urls in background, so slow receivers don't delay refreshes.
+func (n *webhookNotifier) notify(change asn2ip.Change) {
+	body, err := json.Marshal(newChangePayload(change))
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"asn": change.AS, "error": err}).Errorln("failed to encode webhook payload")
+		return
+	}
+	for _, url := range n.opts.URLs {
+		n.wg.Add(1)
+		go func(url string) {
+			defer n.wg.Done()
+			if err := n.post(url, body); err != nil {
+				logrus.WithFields(logrus.Fields{"asn": change.AS, "url": url, "error": err}).Errorln("failed to deliver webhook")
+				return
+			}
+			logrus.WithFields(logrus.Fields{"asn": change.AS, "url": url}).Debugln("delivered webhook")
+		}(url)
+	}
+}
+
+func (n *webhookNotifier) post(url string, body []byte) error {
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "failed to create webhook request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "asn2ip")
+	if n.opts.Secret != "" {
+		req.Header.Set(webhookSignatureHeader, "sha256="+signPayload(n.opts.Secret, body))
+	}
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// signPayload returns the hex encoded HMAC-SHA256 of body.
+func signPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Close waits for webhooks still being delivered.
+func (n *webhookNotifier) Close() {
+	n.wg.Wait()
+	n.client.CloseIdleConnections()
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/g0dsCookie/asn2ip/internal/config"
+	"github.com/g0dsCookie/asn2ip/pkg/asn2ip"
+	"github.com/g0dsCookie/asn2ip/pkg/storage"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+// whoisProxy answers the IRRd queries of routing tools from the cache, falling back to the
+// upstream whois server for ASNs not cached yet.
+type whoisProxy struct {
+	fetcher     asn2ip.Fetcher
+	maxDepth    int
+	idleTimeout time.Duration
+
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+	wg    sync.WaitGroup
+}
+
+func whoisProxyHandler(c *cli.Context) error {
+	conf, err := setup(c)
+	if err != nil {
+		return err
+	}
+	proxy := config.NewWhoisProxyConfig()
+	proxy.UpdateFromCLIContext(c)
+	stor := config.NewStorageConfig()
+	stor.UpdateFromCLIContext(c)
+
+	sources, err := irrSources(conf)
+	if err != nil {
+		return err
+	}
+	source, err := sourceOptionsFromConfig(conf)
+	if err != nil {
+		return err
+	}
+	storageOptions, err := storageOptionsFromConfig(stor)
+	if err != nil {
+		return err
+	}
+	cache, err := storage.NewStorage(storageOptions)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"error": err}).Errorln("failed to initialize storage")
+		return cli.Exit("", exitConfig)
+	}
+	defer cache.Close()
+	upstream, err := fetcherFromConfig(conf, source, sources)
+	if err != nil {
+		return err
+	}
+	p := &whoisProxy{
+		fetcher:     asn2ip.NewCache(upstream, cache),
+		maxDepth:    conf.GetInt("whois.as-set-depth"),
+		idleTimeout: proxy.GetDuration("whois-proxy.idle-timeout"),
+		conns:       map[net.Conn]struct{}{},
+	}
+	defer p.fetcher.Close()
+
+	address := net.JoinHostPort(proxy.GetString("whois-proxy.address"), fmt.Sprint(proxy.GetInt("whois-proxy.port")))
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"address": address, "error": err}).Errorln("failed to listen for whois connections")
+		return cli.Exit("", exitError)
+	}
+	logrus.WithFields(logrus.Fields{"address": l.Addr()}).Infoln("listening for whois connections")
+	return p.serve(c.Context, l)
+}
+
+// serve accepts connections on l until SIGINT or SIGTERM is received, then closes all client
+// connections and waits for their handlers to return.
+func (p *whoisProxy) serve(ctx context.Context, l net.Listener) error {
+	ctx, stop := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		l.Close()
+		p.mu.Lock()
+		for c := range p.conns {
+			c.Close()
+		}
+		p.mu.Unlock()
+	}()
+
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			logrus.WithFields(logrus.Fields{"error": err}).Errorln("failed to accept whois connection")
+			stop()
+			p.wg.Wait()
+			return cli.Exit("", exitError)
+		}
+		p.mu.Lock()
+		if ctx.Err() != nil {
+			p.mu.Unlock()
+			c.Close()
+			break
+		}
+		p.conns[c] = struct{}{}
+		p.wg.Add(1)
+		p.mu.Unlock()
+		go p.handle(ctx, c)
+	}
+	p.wg.Wait()
+	logrus.Infoln("shut down")
+	return nil
+}
+
+// handle answers the commands of a client. Like IRRd a connection is closed after the first
+// answer unless the client enabled multiple commands per connection with !!.
+func (p *whoisProxy) handle(ctx context.Context, c net.Conn) {
+	defer p.wg.Done()
+	defer func() {
+		p.mu.Lock()
+		delete(p.conns, c)
+		p.mu.Unlock()
+		c.Close()
+	}()
+	log := logrus.WithFields(logrus.Fields{"remote": c.RemoteAddr()})
+	log.Debugln("accepted whois connection")
+
+	persistent := false
+	scanner := bufio.NewScanner(c)
+	for {
+		if p.idleTimeout > 0 {
+			c.SetReadDeadline(time.Now().Add(p.idleTimeout))
+		}
+		if !scanner.Scan() {
+			if err := scanner.Err(); err != nil && ctx.Err() == nil {
+				log.WithFields(logrus.Fields{"error": err}).Debugln("closing whois connection")
+			}
+			return
+		}
+		cmd := strings.TrimSpace(scanner.Text())
+		switch cmd {
+		case "":
+			continue
+		case "!!":
+			persistent = true
+			continue
+		case "!q", "exit", "quit":
+			return
+		}
+
+		log.WithFields(logrus.Fields{"cmd": cmd}).Debugln("answering whois command")
+		if _, err := io.WriteString(c, p.answer(ctx, cmd)); err != nil || !persistent {
+			return
+		}
+	}
+}
+
+// answer returns the response to a single whois command.
+func (p *whoisProxy) answer(ctx context.Context, cmd string) string {
+	switch {
+	case strings.HasPrefix(cmd, "!g"), strings.HasPrefix(cmd, "!6"):
+		return p.answerNetworks(ctx, cmd[1] == 'g', cmd[2:])
+	case strings.HasPrefix(cmd, "!i"):
+		return p.answerSet(ctx, cmd[2:])
+	case strings.HasPrefix(cmd, "!n"):
+		return "C\n"
+	case strings.HasPrefix(cmd, "!v"):
+		return whoisData("asn2ip " + Version)
+	}
+	return "F unrecognized command\n"
+}
+
+func (p *whoisProxy) answerNetworks(ctx context.Context, ipv4 bool, as string) string {
+	as, err := asn2ip.NormalizeASN(as)
+	if err != nil {
+		return whoisError(err)
+	}
+	ips, err := p.fetcher.FetchContext(ctx, ipv4, !ipv4, as)
+	if err != nil {
+		return whoisError(err)
+	}
+	nets := ips[as].IPv6
+	if ipv4 {
+		nets = ips[as].IPv4
+	}
+	return whoisData(prefixFields(nets)...)
+}
+
+// answerSet answers !i queries with the members of a set as registered, or all member AS
+// numbers if the query ends with ",1".
+func (p *whoisProxy) answerSet(ctx context.Context, query string) string {
+	set, recursive := strings.TrimSuffix(query, ",1"), strings.HasSuffix(query, ",1")
+	if !asn2ip.IsASSet(set) {
+		return "F invalid as-set " + set + "\n"
+	}
+	if !recursive {
+		lister, ok := p.fetcher.(asn2ip.SetLister)
+		if !ok {
+			return "F source does not support as-sets\n"
+		}
+		members, err := lister.Members(ctx, set)
+		if err != nil {
+			return whoisError(err)
+		}
+		return whoisData(members...)
+	}
+	expander, ok := p.fetcher.(asn2ip.Expander)
+	if !ok {
+		return "F source does not support as-sets\n"
+	}
+	asn, err := expander.Expand(ctx, set, p.maxDepth)
+	if err != nil {
+		return whoisError(err)
+	}
+	members := make([]string, len(asn))
+	for i, as := range asn {
+		members[i] = "AS" + as
+	}
+	return whoisData(members...)
+}
+
+// whoisError returns D for unknown keys and F with the error message otherwise.
+func whoisError(err error) string {
+	if errors.Is(err, asn2ip.ErrASNotFound) {
+		return "D\n"
+	}
+	return "F " + strings.ReplaceAll(err.Error(), "\n", " ") + "\n"
+}
+
+// whoisData returns a response carrying fields separated by spaces, or C without any field.
+func whoisData(fields ...string) string {
+	if len(fields) == 0 {
+		return "C\n"
+	}
+	d := strings.Join(fields, " ") + "\n"
+	return fmt.Sprintf("A%d\n%sC\n", len(d), d)
+}
+
+func prefixFields(nets []netip.Prefix) []string {
+	out := make([]string, len(nets))
+	for i, n := range nets {
+		out[i] = n.String()
+	}
+	return out
+}
@@ -15,13 +15,17 @@ func newConfig(name string, vars map[string]configVar) *Config {
 		vars:  vars,
 		Viper: viper.New(),
 	}
-	conf.SetConfigName(name)
-	conf.SetConfigType("yaml")
-	conf.AddConfigPath("/etc/asn2ip")
-	conf.AddConfigPath("$HOME/.config/asn2ip")
-	conf.AddConfigPath("./configs")
-	conf.AddConfigPath(".")
 	conf.setDefaults()
+	// flags already read their variables, this covers keys without a flag in the current command
+	conf.SetEnvPrefix(envPrefix)
+	conf.SetEnvKeyReplacer(envKeyReplacer)
+	conf.AutomaticEnv()
+	if path := FindFile(); path != "" {
+		// a broken file is reported by Validate while setting up the command
+		if v, err := readFile(path); err == nil {
+			conf.MergeConfigMap(settings(v))
+		}
+	}
 	return conf
 }
 
@@ -31,6 +35,20 @@ func NewDaemonConfig() *Config { return newConfig("asn2ip", daemonVars) }
 
 func NewFetchConfig() *Config { return newConfig("asn2ip", fetchVars) }
 
+func NewWatchConfig() *Config { return newConfig("asn2ip", watchVars) }
+
+func NewDiffConfig() *Config { return newConfig("asn2ip", diffVars) }
+
+func NewExpandConfig() *Config { return newConfig("asn2ip", expandVars) }
+
+func NewExportConfig() *Config { return newConfig("asn2ip", exportVars) }
+
+func NewPrefetchConfig() *Config { return newConfig("asn2ip", prefetchVars) }
+
+func NewBenchConfig() *Config { return newConfig("asn2ip", benchVars) }
+
+func NewWhoisProxyConfig() *Config { return newConfig("asn2ip", whoisProxyVars) }
+
 func NewStorageConfig() *Config { return newConfig("asn2ip", storageVars) }
 
 func (conf *Config) UpdateFromCLIContext(c *cli.Context) {
@@ -45,10 +63,14 @@ func (conf *Config) UpdateFromCLIContext(c *cli.Context) {
 					conf.Set(k, c.String(name))
 				case intType:
 					conf.Set(k, c.Int(name))
+				case floatType:
+					conf.Set(k, c.Float64(name))
 				case boolType:
 					conf.Set(k, c.Bool(name))
 				case durationType:
 					conf.Set(k, c.Duration(name))
+				case sliceType:
+					conf.Set(k, c.StringSlice(name))
 				}
 			}
 		}
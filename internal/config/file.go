@@ -0,0 +1,340 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+	"github.com/urfave/cli/v2"
+)
+
+// searchPaths are the directories searched for asn2ip.yaml, first match wins.
+var searchPaths = []string{"/etc/asn2ip", "$HOME/.config/asn2ip", "./configs", "."}
+
+// minimums holds the lower bound of numeric keys allowed to be negative, all other numbers
+// must be non-negative.
+var minimums = map[string]float64{
+	"fetch.retries": -1,
+}
+
+// limits holds the upper bound of numeric keys.
+var limits = map[string]float64{
+	"log.level":        6,
+	"whois.port":       65535,
+	"cymru.port":       65535,
+	"listen.port":      65535,
+	"whois-proxy.port": 65535,
+}
+
+// commandVars returns the config vars of the global flags and each command.
+func commandVars() []map[string]configVar {
+	return []map[string]configVar{configVars, daemonVars, fetchVars, watchVars, diffVars, expandVars, exportVars, prefetchVars, benchVars, whoisProxyVars, storageVars}
+}
+
+// allVars returns the config vars of all commands.
+func allVars() map[string]configVar {
+	all := map[string]configVar{}
+	for _, vars := range commandVars() {
+		for k, v := range vars {
+			all[k] = v
+		}
+	}
+	return all
+}
+
+// file and format are the config file and its format set with --config and --config-format,
+// see SetFile.
+var file, format string
+
+// formats maps the extensions of config files to their format, searched in this order.
+var formats = []struct{ ext, format string }{
+	{"yaml", "yaml"}, {"yml", "yaml"}, {"toml", "toml"}, {"json", "json"},
+}
+
+// SetFile makes all commands read the config file at path instead of searching for one, an
+// empty path restores the search. An empty format is detected from the extension of the file.
+func SetFile(path, fileFormat string) { file, format = path, fileFormat }
+
+// FindFile returns the config file read by all commands, empty if there is none.
+func FindFile() string {
+	if file != "" {
+		return file
+	}
+	for _, dir := range searchPaths {
+		for _, f := range formats {
+			path := filepath.Join(os.ExpandEnv(dir), "asn2ip."+f.ext)
+			if info, err := os.Stat(path); err == nil && !info.IsDir() {
+				return path
+			}
+		}
+	}
+	return ""
+}
+
+// fileFormat returns the format of the config file at path, set with --config-format or
+// detected from its extension.
+func fileFormat(path string) (string, error) {
+	if format != "" {
+		for _, f := range formats {
+			if f.format == format {
+				return format, nil
+			}
+		}
+		return "", errors.Errorf("unsupported config format %s, expected yaml, toml or json", format)
+	}
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(path), "."))
+	for _, f := range formats {
+		if f.ext == ext {
+			return f.format, nil
+		}
+	}
+	return "", errors.Errorf("unknown format of config file %s, set it with --config-format", path)
+}
+
+func readFile(path string) (*viper.Viper, error) {
+	format, err := fileFormat(path)
+	if err != nil {
+		return nil, err
+	}
+	v := viper.New()
+	v.SetConfigFile(path)
+	v.SetConfigType(format)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, errors.Wrapf(err, "failed to read config file %s", path)
+	}
+	return v, nil
+}
+
+// daemonSection holds the keys only used by the daemon. Earlier versions expected them at the top
+// of the file, which is still read.
+const daemonSection = "daemon"
+
+// fileKey returns the key of a config key in the file. The keys of the daemon are moved into
+// its section, unless their section is shared with the global flags like whois.
+func fileKey(key string) string {
+	if _, ok := daemonVars[key]; !ok {
+		return key
+	}
+	section := strings.SplitN(key, ".", 2)[0]
+	for k := range configVars {
+		if strings.SplitN(k, ".", 2)[0] == section {
+			return key
+		}
+	}
+	return daemonSection + "." + key
+}
+
+// configKey returns the config key of a key in the file, reverting fileKey.
+func configKey(key string) string {
+	if k := strings.TrimPrefix(key, daemonSection+"."); k != key {
+		if _, ok := daemonVars[k]; ok {
+			return k
+		}
+	}
+	return key
+}
+
+// settings returns the values of a config file nested by their config keys. The daemon section
+// wins over keys of the daemon at the top of the file.
+func settings(v *viper.Viper) map[string]interface{} {
+	keys := v.AllKeys()
+	flat := viper.New()
+	for _, key := range keys {
+		if configKey(key) == key {
+			flat.Set(key, v.Get(key))
+		}
+	}
+	for _, key := range keys {
+		if k := configKey(key); k != key {
+			flat.Set(k, v.Get(key))
+		}
+	}
+	return flat.AllSettings()
+}
+
+// Validate reads the config file at path and returns a problem for each unknown key and each
+// value of the wrong type or out of range. An unreadable file is returned as error.
+func Validate(path string) ([]error, error) {
+	v, err := readFile(path)
+	if err != nil {
+		return nil, err
+	}
+	vars := allVars()
+	keys := v.AllKeys()
+	sort.Strings(keys)
+	problems := []error{}
+	for _, key := range keys {
+		cv, ok := vars[configKey(key)]
+		if !ok {
+			problems = append(problems, errors.Errorf("%s: unknown key", key))
+			continue
+		}
+		if err := cv.check(configKey(key), v.Get(key)); err != nil {
+			problems = append(problems, errors.Wrap(err, key))
+		}
+	}
+	return problems, nil
+}
+
+func (c configVar) check(key string, value interface{}) error {
+	var n float64
+	switch c.Type {
+	case stringType:
+		if _, err := cast.ToStringE(value); err != nil {
+			return errors.Errorf("expected a string, got %v", value)
+		}
+		return nil
+	case boolType:
+		if _, err := cast.ToBoolE(value); err != nil {
+			return errors.Errorf("expected true or false, got %v", value)
+		}
+		return nil
+	case sliceType:
+		if _, err := cast.ToStringSliceE(value); err != nil {
+			return errors.Errorf("expected a list of strings, got %v", value)
+		}
+		return nil
+	case intType:
+		i, err := cast.ToIntE(value)
+		if err != nil {
+			return errors.Errorf("expected an integer, got %v", value)
+		}
+		n = float64(i)
+	case floatType:
+		f, err := cast.ToFloat64E(value)
+		if err != nil {
+			return errors.Errorf("expected a number, got %v", value)
+		}
+		n = f
+	case durationType:
+		d, err := cast.ToDurationE(value)
+		if err != nil {
+			return errors.Errorf("expected a duration like 90s or 1h, got %v", value)
+		}
+		n = float64(d)
+	}
+	if min, ok := minimums[key]; ok {
+		if n < min {
+			return errors.Errorf("must be at least %v, got %v", min, value)
+		}
+	} else if n < 0 {
+		return errors.Errorf("must not be negative, got %v", value)
+	}
+	if max, ok := limits[key]; ok && n > max {
+		return errors.Errorf("must be at most %v, got %v", max, value)
+	}
+	return nil
+}
+
+// WriteSample writes a config file setting every key to its default value, each preceded by
+// the usage of its flag as comment.
+func WriteSample(w io.Writer) error {
+	values := map[string]interface{}{}
+	comments := map[string]string{}
+	for k, v := range allVars() {
+		values[fileKey(k)] = v.Default
+		if flag, ok := v.CLIFlag.(cli.DocGenerationFlag); ok {
+			comments[fileKey(k)] = fmt.Sprintf("%s (--%s, $%s)", flag.GetUsage(), flag.Names()[0], envName(k))
+		}
+	}
+	if _, err := fmt.Fprintf(w, "# asn2ip configuration, read from asn2ip.yaml, .toml or .json in %s\n", strings.Join(searchPaths, ", ")); err != nil {
+		return err
+	}
+	return writeYAML(w, values, comments)
+}
+
+// WriteEffective writes the value of every key merged from defaults, config file, environment
+// and the flags of c.
+func WriteEffective(w io.Writer, c *cli.Context) error {
+	values := map[string]interface{}{}
+	for _, vars := range commandVars() {
+		conf := newConfig("asn2ip", vars)
+		conf.UpdateFromCLIContext(c)
+		for k, v := range vars {
+			values[fileKey(k)] = conf.typed(k, v.Type)
+		}
+	}
+	return writeYAML(w, values, nil)
+}
+
+// typed returns the value of key converted to t, environment variables are read as strings.
+func (conf *Config) typed(key string, t configVarType) interface{} {
+	switch t {
+	case stringType:
+		return conf.GetString(key)
+	case intType:
+		return conf.GetInt(key)
+	case floatType:
+		return conf.GetFloat64(key)
+	case boolType:
+		return conf.GetBool(key)
+	case durationType:
+		return conf.GetDuration(key)
+	case sliceType:
+		// separated by commas like the variables of slice flags
+		if s, ok := conf.Get(key).(string); ok {
+			return strings.Split(s, ",")
+		}
+		return conf.GetStringSlice(key)
+	}
+	return conf.Get(key)
+}
+
+// writeYAML writes values nested by the dots of their keys.
+func writeYAML(w io.Writer, values map[string]interface{}, comments map[string]string) error {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var prev []string
+	for _, key := range keys {
+		parts := strings.Split(key, ".")
+		// open the sections not shared with the previous key
+		common := 0
+		for common < len(prev)-1 && common < len(parts)-1 && prev[common] == parts[common] {
+			common++
+		}
+		for i := common; i < len(parts)-1; i++ {
+			if _, err := fmt.Fprintf(w, "%s%s:\n", indent(i), parts[i]); err != nil {
+				return err
+			}
+		}
+		depth := len(parts) - 1
+		if comment, ok := comments[key]; ok {
+			if _, err := fmt.Fprintf(w, "%s# %s\n", indent(depth), comment); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintf(w, "%s%s: %s\n", indent(depth), parts[depth], yamlValue(values[key])); err != nil {
+			return err
+		}
+		prev = parts
+	}
+	return nil
+}
+
+func indent(depth int) string { return strings.Repeat("  ", depth) }
+
+// yamlValue formats v as flow style yaml, which json is a subset of.
+func yamlValue(v interface{}) string {
+	switch v := v.(type) {
+	case time.Duration:
+		return v.String()
+	case nil:
+		return `""`
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("%q", fmt.Sprint(v))
+	}
+	return string(b)
+}
@@ -0,0 +1,46 @@
+package asn2ip
+
+import (
+	"net/netip"
+)
+
+// Aggregate returns the smallest list of networks covering exactly the same addresses as nets.
+// Networks covered by others are dropped and adjacent networks are merged, e.g. 192.0.2.0/25
+// and 192.0.2.128/25 become 192.0.2.0/24. The result is sorted, IPv4 before IPv6.
+func Aggregate(nets []netip.Prefix) []netip.Prefix {
+	masked := make([]netip.Prefix, len(nets))
+	for i, n := range nets {
+		masked[i] = n.Masked()
+	}
+	SortPrefixes(masked)
+
+	result := []netip.Prefix{}
+	for _, n := range masked {
+		// sorted by address, a covering network is always the last one kept
+		if len(result) > 0 && result[len(result)-1].Contains(n.Addr()) {
+			continue
+		}
+		result = append(result, n)
+		// merge siblings into their parent as long as possible
+		for len(result) >= 2 {
+			parent, ok := siblingsParent(result[len(result)-2], result[len(result)-1])
+			if !ok {
+				break
+			}
+			result = append(result[:len(result)-2], parent)
+		}
+	}
+	return result
+}
+
+// siblingsParent returns the network made up of a and b if they are the two halves of it.
+func siblingsParent(a, b netip.Prefix) (netip.Prefix, bool) {
+	if a.Bits() != b.Bits() || a.Bits() == 0 || a.Addr() == b.Addr() {
+		return netip.Prefix{}, false
+	}
+	parent, err := a.Addr().Prefix(a.Bits() - 1)
+	if err != nil || !parent.Contains(b.Addr()) {
+		return netip.Prefix{}, false
+	}
+	return parent, true
+}
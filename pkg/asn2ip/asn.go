@@ -0,0 +1,20 @@
+package asn2ip
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// NormalizeASN strips an optional AS prefix from as and validates it is a 32 bit AS number.
+func NormalizeASN(as string) (string, error) {
+	n := strings.TrimSpace(as)
+	if len(n) > 2 && strings.EqualFold(n[:2], "AS") {
+		n = n[2:]
+	}
+	if _, err := strconv.ParseUint(n, 10, 32); err != nil {
+		return "", errors.Errorf("invalid as number %q", as)
+	}
+	return n, nil
+}
@@ -1,213 +1,514 @@
 package asn2ip
 
 import (
-	"bytes"
+	"bufio"
+	"context"
 	"fmt"
 	"net"
+	"net/netip"
+	"net/url"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/g0dsCookie/asn2ip/pkg/storage"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
 
+// Fetcher fetches the networks of AS numbers. If some of several ASNs fail, the networks of
+// all others are returned together with a *FetchError, the Result holds the failed ASNs
+// with their Error set. Fetchers are returned by NewFetcher, NewCachedFetcher, NewCache and
+// the HTTP API fetchers, package asn2iptest provides a fake for tests.
 type Fetcher interface {
-	Fetch(ipv4, ipv6 bool, asn ...string) (map[string]map[string][]*net.IPNet, error)
+	Fetch(ipv4, ipv6 bool, asn ...string) (Result, error)
+	FetchContext(ctx context.Context, ipv4, ipv6 bool, asn ...string) (Result, error)
+	Close() error
+}
+
+type Option func(*fetcher)
+
+// DialFunc connects to addr, like net.Dialer.DialContext. The connect timeout is enforced
+// through ctx.
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// WithDialer connects to the whois server with dial instead of net.Dialer, e.g. to route
+// whois traffic through a custom transport. A proxy set with WithProxy is reached with dial.
+func WithDialer(dial DialFunc) Option {
+	return func(f *fetcher) { f.dialer = dial }
+}
+
+// WithPool keeps whois connections open and reuses them for subsequent fetches.
+func WithPool(opts PoolOptions) Option {
+	return func(f *fetcher) { f.poolOptions = opts }
+}
+
+// WithMaxConcurrency fetches up to n ASNs in parallel, each over its own whois connection.
+func WithMaxConcurrency(n int) Option {
+	return func(f *fetcher) { f.maxConcurrency = n }
 }
 
 type fetcher struct {
-	host string
-	port int
+	host           string
+	port           int
+	maxConcurrency int
+	maxDepth       int
+	sources        string
+	poolOptions    PoolOptions
+	pool           *pool
+	timeouts       TimeoutOptions
+	retries        RetryOptions
+	proxy          *url.URL
+	dialer         DialFunc
+	log            logrus.FieldLogger
+	limiter        *Limiter
 }
 
 type cachedFetcher struct {
-	cache storage.Storage
-	*fetcher
+	cache    storage.Storage
+	upstream Fetcher
+	log      logrus.FieldLogger
 }
 
-func NewFetcher(host string, port int) Fetcher {
-	return &fetcher{
-		host: host,
-		port: port,
+func newFetcher(host string, port int, opts ...Option) *fetcher {
+	f := &fetcher{
+		host:     host,
+		port:     port,
+		timeouts: DefaultTimeouts,
 	}
+	for _, opt := range opts {
+		opt(f)
+	}
+	f.pool = newPool(f.dial, f.poolOptions, f.log)
+	return f
+}
+
+func NewFetcher(host string, port int, opts ...Option) Fetcher {
+	return newFetcher(host, port, opts...)
+}
+
+func NewCachedFetcher(host string, port int, cache storage.Storage, opts ...Option) Fetcher {
+	return NewCache(newFetcher(host, port, opts...), cache)
 }
 
-func NewCachedFetcher(host string, port int, cache storage.Storage) Fetcher {
-	return &cachedFetcher{
-		cache:   cache,
-		fetcher: &fetcher{host: host, port: port},
+// NewCache serves ASNs from cache and only queries upstream for ASNs not cached yet.
+// Messages are logged to the logger of upstream.
+func NewCache(upstream Fetcher, cache storage.Storage) Fetcher {
+	f := &cachedFetcher{
+		cache:    cache,
+		upstream: upstream,
+	}
+	if l, ok := upstream.(logging); ok {
+		f.log = l.baseLogger()
 	}
+	return f
 }
 
-func readLine(conn net.Conn) (string, error) {
-	resp := bytes.Buffer{}
-	buf := make([]byte, 1)
-	for {
-		if _, err := conn.Read(buf[:1]); err != nil {
-			return "", errors.Wrap(err, "failed to read next byte from connection")
-		}
-		if buf[0] == '\n' {
-			break
-		} else {
-			if _, err := resp.Write(buf); err != nil {
-				return "", errors.Wrap(err, "failed to write received byte to buffer")
-			}
+// contextError prefers the context error over errors caused by aborting the connection.
+func contextError(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return errors.Wrap(ctxErr, "whois query aborted")
+	}
+	return err
+}
+
+// watchContext aborts blocking reads and writes on c as soon as ctx is done.
+// The returned function stops watching and reports whether c was aborted.
+func watchContext(ctx context.Context, c *conn) func() bool {
+	done := make(chan struct{})
+	aborted := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.abort()
+			aborted <- true
+		case <-done:
+			aborted <- false
 		}
+	}()
+	return func() bool {
+		close(done)
+		return <-aborted
 	}
-	return strings.TrimRight(resp.String(), "\r"), nil
 }
 
-func fetch(conn net.Conn, as string, version int) ([]*net.IPNet, error) {
+func fetch(conn *conn, as string, version int) ([]netip.Prefix, error) {
 	cmd := ""
 	if version == 4 {
-		cmd = fmt.Sprintf("!gAS%s\n", as)
+		cmd = fmt.Sprintf("!gAS%s", as)
 	} else if version == 6 {
-		cmd = fmt.Sprintf("!6AS%s\n", as)
+		cmd = fmt.Sprintf("!6AS%s", as)
 	} else {
 		return nil, errors.Errorf("unknown ip protocol version %d", version)
 	}
 
-	logrus.WithFields(logrus.Fields{"remote": conn.RemoteAddr(), "as": as, "version": version, "cmd": cmd}).Debugln("issuing fetch command")
-	if _, err := conn.Write([]byte(cmd)); err != nil {
-		return nil, errors.Wrapf(err, "failed to fetch ip addresses for %s", as)
+	data, err := query(conn, cmd)
+	if err != nil {
+		return nil, err
 	}
 
-	response := []*net.IPNet{}
-	state := "start"
-	for {
-		line, err := readLine(conn)
+	response := []netip.Prefix{}
+	for _, n := range strings.Fields(data) {
+		prefix, err := ParsePrefix(n)
 		if err != nil {
-			panic(err) // TODO
+			return nil, errors.Errorf("failed to parse network %s for as %s", n, as)
+		}
+		response = append(response, prefix)
+	}
+	return response, nil
+}
+
+func (f *fetcher) address() string { return net.JoinHostPort(f.host, strconv.Itoa(f.port)) }
+
+func (f *fetcher) dial(ctx context.Context) (*conn, error) {
+	logger(ctx, f.log).WithFields(logrus.Fields{"host": f.host, "port": f.port}).Debugln("connecting to whois host")
+	dialCtx := ctx
+	if f.timeouts.Connect > 0 {
+		var cancel context.CancelFunc
+		dialCtx, cancel = context.WithTimeout(ctx, f.timeouts.Connect)
+		defer cancel()
+	}
+	dial := f.dialer
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	var nc net.Conn
+	var err error
+	if f.proxy != nil {
+		nc, err = dialProxy(dialCtx, f.proxy, dial, f.address())
+	} else {
+		nc, err = dial(dialCtx, "tcp", f.address())
+	}
+	if err != nil {
+		if ctx.Err() == nil && (isTimeout(err) || dialCtx.Err() != nil) {
+			err = &TimeoutError{Op: "connect", Limit: f.timeouts.Connect}
 		}
+		return nil, errors.Wrapf(err, "failed to connect to %s", f.address())
+	}
 
-		if line == "D" {
-			return nil, errors.Errorf("as %s not found", as)
-		} else if line == "C" {
-			return response, nil
+	logger(ctx, f.log).WithFields(logrus.Fields{"host": f.host, "port": f.port}).Debugln("enabling multicommand mode")
+	// enable multiple commands per connection
+	if f.timeouts.Connect > 0 {
+		nc.SetWriteDeadline(time.Now().Add(f.timeouts.Connect))
+	}
+	if _, err := nc.Write([]byte("!!\n")); err != nil {
+		nc.Close()
+		if isTimeout(err) {
+			err = &TimeoutError{Op: "connect", Limit: f.timeouts.Connect}
 		}
+		return nil, errors.Wrapf(err, "failed to enable multicommand mode")
+	}
 
-		if state == "start" {
-			if len(line) <= 0 {
-				return nil, errors.Errorf("empty response for as %s", as)
-			}
-			if line[0] != 'A' {
-				return nil, errors.Errorf("received invalid response for as %s", as)
-			}
-			state = "response"
-			continue
-		} else if state == "response" {
-			nets := strings.Split(line, " ")
-			for _, n := range nets {
-				_, net, err := net.ParseCIDR(n)
-				if err != nil {
-					return nil, errors.Errorf("failed to parse network %s for as %s", n, as)
-				}
-				response = append(response, net)
-			}
+	c := &conn{Conn: nc, lastUsed: time.Now(), ctx: ctx, log: logger(ctx, f.log), limiter: f.limiter, timeouts: f.timeouts}
+	c.r = bufio.NewReader(c)
+	if f.sources != "" {
+		stopWatching := watchContext(ctx, c)
+		err := setSources(c, f.sources)
+		if stopWatching() || err != nil {
+			nc.Close()
+			return nil, contextError(ctx, err)
 		}
 	}
+	return c, nil
+}
+
+func (f *fetcher) Fetch(ipv4, ipv6 bool, asn ...string) (Result, error) {
+	return f.FetchContext(context.Background(), ipv4, ipv6, asn...)
 }
 
-func (f *fetcher) Fetch(ipv4, ipv6 bool, asn ...string) (map[string]map[string][]*net.IPNet, error) {
-	result := map[string]map[string][]*net.IPNet{}
+func (f *fetcher) FetchContext(ctx context.Context, ipv4, ipv6 bool, asn ...string) (Result, error) {
+	return collect(func(fn StreamFunc) error {
+		return f.FetchStream(ctx, ipv4, ipv6, fn, asn...)
+	})
+}
+
+func (f *fetcher) FetchStream(ctx context.Context, ipv4, ipv6 bool, fn StreamFunc, asn ...string) error {
 	if len(asn) == 0 {
-		return result, nil
+		return nil
 	}
 
-	logrus.WithFields(logrus.Fields{"host": f.host, "port": f.port}).Debugln("connecting to whois host")
-	conn, err := net.Dial("tcp", fmt.Sprintf("%s:%d", f.host, f.port))
-	if err != nil {
-		return nil, errors.Wrapf(err, "failed to connect to %s:%d", f.host, f.port)
+	if hasASSet(asn) {
+		expanded, err := f.expandSets(ctx, asn)
+		if err != nil {
+			return err
+		}
+		asn = expanded
 	}
-	defer func() {
-		logrus.WithFields(logrus.Fields{"host": f.host, "port": f.port}).Debugln("closing socket to whois host")
-		// gracefully close socket
-		conn.Write([]byte("exit\n"))
-		conn.Close()
-	}()
 
-	logrus.WithFields(logrus.Fields{"host": f.host, "port": f.port}).Debugln("enabling multicommand mode")
-	// enable multiple commands per connection
-	if _, err := conn.Write([]byte("!!\n")); err != nil {
-		return nil, errors.Wrapf(err, "failed to enable multicommand mode")
+	workers := f.maxConcurrency
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(asn) {
+		workers = len(asn)
 	}
 
-	for _, v := range asn {
-		result[v] = map[string][]*net.IPNet{"ipv4": {}, "ipv6": {}}
-		if ipv4 {
-			net, err := fetch(conn, v, 4)
-			if err != nil {
-				return nil, err
-			}
-			result[v]["ipv4"] = net
-		}
-		if ipv6 {
-			net, err := fetch(conn, v, 6)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		firstErr error
+		errs     = map[string]error{}
+	)
+	jobs := make(chan string)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := f.worker(ctx, ipv4, ipv6, jobs, func(res *ASResult) error {
+				mu.Lock()
+				defer mu.Unlock()
+				if firstErr != nil {
+					return firstErr
+				}
+				return fn(res)
+			}, func(as string, err error) {
+				mu.Lock()
+				defer mu.Unlock()
+				errs[as] = err
+			})
 			if err != nil {
-				return nil, err
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+				// stop all other workers
+				cancel()
 			}
-			result[v]["ipv6"] = net
+		}()
+	}
+
+feed:
+	for _, v := range asn {
+		select {
+		case jobs <- v:
+		case <-ctx.Done():
+			break feed
 		}
 	}
+	close(jobs)
+	wg.Wait()
 
-	return result, nil
+	if firstErr != nil {
+		return firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		return contextError(ctx, err)
+	}
+	return fetchErrors(asn, errs)
 }
 
-func (f *cachedFetcher) Fetch(ipv4, ipv6 bool, asn ...string) (map[string]map[string][]*net.IPNet, error) {
-	result := map[string]map[string][]*net.IPNet{}
-	if len(asn) == 0 {
-		return result, nil
+// fetchAS fetches the requested ip versions of as. Versions without any networks are empty,
+// if none of the requested versions has networks a NotFoundError is returned.
+func (f *fetcher) fetchAS(conn *conn, as string, ipv4, ipv6 bool) (*ASResult, error) {
+	res := &ASResult{ASN: as, IPv4: []netip.Prefix{}, IPv6: []netip.Prefix{}, Source: f.host}
+	found := false
+	for _, version := range []int{4, 6} {
+		if (version == 4 && !ipv4) || (version == 6 && !ipv6) {
+			continue
+		}
+		n, err := fetch(conn, as, version)
+		if err == errNoEntries {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if version == 4 {
+			res.IPv4 = n
+		} else {
+			res.IPv6 = n
+		}
+		found = true
+	}
+	if !found && (ipv4 || ipv6) {
+		return nil, &NotFoundError{AS: as}
 	}
+	res.FetchedAt = time.Now()
+	return res, nil
+}
 
-	uncached := []string{}
-	for _, as := range asn {
-		r, err := f.cache.Get(as)
-		if err == storage.ErrASNotCached || (ipv4 && !r.FetchedIPv4) || (ipv6 && !r.FetchedIPv6) {
-			uncached = append(uncached, as)
-			continue
+// worker fetches all ASNs received from jobs over a single whois connection, which is only
+// replaced if a query has to be retried. ASNs failing to fetch are passed to fail.
+func (f *fetcher) worker(ctx context.Context, ipv4, ipv6 bool, jobs <-chan string, store StreamFunc, fail func(as string, err error)) error {
+	var (
+		conn         *conn
+		stopWatching func() bool
+	)
+	defer func() {
+		if conn == nil {
+			return
 		}
-		if err != nil {
-			return nil, errors.Wrapf(err, "failed to fetch asn %s from cache", as)
+		if stopWatching() {
+			f.discard(conn)
+		} else {
+			f.putConn(conn)
 		}
+	}()
 
-		result[as] = map[string][]*net.IPNet{"ipv4": {}, "ipv6": {}}
-		if ipv4 {
-			cpy := make([]*net.IPNet, 0, len(r.IPv4))
-			copy(cpy, r.IPv4)
-			result[as]["ipv4"] = r.IPv4
+	for v := range jobs {
+		var res *ASResult
+		err := f.retry(ctx, func() (err error) {
+			if conn == nil {
+				c, err := f.getConn(ctx)
+				if err != nil {
+					return err
+				}
+				conn, stopWatching = c, watchContext(ctx, c)
+			}
+			res, err = f.fetchAS(conn, v, ipv4, ipv6)
+			if err != nil && !errors.Is(err, ErrASNotFound) {
+				stopWatching()
+				f.discard(conn)
+				conn = nil
+			}
+			return err
+		})
+		if err != nil {
+			if ctx.Err() != nil || isFatal(err) {
+				return contextError(ctx, err)
+			}
+			fail(v, err)
+			continue
 		}
-		if ipv6 {
-			cpy := make([]*net.IPNet, 0, len(r.IPv6))
-			copy(cpy, r.IPv6)
-			result[as]["ipv6"] = r.IPv6
+		if err := store(res); err != nil {
+			return err
 		}
 	}
+	return nil
+}
+
+func (f *fetcher) Close() error { return f.pool.Close() }
 
-	if len(uncached) == 0 {
-		// all ASNs were cached
-		return result, nil
+func (f *cachedFetcher) Fetch(ipv4, ipv6 bool, asn ...string) (Result, error) {
+	return f.FetchContext(context.Background(), ipv4, ipv6, asn...)
+}
+
+func (f *cachedFetcher) FetchContext(ctx context.Context, ipv4, ipv6 bool, asn ...string) (Result, error) {
+	return collect(func(fn StreamFunc) error {
+		return f.FetchStream(ctx, ipv4, ipv6, fn, asn...)
+	})
+}
+
+// families are the ip versions of a fetch.
+type families struct{ ipv4, ipv6 bool }
+
+// lookup returns the cache entry of as and the requested ip versions missing from it, which
+// need to be fetched upstream. A cached unknown AS fails with a *NotFoundError.
+func (f *cachedFetcher) lookup(ctx context.Context, as string, ipv4, ipv6 bool) (storage.ASStorage, families, error) {
+	r, err := f.cache.Get(as)
+	if err == storage.ErrASNotCached {
+		return storage.ASStorage{}, families{ipv4, ipv6}, nil
+	} else if err != nil {
+		return storage.ASStorage{}, families{}, errors.Wrapf(err, "failed to fetch asn %s from cache", as)
 	}
+	missing := families{ipv4 && !r.FetchedIPv4, ipv6 && !r.FetchedIPv6}
+	if r.NotFound {
+		if missing.ipv4 || missing.ipv6 {
+			// the AS may have appeared since, look it up again
+			return storage.ASStorage{}, families{ipv4, ipv6}, nil
+		}
+		return storage.ASStorage{}, missing, &NotFoundError{AS: as}
+	}
+	if !missing.ipv4 && !missing.ipv6 {
+		observeExpiry(ctx, r.Expires)
+	}
+	return r, missing, nil
+}
 
-	// request the rest
-	r, err := f.fetcher.Fetch(ipv4, ipv6, uncached...)
-	if err != nil {
-		return nil, err
+// fromCache returns the requested ip versions of the cache entry r.
+func fromCache(r storage.ASStorage, ipv4, ipv6 bool) *ASResult {
+	res := &ASResult{ASN: r.AS, IPv4: []netip.Prefix{}, IPv6: []netip.Prefix{}, Source: SourceCache, FetchedAt: r.Stored}
+	// hand out copies, cached entries are shared between concurrent requests
+	if ipv4 {
+		res.IPv4 = copyPrefixes(r.IPv4)
 	}
+	if ipv6 {
+		res.IPv6 = copyPrefixes(r.IPv6)
+	}
+	return res
+}
 
-	// now cache them and append them the results
-	for as, v := range r {
-		err := f.cache.Set(storage.ASStorage{
-			AS:          as,
-			IPv4:        v["ipv4"],
-			IPv6:        v["ipv6"],
-			FetchedIPv4: ipv4,
-			FetchedIPv6: ipv6,
-		})
-		if err != nil {
-			return nil, errors.Wrapf(err, "failed to put %s on cache", as)
+func copyPrefixes(prefixes []netip.Prefix) []netip.Prefix {
+	out := make([]netip.Prefix, len(prefixes))
+	copy(out, prefixes)
+	return out
+}
+
+// merge stores res, fetched upstream for the ip versions fetched, together with the ip
+// versions already held by the cache entry r. The other requested ip versions of res are
+// taken from r. The merged entry expires as if all of it was fetched now.
+func (f *cachedFetcher) merge(r storage.ASStorage, res *ASResult, fetched families, ipv4, ipv6 bool) error {
+	merged := storage.ASStorage{
+		AS:          res.ASN,
+		IPv4:        r.IPv4,
+		IPv6:        r.IPv6,
+		FetchedIPv4: r.FetchedIPv4 || fetched.ipv4,
+		FetchedIPv6: r.FetchedIPv6 || fetched.ipv6,
+	}
+	if fetched.ipv4 {
+		merged.IPv4 = res.IPv4
+	} else if ipv4 {
+		res.IPv4 = copyPrefixes(r.IPv4)
+	}
+	if fetched.ipv6 {
+		merged.IPv6 = res.IPv6
+	} else if ipv6 {
+		res.IPv6 = copyPrefixes(r.IPv6)
+	}
+	err := f.cache.Set(merged)
+	return errors.Wrapf(err, "failed to put %s on cache", res.ASN)
+}
+
+// upstreamError remembers unknown ASNs reported by err to not query them over and over again.
+func (f *cachedFetcher) upstreamError(err error, ipv4, ipv6 bool) error {
+	if nf := (*NotFoundError)(nil); errors.As(err, &nf) {
+		if err := storeNotFound(f.cache, nf.AS, ipv4, ipv6); err != nil {
+			orStandard(f.log).WithFields(logrus.Fields{"asn": nf.AS, "error": err}).Warnln("failed to put unknown asn on cache")
 		}
-		result[as] = map[string][]*net.IPNet{"ipv4": v["ipv4"], "ipv6": v["ipv6"]}
+		return nf
 	}
+	return err
+}
+
+// upstreamErrors adds the ASNs of uncached failed by err to errs. Errors not caused by
+// single ASNs are returned.
+func (f *cachedFetcher) upstreamErrors(err error, uncached []string, errs map[string]error, ipv4, ipv6 bool) error {
+	if partial := (*FetchError)(nil); errors.As(err, &partial) {
+		for as, err := range partial.Errors {
+			errs[as] = f.upstreamError(err, ipv4, ipv6)
+		}
+		return nil
+	}
+	if len(uncached) == 1 && !isFatal(err) {
+		errs[uncached[0]] = f.upstreamError(err, ipv4, ipv6)
+		return nil
+	}
+	return f.upstreamError(err, ipv4, ipv6)
+}
+
+func (f *cachedFetcher) Close() error { return f.upstream.Close() }
+
+func store(cache storage.Storage, res *ASResult, ipv4, ipv6 bool) error {
+	err := cache.Set(storage.ASStorage{
+		AS:          res.ASN,
+		IPv4:        res.IPv4,
+		IPv6:        res.IPv6,
+		FetchedIPv4: ipv4,
+		FetchedIPv6: ipv6,
+	})
+	return errors.Wrapf(err, "failed to put %s on cache", res.ASN)
+}
 
-	return result, nil
+func storeNotFound(cache storage.Storage, as string, ipv4, ipv6 bool) error {
+	err := cache.Set(storage.ASStorage{
+		AS:          as,
+		FetchedIPv4: ipv4,
+		FetchedIPv6: ipv6,
+		NotFound:    true,
+	})
+	return errors.Wrapf(err, "failed to put %s on cache", as)
 }
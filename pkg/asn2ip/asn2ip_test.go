@@ -0,0 +1,96 @@
+package asn2ip_test
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/g0dsCookie/asn2ip/pkg/asn2ip"
+	"github.com/g0dsCookie/asn2ip/pkg/asn2ip/asn2iptest"
+)
+
+var testData = asn2iptest.Data{
+	Networks: map[string][]string{
+		"1": {"192.0.2.0/24", "198.51.100.0/24", "2001:db8::/32"},
+	},
+}
+
+func TestFetch(t *testing.T) {
+	srv, err := asn2iptest.NewServer(testData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	f := srv.Fetcher()
+	defer f.Close()
+
+	result, err := f.Fetch(true, true, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if as := result["1"]; as == nil || len(as.IPv4) != 2 || len(as.IPv6) != 1 {
+		t.Errorf("got %+v, expected 2 ipv4 and 1 ipv6 networks of AS1", as)
+	}
+}
+
+func TestFetchConnectionDropped(t *testing.T) {
+	srv, err := asn2iptest.NewServer(testData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.Drop("!gAS1")
+	f := srv.Fetcher()
+	defer f.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	result, err := f.FetchContext(ctx, true, true, "1")
+	if err == nil {
+		t.Fatalf("got %+v, expected an error for a response cut off", result["1"])
+	}
+	if ctx.Err() != nil {
+		t.Fatalf("got %v after the deadline, expected the fetch to fail right away", err)
+	}
+}
+
+func TestFetchResponseTooLarge(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		// announce 8 GiB of data to every command
+		r := bufio.NewReader(c)
+		for {
+			if _, err := r.ReadString('\n'); err != nil {
+				return
+			}
+			if _, err := io.WriteString(c, "A8589934592\n"); err != nil {
+				return
+			}
+		}
+	}()
+
+	addr := l.Addr().(*net.TCPAddr)
+	f := asn2ip.NewFetcher(addr.IP.String(), addr.Port)
+	defer f.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err = f.FetchContext(ctx, true, false, "1")
+	if err == nil {
+		t.Fatal("fetch succeeded, expected an error for a response exceeding the maximum length")
+	}
+	if ctx.Err() != nil {
+		t.Fatalf("got %v after the deadline, expected the fetch to fail right away", err)
+	}
+}
@@ -0,0 +1,90 @@
+// Package asn2iptest provides a fake asn2ip.Fetcher and an in-process IRRd whois server, so code
+// using asn2ip can be tested without querying RADB or another public whois server.
+package asn2iptest
+
+import (
+	"net/netip"
+	"strings"
+
+	"github.com/g0dsCookie/asn2ip/pkg/asn2ip"
+	"github.com/pkg/errors"
+)
+
+// Source is the source of results returned by Fetcher and of route objects returned by Server.
+const Source = "ASN2IPTEST"
+
+// Data is what a Fetcher or Server answers queries with.
+type Data struct {
+	// Networks holds the networks in CIDR notation of each AS number, e.g.
+	// "15169": {"8.8.8.0/24", "2001:4860::/32"}. AS numbers missing are not found.
+	Networks map[string][]string
+	// Sets holds the members of each as-set, AS numbers like "AS15169" or nested as-sets.
+	Sets map[string][]string
+	// Names holds the as-name of each AS number.
+	Names map[string]string
+}
+
+// networks returns the networks of as split by ip version, false if as is unknown.
+func (d Data) networks(as string) (ipv4, ipv6 []netip.Prefix, ok bool, err error) {
+	nets, ok := d.Networks[as]
+	if !ok {
+		nets, ok = d.Networks["AS"+as]
+	}
+	if !ok {
+		return nil, nil, false, nil
+	}
+	ipv4, ipv6 = []netip.Prefix{}, []netip.Prefix{}
+	for _, n := range nets {
+		prefix, err := asn2ip.ParsePrefix(n)
+		if err != nil {
+			return nil, nil, true, errors.Wrapf(err, "invalid network of AS %s", as)
+		}
+		if prefix.Addr().Is4() {
+			ipv4 = append(ipv4, prefix)
+		} else {
+			ipv6 = append(ipv6, prefix)
+		}
+	}
+	asn2ip.SortPrefixes(ipv4)
+	asn2ip.SortPrefixes(ipv6)
+	return ipv4, ipv6, true, nil
+}
+
+// members returns the members of set, false if set is unknown.
+func (d Data) members(set string) ([]string, bool) {
+	for name, members := range d.Sets {
+		if strings.EqualFold(name, set) {
+			return members, true
+		}
+	}
+	return nil, false
+}
+
+// expand recursively resolves the member AS numbers of set, ignoring loops.
+func (d Data) expand(set string, seen map[string]bool) ([]string, error) {
+	members, ok := d.members(set)
+	if !ok {
+		return nil, errors.Wrapf(asn2ip.ErrASNotFound, "as-set %s", set)
+	}
+	seen[strings.ToUpper(set)] = true
+	asn := []string{}
+	for _, member := range members {
+		if asn2ip.IsASSet(member) {
+			if seen[strings.ToUpper(member)] {
+				continue
+			}
+			nested, err := d.expand(member, seen)
+			if err != nil {
+				return nil, err
+			}
+			asn = append(asn, nested...)
+			continue
+		}
+		as, err := asn2ip.NormalizeASN(member)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid member of as-set %s", set)
+		}
+		asn = append(asn, as)
+	}
+	return asn, nil
+}
@@ -0,0 +1,147 @@
+package asn2iptest
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/g0dsCookie/asn2ip/pkg/asn2ip"
+)
+
+// Fetcher is an asn2ip.Fetcher and asn2ip.NameResolver answering from Data without any
+// network access. Like the fetchers of asn2ip, a fetch of several ASNs returns the networks
+// of all ASNs found together with a *asn2ip.FetchError holding the others.
+type Fetcher struct {
+	Data
+	// Errors holds the error fetching an AS number fails with, e.g. to test partial results.
+	Errors map[string]error
+
+	mu      sync.Mutex
+	fetched []string
+	closed  bool
+}
+
+// NewFetcher returns a Fetcher answering from data.
+func NewFetcher(data Data) *Fetcher {
+	return &Fetcher{Data: data, Errors: map[string]error{}}
+}
+
+func (f *Fetcher) Fetch(ipv4, ipv6 bool, asn ...string) (asn2ip.Result, error) {
+	return f.FetchContext(context.Background(), ipv4, ipv6, asn...)
+}
+
+func (f *Fetcher) FetchContext(ctx context.Context, ipv4, ipv6 bool, asn ...string) (asn2ip.Result, error) {
+	if err := f.check(ctx); err != nil {
+		return nil, err
+	}
+	expanded := []string{}
+	seen := map[string]bool{}
+	for _, name := range asn {
+		members := []string{}
+		if asn2ip.IsASSet(name) {
+			var err error
+			if members, err = f.expand(name, map[string]bool{}); err != nil {
+				return nil, err
+			}
+		} else {
+			as, err := asn2ip.NormalizeASN(name)
+			if err != nil {
+				return nil, err
+			}
+			members = append(members, as)
+		}
+		for _, as := range members {
+			if !seen[as] {
+				seen[as] = true
+				expanded = append(expanded, as)
+			}
+		}
+	}
+
+	result := asn2ip.Result{}
+	errs := map[string]error{}
+	for _, as := range expanded {
+		res, err := f.fetchAS(as, ipv4, ipv6)
+		if err != nil {
+			errs[as] = err
+			continue
+		}
+		result[as] = res
+	}
+	switch {
+	case len(errs) == 0:
+		return result, nil
+	case len(expanded) == 1:
+		return nil, errs[expanded[0]]
+	}
+	for as, err := range errs {
+		result[as] = &asn2ip.ASResult{ASN: as, Error: err}
+	}
+	return result, &asn2ip.FetchError{Errors: errs}
+}
+
+func (f *Fetcher) fetchAS(as string, ipv4, ipv6 bool) (*asn2ip.ASResult, error) {
+	f.mu.Lock()
+	f.fetched = append(f.fetched, as)
+	f.mu.Unlock()
+
+	if err := f.Errors[as]; err != nil {
+		return nil, err
+	}
+	v4, v6, ok, err := f.networks(as)
+	if err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, &asn2ip.NotFoundError{AS: as}
+	}
+	res := &asn2ip.ASResult{ASN: as, Source: Source, FetchedAt: time.Now()}
+	if ipv4 {
+		res.IPv4 = v4
+	}
+	if ipv6 {
+		res.IPv6 = v6
+	}
+	return res, nil
+}
+
+// LookupAS returns the name of as from Names.
+func (f *Fetcher) LookupAS(ctx context.Context, as string) (asn2ip.ASInfo, error) {
+	if err := f.check(ctx); err != nil {
+		return asn2ip.ASInfo{}, err
+	}
+	as, err := asn2ip.NormalizeASN(as)
+	if err != nil {
+		return asn2ip.ASInfo{}, err
+	}
+	name, ok := f.Names[as]
+	if !ok {
+		return asn2ip.ASInfo{}, &asn2ip.NotFoundError{AS: as}
+	}
+	return asn2ip.ASInfo{AS: as, Name: name, Source: Source}, nil
+}
+
+// check fails queries after Close or with a done context.
+func (f *Fetcher) check(ctx context.Context) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return asn2ip.ErrPoolClosed
+	}
+	return ctx.Err()
+}
+
+// Fetched returns the AS numbers fetched so far in order, e.g. to check which ASNs a cache
+// passed on to its upstream.
+func (f *Fetcher) Fetched() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string{}, f.fetched...)
+}
+
+// Close makes all further queries fail with asn2ip.ErrPoolClosed.
+func (f *Fetcher) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	return nil
+}
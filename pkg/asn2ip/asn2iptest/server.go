@@ -0,0 +1,296 @@
+package asn2iptest
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/g0dsCookie/asn2ip/pkg/asn2ip"
+	"github.com/pkg/errors"
+)
+
+// Server is an in-process IRRd whois server answering the queries of the fetchers, name
+// resolvers and route resolvers of asn2ip from Data, so they can be tested end to end.
+type Server struct {
+	// Host and Port the server listens on, to be passed to asn2ip.NewFetcher and friends.
+	Host string
+	Port int
+
+	data     Data
+	listener net.Listener
+
+	mu      sync.Mutex
+	conns   map[net.Conn]struct{}
+	queries []string
+	drop    []string
+	closed  bool
+	wg      sync.WaitGroup
+}
+
+// NewServer starts a Server answering from data on a random port of the loopback interface.
+// It must be closed after use.
+func NewServer(data Data) (*Server, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to listen for whois connections")
+	}
+	addr := l.Addr().(*net.TCPAddr)
+	s := &Server{
+		Host:     addr.IP.String(),
+		Port:     addr.Port,
+		data:     data,
+		listener: l,
+		conns:    map[net.Conn]struct{}{},
+	}
+	s.wg.Add(1)
+	go s.accept()
+	return s, nil
+}
+
+// Fetcher returns an asn2ip.Fetcher querying the server.
+func (s *Server) Fetcher(opts ...asn2ip.Option) asn2ip.Fetcher {
+	return asn2ip.NewFetcher(s.Host, s.Port, opts...)
+}
+
+// Queries returns the whois commands received so far in order.
+func (s *Server) Queries() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.queries...)
+}
+
+// Drop makes the server close the connection halfway through its response to commands
+// starting with prefix, e.g. "!gAS15169", to test clients losing the connection mid-response.
+func (s *Server) Drop(prefix string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.drop = append(s.drop, prefix)
+}
+
+// drops reports whether the response to cmd is cut off.
+func (s *Server) drops(cmd string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, prefix := range s.drop {
+		if strings.HasPrefix(cmd, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Close stops listening and closes all open connections.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	err := s.listener.Close()
+	for c := range s.conns {
+		c.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) accept() {
+	defer s.wg.Done()
+	for {
+		c, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			c.Close()
+			return
+		}
+		s.conns[c] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+		go s.serve(c)
+	}
+}
+
+func (s *Server) serve(c net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, c)
+		s.mu.Unlock()
+		c.Close()
+	}()
+
+	r := bufio.NewReader(c)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.TrimSpace(line)
+		s.mu.Lock()
+		s.queries = append(s.queries, cmd)
+		s.mu.Unlock()
+
+		switch cmd {
+		case "!!", "":
+			continue
+		case "exit", "!q":
+			return
+		}
+		answer := s.answer(cmd)
+		if s.drops(cmd) {
+			io.WriteString(c, answer[:len(answer)/2])
+			return
+		}
+		if _, err := io.WriteString(c, answer); err != nil {
+			return
+		}
+	}
+}
+
+// answer returns the response to a single whois command.
+func (s *Server) answer(cmd string) string {
+	switch {
+	case strings.HasPrefix(cmd, "!g"), strings.HasPrefix(cmd, "!6"):
+		return s.answerNetworks(cmd[1] == 'g', cmd[2:])
+	case strings.HasPrefix(cmd, "!i"):
+		return s.answerSet(cmd[2:])
+	case strings.HasPrefix(cmd, "!maut-num,"):
+		return s.answerAutNum(strings.TrimPrefix(cmd, "!maut-num,"))
+	case strings.HasPrefix(cmd, "!r"):
+		return s.answerRoutes(cmd[2:])
+	case cmd == "!s-lc":
+		return data(Source)
+	case strings.HasPrefix(cmd, "!s"):
+		return "C\n"
+	case strings.HasPrefix(cmd, "!v"):
+		return data("asn2iptest")
+	}
+	return "F unrecognized command\n"
+}
+
+func (s *Server) answerNetworks(ipv4 bool, as string) string {
+	as, err := asn2ip.NormalizeASN(as)
+	if err != nil {
+		return "F " + err.Error() + "\n"
+	}
+	v4, v6, ok, err := s.data.networks(as)
+	if err != nil {
+		return "F " + err.Error() + "\n"
+	} else if !ok {
+		return "D\n"
+	}
+	nets := v6
+	if ipv4 {
+		nets = v4
+	}
+	return data(prefixStrings(nets)...)
+}
+
+// answerSet answers !i queries, expanding nested sets if the query ends with ",1".
+func (s *Server) answerSet(query string) string {
+	set, recursive := strings.TrimSuffix(query, ",1"), strings.HasSuffix(query, ",1")
+	if !recursive {
+		members, ok := s.data.members(set)
+		if !ok {
+			return "D\n"
+		}
+		return data(members...)
+	}
+	asn, err := s.data.expand(set, map[string]bool{})
+	if errors.Is(err, asn2ip.ErrASNotFound) {
+		return "D\n"
+	} else if err != nil {
+		return "F " + err.Error() + "\n"
+	}
+	members := make([]string, len(asn))
+	for i, as := range asn {
+		members[i] = "AS" + as
+	}
+	return data(members...)
+}
+
+func (s *Server) answerAutNum(as string) string {
+	as, err := asn2ip.NormalizeASN(as)
+	if err != nil {
+		return "F " + err.Error() + "\n"
+	}
+	name, ok := s.data.Names[as]
+	if !ok {
+		return "D\n"
+	}
+	return data(fmt.Sprintf("aut-num: AS%s\nas-name: %s\nsource: %s", as, name, Source))
+}
+
+// answerRoutes answers !r queries with the route objects of all networks covering the
+// queried network, regardless of the requested match type.
+func (s *Server) answerRoutes(query string) string {
+	prefix, err := asn2ip.ParseAddress(strings.SplitN(query, ",", 2)[0])
+	if err != nil {
+		return "F " + err.Error() + "\n"
+	}
+	asn := make([]string, 0, len(s.data.Networks))
+	for as := range s.data.Networks {
+		asn = append(asn, strings.TrimPrefix(strings.ToUpper(as), "AS"))
+	}
+	sort.Slice(asn, func(i, j int) bool {
+		a, _ := strconv.ParseUint(asn[i], 10, 32)
+		b, _ := strconv.ParseUint(asn[j], 10, 32)
+		return a < b
+	})
+
+	objects := []string{}
+	for _, as := range asn {
+		v4, v6, _, err := s.data.networks(as)
+		if err != nil {
+			return "F " + err.Error() + "\n"
+		}
+		for _, n := range append(v4, v6...) {
+			if !covers(n, prefix) {
+				continue
+			}
+			class := "route"
+			if n.Addr().Is6() {
+				class = "route6"
+			}
+			objects = append(objects, fmt.Sprintf("%s: %s\norigin: AS%s\nsource: %s\n", class, n, as, Source))
+		}
+	}
+	if len(objects) == 0 {
+		return "D\n"
+	}
+	return data(strings.Join(objects, "\n"))
+}
+
+// covers reports whether n contains all of prefix.
+func covers(n, prefix netip.Prefix) bool {
+	return n.Bits() <= prefix.Bits() && n.Contains(prefix.Addr())
+}
+
+// data returns a response carrying fields separated by spaces, or "C" without any field.
+func data(fields ...string) string {
+	if len(fields) == 0 {
+		return "C\n"
+	}
+	d := strings.Join(fields, " ") + "\n"
+	return fmt.Sprintf("A%d\n%sC\n", len(d), d)
+}
+
+func prefixStrings(nets []netip.Prefix) []string {
+	out := make([]string, len(nets))
+	for i, n := range nets {
+		out[i] = n.String()
+	}
+	return out
+}
@@ -0,0 +1,211 @@
+package asn2ip
+
+import (
+	"context"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Expander expands RPSL as-set objects into their member AS numbers.
+type Expander interface {
+	// Expand recursively resolves the member AS numbers of set. Nested sets deeper than
+	// maxDepth are not resolved, a maxDepth of 0 or less resolves all levels.
+	Expand(ctx context.Context, set string, maxDepth int) ([]string, error)
+}
+
+// SetLister lists the direct members of RPSL as-set objects.
+type SetLister interface {
+	// Members returns the members of set as registered, AS numbers and nested as-sets.
+	Members(ctx context.Context, set string) ([]string, error)
+}
+
+type maxDepthKey struct{}
+
+// ContextWithMaxDepth overrides the as-set recursion depth for fetches using ctx.
+func ContextWithMaxDepth(ctx context.Context, maxDepth int) context.Context {
+	return context.WithValue(ctx, maxDepthKey{}, maxDepth)
+}
+
+func maxDepthFromContext(ctx context.Context, def int) int {
+	if v, ok := ctx.Value(maxDepthKey{}).(int); ok {
+		return v
+	}
+	return def
+}
+
+// WithMaxDepth limits the recursion depth when expanding as-sets.
+func WithMaxDepth(n int) Option {
+	return func(f *fetcher) { f.maxDepth = n }
+}
+
+// IsASSet reports whether name is an as-set like AS-EXAMPLE or AS1:AS-EXAMPLE.
+func IsASSet(name string) bool {
+	name = strings.ToUpper(strings.TrimSpace(name))
+	return strings.HasPrefix(name, "AS-") || strings.Contains(name, ":AS-")
+}
+
+// Normalize normalizes an AS number or as-set name.
+func Normalize(name string) (string, error) {
+	if IsASSet(name) {
+		return strings.ToUpper(strings.TrimSpace(name)), nil
+	}
+	return NormalizeASN(name)
+}
+
+func (f *fetcher) Expand(ctx context.Context, set string, maxDepth int) ([]string, error) {
+	var members []string
+	err := f.withConn(ctx, func(conn *conn) (err error) {
+		members, err = expand(conn, set, maxDepth)
+		return err
+	})
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+	return members, nil
+}
+
+func (f *fetcher) Members(ctx context.Context, set string) ([]string, error) {
+	var members []string
+	err := f.withConn(ctx, func(conn *conn) error {
+		data, err := query(conn, "!i"+strings.ToUpper(set))
+		if err == errNoEntries {
+			return &NotFoundError{AS: set}
+		} else if err != nil {
+			return errors.Wrapf(err, "failed to list members of %s", set)
+		}
+		members = strings.Fields(data)
+		return nil
+	})
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+	return members, nil
+}
+
+func expand(conn *conn, set string, maxDepth int) ([]string, error) {
+	members := []string{}
+	seen := map[string]bool{}
+	visited := map[string]bool{}
+
+	var walk func(set string, depth int) error
+	walk = func(set string, depth int) error {
+		if visited[set] {
+			conn.logger().WithFields(logrus.Fields{"set": set}).Debugln("skipping already expanded as-set")
+			return nil
+		}
+		visited[set] = true
+
+		data, err := query(conn, "!i"+set)
+		if err == errNoEntries {
+			return &NotFoundError{AS: set}
+		} else if err != nil {
+			return errors.Wrapf(err, "failed to expand %s", set)
+		}
+
+		for _, member := range strings.Fields(data) {
+			if IsASSet(member) {
+				if maxDepth > 0 && depth >= maxDepth {
+					conn.logger().WithFields(logrus.Fields{"set": member, "depth": depth}).Debugln("as-set recursion depth exceeded")
+					continue
+				}
+				if err := walk(strings.ToUpper(member), depth+1); err != nil {
+					// nested sets referencing unknown objects are common, ignore them
+					if errors.Is(err, ErrASNotFound) {
+						conn.logger().WithFields(logrus.Fields{"set": member}).Debugln("nested as-set not found")
+						continue
+					}
+					return err
+				}
+				continue
+			}
+			as, err := NormalizeASN(member)
+			if err != nil {
+				conn.logger().WithFields(logrus.Fields{"set": set, "member": member}).Debugln("ignoring invalid as-set member")
+				continue
+			}
+			if !seen[as] {
+				seen[as] = true
+				members = append(members, as)
+			}
+		}
+		return nil
+	}
+
+	if err := walk(strings.ToUpper(set), 1); err != nil {
+		return nil, err
+	}
+	return members, nil
+}
+
+// expandAll replaces all as-sets in asn with their members and removes duplicates.
+func expandAll(ctx context.Context, expander Expander, maxDepth int, asn []string) ([]string, error) {
+	result := make([]string, 0, len(asn))
+	seen := map[string]bool{}
+	add := func(as string) {
+		if !seen[as] {
+			seen[as] = true
+			result = append(result, as)
+		}
+	}
+
+	for _, as := range asn {
+		if !IsASSet(as) {
+			add(as)
+			continue
+		}
+		members, err := expander.Expand(ctx, as, maxDepth)
+		if err != nil {
+			return nil, err
+		}
+		for _, member := range members {
+			add(member)
+		}
+	}
+	return result, nil
+}
+
+// setExpander is implemented by fetchers with their own default recursion depth.
+type setExpander interface {
+	expandSets(ctx context.Context, asn []string) ([]string, error)
+}
+
+func (f *fetcher) expandSets(ctx context.Context, asn []string) ([]string, error) {
+	return expandAll(ctx, f, maxDepthFromContext(ctx, f.maxDepth), asn)
+}
+
+func (f *cachedFetcher) expandSets(ctx context.Context, asn []string) ([]string, error) {
+	switch upstream := f.upstream.(type) {
+	case setExpander:
+		return upstream.expandSets(ctx, asn)
+	case Expander:
+		return expandAll(ctx, upstream, maxDepthFromContext(ctx, 0), asn)
+	}
+	return nil, errors.New("upstream does not support as-set expansion")
+}
+
+func (f *cachedFetcher) Expand(ctx context.Context, set string, maxDepth int) ([]string, error) {
+	expander, ok := f.upstream.(Expander)
+	if !ok {
+		return nil, errors.New("upstream does not support as-set expansion")
+	}
+	return expander.Expand(ctx, set, maxDepth)
+}
+
+func (f *cachedFetcher) Members(ctx context.Context, set string) ([]string, error) {
+	lister, ok := f.upstream.(SetLister)
+	if !ok {
+		return nil, errors.New("upstream does not support listing as-set members")
+	}
+	return lister.Members(ctx, set)
+}
+
+func hasASSet(asn []string) bool {
+	for _, as := range asn {
+		if IsASSet(as) {
+			return true
+		}
+	}
+	return false
+}
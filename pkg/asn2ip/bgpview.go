@@ -0,0 +1,196 @@
+package asn2ip
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const BGPViewURL = "https://api.bgpview.io"
+
+type BGPViewOptions struct {
+	// URL of the BGPView API, defaults to BGPViewURL.
+	URL string
+	// MaxConcurrency limits the number of parallel requests.
+	MaxConcurrency int
+	// Timeout of a single request, defaults to 30 seconds.
+	Timeout time.Duration
+	// MaxRetries is the number of retries after being rate limited or a server error.
+	MaxRetries int
+	// RetryDelay is the initial delay between retries, doubled on each retry.
+	// A Retry-After header sent by the API takes precedence.
+	RetryDelay time.Duration
+	// Logger receives the messages of the fetcher, defaults to the standard logger of logrus.
+	Logger logrus.FieldLogger
+}
+
+type bgpviewFetcher struct {
+	url            string
+	maxConcurrency int
+	maxRetries     int
+	retryDelay     time.Duration
+	client         *http.Client
+	log            logrus.FieldLogger
+}
+
+type bgpviewPrefix struct {
+	Prefix string `json:"prefix"`
+}
+
+type bgpviewResponse struct {
+	Status        string `json:"status"`
+	StatusMessage string `json:"status_message"`
+	Data          struct {
+		IPv4Prefixes []bgpviewPrefix `json:"ipv4_prefixes"`
+		IPv6Prefixes []bgpviewPrefix `json:"ipv6_prefixes"`
+		// Name and DescriptionShort are only set by the /asn/:asn endpoint.
+		Name             string `json:"name"`
+		DescriptionShort string `json:"description_short"`
+	} `json:"data"`
+}
+
+// NewBGPViewFetcher returns a Fetcher querying prefixes from the BGPView API over HTTPS.
+// As-sets are not supported.
+func NewBGPViewFetcher(opts BGPViewOptions) Fetcher {
+	if opts.URL == "" {
+		opts.URL = BGPViewURL
+	}
+	if opts.MaxConcurrency < 1 {
+		opts.MaxConcurrency = 1
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 30 * time.Second
+	}
+	if opts.RetryDelay <= 0 {
+		opts.RetryDelay = time.Second
+	}
+	return &bgpviewFetcher{
+		url:            strings.TrimSuffix(opts.URL, "/"),
+		maxConcurrency: opts.MaxConcurrency,
+		maxRetries:     opts.MaxRetries,
+		retryDelay:     opts.RetryDelay,
+		client:         &http.Client{Timeout: opts.Timeout},
+		log:            opts.Logger,
+	}
+}
+
+func (f *bgpviewFetcher) Fetch(ipv4, ipv6 bool, asn ...string) (Result, error) {
+	return f.FetchContext(context.Background(), ipv4, ipv6, asn...)
+}
+
+func (f *bgpviewFetcher) FetchContext(ctx context.Context, ipv4, ipv6 bool, asn ...string) (Result, error) {
+	if hasASSet(asn) {
+		return nil, errors.New("as-sets are not supported by the bgpview source")
+	}
+	return fetchParallel(ctx, f.maxConcurrency, asn, func(ctx context.Context, as string) (*ASResult, error) {
+		return f.fetchAS(ctx, as, ipv4, ipv6)
+	})
+}
+
+func (f *bgpviewFetcher) fetchAS(ctx context.Context, as string, ipv4, ipv6 bool) (*ASResult, error) {
+	data, err := f.get(ctx, fmt.Sprintf("%s/asn/%s/prefixes", f.url, as), as)
+	if err != nil {
+		return nil, err
+	}
+	prefixes := make([]string, 0, len(data.Data.IPv4Prefixes)+len(data.Data.IPv6Prefixes))
+	for _, p := range append(data.Data.IPv4Prefixes, data.Data.IPv6Prefixes...) {
+		prefixes = append(prefixes, p.Prefix)
+	}
+	return splitFamilies(as, SourceBGPView, prefixes, ipv4, ipv6)
+}
+
+// LookupAS returns the name and short description of as.
+func (f *bgpviewFetcher) LookupAS(ctx context.Context, as string) (ASInfo, error) {
+	as, err := NormalizeASN(as)
+	if err != nil {
+		return ASInfo{}, err
+	}
+	data, err := f.get(ctx, fmt.Sprintf("%s/asn/%s", f.url, as), as)
+	if err != nil {
+		return ASInfo{}, err
+	}
+	if data.Data.Name == "" {
+		return ASInfo{}, &NotFoundError{AS: as}
+	}
+	return ASInfo{AS: as, Name: data.Data.Name, Description: data.Data.DescriptionShort, Source: SourceBGPView}, nil
+}
+
+// get queries u, retrying after being rate limited or a server error.
+func (f *bgpviewFetcher) get(ctx context.Context, u, as string) (bgpviewResponse, error) {
+	delay := f.retryDelay
+	for attempt := 0; ; attempt++ {
+		data, retryAfter, err := f.request(ctx, u, as)
+		if err == nil {
+			return data, nil
+		}
+		if retryAfter < 0 || attempt >= f.maxRetries {
+			return data, err
+		}
+
+		if retryAfter == 0 {
+			retryAfter = delay
+			delay *= 2
+		}
+		logger(ctx, f.log).WithFields(logrus.Fields{"asn": as, "attempt": attempt + 1, "delay": retryAfter, "error": err}).Warnln("retrying bgpview request")
+		timer := time.NewTimer(retryAfter)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return data, contextError(ctx, err)
+		case <-timer.C:
+		}
+	}
+}
+
+// request queries u once. retryAfter is negative if the request must not be retried,
+// zero if it may be retried after the default delay or the delay requested by the API.
+func (f *bgpviewFetcher) request(ctx context.Context, u, as string) (data bgpviewResponse, retryAfter time.Duration, err error) {
+	logger(ctx, f.log).WithFields(logrus.Fields{"asn": as, "url": u}).Debugln("requesting bgpview")
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return data, -1, errors.Wrap(err, "failed to create bgpview request")
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := f.client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return data, -1, contextError(ctx, err)
+		}
+		return data, 0, errors.Wrapf(err, "failed to request as %s from bgpview", as)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		retryAfter = 0
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+			retryAfter = time.Duration(seconds) * time.Second
+		}
+		return data, retryAfter, errors.Errorf("bgpview returned %s for as %s", resp.Status, as)
+	case resp.StatusCode == http.StatusNotFound:
+		return data, -1, &NotFoundError{AS: as}
+	case resp.StatusCode != http.StatusOK:
+		return data, -1, errors.Errorf("bgpview returned %s for as %s", resp.Status, as)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return data, -1, errors.Wrapf(err, "failed to decode bgpview response for as %s", as)
+	}
+	if data.Status != "ok" {
+		return data, -1, errors.Errorf("bgpview returned status %s for as %s: %s", data.Status, as, data.StatusMessage)
+	}
+	return data, 0, nil
+}
+
+func (f *bgpviewFetcher) Close() error {
+	f.client.CloseIdleConnections()
+	return nil
+}
@@ -0,0 +1,74 @@
+package asn2ip
+
+import "net/netip"
+
+// bogons are networks that must never be announced on the public internet.
+var bogons = mustParsePrefixes(
+	// IPv4
+	"0.0.0.0/8",       // this network, RFC 1122
+	"10.0.0.0/8",      // private, RFC 1918
+	"100.64.0.0/10",   // carrier grade nat, RFC 6598
+	"127.0.0.0/8",     // loopback, RFC 1122
+	"169.254.0.0/16",  // link local, RFC 3927
+	"172.16.0.0/12",   // private, RFC 1918
+	"192.0.0.0/24",    // ietf protocol assignments, RFC 6890
+	"192.0.2.0/24",    // documentation, RFC 5737
+	"192.168.0.0/16",  // private, RFC 1918
+	"198.18.0.0/15",   // benchmarking, RFC 2544
+	"198.51.100.0/24", // documentation, RFC 5737
+	"203.0.113.0/24",  // documentation, RFC 5737
+	"224.0.0.0/4",     // multicast, RFC 5771
+	"240.0.0.0/4",     // reserved and broadcast, RFC 1112
+	// IPv6
+	"::/8",          // loopback, unspecified and ipv4 compatible, RFC 4291
+	"0100::/64",     // discard only, RFC 6666
+	"2001:2::/48",   // benchmarking, RFC 5180
+	"2001:10::/28",  // orchid, RFC 4843
+	"2001:db8::/32", // documentation, RFC 3849
+	"2002::/16",     // 6to4, RFC 7526
+	"3ffe::/16",     // old 6bone, RFC 3701
+	"fc00::/7",      // unique local, RFC 4193
+	"fe80::/10",     // link local, RFC 4291
+	"fec0::/10",     // site local, RFC 3879
+	"ff00::/8",      // multicast, RFC 4291
+)
+
+// globalUnicastIPv6 is the only IPv6 range currently allocated for global unicast.
+var globalUnicastIPv6 = netip.MustParsePrefix("2000::/3")
+
+func mustParsePrefixes(prefixes ...string) []netip.Prefix {
+	result := make([]netip.Prefix, len(prefixes))
+	for i, p := range prefixes {
+		result[i] = netip.MustParsePrefix(p)
+	}
+	return result
+}
+
+// IsBogon reports whether n overlaps any private, reserved, documentation or otherwise
+// unroutable network.
+func IsBogon(n netip.Prefix) bool {
+	if n.Addr().Is6() && !globalUnicastIPv6.Contains(n.Addr()) {
+		return true
+	}
+	if n.Addr().Is6() && n.Bits() < 3 {
+		// covers more than global unicast
+		return true
+	}
+	for _, bogon := range bogons {
+		if bogon.Overlaps(n) {
+			return true
+		}
+	}
+	return false
+}
+
+// FilterBogons returns nets without bogon networks.
+func FilterBogons(nets []netip.Prefix) []netip.Prefix {
+	result := make([]netip.Prefix, 0, len(nets))
+	for _, n := range nets {
+		if !IsBogon(n) {
+			result = append(result, n)
+		}
+	}
+	return result
+}
@@ -0,0 +1,58 @@
+package asn2ip
+
+import "net/netip"
+
+// Within returns the parts of nets inside any of ranges. Networks covering a range are narrowed
+// down to it, e.g. 10.0.0.0/8 within 10.1.0.0/16 becomes 10.1.0.0/16.
+func Within(nets, ranges []netip.Prefix) []netip.Prefix {
+	// disjoint ranges never yield the same addresses twice
+	ranges = Aggregate(ranges)
+	result := make([]netip.Prefix, 0, len(nets))
+	for _, n := range nets {
+		n = n.Masked()
+		for _, r := range ranges {
+			if !r.Overlaps(n) {
+				continue
+			}
+			if r.Bits() <= n.Bits() {
+				result = append(result, n)
+				break
+			}
+			result = append(result, r)
+		}
+	}
+	return result
+}
+
+// Exclude returns nets without the addresses of excluded. Networks covering an excluded one
+// are split into the networks around it, e.g. 10.0.0.0/8 excluding 10.0.0.0/9 becomes 10.128.0.0/9.
+func Exclude(nets, excluded []netip.Prefix) []netip.Prefix {
+	result := make([]netip.Prefix, 0, len(nets))
+	for _, n := range nets {
+		result = append(result, exclude(n.Masked(), excluded)...)
+	}
+	return result
+}
+
+func exclude(n netip.Prefix, excluded []netip.Prefix) []netip.Prefix {
+	for _, e := range excluded {
+		if !e.Overlaps(n) {
+			continue
+		}
+		if e.Bits() <= n.Bits() {
+			return nil
+		}
+		lower, upper := halves(n)
+		return append(exclude(lower, excluded), exclude(upper, excluded)...)
+	}
+	return []netip.Prefix{n}
+}
+
+// halves splits n into its two networks one bit longer, n must not be a single address.
+func halves(n netip.Prefix) (netip.Prefix, netip.Prefix) {
+	bits := n.Bits() + 1
+	b := n.Addr().AsSlice()
+	b[n.Bits()/8] |= 0x80 >> (n.Bits() % 8)
+	upper, _ := netip.AddrFromSlice(b)
+	return netip.PrefixFrom(n.Addr(), bits), netip.PrefixFrom(upper, bits)
+}
@@ -0,0 +1,168 @@
+package asn2ip
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	CymruHost = "whois.cymru.com"
+	CymruPort = 43
+)
+
+// BulkResolver resolves the originating AS numbers of many ip addresses at once.
+type BulkResolver interface {
+	Resolver
+	// LookupIPs returns the routes of each address, keyed by address as passed in.
+	// Addresses without any route are missing from the result.
+	LookupIPs(ctx context.Context, addresses []string) (map[string][]Route, error)
+}
+
+type CymruOptions struct {
+	// Host of the Team Cymru whois service, defaults to CymruHost.
+	Host string
+	// Port of the Team Cymru whois service, defaults to CymruPort.
+	Port int
+	// Timeout of a single bulk query, defaults to 30 seconds.
+	Timeout time.Duration
+	// Proxy connects through a SOCKS5 or HTTP CONNECT proxy if set, see ParseProxy.
+	Proxy *url.URL
+	// Dial connects to the service or proxy instead of net.Dialer if set.
+	Dial DialFunc
+	// Logger receives the messages of the resolver, defaults to the standard logger of logrus.
+	Logger logrus.FieldLogger
+}
+
+type cymruResolver struct {
+	host    string
+	port    int
+	timeout time.Duration
+	proxy   *url.URL
+	dial    DialFunc
+	log     logrus.FieldLogger
+}
+
+// NewCymruResolver returns a BulkResolver using the Team Cymru IP to ASN whois service.
+// Networks are resolved by their first address.
+func NewCymruResolver(opts CymruOptions) BulkResolver {
+	if opts.Host == "" {
+		opts.Host = CymruHost
+	}
+	if opts.Port == 0 {
+		opts.Port = CymruPort
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 30 * time.Second
+	}
+	if opts.Dial == nil {
+		opts.Dial = (&net.Dialer{}).DialContext
+	}
+	return &cymruResolver{host: opts.Host, port: opts.Port, timeout: opts.Timeout, proxy: opts.Proxy, dial: opts.Dial, log: opts.Logger}
+}
+
+func (r *cymruResolver) address() string { return net.JoinHostPort(r.host, strconv.Itoa(r.port)) }
+
+func (r *cymruResolver) LookupIP(ctx context.Context, address string) ([]Route, error) {
+	routes, err := r.LookupIPs(ctx, []string{address})
+	if err != nil {
+		return nil, err
+	}
+	if len(routes[address]) == 0 {
+		return nil, errors.Wrapf(ErrRouteNotFound, "%s", address)
+	}
+	return routes[address], nil
+}
+
+func (r *cymruResolver) LookupIPs(ctx context.Context, addresses []string) (map[string][]Route, error) {
+	// cymru only resolves addresses, remember which address answers which input
+	inputs := map[string][]string{}
+	for _, address := range addresses {
+		prefix, err := ParseAddress(address)
+		if err != nil {
+			return nil, err
+		}
+		ip := prefix.Addr().String()
+		inputs[ip] = append(inputs[ip], address)
+	}
+	result := map[string][]Route{}
+	if len(inputs) == 0 {
+		return result, nil
+	}
+
+	logger(ctx, r.log).WithFields(logrus.Fields{"host": r.host, "port": r.port, "addresses": len(inputs)}).Debugln("connecting to cymru whois")
+	dialCtx, cancel := context.WithTimeout(ctx, r.timeout)
+	var nc net.Conn
+	var err error
+	if r.proxy != nil {
+		nc, err = dialProxy(dialCtx, r.proxy, r.dial, r.address())
+	} else {
+		nc, err = r.dial(dialCtx, "tcp", r.address())
+	}
+	cancel()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to connect to %s", r.address())
+	}
+	defer nc.Close()
+	nc.SetDeadline(time.Now().Add(r.timeout))
+	c := &conn{Conn: nc, r: bufio.NewReader(nc), log: logger(ctx, r.log)}
+	stopWatching := watchContext(ctx, c)
+	defer stopWatching()
+
+	// bulk mode answers all addresses between begin and end over a single connection
+	query := strings.Builder{}
+	query.WriteString("begin\nverbose\n")
+	for ip := range inputs {
+		query.WriteString(ip + "\n")
+	}
+	query.WriteString("end\n")
+	if _, err := nc.Write([]byte(query.String())); err != nil {
+		return nil, contextError(ctx, errors.Wrap(err, "failed to send bulk query"))
+	}
+
+	scanner := bufio.NewScanner(c.r)
+	for scanner.Scan() {
+		route, ip, ok := parseCymruLine(scanner.Text())
+		if !ok {
+			continue
+		}
+		for _, address := range inputs[ip] {
+			result[address] = append(result[address], route)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, contextError(ctx, errors.Wrap(err, "failed to read bulk response"))
+	}
+	return result, nil
+}
+
+// parseCymruLine parses a verbose bulk response line like
+// "15169   | 8.8.8.8          | 8.8.8.0/24          | US | arin     | 2023-12-28 | GOOGLE, US".
+// Header lines and addresses without route are skipped.
+func parseCymruLine(line string) (Route, string, bool) {
+	fields := strings.Split(line, "|")
+	if len(fields) < 3 {
+		return Route{}, "", false
+	}
+	origin, err := NormalizeASN(strings.TrimSpace(fields[0]))
+	if err != nil {
+		// header or NA for unrouted addresses
+		return Route{}, "", false
+	}
+	ip, ipErr := netip.ParseAddr(strings.TrimSpace(fields[1]))
+	prefix, err := ParsePrefix(strings.TrimSpace(fields[2]))
+	if ipErr != nil || err != nil {
+		return Route{}, "", false
+	}
+	return Route{Prefix: prefix, Origin: origin, Source: "CYMRU"}, ip.Unmap().String(), true
+}
+
+func (r *cymruResolver) Close() error { return nil }
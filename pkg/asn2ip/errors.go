@@ -0,0 +1,100 @@
+package asn2ip
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrASNotFound = errors.New("as not found")
+	ErrTimeout    = errors.New("whois timeout")
+
+	// errNoEntries is returned by a whois query answered with "D", key not found.
+	errNoEntries = errors.New("no entries found")
+)
+
+// NotFoundError is returned if the whois server knows no networks for an AS.
+type NotFoundError struct {
+	AS string
+}
+
+func (e *NotFoundError) Error() string { return fmt.Sprintf("as %s not found", e.AS) }
+
+func (e *NotFoundError) Is(target error) bool { return target == ErrASNotFound }
+
+// TimeoutError is returned if a whois connection exceeded one of its TimeoutOptions.
+type TimeoutError struct {
+	// Op is the exceeded limit: connect, read, write or query.
+	Op    string
+	Limit time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("whois %s timed out after %s", e.Op, e.Limit)
+}
+
+func (e *TimeoutError) Is(target error) bool { return target == ErrTimeout }
+
+// FetchError is returned by fetches of several ASNs if some of them failed. The networks of
+// all other ASNs are fetched nevertheless and returned along with it.
+type FetchError struct {
+	// Errors holds the error of each failed AS.
+	Errors map[string]error
+}
+
+func (e *FetchError) Error() string {
+	asn := make([]string, 0, len(e.Errors))
+	for as := range e.Errors {
+		asn = append(asn, as)
+	}
+	sort.Slice(asn, func(i, j int) bool { return lessASN(asn[i], asn[j]) })
+	msgs := make([]string, len(asn))
+	for i, as := range asn {
+		msgs[i] = fmt.Sprintf("AS%s: %s", as, e.Errors[as])
+	}
+	return fmt.Sprintf("failed to fetch %d of the requested ASNs: %s", len(asn), strings.Join(msgs, "; "))
+}
+
+// lessASN orders AS numbers numerically.
+func lessASN(a, b string) bool {
+	x, _ := strconv.ParseUint(a, 10, 32)
+	y, _ := strconv.ParseUint(b, 10, 32)
+	return x < y
+}
+
+// isFatal reports whether err aborts a fetch of several ASNs instead of only failing the
+// AS it was returned for.
+func isFatal(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, ErrPoolClosed)
+}
+
+// withErrors returns result with an ASResult for each failed AS of errs, along with the
+// error of the fetch of asn. A single requested AS fails without result.
+func withErrors(result Result, asn []string, errs map[string]error) (Result, error) {
+	err := fetchErrors(asn, errs)
+	if err != nil && len(asn) == 1 {
+		return nil, err
+	}
+	for as, err := range errs {
+		result[as] = &ASResult{ASN: as, Error: err}
+	}
+	return result, err
+}
+
+// fetchErrors returns the error of a fetch of asn in which the ASNs of errs failed. A single
+// requested AS fails with its own error.
+func fetchErrors(asn []string, errs map[string]error) error {
+	switch {
+	case len(errs) == 0:
+		return nil
+	case len(asn) == 1:
+		return errs[asn[0]]
+	}
+	return &FetchError{Errors: errs}
+}
@@ -0,0 +1,45 @@
+package asn2ip
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type cacheExpiryKey struct{}
+
+// CacheExpiry records when the earliest cached entry used to answer the fetches of a context
+// expires, e.g. to tell http clients how long they may cache a response.
+type CacheExpiry struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+// ContextWithCacheExpiry returns a context recording the expiry of cached entries into the
+// returned CacheExpiry.
+func ContextWithCacheExpiry(ctx context.Context) (context.Context, *CacheExpiry) {
+	e := &CacheExpiry{}
+	return context.WithValue(ctx, cacheExpiryKey{}, e), e
+}
+
+// Time returns the earliest expiry of the cached entries used, zero if nothing was served from cache.
+func (e *CacheExpiry) Time() time.Time {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.t
+}
+
+func (e *CacheExpiry) observe(t time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.t.IsZero() || t.Before(e.t) {
+		e.t = t
+	}
+}
+
+// observeExpiry records t with the CacheExpiry of ctx, if any.
+func observeExpiry(ctx context.Context, t time.Time) {
+	if e, ok := ctx.Value(cacheExpiryKey{}).(*CacheExpiry); ok && !t.IsZero() {
+		e.observe(t)
+	}
+}
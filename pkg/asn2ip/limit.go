@@ -0,0 +1,129 @@
+package asn2ip
+
+import (
+	"context"
+	"math"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/time/rate"
+)
+
+// LimitOptions bound the load put on the whois server. A zero value disables the limit.
+type LimitOptions struct {
+	// MaxConns limits the whois connections in use at once. Idle pooled connections are kept
+	// in addition, see PoolOptions.MaxIdle.
+	MaxConns int
+	// QueriesPerSecond limits the rate of whois queries.
+	QueriesPerSecond float64
+	// Burst is the number of queries allowed at once, defaults to QueriesPerSecond rounded up.
+	Burst int
+}
+
+// LimiterStats is the current usage of a Limiter.
+type LimiterStats struct {
+	// Conns is the number of connections in use, Waiting the number of fetches waiting for one.
+	Conns   int64
+	Waiting int64
+	// Queries counts the queries issued, Throttled those delayed by the rate limit.
+	Queries   uint64
+	Throttled uint64
+}
+
+// Limiter bounds the connections and queries of all fetchers and resolvers sharing it, so a
+// burst of lookups can't get the client rate limited or banned by the whois server.
+type Limiter struct {
+	conns   chan struct{}
+	queries *rate.Limiter
+
+	inUse     int64
+	waiting   int64
+	issued    uint64
+	throttled uint64
+}
+
+// NewLimiter returns a Limiter enforcing opts, pass it to fetchers with WithLimiter.
+func NewLimiter(opts LimitOptions) *Limiter {
+	l := &Limiter{}
+	if opts.MaxConns > 0 {
+		l.conns = make(chan struct{}, opts.MaxConns)
+	}
+	if opts.QueriesPerSecond > 0 {
+		burst := opts.Burst
+		if burst < 1 {
+			burst = int(math.Ceil(opts.QueriesPerSecond))
+		}
+		l.queries = rate.NewLimiter(rate.Limit(opts.QueriesPerSecond), burst)
+	}
+	return l
+}
+
+// WithLimiter shares the connection and query limits of l with other fetchers and resolvers.
+func WithLimiter(l *Limiter) Option {
+	return func(f *fetcher) { f.limiter = l }
+}
+
+// Stats returns the current usage of l.
+func (l *Limiter) Stats() LimiterStats {
+	return LimiterStats{
+		Conns:     atomic.LoadInt64(&l.inUse),
+		Waiting:   atomic.LoadInt64(&l.waiting),
+		Queries:   atomic.LoadUint64(&l.issued),
+		Throttled: atomic.LoadUint64(&l.throttled),
+	}
+}
+
+// acquire waits until another connection may be used. Each acquire must be followed by a release.
+func (l *Limiter) acquire(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	if l.conns != nil {
+		atomic.AddInt64(&l.waiting, 1)
+		defer atomic.AddInt64(&l.waiting, -1)
+		select {
+		case l.conns <- struct{}{}:
+		case <-ctx.Done():
+			return errors.Wrap(ctx.Err(), "waiting for a whois connection")
+		}
+	}
+	atomic.AddInt64(&l.inUse, 1)
+	return nil
+}
+
+func (l *Limiter) release() {
+	if l == nil {
+		return
+	}
+	atomic.AddInt64(&l.inUse, -1)
+	if l.conns != nil {
+		<-l.conns
+	}
+}
+
+// wait waits until another query may be issued.
+func (l *Limiter) wait(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	atomic.AddUint64(&l.issued, 1)
+	if l.queries == nil {
+		return nil
+	}
+	r := l.queries.Reserve()
+	delay := r.Delay()
+	if delay <= 0 {
+		return nil
+	}
+	atomic.AddUint64(&l.throttled, 1)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		r.Cancel()
+		return errors.Wrap(ctx.Err(), "waiting for the whois rate limit")
+	}
+}
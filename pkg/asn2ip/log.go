@@ -0,0 +1,54 @@
+package asn2ip
+
+import (
+	"context"
+
+	"github.com/sirupsen/logrus"
+)
+
+type logFieldsKey struct{}
+
+// ContextWithLogFields adds fields to all messages logged on behalf of ctx, e.g. to trace
+// whois queries back to the http request causing them.
+func ContextWithLogFields(ctx context.Context, fields logrus.Fields) context.Context {
+	merged := logrus.Fields{}
+	if parent, ok := ctx.Value(logFieldsKey{}).(logrus.Fields); ok {
+		for k, v := range parent {
+			merged[k] = v
+		}
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return context.WithValue(ctx, logFieldsKey{}, merged)
+}
+
+// WithLogger writes the messages of the fetcher to log instead of the standard logger of
+// logrus, e.g. logrus.New() or an entry with fields identifying the embedding service.
+func WithLogger(log logrus.FieldLogger) Option {
+	return func(f *fetcher) { f.log = log }
+}
+
+// logging is implemented by fetchers writing to a logger passed by the caller, so fetchers
+// wrapping them like NewCache log to the same logger.
+type logging interface {
+	baseLogger() logrus.FieldLogger
+}
+
+func (f *fetcher) baseLogger() logrus.FieldLogger         { return f.log }
+func (f *ripestatFetcher) baseLogger() logrus.FieldLogger { return f.log }
+func (f *bgpviewFetcher) baseLogger() logrus.FieldLogger  { return f.log }
+
+// orStandard returns log, or the standard logger of logrus if log is nil.
+func orStandard(log logrus.FieldLogger) logrus.FieldLogger {
+	if log == nil {
+		return logrus.StandardLogger()
+	}
+	return log
+}
+
+// logger returns the log entry for messages logged to log on behalf of ctx.
+func logger(ctx context.Context, log logrus.FieldLogger) *logrus.Entry {
+	fields, _ := ctx.Value(logFieldsKey{}).(logrus.Fields)
+	return orStandard(log).WithFields(fields)
+}
@@ -0,0 +1,142 @@
+package asn2ip
+
+import (
+	"context"
+	"net/netip"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// SourcedPrefix is a network together with the IRR databases it was seen in.
+type SourcedPrefix struct {
+	Prefix  netip.Prefix
+	Sources []string
+}
+
+// Merger queries several IRR databases in parallel and merges their results.
+type Merger interface {
+	// FetchMerged fetches asn from each of sources and returns the deduplicated networks
+	// annotated with the sources they were seen in. ASNs unknown to all sources are reported
+	// by a *FetchError along with the others. Merged results are never cached.
+	FetchMerged(ctx context.Context, ipv4, ipv6 bool, sources []string, asn ...string) (map[string]map[string][]SourcedPrefix, error)
+}
+
+func (f *fetcher) FetchMerged(ctx context.Context, ipv4, ipv6 bool, sources []string, asn ...string) (map[string]map[string][]SourcedPrefix, error) {
+	if len(sources) == 0 {
+		return nil, errors.New("no irr sources to merge")
+	}
+	if hasASSet(asn) {
+		expanded, err := f.expandSets(ctx, asn)
+		if err != nil {
+			return nil, err
+		}
+		asn = expanded
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		firstErr error
+	)
+	results := make([]Result, len(sources))
+	for i, source := range sources {
+		wg.Add(1)
+		go func(i int, source string) {
+			defer wg.Done()
+			result, err := f.fetchSource(ContextWithSources(ctx, source), ipv4, ipv6, asn)
+			if err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = errors.Wrapf(err, "failed to fetch from %s", source)
+				}
+				mu.Unlock()
+				// stop querying the other sources
+				cancel()
+				return
+			}
+			results[i] = result
+		}(i, source)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	merged := map[string]map[string][]SourcedPrefix{}
+	errs := map[string]error{}
+	for _, as := range asn {
+		// remembers the position of each prefix in merged to append further sources
+		index := map[netip.Prefix]int{}
+		found := false
+		for i, result := range results {
+			res, ok := result[as]
+			if !ok {
+				continue
+			}
+			if !found {
+				merged[as] = map[string][]SourcedPrefix{"ipv4": {}, "ipv6": {}}
+				found = true
+			}
+			for family, prefixes := range map[string][]netip.Prefix{"ipv4": res.IPv4, "ipv6": res.IPv6} {
+				for _, prefix := range prefixes {
+					if pos, ok := index[prefix]; ok {
+						merged[as][family][pos].Sources = append(merged[as][family][pos].Sources, sources[i])
+						continue
+					}
+					index[prefix] = len(merged[as][family])
+					merged[as][family] = append(merged[as][family], SourcedPrefix{Prefix: prefix, Sources: []string{sources[i]}})
+				}
+			}
+		}
+		if !found && (ipv4 || ipv6) {
+			errs[as] = &NotFoundError{AS: as}
+		}
+	}
+	if err := fetchErrors(asn, errs); err != nil {
+		if len(asn) == 1 {
+			return nil, err
+		}
+		return merged, err
+	}
+	return merged, nil
+}
+
+// fetchSource fetches all of asn over a single connection, ASNs unknown to the source are skipped.
+func (f *fetcher) fetchSource(ctx context.Context, ipv4, ipv6 bool, asn []string) (Result, error) {
+	var result Result
+	err := f.withConn(ctx, func(conn *conn) error {
+		result = Result{}
+		for _, as := range asn {
+			res, err := f.fetchAS(conn, as, ipv4, ipv6)
+			if errors.Is(err, ErrASNotFound) {
+				conn.logger().WithFields(logrus.Fields{"asn": as, "sources": conn.sources}).Debugln("asn not found in source")
+				continue
+			} else if err != nil {
+				return err
+			}
+			result[as] = res
+		}
+		return nil
+	})
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+	return result, nil
+}
+
+func (f *cachedFetcher) FetchMerged(ctx context.Context, ipv4, ipv6 bool, sources []string, asn ...string) (map[string]map[string][]SourcedPrefix, error) {
+	merger, ok := f.upstream.(Merger)
+	if !ok {
+		return nil, errors.New("upstream does not support merging irr sources")
+	}
+	return merger.FetchMerged(ctx, ipv4, ipv6, sources, asn...)
+}
@@ -0,0 +1,157 @@
+package asn2ip
+
+import (
+	"bufio"
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ASInfo is the name and holder of an AS.
+type ASInfo struct {
+	AS          string
+	Name        string
+	Description string
+	Source      string
+}
+
+// NameResolver resolves the names of AS numbers.
+type NameResolver interface {
+	// LookupAS returns the name of as, a *NotFoundError if the AS is unknown.
+	LookupAS(ctx context.Context, as string) (ASInfo, error)
+	Close() error
+}
+
+// NewNameResolver returns a NameResolver querying aut-num objects from an IRRd whois server.
+func NewNameResolver(host string, port int, opts ...Option) NameResolver {
+	return newFetcher(host, port, opts...)
+}
+
+// LookupNames resolves the names of all AS numbers in asn. Unknown AS numbers are missing
+// from the result.
+func LookupNames(ctx context.Context, resolver NameResolver, asn []string) (map[string]ASInfo, error) {
+	result := map[string]ASInfo{}
+	for _, as := range asn {
+		if _, ok := result[as]; ok {
+			continue
+		}
+		info, err := resolver.LookupAS(ctx, as)
+		if errors.Is(err, ErrASNotFound) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		result[as] = info
+	}
+	return result, nil
+}
+
+func (f *fetcher) LookupAS(ctx context.Context, as string) (ASInfo, error) {
+	as, err := NormalizeASN(as)
+	if err != nil {
+		return ASInfo{}, err
+	}
+
+	var data string
+	err = f.withConn(ctx, func(conn *conn) (err error) {
+		data, err = query(conn, "!maut-num,AS"+as)
+		return err
+	})
+	if err == errNoEntries {
+		return ASInfo{}, &NotFoundError{AS: as}
+	} else if err != nil {
+		return ASInfo{}, contextError(ctx, err)
+	}
+
+	info := parseAutNum(data)
+	if info.Name == "" {
+		return ASInfo{}, &NotFoundError{AS: as}
+	}
+	info.AS = as
+	return info, nil
+}
+
+// parseAutNum parses the name, first description and source of an RPSL aut-num object.
+func parseAutNum(data string) ASInfo {
+	info := ASInfo{}
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || line[0] == ' ' || line[0] == '\t' || line[0] == '+' {
+			continue
+		}
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		value := strings.TrimSpace(kv[1])
+		switch strings.ToLower(strings.TrimSpace(kv[0])) {
+		case "as-name":
+			info.Name = value
+		case "descr":
+			if info.Description == "" {
+				info.Description = value
+			}
+		case "source":
+			info.Source = value
+		}
+	}
+	return info
+}
+
+// splitHolder splits holders like "GOOGLE - Google LLC" as returned by RIPEstat into
+// name and description.
+func splitHolder(holder string) (string, string) {
+	parts := strings.SplitN(holder, " - ", 2)
+	if len(parts) == 1 {
+		return strings.TrimSpace(holder), ""
+	}
+	return strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+}
+
+type nameCacheEntry struct {
+	info    ASInfo
+	err     error
+	expires time.Time
+}
+
+type nameCache struct {
+	NameResolver
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]nameCacheEntry
+}
+
+// NewNameCache returns a NameResolver remembering names and unknown AS numbers resolved by
+// resolver for ttl. Names rarely change, so they are kept in memory only.
+func NewNameCache(resolver NameResolver, ttl time.Duration) NameResolver {
+	return &nameCache{NameResolver: resolver, ttl: ttl, entries: map[string]nameCacheEntry{}}
+}
+
+func (c *nameCache) LookupAS(ctx context.Context, as string) (ASInfo, error) {
+	now := time.Now()
+	c.mu.Lock()
+	entry, ok := c.entries[as]
+	c.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.info, entry.err
+	}
+
+	info, err := c.NameResolver.LookupAS(ctx, as)
+	if err != nil && !errors.Is(err, ErrASNotFound) {
+		return info, err
+	}
+	c.mu.Lock()
+	for key, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, key)
+		}
+	}
+	c.entries[as] = nameCacheEntry{info: info, err: err, expires: now.Add(c.ttl)}
+	c.mu.Unlock()
+	return info, err
+}
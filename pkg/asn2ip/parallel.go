@@ -0,0 +1,90 @@
+package asn2ip
+
+import (
+	"context"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// fetchParallel calls fetch for each of asn with up to maxConcurrency calls in parallel.
+// Failed ASNs are reported by a *FetchError along with the result of all others, only
+// cancellation aborts all other calls.
+func fetchParallel(ctx context.Context, maxConcurrency int, asn []string, fetch func(context.Context, string) (*ASResult, error)) (Result, error) {
+	result := Result{}
+	errs := map[string]error{}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		firstErr error
+	)
+	sem := make(chan struct{}, maxConcurrency)
+feed:
+	for _, as := range asn {
+		select {
+		case <-ctx.Done():
+			break feed
+		case sem <- struct{}{}:
+		}
+		wg.Add(1)
+		go func(as string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			res, err := fetch(ctx, as)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil && (ctx.Err() != nil || isFatal(err)) {
+				if firstErr == nil {
+					firstErr = err
+				}
+				cancel()
+				return
+			} else if err != nil {
+				errs[as] = err
+				return
+			}
+			result[as] = res
+		}(as)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, contextError(ctx, err)
+	}
+	return withErrors(result, asn, errs)
+}
+
+// splitFamilies parses prefixes of as fetched from source into the requested ip versions. If
+// none of the requested versions has networks a NotFoundError is returned.
+func splitFamilies(as, source string, prefixes []string, ipv4, ipv6 bool) (*ASResult, error) {
+	res := &ASResult{ASN: as, IPv4: []netip.Prefix{}, IPv6: []netip.Prefix{}, Source: source, FetchedAt: time.Now()}
+	found := false
+	for _, p := range prefixes {
+		n, err := ParsePrefix(p)
+		if err != nil {
+			return nil, errors.Errorf("failed to parse network %s for as %s", p, as)
+		}
+		if n.Addr().Is4() {
+			if ipv4 {
+				res.IPv4 = append(res.IPv4, n)
+				found = true
+			}
+		} else if ipv6 {
+			res.IPv6 = append(res.IPv6, n)
+			found = true
+		}
+	}
+	if !found && (ipv4 || ipv6) {
+		return nil, &NotFoundError{AS: as}
+	}
+	return res, nil
+}
@@ -0,0 +1,293 @@
+package asn2ip
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+var ErrPoolClosed = errors.New("connection pool closed")
+
+type PoolOptions struct {
+	// MinIdle is the number of idle connections kept open even if they exceed IdleTimeout.
+	MinIdle int
+	// MaxIdle is the maximum number of idle connections kept for reuse.
+	// With MaxIdle set to 0 every connection is closed after use.
+	MaxIdle int
+	// IdleTimeout closes idle connections not used within this duration.
+	IdleTimeout time.Duration
+	// KeepAlive validates idle connections not used within this duration with a no-op query,
+	// closing those the server dropped before a request picks them. 0 disables it.
+	KeepAlive time.Duration
+}
+
+// keepAliveCmd is answered by IRRd without querying any database.
+const keepAliveCmd = "!v"
+
+// conn is a whois connection in multicommand mode.
+type conn struct {
+	net.Conn
+	r        *bufio.Reader
+	lastUsed time.Time
+	// pinged is when the connection last answered a keepalive query while idle
+	pinged time.Time
+	// sources are the IRR databases selected on this connection, empty for server defaults
+	sources string
+	// ctx is the context the connection is currently used for, log carries its fields
+	ctx context.Context
+	log *logrus.Entry
+	// limiter delays queries exceeding the rate limit, nil if unlimited
+	limiter *Limiter
+
+	timeouts TimeoutOptions
+	// mu guards the deadline of the current command and aborted
+	mu       sync.Mutex
+	deadline time.Time
+	aborted  bool
+}
+
+func (c *conn) context() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
+
+func (c *conn) logger() *logrus.Entry {
+	if c.log == nil {
+		return logrus.NewEntry(logrus.StandardLogger())
+	}
+	return c.log
+}
+
+type connDialFunc func(ctx context.Context) (*conn, error)
+
+type pool struct {
+	dial connDialFunc
+	opts PoolOptions
+	log  logrus.FieldLogger
+
+	mu     sync.Mutex
+	idle   []*conn
+	closed bool
+	stop   chan struct{}
+	wg     sync.WaitGroup
+}
+
+func newPool(dial connDialFunc, opts PoolOptions, log logrus.FieldLogger) *pool {
+	if opts.MinIdle > opts.MaxIdle {
+		opts.MinIdle = opts.MaxIdle
+	}
+	p := &pool{
+		dial: dial,
+		opts: opts,
+		log:  log,
+		stop: make(chan struct{}),
+	}
+	if opts.MaxIdle > 0 && (opts.MinIdle > 0 || opts.IdleTimeout > 0 || opts.KeepAlive > 0) {
+		p.wg.Add(1)
+		go p.maintain()
+	}
+	return p
+}
+
+func (p *pool) get(ctx context.Context) (*conn, error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, ErrPoolClosed
+	}
+	for len(p.idle) > 0 {
+		c := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		if p.expired(c) {
+			p.closeConn(c)
+			continue
+		}
+		p.mu.Unlock()
+		c.ctx, c.log = ctx, logger(ctx, p.log)
+		c.logger().WithFields(logrus.Fields{"remote": c.RemoteAddr()}).Debugln("reusing pooled whois connection")
+		return c, nil
+	}
+	p.mu.Unlock()
+	return p.dial(ctx)
+}
+
+func (p *pool) put(c *conn) {
+	c.lastUsed = time.Now()
+	c.ctx, c.log = nil, logger(context.Background(), p.log)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed || len(p.idle) >= p.opts.MaxIdle {
+		p.closeConn(c)
+		return
+	}
+	p.idle = append(p.idle, c)
+}
+
+// discard closes a connection which is in an unknown state, e.g. after a failed query.
+func (p *pool) discard(c *conn) {
+	c.logger().WithFields(logrus.Fields{"remote": c.RemoteAddr()}).Debugln("discarding whois connection")
+	c.Close()
+}
+
+func (p *pool) expired(c *conn) bool {
+	return p.opts.IdleTimeout > 0 && time.Since(c.lastUsed) > p.opts.IdleTimeout
+}
+
+func (p *pool) closeConn(c *conn) {
+	c.logger().WithFields(logrus.Fields{"remote": c.RemoteAddr()}).Debugln("closing socket to whois host")
+	// gracefully close socket
+	c.SetWriteDeadline(time.Now().Add(time.Second))
+	c.Write([]byte("exit\n"))
+	c.Close()
+}
+
+func (p *pool) maintain() {
+	defer p.wg.Done()
+
+	interval := p.opts.IdleTimeout / 2
+	if keepAlive := p.opts.KeepAlive / 2; keepAlive > 0 && (interval <= 0 || keepAlive < interval) {
+		interval = keepAlive
+	}
+	if interval <= 0 || interval > 30*time.Second {
+		interval = 30 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	// aborts keepalive queries once the pool is closed
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-p.stop
+		cancel()
+	}()
+
+	for {
+		p.prune()
+		p.ping(ctx)
+		p.fill()
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// prune closes expired idle connections while keeping at least MinIdle of them.
+func (p *pool) prune() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	kept := p.idle[:0]
+	for i, c := range p.idle {
+		// idle is ordered from least to most recently used
+		if len(p.idle)-i > p.opts.MinIdle && p.expired(c) {
+			p.closeConn(c)
+			continue
+		}
+		kept = append(kept, c)
+	}
+	p.idle = kept
+}
+
+// ping sends a keepalive query on idle connections neither used nor pinged within KeepAlive,
+// closing those failing to answer. They are taken from the pool meanwhile.
+func (p *pool) ping(ctx context.Context) {
+	if p.opts.KeepAlive <= 0 {
+		return
+	}
+	p.mu.Lock()
+	due := []*conn{}
+	kept := p.idle[:0]
+	for _, c := range p.idle {
+		if time.Since(c.lastUsed) > p.opts.KeepAlive && time.Since(c.pinged) > p.opts.KeepAlive {
+			due = append(due, c)
+			continue
+		}
+		kept = append(kept, c)
+	}
+	p.idle = kept
+	p.mu.Unlock()
+
+	for _, c := range due {
+		c.ctx = ctx
+		stopWatching := watchContext(ctx, c)
+		_, err := query(c, keepAliveCmd)
+		if stopWatching() || err != nil {
+			c.logger().WithFields(logrus.Fields{"remote": c.RemoteAddr(), "error": err}).Debugln("idle whois connection failed keepalive")
+			p.discard(c)
+			continue
+		}
+		c.ctx = nil
+		c.pinged = time.Now()
+
+		p.mu.Lock()
+		if p.closed || len(p.idle) >= p.opts.MaxIdle {
+			p.mu.Unlock()
+			p.closeConn(c)
+			continue
+		}
+		// keep idle ordered from least to most recently used
+		i := 0
+		for i < len(p.idle) && !p.idle[i].lastUsed.After(c.lastUsed) {
+			i++
+		}
+		p.idle = append(p.idle[:i], append([]*conn{c}, p.idle[i:]...)...)
+		p.mu.Unlock()
+	}
+}
+
+// fill dials new connections until MinIdle connections are idle.
+func (p *pool) fill() {
+	for {
+		p.mu.Lock()
+		missing := !p.closed && len(p.idle) < p.opts.MinIdle
+		p.mu.Unlock()
+		if !missing {
+			return
+		}
+
+		c, err := p.dial(context.Background())
+		if err != nil {
+			orStandard(p.log).WithFields(logrus.Fields{"error": err}).Warnln("failed to open idle whois connection")
+			return
+		}
+		c.lastUsed = time.Now()
+
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			p.closeConn(c)
+			return
+		}
+		// prepend so freshly dialed connections are pruned last
+		p.idle = append([]*conn{c}, p.idle...)
+		p.mu.Unlock()
+	}
+}
+
+func (p *pool) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	idle := p.idle
+	p.idle = nil
+	p.mu.Unlock()
+
+	close(p.stop)
+	p.wg.Wait()
+	for _, c := range idle {
+		p.closeConn(c)
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+package asn2ip
+
+import (
+	"net/netip"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// ParsePrefix parses a network in CIDR notation like net.ParseCIDR, host bits are cleared.
+func ParsePrefix(s string) (netip.Prefix, error) {
+	prefix, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, errors.Errorf("invalid network %q", s)
+	}
+	return prefix.Masked(), nil
+}
+
+// SortPrefixes sorts prefixes by address, IPv4 before IPv6, and less specific networks
+// before more specific ones with the same address.
+func SortPrefixes(prefixes []netip.Prefix) {
+	sort.Slice(prefixes, func(i, j int) bool {
+		if c := prefixes[i].Addr().Compare(prefixes[j].Addr()); c != 0 {
+			return c < 0
+		}
+		return prefixes[i].Bits() < prefixes[j].Bits()
+	})
+}
@@ -0,0 +1,253 @@
+package asn2ip
+
+import (
+	"context"
+	"math/rand"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/g0dsCookie/asn2ip/pkg/storage"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+type RefresherOptions struct {
+	// ASNs are the AS numbers kept warm in cache.
+	ASNs []string
+	// Interval between two refresh cycles.
+	Interval time.Duration
+	// Jitter is the maximum random delay added to each cycle.
+	Jitter time.Duration
+	// Concurrency limits the number of ASNs refreshed in parallel.
+	Concurrency int
+	// Logger receives the messages of the refresher, defaults to the standard logger of logrus.
+	Logger logrus.FieldLogger
+}
+
+// Change describes how the networks of an AS changed between two refreshes.
+type Change struct {
+	AS      string
+	Added   []netip.Prefix
+	Removed []netip.Prefix
+}
+
+// RefreshStatus is the outcome of the last successful refresh of an AS.
+type RefreshStatus struct {
+	// IPv4 and IPv6 are the number of networks fetched.
+	IPv4, IPv6  int
+	RefreshedAt time.Time
+}
+
+// Refresher periodically fetches a fixed set of ASNs from upstream and stores them in cache.
+type Refresher struct {
+	upstream Fetcher
+	cache    storage.Storage
+	opts     RefresherOptions
+
+	mu       sync.Mutex
+	onChange []func(Change)
+	status   map[string]RefreshStatus
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func NewRefresher(upstream Fetcher, cache storage.Storage, opts RefresherOptions) *Refresher {
+	if opts.Concurrency < 1 {
+		opts.Concurrency = 1
+	}
+	opts.Logger = orStandard(opts.Logger)
+	asns := make([]string, 0, len(opts.ASNs))
+	for _, as := range opts.ASNs {
+		normalized, err := NormalizeASN(as)
+		if err != nil {
+			opts.Logger.WithFields(logrus.Fields{"error": err}).Warnln("ignoring invalid asn to refresh")
+			continue
+		}
+		asns = append(asns, normalized)
+	}
+	opts.ASNs = asns
+	return &Refresher{
+		upstream: upstream,
+		cache:    cache,
+		opts:     opts,
+		status:   map[string]RefreshStatus{},
+		stop:     make(chan struct{}),
+	}
+}
+
+// OnChange registers fn to be called whenever the networks of a refreshed AS changed.
+func (r *Refresher) OnChange(fn func(Change)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.onChange = append(r.onChange, fn)
+}
+
+// Status returns the outcome of the last successful refresh of each AS, ASNs which never
+// refreshed successfully are missing.
+func (r *Refresher) Status() map[string]RefreshStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	status := make(map[string]RefreshStatus, len(r.status))
+	for as, s := range r.status {
+		status[as] = s
+	}
+	return status
+}
+
+// ASNs returns the normalized AS numbers refreshed periodically.
+func (r *Refresher) ASNs() []string {
+	return append([]string(nil), r.opts.ASNs...)
+}
+
+// Tracks reports whether as is refreshed periodically.
+func (r *Refresher) Tracks(as string) bool {
+	for _, tracked := range r.opts.ASNs {
+		if tracked == as {
+			return true
+		}
+	}
+	return false
+}
+
+// Start refreshes all ASNs immediately and then once every interval until Stop is called.
+func (r *Refresher) Start() {
+	r.wg.Add(1)
+	go r.run()
+}
+
+func (r *Refresher) Stop() {
+	close(r.stop)
+	r.wg.Wait()
+}
+
+func (r *Refresher) run() {
+	defer r.wg.Done()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-r.stop
+		cancel()
+	}()
+
+	for {
+		r.Refresh(ctx)
+
+		delay := r.opts.Interval
+		if r.opts.Jitter > 0 {
+			delay += time.Duration(rand.Int63n(int64(r.opts.Jitter)))
+		}
+		r.opts.Logger.WithFields(logrus.Fields{"delay": delay}).Debugln("scheduled next refresh cycle")
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-r.stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// Refresh runs a single refresh cycle over all ASNs. ASNs failing to refresh are logged and
+// returned as *FetchError, the cache of all others is refreshed nevertheless.
+func (r *Refresher) Refresh(ctx context.Context) error {
+	start := time.Now()
+	r.opts.Logger.WithFields(logrus.Fields{"asns": len(r.opts.ASNs)}).Infoln("refreshing tracked asns")
+
+	sem := make(chan struct{}, r.opts.Concurrency)
+	wg := sync.WaitGroup{}
+	mu := sync.Mutex{}
+	errs := map[string]error{}
+	for _, as := range r.opts.ASNs {
+		select {
+		case <-ctx.Done():
+		case sem <- struct{}{}:
+			wg.Add(1)
+			go func(as string) {
+				defer wg.Done()
+				defer func() { <-sem }()
+				if err := r.refresh(ctx, as); err != nil {
+					r.opts.Logger.WithFields(logrus.Fields{"asn": as, "error": err}).Errorln("failed to refresh asn")
+					mu.Lock()
+					errs[as] = err
+					mu.Unlock()
+				}
+			}(as)
+		}
+	}
+	wg.Wait()
+
+	r.opts.Logger.WithFields(logrus.Fields{"asns": len(r.opts.ASNs), "failed": len(errs), "duration": time.Since(start)}).Infoln("refreshed tracked asns")
+	if err := ctx.Err(); err != nil {
+		return errors.Wrap(err, "refresh aborted")
+	}
+	if len(errs) > 0 {
+		return &FetchError{Errors: errs}
+	}
+	return nil
+}
+
+func (r *Refresher) refresh(ctx context.Context, as string) error {
+	previous, err := r.cache.Get(as)
+	if err != nil && err != storage.ErrASNotCached {
+		return errors.Wrap(err, "failed to read previous networks from cache")
+	}
+
+	result, err := r.upstream.FetchContext(ctx, true, true, as)
+	if errors.Is(err, ErrASNotFound) {
+		if err := storeNotFound(r.cache, as, true, true); err != nil {
+			return err
+		}
+		result = Result{as: {ASN: as}}
+	} else if err != nil {
+		return err
+	} else if err := store(r.cache, result[as], true, true); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.status[as] = RefreshStatus{IPv4: len(result[as].IPv4), IPv6: len(result[as].IPv6), RefreshedAt: time.Now()}
+	r.mu.Unlock()
+
+	if previous.AS == "" {
+		// nothing to compare against
+		return nil
+	}
+	change := Diff(as, previous.IPAddresses(), result[as].Networks())
+	if len(change.Added) == 0 && len(change.Removed) == 0 {
+		return nil
+	}
+
+	r.opts.Logger.WithFields(logrus.Fields{"asn": as, "added": len(change.Added), "removed": len(change.Removed)}).Infoln("networks of asn changed")
+	r.mu.Lock()
+	hooks := append([]func(Change){}, r.onChange...)
+	r.mu.Unlock()
+	for _, fn := range hooks {
+		fn(change)
+	}
+	return nil
+}
+
+// Diff returns the networks of as added and removed between previous and current.
+func Diff(as string, previous, current []netip.Prefix) Change {
+	change := Change{AS: as, Added: []netip.Prefix{}, Removed: []netip.Prefix{}}
+	seen := map[netip.Prefix]bool{}
+	for _, n := range previous {
+		seen[n] = true
+	}
+	now := map[netip.Prefix]bool{}
+	for _, n := range current {
+		now[n] = true
+		if !seen[n] {
+			change.Added = append(change.Added, n)
+		}
+	}
+	for _, n := range previous {
+		if !now[n] {
+			change.Removed = append(change.Removed, n)
+		}
+	}
+	return change
+}
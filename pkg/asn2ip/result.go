@@ -0,0 +1,92 @@
+package asn2ip
+
+import (
+	"net/netip"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Sources of results not fetched from a whois server.
+const (
+	SourceCache    = "CACHE"
+	SourceRIPEstat = "RIPESTAT"
+	SourceBGPView  = "BGPVIEW"
+)
+
+// ASResult holds the networks of a single AS.
+type ASResult struct {
+	ASN string
+	// Name is the name of the AS, only set after resolving it with SetNames.
+	Name string
+	IPv4 []netip.Prefix
+	IPv6 []netip.Prefix
+	// Source is where the networks were fetched from: the whois host, RIPESTAT, BGPVIEW,
+	// or CACHE if they were served from the cache.
+	Source    string
+	FetchedAt time.Time
+	// Error is set if the AS failed to fetch while others were fetched, see FetchError.
+	Error error
+}
+
+// Networks returns the networks of both ip versions.
+func (r *ASResult) Networks() []netip.Prefix {
+	return append(append([]netip.Prefix{}, r.IPv4...), r.IPv6...)
+}
+
+// Result holds the ASResult of each AS of a fetch, keyed by AS number.
+type Result map[string]*ASResult
+
+// ASNs returns the successfully fetched AS numbers in numerical order.
+func (r Result) ASNs() []string {
+	asn := make([]string, 0, len(r))
+	for as, res := range r {
+		if res.Error == nil {
+			asn = append(asn, as)
+		}
+	}
+	sort.Slice(asn, func(i, j int) bool { return lessASN(asn[i], asn[j]) })
+	return asn
+}
+
+// Errors returns the error of each AS which failed to fetch.
+func (r Result) Errors() map[string]error {
+	errs := map[string]error{}
+	for as, res := range r {
+		if res.Error != nil {
+			errs[as] = res.Error
+		}
+	}
+	return errs
+}
+
+// Networks returns the networks of all fetched ASNs keyed by AS number and ip version
+// ("ipv4" and "ipv6"), e.g. to render them with package format.
+func (r Result) Networks() map[string]map[string][]netip.Prefix {
+	ips := map[string]map[string][]netip.Prefix{}
+	for as, res := range r {
+		if res.Error == nil {
+			ips[as] = map[string][]netip.Prefix{"ipv4": res.IPv4, "ipv6": res.IPv6}
+		}
+	}
+	return ips
+}
+
+// SetNames sets the name of each AS found in names, as returned by LookupNames.
+func (r Result) SetNames(names map[string]ASInfo) {
+	for as, res := range r {
+		if info, ok := names[as]; ok {
+			res.Name = info.Name
+		}
+	}
+}
+
+// addErrors adds an ASResult for each AS failed by err, if it is a *FetchError.
+func (r Result) addErrors(err error) {
+	if partial := (*FetchError)(nil); errors.As(err, &partial) {
+		for as, err := range partial.Errors {
+			r[as] = &ASResult{ASN: as, Error: err}
+		}
+	}
+}
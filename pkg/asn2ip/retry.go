@@ -0,0 +1,107 @@
+package asn2ip
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// RetryOptions configure retries of whois queries failing with transient errors like
+// timeouts or reset connections. Each retry uses a new connection.
+type RetryOptions struct {
+	// MaxRetries is the number of retries after the first attempt, 0 disables retries.
+	MaxRetries int
+	// Delay is the initial delay between retries, doubled on each retry. Defaults to a second.
+	Delay time.Duration
+	// Jitter randomly shortens each delay by up to this fraction, between 0 and 1, so
+	// concurrent retries are spread out.
+	Jitter float64
+	// OnRetry is called before each retry, e.g. to count retries.
+	OnRetry func(attempt int, err error)
+}
+
+// WithRetry retries whois queries failing with transient errors.
+func WithRetry(opts RetryOptions) Option {
+	return func(f *fetcher) { f.retries = opts }
+}
+
+// delay returns the backoff before retry number attempt, starting with 1.
+func (o RetryOptions) delay(attempt int) time.Duration {
+	d := o.Delay
+	if d <= 0 {
+		d = time.Second
+	}
+	for i := 1; i < attempt; i++ {
+		d *= 2
+	}
+	if o.Jitter > 0 {
+		jitter := o.Jitter
+		if jitter > 1 {
+			jitter = 1
+		}
+		d -= time.Duration(float64(d) * jitter * rand.Float64())
+	}
+	return d
+}
+
+// isTransient reports whether err is caused by the connection rather than the query, so
+// retrying it over a new connection may succeed.
+func isTransient(err error) bool {
+	switch {
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded), errors.Is(err, ErrPoolClosed):
+		return false
+	case errors.Is(err, ErrTimeout), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.ECONNREFUSED), errors.Is(err, syscall.EPIPE):
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// retry calls fn until it succeeds, fails with a permanent error or all retries are used up.
+func (f *fetcher) retry(ctx context.Context, fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt > f.retries.MaxRetries || ctx.Err() != nil || !isTransient(err) {
+			return err
+		}
+
+		delay := f.retries.delay(attempt)
+		logger(ctx, f.log).WithFields(logrus.Fields{"host": f.host, "attempt": attempt, "delay": delay, "error": err}).Warnln("retrying whois query")
+		if f.retries.OnRetry != nil {
+			f.retries.OnRetry(attempt, err)
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+// withConn runs fn on a pooled connection, retrying transient failures on a new connection.
+// Connections are only reused if fn succeeded or the queried key does not exist.
+func (f *fetcher) withConn(ctx context.Context, fn func(*conn) error) error {
+	return f.retry(ctx, func() error {
+		conn, err := f.getConn(ctx)
+		if err != nil {
+			return err
+		}
+		stopWatching := watchContext(ctx, conn)
+		err = fn(conn)
+		if stopWatching() || (err != nil && err != errNoEntries && !errors.Is(err, ErrASNotFound)) {
+			f.discard(conn)
+		} else {
+			f.putConn(conn)
+		}
+		return err
+	})
+}
@@ -0,0 +1,160 @@
+package asn2ip
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const RIPEstatURL = "https://stat.ripe.net"
+
+type RIPEstatOptions struct {
+	// URL of the RIPEstat data API, defaults to RIPEstatURL.
+	URL string
+	// MaxConcurrency limits the number of parallel requests.
+	MaxConcurrency int
+	// Timeout of a single request, defaults to 30 seconds.
+	Timeout time.Duration
+	// Logger receives the messages of the fetcher, defaults to the standard logger of logrus.
+	Logger logrus.FieldLogger
+}
+
+type ripestatFetcher struct {
+	url            string
+	maxConcurrency int
+	client         *http.Client
+	log            logrus.FieldLogger
+}
+
+type ripestatResponse struct {
+	Status  string `json:"status"`
+	Message string `json:"message"`
+	Data    struct {
+		Prefixes []struct {
+			Prefix string `json:"prefix"`
+		} `json:"prefixes"`
+	} `json:"data"`
+}
+
+// NewRIPEstatFetcher returns a Fetcher querying announced prefixes from the RIPEstat REST API
+// over HTTPS, for environments where whois is not reachable. As-sets are not supported.
+func NewRIPEstatFetcher(opts RIPEstatOptions) Fetcher {
+	if opts.URL == "" {
+		opts.URL = RIPEstatURL
+	}
+	if opts.MaxConcurrency < 1 {
+		opts.MaxConcurrency = 1
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 30 * time.Second
+	}
+	return &ripestatFetcher{
+		url:            strings.TrimSuffix(opts.URL, "/"),
+		maxConcurrency: opts.MaxConcurrency,
+		client:         &http.Client{Timeout: opts.Timeout},
+		log:            opts.Logger,
+	}
+}
+
+func (f *ripestatFetcher) Fetch(ipv4, ipv6 bool, asn ...string) (Result, error) {
+	return f.FetchContext(context.Background(), ipv4, ipv6, asn...)
+}
+
+func (f *ripestatFetcher) FetchContext(ctx context.Context, ipv4, ipv6 bool, asn ...string) (Result, error) {
+	if hasASSet(asn) {
+		return nil, errors.New("as-sets are not supported by the ripestat source")
+	}
+	return fetchParallel(ctx, f.maxConcurrency, asn, func(ctx context.Context, as string) (*ASResult, error) {
+		return f.fetchAS(ctx, as, ipv4, ipv6)
+	})
+}
+
+func (f *ripestatFetcher) fetchAS(ctx context.Context, as string, ipv4, ipv6 bool) (*ASResult, error) {
+	query := url.Values{"resource": {"AS" + as}, "sourceapp": {"asn2ip"}}
+	u := fmt.Sprintf("%s/data/announced-prefixes/data.json?%s", f.url, query.Encode())
+	logger(ctx, f.log).WithFields(logrus.Fields{"asn": as, "url": u}).Debugln("requesting announced prefixes from ripestat")
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create ripestat request")
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to request as %s from ripestat", as)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("ripestat returned %s for as %s", resp.Status, as)
+	}
+
+	data := ripestatResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return nil, errors.Wrapf(err, "failed to decode ripestat response for as %s", as)
+	}
+	if data.Status != "ok" {
+		return nil, errors.Errorf("ripestat returned status %s for as %s: %s", data.Status, as, data.Message)
+	}
+
+	prefixes := make([]string, len(data.Data.Prefixes))
+	for i, p := range data.Data.Prefixes {
+		prefixes[i] = p.Prefix
+	}
+	return splitFamilies(as, SourceRIPEstat, prefixes, ipv4, ipv6)
+}
+
+type ripestatOverview struct {
+	Status  string `json:"status"`
+	Message string `json:"message"`
+	Data    struct {
+		Holder string `json:"holder"`
+	} `json:"data"`
+}
+
+// LookupAS returns the holder of as from the RIPEstat as-overview, split into name and description.
+func (f *ripestatFetcher) LookupAS(ctx context.Context, as string) (ASInfo, error) {
+	as, err := NormalizeASN(as)
+	if err != nil {
+		return ASInfo{}, err
+	}
+	query := url.Values{"resource": {"AS" + as}, "sourceapp": {"asn2ip"}}
+	u := fmt.Sprintf("%s/data/as-overview/data.json?%s", f.url, query.Encode())
+	logger(ctx, f.log).WithFields(logrus.Fields{"asn": as, "url": u}).Debugln("requesting as overview from ripestat")
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return ASInfo{}, errors.Wrap(err, "failed to create ripestat request")
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return ASInfo{}, errors.Wrapf(err, "failed to request as %s from ripestat", as)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return ASInfo{}, errors.Errorf("ripestat returned %s for as %s", resp.Status, as)
+	}
+
+	data := ripestatOverview{}
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return ASInfo{}, errors.Wrapf(err, "failed to decode ripestat response for as %s", as)
+	}
+	if data.Status != "ok" {
+		return ASInfo{}, errors.Errorf("ripestat returned status %s for as %s: %s", data.Status, as, data.Message)
+	}
+	if data.Data.Holder == "" {
+		return ASInfo{}, &NotFoundError{AS: as}
+	}
+	name, descr := splitHolder(data.Data.Holder)
+	return ASInfo{AS: as, Name: name, Description: descr, Source: SourceRIPEstat}, nil
+}
+
+func (f *ripestatFetcher) Close() error {
+	f.client.CloseIdleConnections()
+	return nil
+}
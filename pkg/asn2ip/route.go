@@ -0,0 +1,143 @@
+package asn2ip
+
+import (
+	"bufio"
+	"context"
+	"net/netip"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var ErrRouteNotFound = errors.New("no route found")
+
+// Route is a route object announcing Prefix from Origin.
+type Route struct {
+	Prefix netip.Prefix
+	Origin string
+	Source string
+}
+
+// Resolver resolves the originating AS numbers of ip addresses and networks.
+type Resolver interface {
+	// LookupIP returns all routes covering address, an ip address or network in CIDR notation,
+	// ordered from most to least specific.
+	LookupIP(ctx context.Context, address string) ([]Route, error)
+	Close() error
+}
+
+// NewResolver returns a Resolver querying route objects from an IRRd whois server.
+func NewResolver(host string, port int, opts ...Option) Resolver {
+	return newFetcher(host, port, opts...)
+}
+
+// LookupIPs resolves many addresses at once, using a single bulk query if resolver supports it.
+// Addresses without any route are missing from the result.
+func LookupIPs(ctx context.Context, resolver Resolver, addresses []string) (map[string][]Route, error) {
+	if bulk, ok := resolver.(BulkResolver); ok {
+		return bulk.LookupIPs(ctx, addresses)
+	}
+	result := map[string][]Route{}
+	for _, address := range addresses {
+		routes, err := resolver.LookupIP(ctx, address)
+		if errors.Is(err, ErrRouteNotFound) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		result[address] = routes
+	}
+	return result, nil
+}
+
+// ParseAddress parses an ip address or network into a network, addresses become host networks.
+func ParseAddress(address string) (netip.Prefix, error) {
+	if strings.Contains(address, "/") {
+		return ParsePrefix(address)
+	}
+	ip, err := netip.ParseAddr(address)
+	if err != nil || ip.Zone() != "" {
+		return netip.Prefix{}, errors.Errorf("invalid ip address %q", address)
+	}
+	ip = ip.Unmap()
+	return netip.PrefixFrom(ip, ip.BitLen()), nil
+}
+
+func (f *fetcher) LookupIP(ctx context.Context, address string) ([]Route, error) {
+	prefix, err := ParseAddress(address)
+	if err != nil {
+		return nil, err
+	}
+
+	var data string
+	err = f.withConn(ctx, func(conn *conn) (err error) {
+		// L returns all less specific route objects including exact matches
+		data, err = query(conn, "!r"+prefix.String()+",L")
+		return err
+	})
+	if err == errNoEntries {
+		return nil, errors.Wrapf(ErrRouteNotFound, "%s", prefix)
+	} else if err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	routes, err := parseRoutes(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(routes) == 0 {
+		return nil, errors.Wrapf(ErrRouteNotFound, "%s", prefix)
+	}
+	return routes, nil
+}
+
+// parseRoutes parses RPSL route and route6 objects.
+func parseRoutes(data string) ([]Route, error) {
+	routes := []Route{}
+	current := Route{}
+	flush := func() {
+		if current.Prefix.IsValid() && current.Origin != "" {
+			routes = append(routes, current)
+		}
+		current = Route{}
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			flush()
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' || line[0] == '+' {
+			// continuation of the previous attribute
+			continue
+		}
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		value := strings.TrimSpace(kv[1])
+		switch strings.ToLower(strings.TrimSpace(kv[0])) {
+		case "route", "route6":
+			n, err := ParsePrefix(value)
+			if err != nil {
+				return nil, errors.Errorf("failed to parse route %s", value)
+			}
+			current.Prefix = n
+		case "origin":
+			origin, err := NormalizeASN(value)
+			if err != nil {
+				return nil, errors.Wrap(err, "failed to parse route origin")
+			}
+			current.Origin = origin
+		case "source":
+			current.Source = value
+		}
+	}
+	flush()
+
+	sort.SliceStable(routes, func(i, j int) bool { return routes[i].Prefix.Bits() > routes[j].Prefix.Bits() })
+	return routes, nil
+}
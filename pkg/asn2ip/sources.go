@@ -0,0 +1,118 @@
+package asn2ip
+
+import (
+	"context"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+type sourcesKey struct{}
+
+// WithSources restricts all queries to the given IRR databases, e.g. RADB, RIPE or ARIN.
+func WithSources(sources ...string) Option {
+	return func(f *fetcher) { f.sources = strings.Join(sources, ",") }
+}
+
+// ContextWithSources restricts queries using ctx to the given IRR databases.
+// Results of these queries are not cached.
+func ContextWithSources(ctx context.Context, sources ...string) context.Context {
+	if len(sources) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, sourcesKey{}, strings.Join(sources, ","))
+}
+
+func sourcesFromContext(ctx context.Context) (string, bool) {
+	v, ok := ctx.Value(sourcesKey{}).(string)
+	return v, ok
+}
+
+// ParseSources parses a comma separated list of IRR database names.
+func ParseSources(s string) ([]string, error) {
+	sources := []string{}
+	for _, v := range strings.Split(s, ",") {
+		v = strings.ToUpper(strings.TrimSpace(v))
+		if v == "" {
+			continue
+		}
+		for _, r := range v {
+			if (r < 'A' || r > 'Z') && (r < '0' || r > '9') && r != '-' && r != '_' {
+				return nil, errors.Errorf("invalid irr source %q", v)
+			}
+		}
+		sources = append(sources, v)
+	}
+	return sources, nil
+}
+
+// SourceLister lists the IRR databases mirrored by a whois server.
+type SourceLister interface {
+	// ListSources returns the names of the IRR databases queried by default.
+	ListSources(ctx context.Context) ([]string, error)
+}
+
+// ListSources returns the IRR databases selected on a new connection with !s-lc. Unless the
+// fetcher was created WithSources, these are all databases mirrored by the server.
+func (f *fetcher) ListSources(ctx context.Context) ([]string, error) {
+	var sources []string
+	err := f.withConn(ctx, func(c *conn) error {
+		data, err := query(c, "!s-lc")
+		if err != nil {
+			return errors.Wrap(err, "failed to list irr sources")
+		}
+		sources, err = ParseSources(strings.TrimSpace(data))
+		return err
+	})
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+	return sources, nil
+}
+
+// setSources selects the IRR databases queried over c.
+func setSources(c *conn, sources string) error {
+	c.logger().WithFields(logrus.Fields{"sources": sources}).Debugln("selecting irr sources")
+	if _, err := query(c, "!s"+sources); err != nil {
+		return errors.Wrapf(err, "failed to select irr sources %s", sources)
+	}
+	c.sources = sources
+	return nil
+}
+
+// getConn returns a pooled connection querying the sources requested by ctx.
+// Each connection counts against the connection limit until returned with putConn or discard.
+func (f *fetcher) getConn(ctx context.Context) (*conn, error) {
+	if err := f.limiter.acquire(ctx); err != nil {
+		return nil, err
+	}
+	c, err := f.pool.get(ctx)
+	if err != nil {
+		f.limiter.release()
+		return nil, err
+	}
+	if sources, ok := sourcesFromContext(ctx); ok && sources != c.sources {
+		if err := setSources(c, sources); err != nil {
+			f.discard(c)
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// putConn returns c to the pool unless it queries other sources than configured.
+func (f *fetcher) putConn(c *conn) {
+	f.limiter.release()
+	if c.sources != f.sources {
+		f.pool.discard(c)
+		return
+	}
+	f.pool.put(c)
+}
+
+// discard closes a connection taken with getConn which is in an unknown state.
+func (f *fetcher) discard(c *conn) {
+	f.limiter.release()
+	f.pool.discard(c)
+}
@@ -0,0 +1,119 @@
+package asn2ip
+
+import (
+	"context"
+
+	"github.com/g0dsCookie/asn2ip/pkg/storage"
+	"github.com/pkg/errors"
+)
+
+// StreamFunc receives the result of a single AS. Returning an error aborts the fetch.
+// ASNs failing to fetch are skipped and reported by a *FetchError once all others are streamed.
+type StreamFunc func(res *ASResult) error
+
+// Streamer hands out the networks of each AS as soon as they are fetched instead of
+// collecting all of them first, which keeps memory bounded for huge as-set expansions.
+type Streamer interface {
+	// FetchStream calls fn for every AS in the order they are fetched. fn is never
+	// called concurrently.
+	FetchStream(ctx context.Context, ipv4, ipv6 bool, fn StreamFunc, asn ...string) error
+}
+
+// FetchStream streams the networks of asn from f. Fetchers not implementing Streamer
+// are fetched at once and handed out afterwards in numerical order.
+func FetchStream(ctx context.Context, f Fetcher, ipv4, ipv6 bool, fn StreamFunc, asn ...string) error {
+	if s, ok := f.(Streamer); ok {
+		return s.FetchStream(ctx, ipv4, ipv6, fn, asn...)
+	}
+
+	ips, err := f.FetchContext(ctx, ipv4, ipv6, asn...)
+	if partial := (*FetchError)(nil); err != nil && !errors.As(err, &partial) {
+		return err
+	}
+	for _, as := range ips.ASNs() {
+		if err := fn(ips[as]); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// collect gathers the results streamed by fetch into a Result.
+func collect(fetch func(fn StreamFunc) error) (Result, error) {
+	result := Result{}
+	err := fetch(func(res *ASResult) error {
+		result[res.ASN] = res
+		return nil
+	})
+	if partial := (*FetchError)(nil); err != nil && !errors.As(err, &partial) {
+		return nil, err
+	}
+	result.addErrors(err)
+	return result, err
+}
+
+func (f *cachedFetcher) FetchStream(ctx context.Context, ipv4, ipv6 bool, fn StreamFunc, asn ...string) error {
+	if len(asn) == 0 {
+		return nil
+	}
+
+	if _, ok := sourcesFromContext(ctx); ok {
+		// the cache only holds results of the configured sources
+		return FetchStream(ctx, f.upstream, ipv4, ipv6, fn, asn...)
+	}
+
+	if hasASSet(asn) {
+		expanded, err := f.expandSets(ctx, asn)
+		if err != nil {
+			return err
+		}
+		asn = expanded
+	}
+
+	errs := map[string]error{}
+	entries := map[string]storage.ASStorage{}
+	missing := map[families][]string{}
+	for _, as := range asn {
+		r, fetch, err := f.lookup(ctx, as, ipv4, ipv6)
+		if errors.Is(err, ErrASNotFound) {
+			errs[as] = err
+			continue
+		} else if err != nil {
+			return err
+		}
+		if fetch.ipv4 || fetch.ipv6 {
+			entries[as] = r
+			missing[fetch] = append(missing[fetch], as)
+			continue
+		}
+		if err := fn(fromCache(r, ipv4, ipv6)); err != nil {
+			return err
+		}
+	}
+
+	// fetch only the ip versions missing from cache, e.g. just IPv6 of ASNs cached for IPv4
+	for _, fetch := range []families{{true, true}, {true, false}, {false, true}} {
+		uncached := missing[fetch]
+		if len(uncached) == 0 {
+			continue
+		}
+		// errors of storing and streaming abort the fetch instead of failing a single AS
+		var aborted error
+		err := FetchStream(ctx, f.upstream, fetch.ipv4, fetch.ipv6, func(res *ASResult) error {
+			if aborted = f.merge(entries[res.ASN], res, fetch, ipv4, ipv6); aborted != nil {
+				return aborted
+			}
+			aborted = fn(res)
+			return aborted
+		}, uncached...)
+		if aborted != nil {
+			return aborted
+		}
+		if err != nil {
+			if err := f.upstreamErrors(err, uncached, errs, fetch.ipv4, fetch.ipv6); err != nil {
+				return err
+			}
+		}
+	}
+	return fetchErrors(asn, errs)
+}
@@ -0,0 +1,117 @@
+package asn2ip
+
+import (
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// TimeoutOptions limit how long whois connections may stall. A zero duration disables the limit.
+type TimeoutOptions struct {
+	// Connect limits establishing a connection including the multicommand handshake.
+	Connect time.Duration
+	// Read limits waiting for the next data of a response, e.g. when the server stalls.
+	Read time.Duration
+	// Query limits the total time of a single command, however fast the data arrives.
+	Query time.Duration
+}
+
+// DefaultTimeouts are used by fetchers created without WithTimeouts.
+var DefaultTimeouts = TimeoutOptions{
+	Connect: 30 * time.Second,
+	Read:    30 * time.Second,
+}
+
+// WithTimeouts replaces DefaultTimeouts of whois connections. Exceeding them fails the query
+// with a *TimeoutError.
+func WithTimeouts(opts TimeoutOptions) Option {
+	return func(f *fetcher) { f.timeouts = opts }
+}
+
+// earliest returns the earlier of both deadlines, the zero time being no deadline.
+func earliest(a, b time.Time) time.Time {
+	if a.IsZero() || (!b.IsZero() && b.Before(a)) {
+		return b
+	}
+	return a
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// begin starts a command on c, its deadline applies to all reads and writes until the next command.
+func (c *conn) begin() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.aborted {
+		return
+	}
+	c.deadline = time.Time{}
+	if c.timeouts.Query > 0 {
+		c.deadline = time.Now().Add(c.timeouts.Query)
+	}
+	c.Conn.SetDeadline(c.nextDeadline())
+}
+
+// nextDeadline returns the deadline of the next read or write, zero if unlimited.
+func (c *conn) nextDeadline() time.Time {
+	if c.timeouts.Read <= 0 {
+		return c.deadline
+	}
+	return earliest(c.deadline, time.Now().Add(c.timeouts.Read))
+}
+
+// Read refreshes the read timeout before each read from the connection.
+func (c *conn) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	if c.aborted {
+		c.mu.Unlock()
+		return 0, errors.New("connection aborted")
+	}
+	if c.timeouts.Read > 0 {
+		c.Conn.SetReadDeadline(c.nextDeadline())
+	}
+	c.mu.Unlock()
+
+	n, err := c.Conn.Read(p)
+	if err != nil {
+		err = c.timeoutError("read", err)
+	}
+	return n, err
+}
+
+func (c *conn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if err != nil {
+		err = c.timeoutError("write", err)
+	}
+	return n, err
+}
+
+// abort fails all pending and future reads and writes on c.
+func (c *conn) abort() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.aborted = true
+	c.Conn.SetDeadline(time.Unix(1, 0))
+}
+
+// timeoutError turns errors caused by exceeding the timeouts of c into a *TimeoutError.
+// Aborted connections report the original error, the context error takes precedence.
+func (c *conn) timeoutError(op string, err error) error {
+	if !isTimeout(err) {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case c.aborted:
+		return err
+	case !c.deadline.IsZero() && !time.Now().Before(c.deadline):
+		return &TimeoutError{Op: "query", Limit: c.timeouts.Query}
+	}
+	return &TimeoutError{Op: op, Limit: c.timeouts.Read}
+}
@@ -0,0 +1,80 @@
+package asn2ip
+
+import (
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// maxResponseLength bounds the memory allocated for the data of a single response, the
+// networks of the largest AS numbers and as-sets take a few megabytes at most.
+const maxResponseLength = 64 << 20
+
+func readLine(c *conn) (string, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return "", errors.Wrap(err, "failed to read line from connection")
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// query issues an IRRd command and returns the data of its response.
+//
+// Responses either start with A<length> followed by length bytes of data and a final C,
+// or consist of a single status line: C (success without data), D (key not found),
+// E (multiple copies of key) or F <message> (error).
+func query(c *conn, cmd string) (string, error) {
+	if err := c.limiter.wait(c.context()); err != nil {
+		return "", err
+	}
+	c.logger().WithFields(logrus.Fields{"remote": c.RemoteAddr(), "cmd": cmd}).Debugln("issuing whois command")
+	c.begin()
+	if _, err := c.Write([]byte(cmd + "\n")); err != nil {
+		return "", errors.Wrapf(err, "failed to send command %s", cmd)
+	}
+
+	line, err := readLine(c)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to read response for %s", cmd)
+	}
+	switch {
+	case line == "C":
+		return "", nil
+	case line == "D":
+		return "", errNoEntries
+	case line == "E":
+		return "", errors.Errorf("multiple copies of key for %s", cmd)
+	case strings.HasPrefix(line, "F"):
+		return "", errors.Errorf("whois server failed to answer %s: %s", cmd, strings.TrimSpace(line[1:]))
+	case !strings.HasPrefix(line, "A"):
+		return "", errors.Errorf("received invalid response for %s", cmd)
+	}
+
+	length, err := strconv.Atoi(line[1:])
+	if err != nil || length < 0 {
+		return "", errors.Errorf("received invalid response length for %s", cmd)
+	}
+	if length > maxResponseLength {
+		return "", errors.Errorf("response of %d bytes for %s exceeds the maximum of %d bytes", length, cmd, maxResponseLength)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		return "", errors.Wrapf(err, "failed to read response for %s", cmd)
+	}
+
+	// skip everything up to the final status line
+	for {
+		line, err := readLine(c)
+		if err != nil {
+			return "", errors.Wrapf(err, "failed to read response for %s", cmd)
+		}
+		if line == "C" {
+			return string(data), nil
+		} else if line != "" {
+			return "", errors.Errorf("received invalid response for %s", cmd)
+		}
+	}
+}
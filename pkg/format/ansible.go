@@ -0,0 +1,36 @@
+package format
+
+import (
+	"fmt"
+	"io"
+	"net/netip"
+
+	"gopkg.in/yaml.v2"
+)
+
+func init() {
+	Register("ansible", New("application/yaml; charset=utf-8", writeAnsibleVars))
+}
+
+// writeAnsibleVars writes an Ansible vars file with a list variable per AS and ip version,
+// e.g. as15169_ipv4 and as15169_ipv6. Families not fetched are left out.
+func writeAnsibleVars(w io.Writer, ips map[string]map[string][]netip.Prefix, opts Options) error {
+	vars := yaml.MapSlice{}
+	for _, as := range SortedASNs(ips) {
+		for _, family := range []string{"ipv4", "ipv6"} {
+			nets, ok := ips[as][family]
+			if !ok {
+				continue
+			}
+			vars = append(vars, yaml.MapItem{Key: fmt.Sprintf("as%s_%s", as, family), Value: networkStrings(nets)})
+		}
+	}
+	if _, err := fmt.Fprint(w, "---\n# generated by asn2ip\n"); err != nil {
+		return err
+	}
+	enc := yaml.NewEncoder(w)
+	if err := enc.Encode(vars); err != nil {
+		return err
+	}
+	return enc.Close()
+}
@@ -0,0 +1,99 @@
+package format
+
+import (
+	_ "embed"
+	"io"
+	"net/netip"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// ProtoSchema is the protobuf schema of the protobuf format.
+//
+//go:embed asn2ip.proto
+var ProtoSchema []byte
+
+func init() {
+	Register("protobuf", New("application/x-protobuf", writeProtobuf))
+	Register("msgpack", New("application/msgpack", writeMsgpack))
+}
+
+// writeProtobuf writes the networks as Networks message of ProtoSchema.
+func writeProtobuf(w io.Writer, ips map[string]map[string][]netip.Prefix, opts Options) error {
+	var msg []byte
+	for _, as := range SortedASNs(ips) {
+		var m []byte
+		m = protowire.AppendTag(m, 1, protowire.BytesType)
+		m = protowire.AppendString(m, as)
+		if name := opts.Names[as]; name != "" {
+			m = protowire.AppendTag(m, 2, protowire.BytesType)
+			m = protowire.AppendString(m, name)
+		}
+		for i, family := range []string{"ipv4", "ipv6"} {
+			for _, n := range ips[as][family] {
+				var p []byte
+				p = protowire.AppendTag(p, 1, protowire.BytesType)
+				p = protowire.AppendBytes(p, n.Addr().AsSlice())
+				p = protowire.AppendTag(p, 2, protowire.VarintType)
+				p = protowire.AppendVarint(p, uint64(n.Bits()))
+				m = protowire.AppendTag(m, protowire.Number(3+i), protowire.BytesType)
+				m = protowire.AppendBytes(m, p)
+			}
+		}
+		msg = protowire.AppendTag(msg, 1, protowire.BytesType)
+		msg = protowire.AppendBytes(msg, m)
+	}
+	_, err := w.Write(msg)
+	return err
+}
+
+// writeMsgpack writes the networks keyed by AS number and ip version, like json.
+func writeMsgpack(w io.Writer, ips map[string]map[string][]netip.Prefix, opts Options) error {
+	b := appendMsgpackHeader(nil, 0x80, 0xde, len(ips))
+	for _, as := range SortedASNs(ips) {
+		b = appendMsgpackString(b, as)
+		b = appendMsgpackHeader(b, 0x80, 0xde, len(ips[as]))
+		for _, family := range []string{"ipv4", "ipv6"} {
+			nets, ok := ips[as][family]
+			if !ok {
+				continue
+			}
+			b = appendMsgpackString(b, family)
+			b = appendMsgpackHeader(b, 0x90, 0xdc, len(nets))
+			for _, n := range nets {
+				b = appendMsgpackString(b, n.String())
+			}
+		}
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+func appendMsgpackString(b []byte, s string) []byte {
+	switch {
+	case len(s) < 32:
+		b = append(b, 0xa0|byte(len(s)))
+	case len(s) < 1<<8:
+		b = append(b, 0xd9, byte(len(s)))
+	default:
+		b = appendMsgpackLength(b, 0xda, len(s))
+	}
+	return append(b, s...)
+}
+
+// appendMsgpackHeader appends the header of a map or array of n entries. fix is the type of up to
+// 15 entries, long the 16 bit type directly followed by the 32 bit one.
+func appendMsgpackHeader(b []byte, fix, long byte, n int) []byte {
+	if n < 16 {
+		return append(b, fix|byte(n))
+	}
+	return appendMsgpackLength(b, long, n)
+}
+
+// appendMsgpackLength appends n as 16 bit length of type long or 32 bit length of the type following it.
+func appendMsgpackLength(b []byte, long byte, n int) []byte {
+	if n < 1<<16 {
+		return append(b, long, byte(n>>8), byte(n))
+	}
+	return append(b, long+1, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+}
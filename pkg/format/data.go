@@ -0,0 +1,166 @@
+package format
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"net/netip"
+	"strings"
+
+	"github.com/g0dsCookie/asn2ip/pkg/asn2ip"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+func init() {
+	Register("plain", New("text/plain; charset=utf-8", writePlain))
+	Register("text", New("text/plain; charset=utf-8", writeText))
+	Register("json", New("application/json; charset=utf-8", writeJSON))
+	Register("csv", New("text/csv; charset=utf-8", writeCSV))
+	Register("yaml", New("application/yaml; charset=utf-8", writeYAML))
+	Register("jsonl", jsonLines{})
+}
+
+type jsonLine struct {
+	ASN    string `json:"asn"`
+	Family string `json:"family"`
+	Prefix string `json:"prefix"`
+	Name   string `json:"name,omitempty"`
+}
+
+// jsonLines writes every network as a separate json object per line. As lines do not depend
+// on each other, output is streamed while fetching.
+type jsonLines struct{}
+
+func (jsonLines) ContentType() string { return "application/x-ndjson" }
+
+func (jsonLines) Write(w io.Writer, ips map[string]map[string][]netip.Prefix, opts Options) error {
+	enc := json.NewEncoder(w)
+	for _, as := range SortedASNs(ips) {
+		for _, family := range []string{"ipv4", "ipv6"} {
+			for _, n := range ips[as][family] {
+				if err := enc.Encode(jsonLine{ASN: as, Family: family, Prefix: n.String(), Name: opts.Names[as]}); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (jsonLines) WriteError(w io.Writer, err error) error {
+	return json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
+
+// writeText writes the networks of all ASNs, IPv4 first, joined by the separator. Networks
+// are listed by AS number unless sorted. Grouped by AS number, the networks of each AS follow
+// a comment line naming it.
+func writeText(w io.Writer, ips map[string]map[string][]netip.Prefix, opts Options) error {
+	seen := map[netip.Prefix]bool{}
+	switch opts.Group {
+	case "":
+		all := []netip.Prefix{}
+		for _, family := range []string{"ipv4", "ipv6"} {
+			for _, as := range SortedASNs(ips) {
+				all = append(all, ips[as][family]...)
+			}
+		}
+		_, err := io.WriteString(w, textNetworks(all, opts, seen))
+		return err
+	case GroupASN:
+		for _, as := range SortedASNs(ips) {
+			header := "# AS" + as
+			if name := opts.Names[as]; name != "" {
+				header += " " + name
+			}
+			nets := append(append([]netip.Prefix{}, ips[as]["ipv4"]...), ips[as]["ipv6"]...)
+			if _, err := io.WriteString(w, header+"\n"+textNetworks(nets, opts, seen)+"\n"); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return errors.Errorf("unknown grouping %q of text output", opts.Group)
+}
+
+// textNetworks joins nets by the separator. If sorted, nets are sorted in place. Without
+// duplicates, networks in seen are skipped and the others added to it.
+func textNetworks(nets []netip.Prefix, opts Options, seen map[netip.Prefix]bool) string {
+	if opts.Sort {
+		// IPv4 sorts before IPv6
+		asn2ip.SortPrefixes(nets)
+	}
+	if opts.Dedup {
+		unique := nets[:0]
+		for _, n := range nets {
+			if !seen[n] {
+				seen[n] = true
+				unique = append(unique, n)
+			}
+		}
+		nets = unique
+	}
+	return strings.Join(networkStrings(nets), opts.Separator)
+}
+
+// writePlain writes each AS on its own line, labeled with its name if given, followed by a line
+// of its comma separated networks per ip version.
+func writePlain(w io.Writer, ips map[string]map[string][]netip.Prefix, opts Options) error {
+	for _, as := range SortedASNs(ips) {
+		label := "AS" + as
+		if name := opts.Names[as]; name != "" {
+			label += " " + name
+		}
+		if _, err := io.WriteString(w, label+"\n"); err != nil {
+			return err
+		}
+		for _, family := range []string{"ipv4", "ipv6"} {
+			if _, err := io.WriteString(w, "  "+strings.Join(networkStrings(ips[as][family]), ",")+"\n"); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writeJSON writes the networks keyed by AS number and ip version.
+func writeJSON(w io.Writer, ips map[string]map[string][]netip.Prefix, opts Options) error {
+	return json.NewEncoder(w).Encode(networksByFamily(ips))
+}
+
+// writeYAML writes the networks keyed by AS number and ip version.
+func writeYAML(w io.Writer, ips map[string]map[string][]netip.Prefix, opts Options) error {
+	enc := yaml.NewEncoder(w)
+	if err := enc.Encode(networksByFamily(ips)); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// writeCSV writes one asn,family,prefix record per network, with an additional name column
+// if AS names are given.
+func writeCSV(w io.Writer, ips map[string]map[string][]netip.Prefix, opts Options) error {
+	cw := csv.NewWriter(w)
+	header := []string{"asn", "family", "prefix"}
+	if opts.Names != nil {
+		header = append(header, "name")
+	}
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	for _, as := range SortedASNs(ips) {
+		for _, family := range []string{"ipv4", "ipv6"} {
+			for _, n := range ips[as][family] {
+				record := []string{as, family, n.String()}
+				if opts.Names != nil {
+					record = append(record, opts.Names[as])
+				}
+				if err := cw.Write(record); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
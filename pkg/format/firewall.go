@@ -0,0 +1,158 @@
+package format
+
+import (
+	"fmt"
+	"io"
+	"net/netip"
+	"strings"
+)
+
+func init() {
+	Register("nftables", New("text/plain; charset=utf-8", writeNftablesDefine))
+	Register("nftables-set", New("text/plain; charset=utf-8", writeNftablesSet))
+	Register("ipset", New("text/plain; charset=utf-8", writeIpset))
+	Register("pf", New("text/plain; charset=utf-8", writePfTable))
+	Register("pf-table", New("text/plain; charset=utf-8", writePfConf))
+	Register("haproxy", New("text/plain; charset=utf-8", writeHaproxy))
+}
+
+// eachSet calls fn for every non empty set of networks, named by the set name template.
+func eachSet(ips map[string]map[string][]netip.Prefix, opts Options, fn func(name, family string, nets []netip.Prefix) error) error {
+	for _, as := range SortedASNs(ips) {
+		for _, family := range []string{"ipv4", "ipv6"} {
+			nets := ips[as][family]
+			if len(nets) == 0 {
+				continue
+			}
+			name := opts.setName(as, family)
+			if err := fn(name, family, nets); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func writeNftablesElements(w io.Writer, indent string, nets []netip.Prefix) error {
+	for i, n := range nets {
+		sep := ","
+		if i == len(nets)-1 {
+			sep = ""
+		}
+		if _, err := fmt.Fprintf(w, "%s%s%s\n", indent, n, sep); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeNftablesDefine writes a variable per AS and ip version, e.g. define as15169_v4 = { ... }
+func writeNftablesDefine(w io.Writer, ips map[string]map[string][]netip.Prefix, opts Options) error {
+	return eachSet(ips, opts, func(name, family string, nets []netip.Prefix) error {
+		if _, err := fmt.Fprintf(w, "define %s = {\n", name); err != nil {
+			return err
+		}
+		if err := writeNftablesElements(w, "\t", nets); err != nil {
+			return err
+		}
+		_, err := fmt.Fprint(w, "}\n")
+		return err
+	})
+}
+
+// writeNftablesSet writes a named interval set per AS and ip version to be included in a table.
+func writeNftablesSet(w io.Writer, ips map[string]map[string][]netip.Prefix, opts Options) error {
+	return eachSet(ips, opts, func(name, family string, nets []netip.Prefix) error {
+		typ := "ipv4_addr"
+		if family == "ipv6" {
+			typ = "ipv6_addr"
+		}
+		if _, err := fmt.Fprintf(w, "set %s {\n\ttype %s\n\tflags interval\n\tauto-merge\n\telements = {\n", name, typ); err != nil {
+			return err
+		}
+		if err := writeNftablesElements(w, "\t\t", nets); err != nil {
+			return err
+		}
+		_, err := fmt.Fprint(w, "\t}\n}\n")
+		return err
+	})
+}
+
+// writeIpset writes create and add commands for ipset restore. Sets hold networks of a single
+// ip version, so each AS gets a hash:net set per family.
+func writeIpset(w io.Writer, ips map[string]map[string][]netip.Prefix, opts Options) error {
+	return eachSet(ips, opts, func(name, family string, nets []netip.Prefix) error {
+		ipsetFamily := "inet"
+		if family == "ipv6" {
+			ipsetFamily = "inet6"
+		}
+		maxelem := 65536
+		if len(nets) > maxelem {
+			maxelem = len(nets)
+		}
+		if _, err := fmt.Fprintf(w, "create %s hash:net family %s maxelem %d -exist\n", name, ipsetFamily, maxelem); err != nil {
+			return err
+		}
+		for _, n := range nets {
+			if _, err := fmt.Fprintf(w, "add %s %s -exist\n", name, n); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// writePfTable writes a pf table file with the networks of all ASNs, one per line.
+func writePfTable(w io.Writer, ips map[string]map[string][]netip.Prefix, opts Options) error {
+	asns := SortedASNs(ips)
+	if _, err := fmt.Fprintf(w, "# pf table generated by asn2ip for AS%s\n", strings.Join(asns, ", AS")); err != nil {
+		return err
+	}
+	for _, as := range asns {
+		for _, n := range append(ips[as]["ipv4"], ips[as]["ipv6"]...) {
+			if _, err := fmt.Fprintf(w, "%s\n", n); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writePfConf writes a persistent pf table definition per AS, loading the networks from
+// the table file if configured.
+func writePfConf(w io.Writer, ips map[string]map[string][]netip.Prefix, opts Options) error {
+	for _, as := range SortedASNs(ips) {
+		name := ExpandName(opts.TableName, DefaultTableName, as, "")
+		if opts.TableFile != "" {
+			if _, err := fmt.Fprintf(w, "table <%s> persist file \"%s\"\n", name, ExpandName(opts.TableFile, "", as, "")); err != nil {
+				return err
+			}
+			continue
+		}
+		nets := networkStrings(append(ips[as]["ipv4"], ips[as]["ipv6"]...))
+		if _, err := fmt.Fprintf(w, "table <%s> persist { %s }\n", name, strings.Join(nets, ", ")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeHaproxy writes an ACL file for HAProxy, e.g. loaded by acl with src -f, listing the
+// networks of each AS after a comment naming it.
+func writeHaproxy(w io.Writer, ips map[string]map[string][]netip.Prefix, opts Options) error {
+	for _, as := range SortedASNs(ips) {
+		comment := "AS" + as
+		if name := opts.Names[as]; name != "" {
+			comment += " " + name
+		}
+		if _, err := fmt.Fprintf(w, "# %s, generated by asn2ip\n", comment); err != nil {
+			return err
+		}
+		for _, n := range append(ips[as]["ipv4"], ips[as]["ipv6"]...) {
+			if _, err := fmt.Fprintf(w, "%s\n", n); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,236 @@
+// Package format renders fetched networks for other tools, e.g. as firewall sets or router
+// prefix lists. Formatters are looked up by name from a registry shared by the CLI and the
+// http server, custom formatters can be added with Register.
+package format
+
+import (
+	"bytes"
+	"io"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	DefaultSetName   = "as{asn}_v{family}"
+	DefaultListName  = "AS{asn}"
+	DefaultTableName = "as{asn}"
+	DefaultSeqStep   = 5
+	// DefaultRuleSize is the default quota of rules per AWS security group.
+	DefaultRuleSize = 60
+	// DefaultResourceName is a valid Kubernetes resource name for any AS number.
+	DefaultResourceName = "as{asn}"
+)
+
+// GroupASN groups text output by AS number, see Options.Group.
+const GroupASN = "asn"
+
+// Options customize the output of formatters.
+type Options struct {
+	// SetName is the name template of sets, {asn} and {family} are replaced
+	// with the AS number and ip version.
+	SetName string
+	// ListName is the name template of router prefix lists, {asn} and {family} are replaced
+	// with the AS number and ip version.
+	ListName string
+	// SeqStep is the increment between sequence numbers of prefix list entries.
+	SeqStep int
+	// TableName is the name template of pf tables, {asn} is replaced with the AS number.
+	TableName string
+	// TableFile is the path template of pf table files, {asn} is replaced with the AS number.
+	// Without a path the networks are listed inline.
+	TableFile string
+	// RuleSize is the maximum number of CIDR blocks of a security group rule.
+	RuleSize int
+	// ResourceName is the name template of Kubernetes resources, {asn} is replaced with the
+	// AS number.
+	ResourceName string
+	// Separator is put between the networks of text output.
+	Separator string
+	// Sort orders the networks of text output numerically instead of by AS number.
+	Sort bool
+	// Dedup lists networks of several ASNs only once in text output.
+	Dedup bool
+	// Group splits text output into the networks of each AS number if set to GroupASN,
+	// each preceded by a comment line naming the AS.
+	Group string
+	// Names maps AS numbers to their names, added to csv and jsonl output if set.
+	Names map[string]string
+}
+
+// Formatter renders the networks of multiple ASNs, keyed by AS number and ip version.
+type Formatter interface {
+	ContentType() string
+	Write(w io.Writer, ips map[string]map[string][]netip.Prefix, opts Options) error
+}
+
+// StreamFormatter renders each AS on its own, so its output can be written while fetching.
+type StreamFormatter interface {
+	Formatter
+	// WriteError reports an error of a stream that has already been partially written.
+	WriteError(w io.Writer, err error) error
+}
+
+// WriteFunc renders the networks of multiple ASNs, keyed by AS number and ip version.
+type WriteFunc func(w io.Writer, ips map[string]map[string][]netip.Prefix, opts Options) error
+
+type funcFormatter struct {
+	contentType string
+	write       WriteFunc
+}
+
+// New returns a Formatter writing content of contentType with fn.
+func New(contentType string, fn WriteFunc) Formatter {
+	return funcFormatter{contentType: contentType, write: fn}
+}
+
+func (f funcFormatter) ContentType() string { return f.contentType }
+
+func (f funcFormatter) Write(w io.Writer, ips map[string]map[string][]netip.Prefix, opts Options) error {
+	return f.write(w, ips, opts)
+}
+
+var (
+	mu         sync.RWMutex
+	formatters = map[string]Formatter{}
+)
+
+// Register makes f available by name. Registering a name twice replaces the previous formatter.
+func Register(name string, f Formatter) {
+	if f == nil {
+		panic("format: register of nil formatter " + name)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	formatters[name] = f
+}
+
+// Names returns the names of all registered formatters in alphabetical order.
+func Names() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	names := make([]string, 0, len(formatters))
+	for name := range formatters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Lookup returns the formatter registered by name.
+func Lookup(name string) (Formatter, error) {
+	mu.RLock()
+	f, ok := formatters[name]
+	mu.RUnlock()
+	if !ok {
+		return nil, errors.Errorf("unknown format %q, available formats: %s", name, strings.Join(Names(), ", "))
+	}
+	return f, nil
+}
+
+// Format renders ips with f into a buffer.
+func Format(f Formatter, ips map[string]map[string][]netip.Prefix, opts Options) ([]byte, error) {
+	buf := bytes.Buffer{}
+	if err := f.Write(&buf, ips, opts); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// SortedASNs returns the AS numbers of ips in numerical order.
+func SortedASNs(ips map[string]map[string][]netip.Prefix) []string {
+	asns := make([]string, 0, len(ips))
+	for as := range ips {
+		asns = append(asns, as)
+	}
+	sort.Slice(asns, func(i, j int) bool {
+		a, errA := strconv.ParseUint(asns[i], 10, 32)
+		b, errB := strconv.ParseUint(asns[j], 10, 32)
+		if errA != nil || errB != nil {
+			return asns[i] < asns[j]
+		}
+		return a < b
+	})
+	return asns
+}
+
+func networkStrings(nets []netip.Prefix) []string {
+	out := make([]string, len(nets))
+	for i, n := range nets {
+		out[i] = n.String()
+	}
+	return out
+}
+
+// networksByFamily returns the networks of ips as strings, keyed by AS number and ip version.
+func networksByFamily(ips map[string]map[string][]netip.Prefix) map[string]map[string][]string {
+	result := map[string]map[string][]string{}
+	for as, families := range ips {
+		result[as] = map[string][]string{}
+		for family, nets := range families {
+			result[as][family] = networkStrings(nets)
+		}
+	}
+	return result
+}
+
+// ExpandName replaces {asn} and {family} in template, using def if template is empty.
+// family may be given as ip version or as "ipv4" and "ipv6".
+func ExpandName(template, def, as, family string) string {
+	if template == "" {
+		template = def
+	}
+	return strings.NewReplacer("{asn}", as, "{family}", strings.TrimPrefix(family, "ipv")).Replace(template)
+}
+
+// separators are the named separators accepted by ParseSeparator.
+var separators = map[string]string{
+	"newline": "\n",
+	"comma":   ",",
+	"space":   " ",
+	"tab":     "\t",
+}
+
+var separatorEscapes = strings.NewReplacer(`\\`, `\`, `\n`, "\n", `\r`, "\r", `\t`, "\t")
+
+// ParseSeparator returns the separator named by s, e.g. newline, comma, space or tab. Other
+// separators are returned with the escapes \n, \r, \t and \\ interpreted.
+func ParseSeparator(s string) string {
+	if sep, ok := separators[s]; ok {
+		return sep
+	}
+	return separatorEscapes.Replace(s)
+}
+
+// setName returns the name of the set holding the networks of as and family.
+func (o Options) setName(as, family string) string {
+	return ExpandName(o.SetName, DefaultSetName, as, family)
+}
+
+// listName returns the name of the prefix list holding the networks of as and family.
+func (o Options) listName(as, family string) string {
+	return ExpandName(o.ListName, DefaultListName, as, family)
+}
+
+// resourceName returns the name of the Kubernetes resource holding the networks of as.
+func (o Options) resourceName(as string) string {
+	return ExpandName(o.ResourceName, DefaultResourceName, as, "")
+}
+
+func (o Options) ruleSize() int {
+	if o.RuleSize < 1 {
+		return DefaultRuleSize
+	}
+	return o.RuleSize
+}
+
+func (o Options) seqStep() int {
+	if o.SeqStep < 1 {
+		return DefaultSeqStep
+	}
+	return o.SeqStep
+}
@@ -0,0 +1,94 @@
+package format
+
+import (
+	"io"
+	"net/netip"
+
+	"gopkg.in/yaml.v2"
+)
+
+func init() {
+	Register("istio", New("application/yaml; charset=utf-8", writeIstioServiceEntry))
+	Register("envoy", New("application/yaml; charset=utf-8", writeEnvoyCIDRs))
+}
+
+type serviceEntry struct {
+	APIVersion string           `yaml:"apiVersion"`
+	Kind       string           `yaml:"kind"`
+	Metadata   serviceEntryMeta `yaml:"metadata"`
+	Spec       serviceEntrySpec `yaml:"spec"`
+}
+
+type serviceEntryMeta struct {
+	Name   string            `yaml:"name"`
+	Labels map[string]string `yaml:"labels"`
+}
+
+type serviceEntrySpec struct {
+	Hosts      []string           `yaml:"hosts"`
+	Addresses  []string           `yaml:"addresses"`
+	Ports      []serviceEntryPort `yaml:"ports"`
+	Location   string             `yaml:"location"`
+	Resolution string             `yaml:"resolution"`
+}
+
+type serviceEntryPort struct {
+	Number   int    `yaml:"number"`
+	Name     string `yaml:"name"`
+	Protocol string `yaml:"protocol"`
+}
+
+// writeIstioServiceEntry writes an Istio ServiceEntry per AS, allowing egress over TLS to its
+// networks from a mesh with an outbound traffic policy of REGISTRY_ONLY.
+func writeIstioServiceEntry(w io.Writer, ips map[string]map[string][]netip.Prefix, opts Options) error {
+	enc := yaml.NewEncoder(w)
+	for _, as := range SortedASNs(ips) {
+		nets := append(ips[as]["ipv4"], ips[as]["ipv6"]...)
+		if len(nets) == 0 {
+			// a ServiceEntry without addresses would match the host name only
+			continue
+		}
+		name := opts.resourceName(as)
+		entry := serviceEntry{
+			APIVersion: "networking.istio.io/v1beta1",
+			Kind:       "ServiceEntry",
+			Metadata: serviceEntryMeta{
+				Name:   name,
+				Labels: map[string]string{"app.kubernetes.io/managed-by": "asn2ip", "asn2ip/asn": as},
+			},
+			Spec: serviceEntrySpec{
+				// hosts are required, but only name the entry for TCP traffic matched by addresses
+				Hosts:      []string{name + ".asn2ip.internal"},
+				Addresses:  networkStrings(nets),
+				Ports:      []serviceEntryPort{{Number: 443, Name: "tls", Protocol: "TLS"}},
+				Location:   "MESH_EXTERNAL",
+				Resolution: "NONE",
+			},
+		}
+		if err := enc.Encode(entry); err != nil {
+			return err
+		}
+	}
+	return enc.Close()
+}
+
+type envoyCIDRRange struct {
+	AddressPrefix string `yaml:"address_prefix"`
+	PrefixLen     int    `yaml:"prefix_len"`
+}
+
+// writeEnvoyCIDRs writes the networks of all ASNs as list of Envoy CidrRange messages, e.g. for
+// the remote_ip principals of an RBAC filter.
+func writeEnvoyCIDRs(w io.Writer, ips map[string]map[string][]netip.Prefix, opts Options) error {
+	ranges := []envoyCIDRRange{}
+	for _, as := range SortedASNs(ips) {
+		for _, n := range append(ips[as]["ipv4"], ips[as]["ipv6"]...) {
+			ranges = append(ranges, envoyCIDRRange{AddressPrefix: n.Addr().String(), PrefixLen: n.Bits()})
+		}
+	}
+	enc := yaml.NewEncoder(w)
+	if err := enc.Encode(ranges); err != nil {
+		return err
+	}
+	return enc.Close()
+}
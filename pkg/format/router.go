@@ -0,0 +1,78 @@
+package format
+
+import (
+	"fmt"
+	"io"
+	"net/netip"
+)
+
+func init() {
+	Register("cisco", New("text/plain; charset=utf-8", writeCiscoPrefixList))
+	Register("bird", New("text/plain; charset=utf-8", writeBirdDefine))
+	Register("bird-function", New("text/plain; charset=utf-8", writeBirdFunction))
+}
+
+// writeCiscoPrefixList writes an IOS prefix list per AS and ip version.
+func writeCiscoPrefixList(w io.Writer, ips map[string]map[string][]netip.Prefix, opts Options) error {
+	for _, as := range SortedASNs(ips) {
+		for _, family := range []string{"ipv4", "ipv6"} {
+			command := "ip prefix-list"
+			if family == "ipv6" {
+				command = "ipv6 prefix-list"
+			}
+			name := opts.listName(as, family)
+			for i, n := range ips[as][family] {
+				seq := (i + 1) * opts.seqStep()
+				if _, err := fmt.Fprintf(w, "%s %s seq %d permit %s\n", command, name, seq, n); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func writeBirdPrefixSet(w io.Writer, indent string, nets []netip.Prefix) error {
+	if _, err := fmt.Fprint(w, "[\n"); err != nil {
+		return err
+	}
+	for i, n := range nets {
+		sep := ","
+		if i == len(nets)-1 {
+			sep = ""
+		}
+		if _, err := fmt.Fprintf(w, "%s\t%s%s\n", indent, n, sep); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "%s]", indent)
+	return err
+}
+
+// writeBirdDefine writes a BIRD2 prefix set constant per AS and ip version.
+func writeBirdDefine(w io.Writer, ips map[string]map[string][]netip.Prefix, opts Options) error {
+	return eachSet(ips, opts, func(name, family string, nets []netip.Prefix) error {
+		if _, err := fmt.Fprintf(w, "define %s = ", name); err != nil {
+			return err
+		}
+		if err := writeBirdPrefixSet(w, "", nets); err != nil {
+			return err
+		}
+		_, err := fmt.Fprint(w, ";\n")
+		return err
+	})
+}
+
+// writeBirdFunction writes a BIRD2 function per AS and ip version matching the prefix set.
+func writeBirdFunction(w io.Writer, ips map[string]map[string][]netip.Prefix, opts Options) error {
+	return eachSet(ips, opts, func(name, family string, nets []netip.Prefix) error {
+		if _, err := fmt.Fprintf(w, "function is_%s()\n{\n\treturn net ~ ", name); err != nil {
+			return err
+		}
+		if err := writeBirdPrefixSet(w, "\t", nets); err != nil {
+			return err
+		}
+		_, err := fmt.Fprint(w, ";\n}\n")
+		return err
+	})
+}
@@ -0,0 +1,56 @@
+package format
+
+import (
+	"fmt"
+	"io"
+	"net/netip"
+	"strconv"
+)
+
+func init() {
+	Register("terraform", New("text/plain; charset=utf-8", writeTerraform))
+}
+
+// writeTerraform writes aws_security_group_rule resources allowing ingress from the networks of
+// each AS to the security group given by the variable security_group_id. The networks are
+// split into rules of at most RuleSize CIDR blocks, as AWS counts each CIDR block as a rule of
+// the security group.
+func writeTerraform(w io.Writer, ips map[string]map[string][]netip.Prefix, opts Options) error {
+	_, err := fmt.Fprint(w, "variable \"security_group_id\" {\n  type        = string\n  description = \"security group to allow ingress to\"\n}\n")
+	if err != nil {
+		return err
+	}
+	return eachSet(ips, opts, func(name, family string, nets []netip.Prefix) error {
+		attribute := "cidr_blocks"
+		if family == "ipv6" {
+			attribute = "ipv6_cidr_blocks"
+		}
+		for i := 0; i*opts.ruleSize() < len(nets); i++ {
+			chunk := nets[i*opts.ruleSize():]
+			if len(chunk) > opts.ruleSize() {
+				chunk = chunk[:opts.ruleSize()]
+			}
+			_, err := fmt.Fprintf(w, "\nresource \"aws_security_group_rule\" %s {\n"+
+				"  type              = \"ingress\"\n"+
+				"  security_group_id = var.security_group_id\n"+
+				"  protocol          = \"-1\"\n"+
+				"  from_port         = 0\n"+
+				"  to_port           = 0\n"+
+				"  description       = %s\n"+
+				"  %-17s = [\n",
+				strconv.Quote(fmt.Sprintf("%s_%d", name, i+1)), strconv.Quote("managed by asn2ip"), attribute)
+			if err != nil {
+				return err
+			}
+			for _, n := range chunk {
+				if _, err := fmt.Fprintf(w, "    %s,\n", strconv.Quote(n.String())); err != nil {
+					return err
+				}
+			}
+			if _, err := fmt.Fprint(w, "  ]\n}\n"); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,119 @@
+// Package geoip locates networks with a MaxMind DB like GeoLite2 Country, read entirely into
+// memory so lookups need no locking.
+package geoip
+
+import (
+	"net/netip"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Location is the country of a network and the regional internet registry serving it.
+type Location struct {
+	// Country is the ISO 3166-1 code of the country, empty if unknown.
+	Country string
+	// Registry is the RIR serving Country, e.g. ripencc or arin, empty if unknown.
+	Registry string
+}
+
+// DB is a MaxMind DB opened with Open.
+type DB struct {
+	meta metadata
+	tree []byte
+	data decoder
+	// ipv4Start is the node of ::/96, where IPv4 addresses start in IPv6 trees.
+	ipv4Start uint
+}
+
+// Open reads the MaxMind DB at path.
+func Open(path string) (*DB, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read geoip database")
+	}
+	db, err := Parse(b)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid geoip database %s", path)
+	}
+	return db, nil
+}
+
+// Parse returns the MaxMind DB held by b.
+func Parse(b []byte) (*DB, error) {
+	meta, b, err := parseMetadata(b)
+	if err != nil {
+		return nil, err
+	}
+	treeSize := meta.nodeCount * meta.recordSize / 4
+	// the search tree is followed by 16 zero bytes separating it from the data section
+	if uint(len(b)) < treeSize+16 {
+		return nil, errors.Errorf("search tree of %d nodes exceeds database", meta.nodeCount)
+	}
+	db := &DB{meta: meta, tree: b[:treeSize], data: decoder{data: b[treeSize+16:]}}
+	if meta.ipVersion == 6 {
+		for i := 0; i < 96 && db.ipv4Start < meta.nodeCount; i++ {
+			db.ipv4Start = meta.record(db.tree, db.ipv4Start, 0)
+		}
+	}
+	return db, nil
+}
+
+// Lookup returns the location of the first address of n. Networks spanning several countries
+// are located by their first address only.
+func (db *DB) Lookup(n netip.Prefix) (Location, error) {
+	record, err := db.lookup(n.Masked().Addr().Unmap())
+	if err != nil || record == nil {
+		return Location{}, err
+	}
+	country := stringAt(record, "country", "iso_code")
+	if country == "" {
+		// networks of anycast or satellite providers only name the country they are registered in
+		country = stringAt(record, "registered_country", "iso_code")
+	}
+	return Location{Country: country, Registry: Registry(country, stringAt(record, "continent", "code"))}, nil
+}
+
+// lookup returns the data record of addr, nil if the database holds none.
+func (db *DB) lookup(addr netip.Addr) (map[string]interface{}, error) {
+	node, bits := uint(0), addr.BitLen()
+	if addr.Is4() {
+		if db.meta.ipVersion == 6 {
+			node = db.ipv4Start
+		}
+	} else if db.meta.ipVersion == 4 {
+		return nil, nil
+	}
+	ip := addr.AsSlice()
+	for i := 0; i < bits && node < db.meta.nodeCount; i++ {
+		node = db.meta.record(db.tree, node, uint(ip[i/8]>>(7-i%8)&1))
+	}
+	if node <= db.meta.nodeCount {
+		// equal to the node count marks addresses without data
+		return nil, nil
+	}
+	value, _, err := db.data.decode(node - db.meta.nodeCount - 16)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to decode record of %s", addr)
+	}
+	record, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, errors.Errorf("record of %s is no map", addr)
+	}
+	return record, nil
+}
+
+// stringAt returns the string found by following keys through nested maps of record.
+func stringAt(record map[string]interface{}, keys ...string) string {
+	var value interface{} = record
+	for _, key := range keys {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		value = m[key]
+	}
+	s, _ := value.(string)
+	return strings.ToUpper(s)
+}
@@ -0,0 +1,96 @@
+package geoip
+
+import (
+	"net/netip"
+	"testing"
+)
+
+// mmdbString encodes a string of less than 29 bytes.
+func mmdbString(s string) []byte {
+	return append([]byte{typeString<<5 | byte(len(s))}, s...)
+}
+
+// mmdbMap encodes a map of less than 29 entries from alternating keys and values.
+func mmdbMap(kv ...[]byte) []byte {
+	b := []byte{typeMap<<5 | byte(len(kv)/2)}
+	for _, v := range kv {
+		b = append(b, v...)
+	}
+	return b
+}
+
+// mmdbUint16 encodes n as uint16 of two bytes.
+func mmdbUint16(n uint16) []byte {
+	return []byte{typeUint16<<5 | 2, byte(n >> 8), byte(n)}
+}
+
+// mmdbPointer encodes a pointer to an offset below 2048.
+func mmdbPointer(offset uint16) []byte {
+	return []byte{typePointer<<5 | byte(offset>>8), byte(offset)}
+}
+
+// mmdb builds an IPv4 database of a single node, locating 0.0.0.0/1 by the record at the
+// start of data and leaving 128.0.0.0/1 without data.
+func mmdb(data []byte) []byte {
+	const nodeCount = 1
+	left := nodeCount + 16
+	b := []byte{0, 0, byte(left), 0, 0, nodeCount}
+	b = append(b, make([]byte, 16)...)
+	b = append(b, data...)
+	b = append(b, metadataMarker...)
+	return append(b, mmdbMap(
+		mmdbString("node_count"), mmdbUint16(nodeCount),
+		mmdbString("record_size"), mmdbUint16(24),
+		mmdbString("ip_version"), mmdbUint16(4),
+	)...)
+}
+
+func TestLookup(t *testing.T) {
+	db, err := Parse(mmdb(mmdbMap(
+		mmdbString("country"), mmdbMap(mmdbString("iso_code"), mmdbString("de")),
+		mmdbString("continent"), mmdbMap(mmdbString("code"), mmdbString("EU")),
+	)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		network string
+		want    Location
+	}{
+		{"192.0.2.0/24", Location{}},
+		{"10.0.0.0/8", Location{Country: "DE", Registry: Registry("DE", "EU")}},
+		{"2001:db8::/32", Location{}},
+	} {
+		got, err := db.Lookup(netip.MustParsePrefix(tt.network))
+		if err != nil {
+			t.Errorf("lookup of %s failed: %s", tt.network, err)
+		} else if got != tt.want {
+			t.Errorf("got %+v for %s, expected %+v", got, tt.network, tt.want)
+		}
+	}
+}
+
+func TestLookupCorrupt(t *testing.T) {
+	for name, data := range map[string][]byte{
+		"pointer to pointer": append(mmdbPointer(2), mmdbPointer(0)...),
+		"pointer cycle":      mmdbMap(mmdbString("country"), mmdbPointer(0)),
+		// an extended array type announcing 16M entries
+		"oversized array": {0x1f, 4, 0xff, 0xff, 0xff},
+		"oversized map":   {typeMap<<5 | 30, 0xff, 0xff},
+	} {
+		db, err := Parse(mmdb(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Lookup(netip.MustParsePrefix("10.0.0.0/8")); err == nil {
+			t.Errorf("lookup in database with %s succeeded, expected an error", name)
+		}
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	if _, err := Parse([]byte("no database")); err == nil {
+		t.Error("parsing data without metadata succeeded, expected an error")
+	}
+}
@@ -0,0 +1,240 @@
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+
+	"github.com/pkg/errors"
+)
+
+// metadataMarker precedes the metadata map at the end of a MaxMind DB file.
+var metadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// data types of the MaxMind DB data section
+const (
+	typeExtended = iota
+	typePointer
+	typeString
+	typeDouble
+	typeBytes
+	typeUint16
+	typeUint32
+	typeMap
+	typeInt32
+	typeUint64
+	typeUint128
+	typeArray
+	typeContainer
+	typeEndMarker
+	typeBool
+	typeFloat
+)
+
+// decoder decodes values of the data section of a MaxMind DB, see
+// https://maxmind.github.io/MaxMind-DB/.
+type decoder struct {
+	data []byte
+}
+
+// maxDepth bounds the nesting of maps, arrays and pointers, so corrupt databases with pointer
+// cycles fail to decode instead of overflowing the stack. libmaxminddb uses the same limit.
+const maxDepth = 512
+
+// decode returns the value at offset and the offset following it. Maps are returned as
+// map[string]interface{}, arrays as []interface{} and numbers as uint64, int64 or float64.
+func (d decoder) decode(offset uint) (interface{}, uint, error) {
+	return d.decodeAt(offset, 0)
+}
+
+func (d decoder) decodeAt(offset uint, depth int) (interface{}, uint, error) {
+	if depth > maxDepth {
+		return nil, 0, errors.Errorf("data nested deeper than %d levels at offset %d", maxDepth, offset)
+	}
+	typ, size, offset, err := d.control(offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	if typ == typePointer {
+		// pointers to pointers are invalid
+		if target, _, _, err := d.control(size); err != nil {
+			return nil, 0, err
+		} else if target == typePointer {
+			return nil, 0, errors.Errorf("pointer at offset %d points to another pointer", offset)
+		}
+		// pointers are followed, but the offset continues after the pointer itself
+		value, _, err := d.decodeAt(size, depth+1)
+		return value, offset, err
+	}
+	// every key and value takes at least a byte, check sizes before allocating for them
+	remaining := uint(len(d.data)) - offset
+	if typ == typeMap && remaining/2 < size || typ == typeArray && remaining < size {
+		return nil, 0, errors.Errorf("%d entries at offset %d exceed data section", size, offset)
+	}
+	if typ != typeMap && typ != typeArray && typ != typeBool && uint(len(d.data)) < offset+size {
+		return nil, 0, errors.Errorf("value of size %d at offset %d exceeds data section", size, offset)
+	}
+	switch typ {
+	case typeString:
+		return string(d.data[offset : offset+size]), offset + size, nil
+	case typeBytes:
+		return append([]byte{}, d.data[offset:offset+size]...), offset + size, nil
+	case typeDouble:
+		if size != 8 {
+			return nil, 0, errors.Errorf("invalid double of size %d", size)
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(d.data[offset:])), offset + size, nil
+	case typeFloat:
+		if size != 4 {
+			return nil, 0, errors.Errorf("invalid float of size %d", size)
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(d.data[offset:]))), offset + size, nil
+	case typeUint16, typeUint32, typeUint64, typeUint128:
+		var n uint64
+		for _, b := range d.data[offset : offset+size] {
+			n = n<<8 | uint64(b)
+		}
+		return n, offset + size, nil
+	case typeInt32:
+		var n uint32
+		for _, b := range d.data[offset : offset+size] {
+			n = n<<8 | uint32(b)
+		}
+		return int64(int32(n)), offset + size, nil
+	case typeBool:
+		return size != 0, offset, nil
+	case typeMap:
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			key, next, err := d.decodeAt(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			k, ok := key.(string)
+			if !ok {
+				return nil, 0, errors.Errorf("map key at offset %d is no string", offset)
+			}
+			if m[k], offset, err = d.decodeAt(next, depth+1); err != nil {
+				return nil, 0, err
+			}
+		}
+		return m, offset, nil
+	case typeArray:
+		a := make([]interface{}, size)
+		for i := range a {
+			if a[i], offset, err = d.decodeAt(offset, depth+1); err != nil {
+				return nil, 0, err
+			}
+		}
+		return a, offset, nil
+	}
+	return nil, 0, errors.Errorf("unsupported data type %d at offset %d", typ, offset)
+}
+
+// control parses the control byte at offset, returning the type and size of the value and the
+// offset of its payload. The size of pointers is the offset they point to.
+func (d decoder) control(offset uint) (int, uint, uint, error) {
+	next := func(n uint) ([]byte, error) {
+		if uint(len(d.data)) < offset+n {
+			return nil, errors.Errorf("truncated data at offset %d", offset)
+		}
+		b := d.data[offset : offset+n]
+		offset += n
+		return b, nil
+	}
+	b, err := next(1)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	ctrl := b[0]
+	typ := int(ctrl >> 5)
+	if typ == typePointer {
+		n := uint(ctrl>>3&0x3) + 1
+		b, err := next(n)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		var p uint
+		if n < 4 {
+			p = uint(ctrl & 0x7)
+		}
+		for _, c := range b {
+			p = p<<8 | uint(c)
+		}
+		p += [...]uint{0, 2048, 526336, 0}[n-1]
+		return typ, p, offset, nil
+	}
+	if typ == typeExtended {
+		b, err := next(1)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		typ = 7 + int(b[0])
+	}
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		b, err := next(size - 28)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		n := uint(0)
+		for _, c := range b {
+			n = n<<8 | uint(c)
+		}
+		size = [...]uint{29, 285, 65821}[size-29] + n
+	}
+	return typ, size, offset, nil
+}
+
+// metadata holds the fields of the metadata map needed to search the tree.
+type metadata struct {
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+}
+
+// parseMetadata decodes the metadata map following the last metadata marker of db.
+func parseMetadata(db []byte) (metadata, []byte, error) {
+	i := bytes.LastIndex(db, metadataMarker)
+	if i < 0 {
+		return metadata{}, nil, errors.New("no MaxMind DB metadata found")
+	}
+	value, _, err := decoder{data: db[i+len(metadataMarker):]}.decode(0)
+	if err != nil {
+		return metadata{}, nil, errors.Wrap(err, "failed to decode metadata")
+	}
+	m, ok := value.(map[string]interface{})
+	if !ok {
+		return metadata{}, nil, errors.New("metadata is no map")
+	}
+	uintOf := func(key string) uint {
+		n, _ := m[key].(uint64)
+		return uint(n)
+	}
+	meta := metadata{nodeCount: uintOf("node_count"), recordSize: uintOf("record_size"), ipVersion: uintOf("ip_version")}
+	switch meta.recordSize {
+	case 24, 28, 32:
+	default:
+		return metadata{}, nil, errors.Errorf("unsupported record size %d", meta.recordSize)
+	}
+	if meta.ipVersion != 4 && meta.ipVersion != 6 {
+		return metadata{}, nil, errors.Errorf("unsupported ip version %d", meta.ipVersion)
+	}
+	return meta, db[:i], nil
+}
+
+// record returns the left (bit 0) or right (bit 1) record of node in tree.
+func (m metadata) record(tree []byte, node, bit uint) uint {
+	n := tree[node*m.recordSize/4:]
+	switch m.recordSize {
+	case 24:
+		b := n[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		if bit == 0 {
+			return uint(n[3]&0xf0)<<20 | uint(n[0])<<16 | uint(n[1])<<8 | uint(n[2])
+		}
+		return uint(n[3]&0x0f)<<24 | uint(n[4])<<16 | uint(n[5])<<8 | uint(n[6])
+	}
+	return uint(binary.BigEndian.Uint32(n[bit*4:]))
+}
@@ -0,0 +1,36 @@
+package geoip
+
+// continentRegistries are the RIRs serving most countries of a continent, named like the
+// registries in Team Cymru responses.
+var continentRegistries = map[string]string{
+	"AF": "afrinic",
+	"AS": "apnic",
+	"EU": "ripencc",
+	"NA": "arin",
+	"OC": "apnic",
+	"SA": "lacnic",
+}
+
+// countryRegistries are the countries served by another RIR than most of their continent.
+var countryRegistries = map[string]string{
+	// Middle East and Central Asia
+	"AE": "ripencc", "AM": "ripencc", "AZ": "ripencc", "BH": "ripencc", "CY": "ripencc",
+	"GE": "ripencc", "IL": "ripencc", "IQ": "ripencc", "IR": "ripencc", "JO": "ripencc",
+	"KG": "ripencc", "KW": "ripencc", "KZ": "ripencc", "LB": "ripencc", "OM": "ripencc",
+	"PS": "ripencc", "QA": "ripencc", "SA": "ripencc", "SY": "ripencc", "TJ": "ripencc",
+	"TM": "ripencc", "TR": "ripencc", "UZ": "ripencc", "YE": "ripencc", "GL": "ripencc",
+	// Central America and the Caribbean
+	"AW": "lacnic", "BQ": "lacnic", "BZ": "lacnic", "CR": "lacnic", "CU": "lacnic",
+	"CW": "lacnic", "DO": "lacnic", "GT": "lacnic", "HN": "lacnic", "HT": "lacnic",
+	"MX": "lacnic", "NI": "lacnic", "PA": "lacnic", "SV": "lacnic", "SX": "lacnic",
+	"TT": "lacnic",
+}
+
+// Registry returns the RIR serving the country with the ISO 3166-1 code country on continent,
+// empty if unknown.
+func Registry(country, continent string) string {
+	if registry, ok := countryRegistries[country]; ok {
+		return registry
+	}
+	return continentRegistries[continent]
+}
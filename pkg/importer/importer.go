@@ -0,0 +1,59 @@
+package importer
+
+import (
+	"context"
+	"io"
+	"net/netip"
+
+	"github.com/g0dsCookie/asn2ip/pkg/storage"
+	"github.com/pkg/errors"
+)
+
+// Result summarizes an import.
+type Result struct {
+	// Prefixes is the number of prefixes read from the dump.
+	Prefixes int
+	// ASNs is the number of origin AS numbers written to storage.
+	ASNs int
+}
+
+// Import reads a MRT RIB dump from r and replaces the networks of each origin AS found in it.
+// ASNs not announcing any prefix in the dump are left untouched.
+func Import(ctx context.Context, r io.Reader, stor storage.Storage) (Result, error) {
+	result := Result{}
+	asns := map[string]*storage.ASStorage{}
+	err := ReadRIB(r, func(prefix netip.Prefix, origins []string) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		result.Prefixes++
+		for _, as := range origins {
+			entry, ok := asns[as]
+			if !ok {
+				entry = &storage.ASStorage{AS: as, IPv4: []netip.Prefix{}, IPv6: []netip.Prefix{}, FetchedIPv4: true, FetchedIPv6: true}
+				asns[as] = entry
+			}
+			// every prefix appears once in a rib dump, no need to deduplicate
+			if prefix.Addr().Is4() {
+				entry.IPv4 = append(entry.IPv4, prefix)
+			} else {
+				entry.IPv6 = append(entry.IPv6, prefix)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return result, errors.Wrap(err, "failed to read rib dump")
+	}
+
+	for as, entry := range asns {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+		if err := stor.Set(*entry); err != nil {
+			return result, errors.Wrapf(err, "failed to store asn %s", as)
+		}
+		result.ASNs++
+	}
+	return result, nil
+}
@@ -0,0 +1,256 @@
+// Package importer populates the storage with BGP announced prefixes taken from MRT RIB dumps,
+// as published by RouteViews or RIPE RIS.
+package importer
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// MRT types and subtypes as defined in RFC 6396.
+const (
+	mrtTableDumpV2 = 13
+
+	subtypePeerIndexTable = 1
+	subtypeRIBIPv4Unicast = 2
+	subtypeRIBIPv6Unicast = 4
+
+	attrASPath = 2
+
+	asPathSegmentSet = 1
+
+	// mrtMaxRecordLength bounds the memory allocated for a single record, RIB entries of a
+	// prefix seen by thousands of peers take a few megabytes at most.
+	mrtMaxRecordLength = 64 << 20
+)
+
+var ErrUnsupportedFormat = errors.New("unsupported mrt format")
+
+// Open opens a local MRT dump or downloads it if source is an http(s) url.
+// Gzip and bzip2 compressed dumps are decompressed transparently.
+func Open(ctx context.Context, source string) (io.ReadCloser, error) {
+	var rc io.ReadCloser
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to create request for %s", source)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to download %s", source)
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, errors.Errorf("failed to download %s: %s", source, resp.Status)
+		}
+		rc = resp.Body
+	} else {
+		f, err := os.Open(source)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to open %s", source)
+		}
+		rc = f
+	}
+
+	br := bufio.NewReader(rc)
+	magic, _ := br.Peek(3)
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			rc.Close()
+			return nil, errors.Wrapf(err, "failed to decompress %s", source)
+		}
+		return readCloser{Reader: gz, closers: []io.Closer{gz, rc}}, nil
+	case bytes.Equal(magic, []byte("BZh")):
+		return readCloser{Reader: bzip2.NewReader(br), closers: []io.Closer{rc}}, nil
+	}
+	return readCloser{Reader: br, closers: []io.Closer{rc}}, nil
+}
+
+type readCloser struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (r readCloser) Close() error {
+	var err error
+	for _, c := range r.closers {
+		if cerr := c.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// ReadRIB parses a TABLE_DUMP_V2 RIB dump and calls fn for each prefix with the origin AS
+// numbers of all its announcements. Records of other types are skipped, dumps without any
+// TABLE_DUMP_V2 record fail with ErrUnsupportedFormat.
+func ReadRIB(r io.Reader, fn func(prefix netip.Prefix, origins []string) error) error {
+	header := make([]byte, 12)
+	found := false
+	for {
+		if _, err := io.ReadFull(r, header); err == io.EOF {
+			if !found {
+				return errors.Wrap(ErrUnsupportedFormat, "no TABLE_DUMP_V2 records")
+			}
+			return nil
+		} else if err != nil {
+			return errors.Wrap(err, "failed to read mrt header")
+		}
+		typ := binary.BigEndian.Uint16(header[4:6])
+		subtype := binary.BigEndian.Uint16(header[6:8])
+		length := binary.BigEndian.Uint32(header[8:12])
+		if length > mrtMaxRecordLength {
+			return errors.Errorf("mrt record of %d bytes exceeds the maximum of %d bytes", length, mrtMaxRecordLength)
+		}
+		if typ != mrtTableDumpV2 {
+			if _, err := io.CopyN(io.Discard, r, int64(length)); err != nil {
+				return errors.Wrap(err, "failed to read mrt record")
+			}
+			continue
+		}
+		found = true
+
+		body := make([]byte, length)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return errors.Wrap(err, "failed to read mrt record")
+		}
+
+		var family int
+		switch subtype {
+		case subtypeRIBIPv4Unicast:
+			family = 4
+		case subtypeRIBIPv6Unicast:
+			family = 6
+		default:
+			// peer index table and other address families are not needed
+			continue
+		}
+
+		prefix, origins, err := parseRIB(body, family)
+		if err != nil {
+			return err
+		}
+		if len(origins) == 0 {
+			continue
+		}
+		if err := fn(prefix, origins); err != nil {
+			return err
+		}
+	}
+}
+
+// parseRIB parses a RIB_IPV4_UNICAST or RIB_IPV6_UNICAST record.
+func parseRIB(b []byte, family int) (netip.Prefix, []string, error) {
+	size := 4
+	if family == 6 {
+		size = 16
+	}
+	if len(b) < 5 {
+		return netip.Prefix{}, nil, errors.New("truncated rib record")
+	}
+	// skip sequence number
+	bits := int(b[4])
+	n := (bits + 7) / 8
+	if bits > size*8 || len(b) < 5+n+2 {
+		return netip.Prefix{}, nil, errors.New("invalid rib prefix")
+	}
+	var ip [16]byte
+	copy(ip[:], b[5:5+n])
+	addr := netip.AddrFrom16(ip)
+	if family == 4 {
+		addr = netip.AddrFrom4([4]byte{ip[0], ip[1], ip[2], ip[3]})
+	}
+	prefix := netip.PrefixFrom(addr, bits).Masked()
+	b = b[5+n:]
+
+	count := int(binary.BigEndian.Uint16(b[:2]))
+	b = b[2:]
+	origins := []string{}
+	seen := map[string]bool{}
+	for i := 0; i < count; i++ {
+		// peer index (2), originated time (4), attribute length (2)
+		if len(b) < 8 {
+			return netip.Prefix{}, nil, errors.Errorf("truncated rib entry of %s", prefix)
+		}
+		attrLen := int(binary.BigEndian.Uint16(b[6:8]))
+		if len(b) < 8+attrLen {
+			return netip.Prefix{}, nil, errors.Errorf("truncated rib entry of %s", prefix)
+		}
+		entryOrigins, err := parseOrigins(b[8 : 8+attrLen])
+		if err != nil {
+			return netip.Prefix{}, nil, errors.Wrapf(err, "invalid rib entry of %s", prefix)
+		}
+		for _, as := range entryOrigins {
+			if !seen[as] {
+				seen[as] = true
+				origins = append(origins, as)
+			}
+		}
+		b = b[8+attrLen:]
+	}
+	return prefix, origins, nil
+}
+
+// parseOrigins returns the origin AS numbers from the AS_PATH attribute. Aggregated routes
+// ending in an AS_SET have all set members as origin.
+func parseOrigins(attrs []byte) ([]string, error) {
+	for len(attrs) > 0 {
+		if len(attrs) < 3 {
+			return nil, errors.New("truncated path attribute")
+		}
+		flags, typ := attrs[0], attrs[1]
+		length, offset := int(attrs[2]), 3
+		if flags&0x10 != 0 {
+			// extended length
+			if len(attrs) < 4 {
+				return nil, errors.New("truncated path attribute")
+			}
+			length, offset = int(binary.BigEndian.Uint16(attrs[2:4])), 4
+		}
+		if len(attrs) < offset+length {
+			return nil, errors.New("truncated path attribute")
+		}
+		value := attrs[offset : offset+length]
+		attrs = attrs[offset+length:]
+		if typ != attrASPath {
+			continue
+		}
+
+		// AS_PATH in TABLE_DUMP_V2 always uses 4 byte AS numbers
+		var last []string
+		for len(value) > 0 {
+			if len(value) < 2 || len(value) < 2+int(value[1])*4 {
+				return nil, errors.New("truncated as path segment")
+			}
+			segType, count := value[0], int(value[1])
+			asns := make([]string, count)
+			for i := 0; i < count; i++ {
+				asns[i] = strconv.FormatUint(uint64(binary.BigEndian.Uint32(value[2+i*4:])), 10)
+			}
+			if count > 0 {
+				if segType == asPathSegmentSet {
+					last = asns
+				} else {
+					last = asns[count-1:]
+				}
+			}
+			value = value[2+count*4:]
+		}
+		return last, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,40 @@
+package importer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net/netip"
+	"testing"
+)
+
+// mrtHeader returns the common header of a record of typ announcing length bytes of body.
+func mrtHeader(typ, subtype uint16, length uint32) []byte {
+	header := make([]byte, 12)
+	binary.BigEndian.PutUint16(header[4:6], typ)
+	binary.BigEndian.PutUint16(header[6:8], subtype)
+	binary.BigEndian.PutUint32(header[8:12], length)
+	return header
+}
+
+func TestReadRIBRecordTypes(t *testing.T) {
+	fn := func(prefix netip.Prefix, origins []string) error {
+		t.Errorf("got prefix %s, expected none", prefix)
+		return nil
+	}
+	tableDump := append(mrtHeader(12, 1, 4), 0, 0, 0, 0)
+	peerIndex := mrtHeader(mrtTableDumpV2, subtypePeerIndexTable, 0)
+
+	if err := ReadRIB(bytes.NewReader(append(tableDump, peerIndex...)), fn); err != nil {
+		t.Errorf("got %v, expected the TABLE_DUMP record to be skipped", err)
+	}
+	if err := ReadRIB(bytes.NewReader(tableDump), fn); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Errorf("got %v for a dump without TABLE_DUMP_V2 records, expected %v", err, ErrUnsupportedFormat)
+	}
+	if err := ReadRIB(bytes.NewReader(mrtHeader(12, 1, 1<<32-1)), fn); err == nil {
+		t.Error("ReadRIB succeeded for a TABLE_DUMP record of 4 GiB, expected an error")
+	}
+	if err := ReadRIB(bytes.NewReader(mrtHeader(mrtTableDumpV2, subtypeRIBIPv4Unicast, 1<<32-1)), fn); err == nil {
+		t.Error("ReadRIB succeeded for a record of 4 GiB, expected an error")
+	}
+}
@@ -0,0 +1,733 @@
+package storage
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"net/netip"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"go.etcd.io/bbolt"
+)
+
+const (
+	boltDefaultPath     = "asn2ip.db"
+	boltCompactInterval = time.Hour
+)
+
+var (
+	boltBucket = []byte("asn")
+	// boltSnapshots holds a bucket per AS, keyed by the big endian unix time in nanoseconds
+	boltSnapshots = []byte("snapshots")
+	// boltHistory holds a bucket per AS, keyed by prefix
+	boltHistory = []byte("history")
+	// boltChanges holds a bucket per AS, keyed by a big endian sequence number
+	boltChanges = []byte("changes")
+	// boltChangeLogs holds the start and present prefixes of the change log, keyed by AS
+	boltChangeLogs = []byte("change_logs")
+)
+
+type boltRecord struct {
+	IPv4        []string  `json:"ipv4"`
+	IPv6        []string  `json:"ipv6"`
+	FetchedIPv4 bool      `json:"fetched_ipv4"`
+	FetchedIPv6 bool      `json:"fetched_ipv6"`
+	NotFound    bool      `json:"not_found,omitempty"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+type boltSnapshot struct {
+	IPv4 []string `json:"ipv4"`
+	IPv6 []string `json:"ipv6"`
+}
+
+type boltPrefixHistory struct {
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+type boltChangeLog struct {
+	// Start is zero unless changes were pruned
+	Start   time.Time `json:"start"`
+	Present []string  `json:"present"`
+}
+
+type boltPrefixChange struct {
+	Prefix string    `json:"prefix"`
+	Time   time.Time `json:"time"`
+	Added  bool      `json:"added"`
+}
+
+type boltStorage struct {
+	// mu guards db against being swapped while compacting
+	mu      sync.RWMutex
+	db      *bbolt.DB
+	path    string
+	opts    StorageOptions
+	expired uint64
+	hits    uint64
+	misses  uint64
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+
+	*ttls
+}
+
+func newBolt(opts StorageOptions) (Storage, error) {
+	path := opts.Path
+	if path == "" {
+		path = opts.String("path", boltDefaultPath)
+	}
+	compactInterval, err := opts.Duration("compact-interval", boltCompactInterval)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := openBolt(path)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &boltStorage{
+		db:   db,
+		path: path,
+		opts: opts,
+		ttls: newTTLs(opts),
+		stop: make(chan struct{}),
+	}
+	b.wg.Add(1)
+	go b.maintain(compactInterval)
+	return b, nil
+}
+
+func openBolt(path string) (*bbolt.DB, error) {
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open bolt database %s", path)
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(boltBucket); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists(boltSnapshots); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists(boltHistory); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists(boltChanges); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(boltChangeLogs)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, errors.Wrapf(err, "failed to create bucket in %s", path)
+	}
+	return db, nil
+}
+
+func encodeNets(nets []netip.Prefix) []string {
+	out := make([]string, len(nets))
+	for i, n := range nets {
+		out[i] = n.String()
+	}
+	return out
+}
+
+// parsePrefix parses a stored network, which is always masked.
+func parsePrefix(s string) (netip.Prefix, error) {
+	prefix, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, errors.Wrapf(err, "failed to parse stored network %s", s)
+	}
+	return prefix.Masked(), nil
+}
+
+func decodeNets(nets []string) ([]netip.Prefix, error) {
+	out := make([]netip.Prefix, 0, len(nets))
+	for _, n := range nets {
+		prefix, err := parsePrefix(n)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, prefix)
+	}
+	return out, nil
+}
+
+func (b *boltStorage) Get(as string) (ASStorage, error) {
+	b.opts.Logger.WithFields(logrus.Fields{"asn": as}).Debugln("trying to fetch asn from cache")
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	var rec *boltRecord
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		v := tx.Bucket(boltBucket).Get([]byte(as))
+		if v == nil {
+			return nil
+		}
+		rec = &boltRecord{}
+		return json.Unmarshal(v, rec)
+	})
+	if err != nil {
+		return ASStorage{}, errors.Wrapf(err, "failed to read asn %s from bolt database", as)
+	}
+	if rec == nil {
+		b.opts.Logger.WithFields(logrus.Fields{"asn": as}).Debugln("cache missed for asn")
+		atomic.AddUint64(&b.misses, 1)
+		return ASStorage{}, ErrASNotCached
+	}
+	if b.isExpired(rec) {
+		b.opts.Logger.WithFields(logrus.Fields{"asn": as, "ttl": rec.UpdatedAt}).Infoln("ttl expired for asn")
+		// expired entries are purged by the maintenance routine
+		atomic.AddUint64(&b.misses, 1)
+		return ASStorage{}, ErrASNotCached
+	}
+	atomic.AddUint64(&b.hits, 1)
+	return rec.entry(as, b.ttls)
+}
+
+func (b *boltStorage) List() ([]ASStorage, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	entries := []ASStorage{}
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(boltBucket).ForEach(func(k, v []byte) error {
+			rec := &boltRecord{}
+			if err := json.Unmarshal(v, rec); err != nil {
+				return errors.Wrapf(err, "failed to decode asn %s", k)
+			}
+			if b.isExpired(rec) {
+				return nil
+			}
+			entry, err := rec.entry(string(k), b.ttls)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, entry)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list asns in bolt database")
+	}
+	sortEntries(entries)
+	return entries, nil
+}
+
+// entry decodes rec, the cache entry of as.
+func (rec *boltRecord) entry(as string, ttls *ttls) (ASStorage, error) {
+	ipv4, err := decodeNets(rec.IPv4)
+	if err != nil {
+		return ASStorage{}, err
+	}
+	ipv6, err := decodeNets(rec.IPv6)
+	if err != nil {
+		return ASStorage{}, err
+	}
+	return ASStorage{
+		AS:          as,
+		IPv4:        ipv4,
+		IPv6:        ipv6,
+		FetchedIPv4: rec.FetchedIPv4,
+		FetchedIPv6: rec.FetchedIPv6,
+		NotFound:    rec.NotFound,
+		Expires:     rec.UpdatedAt.Add(ttls.of(ASStorage{NotFound: rec.NotFound})),
+		Stored:      rec.UpdatedAt,
+	}, nil
+}
+
+func (b *boltStorage) isExpired(rec *boltRecord) bool {
+	return time.Since(rec.UpdatedAt) > b.ttls.of(ASStorage{NotFound: rec.NotFound})
+}
+
+func (b *boltStorage) Set(as ASStorage) error {
+	now := time.Now()
+	v, err := json.Marshal(boltRecord{
+		IPv4:        encodeNets(as.IPv4),
+		IPv6:        encodeNets(as.IPv6),
+		FetchedIPv4: as.FetchedIPv4,
+		FetchedIPv6: as.FetchedIPv6,
+		NotFound:    as.NotFound,
+		UpdatedAt:   now,
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to encode asn %s", as.AS)
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	err = b.db.Update(func(tx *bbolt.Tx) error {
+		if err := tx.Bucket(boltBucket).Put([]byte(as.AS), v); err != nil {
+			return err
+		}
+		if err := b.snapshot(tx, as, now); err != nil {
+			return err
+		}
+		return b.record(tx, as, now)
+	})
+	return errors.Wrapf(err, "failed to write asn %s to bolt database", as.AS)
+}
+
+// snapshot records as if it changed since the last snapshot.
+func (b *boltStorage) snapshot(tx *bbolt.Tx, as ASStorage, now time.Time) error {
+	if b.opts.Snapshots <= 0 {
+		return nil
+	}
+	bucket, err := tx.Bucket(boltSnapshots).CreateBucketIfNotExists([]byte(as.AS))
+	if err != nil {
+		return err
+	}
+	var last *Snapshot
+	if k, v := bucket.Cursor().Last(); k != nil {
+		snap, err := decodeBoltSnapshot(as.AS, k, v)
+		if err != nil {
+			return err
+		}
+		last = &snap
+	}
+	snap, ok := takeSnapshot(last, as, now)
+	if !ok {
+		return nil
+	}
+	v, err := json.Marshal(boltSnapshot{IPv4: encodeNets(snap.IPv4), IPv6: encodeNets(snap.IPv6)})
+	if err != nil {
+		return err
+	}
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(now.UnixNano()))
+	if err := bucket.Put(key, v); err != nil {
+		return err
+	}
+	// drop the oldest snapshots
+	keys := [][]byte{}
+	bucket.ForEach(func(k, v []byte) error {
+		keys = append(keys, append([]byte{}, k...))
+		return nil
+	})
+	for len(keys) > b.opts.Snapshots {
+		if err := bucket.Delete(keys[0]); err != nil {
+			return err
+		}
+		keys = keys[1:]
+	}
+	return nil
+}
+
+// record updates the prefix history and change log of as.
+func (b *boltStorage) record(tx *bbolt.Tx, as ASStorage, now time.Time) error {
+	if !b.opts.History {
+		return nil
+	}
+	bucket, err := tx.Bucket(boltHistory).CreateBucketIfNotExists([]byte(as.AS))
+	if err != nil {
+		return err
+	}
+	for _, n := range as.IPAddresses() {
+		key := []byte(n.String())
+		h := boltPrefixHistory{FirstSeen: now}
+		if v := bucket.Get(key); v != nil {
+			if err := json.Unmarshal(v, &h); err != nil {
+				return errors.Wrapf(err, "failed to decode history of %s", n)
+			}
+		}
+		h.LastSeen = now
+		v, err := json.Marshal(h)
+		if err != nil {
+			return err
+		}
+		if err := bucket.Put(key, v); err != nil {
+			return err
+		}
+	}
+	return b.recordChanges(tx, as, now)
+}
+
+// recordChanges appends the prefixes added to or removed from as to its change log and
+// drops changes older than the history retention.
+func (b *boltStorage) recordChanges(tx *bbolt.Tx, as ASStorage, now time.Time) error {
+	bucket, err := tx.Bucket(boltChanges).CreateBucketIfNotExists([]byte(as.AS))
+	if err != nil {
+		return err
+	}
+	state, err := readChangeLog(tx, bucket, as.AS)
+	if err != nil {
+		return err
+	}
+	present := map[netip.Prefix]bool{}
+	for _, n := range state.Present {
+		present[n] = true
+	}
+	for _, c := range changes(present, as, now) {
+		seq, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, seq)
+		v, err := json.Marshal(boltPrefixChange{Prefix: c.Prefix.String(), Time: c.Time, Added: c.Added})
+		if err != nil {
+			return err
+		}
+		if err := bucket.Put(key, v); err != nil {
+			return err
+		}
+		present[c.Prefix] = c.Added
+	}
+
+	if b.opts.HistoryRetention > 0 {
+		cutoff := now.Add(-b.opts.HistoryRetention)
+		keys := [][]byte{}
+		c := bucket.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			change := boltPrefixChange{}
+			if err := json.Unmarshal(v, &change); err != nil {
+				return errors.Wrap(err, "failed to decode prefix change")
+			}
+			if !change.Time.Before(cutoff) {
+				break
+			}
+			keys = append(keys, append([]byte{}, k...))
+		}
+		for _, k := range keys {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		if len(keys) > 0 {
+			state.Start = cutoff
+		}
+	}
+
+	nets := []netip.Prefix{}
+	for n, ok := range present {
+		if ok {
+			nets = append(nets, n)
+		}
+	}
+	sortNets(nets)
+	v, err := json.Marshal(boltChangeLog{Start: state.Start, Present: encodeNets(nets)})
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(boltChangeLogs).Put([]byte(as.AS), v)
+}
+
+// readChangeLog returns the start and present prefixes of the change log of as in bucket.
+// For logs written before both were recorded the present prefixes are derived from the
+// changes.
+func readChangeLog(tx *bbolt.Tx, bucket *bbolt.Bucket, as string) (ChangeLog, error) {
+	v := tx.Bucket(boltChangeLogs).Get([]byte(as))
+	if v == nil {
+		log, err := readChanges(bucket)
+		if err != nil {
+			return ChangeLog{}, err
+		}
+		present := map[netip.Prefix]bool{}
+		for _, c := range log {
+			present[c.Prefix] = c.Added
+		}
+		l := ChangeLog{Present: []netip.Prefix{}}
+		for n, ok := range present {
+			if ok {
+				l.Present = append(l.Present, n)
+			}
+		}
+		return l, nil
+	}
+	state := boltChangeLog{}
+	if err := json.Unmarshal(v, &state); err != nil {
+		return ChangeLog{}, errors.Wrapf(err, "failed to decode change log of %s", as)
+	}
+	present, err := decodeNets(state.Present)
+	if err != nil {
+		return ChangeLog{}, err
+	}
+	return ChangeLog{Start: state.Start, Present: present}, nil
+}
+
+// readChanges decodes the change log in bucket, oldest first.
+func readChanges(bucket *bbolt.Bucket) ([]PrefixChange, error) {
+	log := []PrefixChange{}
+	err := bucket.ForEach(func(k, v []byte) error {
+		c := boltPrefixChange{}
+		if err := json.Unmarshal(v, &c); err != nil {
+			return errors.Wrap(err, "failed to decode prefix change")
+		}
+		prefix, err := parsePrefix(c.Prefix)
+		if err != nil {
+			return err
+		}
+		log = append(log, PrefixChange{Prefix: prefix, Time: c.Time, Added: c.Added})
+		return nil
+	})
+	return log, err
+}
+
+func (b *boltStorage) Changes(as string) (ChangeLog, error) {
+	if !b.opts.History {
+		return ChangeLog{}, ErrHistoryDisabled
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	l := ChangeLog{}
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(boltChanges).Bucket([]byte(as))
+		if bucket == nil {
+			return nil
+		}
+		state, err := readChangeLog(tx, bucket, as)
+		if err != nil {
+			return err
+		}
+		log, err := readChanges(bucket)
+		if err != nil {
+			return err
+		}
+		l = newChangeLog(state.Start, log, state.Present)
+		return nil
+	})
+	if err != nil {
+		return ChangeLog{}, errors.Wrapf(err, "failed to read changes of asn %s from bolt database", as)
+	}
+	return l, nil
+}
+
+func (b *boltStorage) History(as string) ([]PrefixHistory, error) {
+	if !b.opts.History {
+		return nil, ErrHistoryDisabled
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	history := []PrefixHistory{}
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(boltHistory).Bucket([]byte(as))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			h := boltPrefixHistory{}
+			if err := json.Unmarshal(v, &h); err != nil {
+				return errors.Wrapf(err, "failed to decode history of %s", k)
+			}
+			prefix, err := parsePrefix(string(k))
+			if err != nil {
+				return err
+			}
+			history = append(history, PrefixHistory{Prefix: prefix, FirstSeen: h.FirstSeen, LastSeen: h.LastSeen})
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read history of asn %s from bolt database", as)
+	}
+	sortHistory(history)
+	return history, nil
+}
+
+func decodeBoltSnapshot(as string, k, v []byte) (Snapshot, error) {
+	rec := boltSnapshot{}
+	if err := json.Unmarshal(v, &rec); err != nil {
+		return Snapshot{}, errors.Wrapf(err, "failed to decode snapshot of asn %s", as)
+	}
+	ipv4, err := decodeNets(rec.IPv4)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	ipv6, err := decodeNets(rec.IPv6)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	t := time.Unix(0, int64(binary.BigEndian.Uint64(k)))
+	return Snapshot{AS: as, Time: t, IPv4: ipv4, IPv6: ipv6}, nil
+}
+
+func (b *boltStorage) Snapshots(as string, since time.Time) ([]Snapshot, error) {
+	if b.opts.Snapshots <= 0 {
+		return nil, ErrSnapshotsDisabled
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	all := []Snapshot{}
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(boltSnapshots).Bucket([]byte(as))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			snap, err := decodeBoltSnapshot(as, k, v)
+			if err != nil {
+				return err
+			}
+			all = append(all, snap)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read snapshots of asn %s from bolt database", as)
+	}
+	return snapshotsSince(all, since), nil
+}
+
+func (b *boltStorage) Delete(as string) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	err := b.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(boltBucket).Delete([]byte(as))
+	})
+	return errors.Wrapf(err, "failed to delete asn %s from bolt database", as)
+}
+
+func (b *boltStorage) Clear() error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	err := b.db.Update(func(tx *bbolt.Tx) error {
+		if err := tx.DeleteBucket(boltBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucket(boltBucket)
+		return err
+	})
+	return errors.Wrap(err, "failed to clear bolt database")
+}
+
+func (b *boltStorage) Stats() (Stats, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	stats := Stats{
+		Expired: atomic.LoadUint64(&b.expired),
+		Hits:    atomic.LoadUint64(&b.hits),
+		Misses:  atomic.LoadUint64(&b.misses),
+		Ages:    map[string]time.Duration{},
+	}
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(boltBucket).ForEach(func(k, v []byte) error {
+			rec := boltRecord{}
+			if err := json.Unmarshal(v, &rec); err != nil {
+				return errors.Wrapf(err, "failed to decode asn %s", k)
+			}
+			stats.Entries++
+			stats.Ages[string(k)] = time.Since(rec.UpdatedAt)
+			return nil
+		})
+	})
+	return stats, errors.Wrap(err, "failed to read bolt database stats")
+}
+
+func (b *boltStorage) maintain(interval time.Duration) {
+	defer b.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-ticker.C:
+		}
+
+		purged, err := b.purge()
+		if err != nil {
+			b.opts.Logger.WithFields(logrus.Fields{"path": b.path, "error": err}).Errorln("failed to purge expired entries")
+			continue
+		}
+		b.opts.Logger.WithFields(logrus.Fields{"path": b.path, "purged": purged}).Debugln("purged expired entries")
+		atomic.AddUint64(&b.expired, uint64(purged))
+
+		if err := b.compact(); err != nil {
+			b.opts.Logger.WithFields(logrus.Fields{"path": b.path, "error": err}).Errorln("failed to compact bolt database")
+		}
+	}
+}
+
+// purge removes all expired entries from the database.
+func (b *boltStorage) purge() (int, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	purged := 0
+	err := b.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(boltBucket)
+		expired := [][]byte{}
+		err := bucket.ForEach(func(k, v []byte) error {
+			rec := boltRecord{}
+			if err := json.Unmarshal(v, &rec); err != nil || b.isExpired(&rec) {
+				expired = append(expired, append([]byte{}, k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range expired {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		purged = len(expired)
+		return nil
+	})
+	return purged, err
+}
+
+// compact rewrites the database file if at least half of it is unused.
+func (b *boltStorage) compact() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	info, err := os.Stat(b.path)
+	if err != nil {
+		return errors.Wrapf(err, "failed to stat %s", b.path)
+	}
+	if free := b.db.Stats().FreeAlloc; int64(free) < info.Size()/2 {
+		return nil
+	}
+
+	tmpPath := b.path + ".compact"
+	dst, err := bbolt.Open(tmpPath, 0600, nil)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open %s", tmpPath)
+	}
+	if err := bbolt.Compact(dst, b.db, 0); err != nil {
+		dst.Close()
+		os.Remove(tmpPath)
+		return errors.Wrap(err, "failed to copy entries")
+	}
+	// keep both handles open until the compacted file replaced the original, bolt keeps
+	// using the file descriptor of dst after the rename
+	if err := os.Rename(tmpPath, b.path); err != nil {
+		dst.Close()
+		os.Remove(tmpPath)
+		return errors.Wrapf(err, "failed to replace %s", b.path)
+	}
+	old := b.db
+	b.db = dst
+	if err := old.Close(); err != nil {
+		return errors.Wrapf(err, "failed to close %s", b.path)
+	}
+
+	b.opts.Logger.WithFields(logrus.Fields{"path": b.path, "size": info.Size()}).Infoln("compacted bolt database")
+	return nil
+}
+
+func (b *boltStorage) Close() error {
+	close(b.stop)
+	b.wg.Wait()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.db.Close()
+}
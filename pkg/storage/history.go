@@ -0,0 +1,146 @@
+package storage
+
+import (
+	"errors"
+	"net/netip"
+	"sort"
+	"time"
+)
+
+var ErrHistoryDisabled = errors.New("prefix history is disabled")
+
+// PrefixHistory tells when a prefix was first and last seen announced for an AS.
+type PrefixHistory struct {
+	Prefix    netip.Prefix
+	FirstSeen time.Time
+	LastSeen  time.Time
+}
+
+// HistoryStorage is implemented by storages recording when each prefix of an AS was first
+// and last seen. Like snapshots the history survives Delete and Clear.
+type HistoryStorage interface {
+	Storage
+	// History returns the prefixes ever seen for as, ordered by the time they were first seen.
+	History(as string) ([]PrefixHistory, error)
+	// Changes returns the prefixes added to or removed from as. The log starts with the
+	// first fetch recorded, all its prefixes count as added, unless older changes were
+	// pruned as configured by HistoryRetention.
+	Changes(as string) (ChangeLog, error)
+}
+
+// sortHistory orders history by the time prefixes were first seen, then by prefix.
+func sortHistory(history []PrefixHistory) {
+	sort.Slice(history, func(i, j int) bool {
+		if !history[i].FirstSeen.Equal(history[j].FirstSeen) {
+			return history[i].FirstSeen.Before(history[j].FirstSeen)
+		}
+		return history[i].Prefix.String() < history[j].Prefix.String()
+	})
+}
+
+// PrefixChange records a prefix added to or removed from an AS by a fetch.
+type PrefixChange struct {
+	Prefix netip.Prefix
+	Time   time.Time
+	Added  bool
+}
+
+// changes returns the changes turning the prefixes present before into the networks of as.
+// Only ip versions fetched for as are compared, so fetching a single ip version does not
+// remove the networks of the other.
+func changes(present map[netip.Prefix]bool, as ASStorage, now time.Time) []PrefixChange {
+	fetched := map[netip.Prefix]bool{}
+	for _, n := range as.IPAddresses() {
+		fetched[n] = true
+	}
+	out := []PrefixChange{}
+	for _, n := range as.IPAddresses() {
+		if !present[n] {
+			out = append(out, PrefixChange{Prefix: n, Time: now, Added: true})
+		}
+	}
+	for n, ok := range present {
+		if ok && !fetched[n] && (n.Addr().Is4() && as.FetchedIPv4 || !n.Addr().Is4() && as.FetchedIPv6) {
+			out = append(out, PrefixChange{Prefix: n, Time: now})
+		}
+	}
+	sortChanges(out)
+	return out
+}
+
+// sortChanges orders changes by time, then by prefix.
+func sortChanges(changes []PrefixChange) {
+	sort.SliceStable(changes, func(i, j int) bool {
+		if !changes[i].Time.Equal(changes[j].Time) {
+			return changes[i].Time.Before(changes[j].Time)
+		}
+		return changes[i].Prefix.String() < changes[j].Prefix.String()
+	})
+}
+
+// sortNets orders nets by address, then by prefix length.
+func sortNets(nets []netip.Prefix) {
+	sort.Slice(nets, func(i, j int) bool {
+		if c := nets[i].Addr().Compare(nets[j].Addr()); c != 0 {
+			return c < 0
+		}
+		return nets[i].Bits() < nets[j].Bits()
+	})
+}
+
+// ChangeLog lists the prefixes added to and removed from an AS.
+type ChangeLog struct {
+	// Start is the time the log starts at, the first fetch recorded or the time older
+	// changes were pruned at. It is zero for an empty log.
+	Start time.Time
+	// Changes are the prefixes added and removed since Start, oldest first.
+	Changes []PrefixChange
+	// Present are the prefixes announced according to the last fetch.
+	Present []netip.Prefix
+}
+
+// newChangeLog returns the change log of changes starting at start, or at the first change
+// if start is zero as nothing was pruned yet.
+func newChangeLog(start time.Time, changes []PrefixChange, present []netip.Prefix) ChangeLog {
+	if start.IsZero() && len(changes) > 0 {
+		start = changes[0].Time
+	}
+	sortNets(present)
+	return ChangeLog{Start: start, Changes: changes, Present: present}
+}
+
+// Since returns the prefixes added and removed after since, ordered oldest first. Prefixes
+// added and removed again in between are left out. from is the time of the last change not
+// after since, or the start of the log. ok is false if the log starts after since, in which
+// case all present prefixes are considered added.
+func (l ChangeLog) Since(since time.Time) (added, removed []netip.Prefix, from time.Time, ok bool) {
+	added, removed = []netip.Prefix{}, []netip.Prefix{}
+	if l.Start.IsZero() || since.Before(l.Start) {
+		return append(added, l.Present...), removed, time.Time{}, false
+	}
+	from = l.Start
+	first := map[netip.Prefix]bool{}
+	last := map[netip.Prefix]bool{}
+	order := []netip.Prefix{}
+	for _, c := range l.Changes {
+		if !c.Time.After(since) {
+			from = c.Time
+			continue
+		}
+		if _, seen := first[c.Prefix]; !seen {
+			first[c.Prefix] = c.Added
+			order = append(order, c.Prefix)
+		}
+		last[c.Prefix] = c.Added
+	}
+	for _, n := range order {
+		// absent at since and present now, or the other way round
+		switch {
+		case first[n] && last[n]:
+			added = append(added, n)
+		case !first[n] && !last[n]:
+			removed = append(removed, n)
+		}
+	}
+	return added, removed, from, true
+}
@@ -0,0 +1,115 @@
+package storage
+
+import (
+	"io"
+	"net/netip"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// newHistoryStorages returns a memory and a bolt storage recording the prefix history.
+func newHistoryStorages(t *testing.T, retention time.Duration) map[string]HistoryStorage {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	storages := map[string]HistoryStorage{}
+	for _, name := range []string{"memory", "bolt"} {
+		s, err := NewStorage(StorageOptions{
+			Name:             name,
+			TTL:              time.Hour,
+			History:          true,
+			HistoryRetention: retention,
+			Path:             filepath.Join(t.TempDir(), "asn2ip.db"),
+			Logger:           logger,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { s.Close() })
+		storages[name] = s.(HistoryStorage)
+	}
+	return storages
+}
+
+func mustParsePrefixes(nets ...string) []netip.Prefix {
+	prefixes := []netip.Prefix{}
+	for _, n := range nets {
+		prefixes = append(prefixes, netip.MustParsePrefix(n))
+	}
+	return prefixes
+}
+
+func TestHistoryChanges(t *testing.T) {
+	for name, s := range newHistoryStorages(t, 0) {
+		before := time.Now()
+		err := s.Set(ASStorage{
+			AS:          "1",
+			IPv4:        mustParsePrefixes("192.0.2.0/24", "198.51.100.0/24"),
+			IPv6:        mustParsePrefixes("2001:db8::/32"),
+			FetchedIPv4: true,
+			FetchedIPv6: true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// fetching ipv4 only keeps the ipv6 networks
+		if err := s.Set(ASStorage{AS: "1", IPv4: mustParsePrefixes("192.0.2.0/24"), FetchedIPv4: true}); err != nil {
+			t.Fatal(err)
+		}
+
+		log, err := s.Changes("1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(log.Changes) != 4 {
+			t.Fatalf("%s: got %+v, expected 3 prefixes added and 1 removed", name, log.Changes)
+		}
+		if want := mustParsePrefixes("192.0.2.0/24", "2001:db8::/32"); !reflect.DeepEqual(log.Present, want) {
+			t.Errorf("%s: got present prefixes %v, expected %v", name, log.Present, want)
+		}
+
+		added, removed, _, ok := log.Since(before)
+		if ok || !reflect.DeepEqual(added, log.Present) || len(removed) != 0 {
+			t.Errorf("%s: got %v added and %v removed since before the log, expected all present prefixes added", name, added, removed)
+		}
+		added, removed, from, ok := log.Since(log.Start)
+		if !ok || !from.Equal(log.Start) || len(added) != 0 || !reflect.DeepEqual(removed, mustParsePrefixes("198.51.100.0/24")) {
+			t.Errorf("%s: got %v added and %v removed from %s, expected 198.51.100.0/24 removed", name, added, removed, from)
+		}
+	}
+}
+
+func TestHistoryRetention(t *testing.T) {
+	const retention = 50 * time.Millisecond
+	for name, s := range newHistoryStorages(t, retention) {
+		before := time.Now()
+		if err := s.Set(ASStorage{AS: "1", IPv4: mustParsePrefixes("192.0.2.0/24"), FetchedIPv4: true}); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(2 * retention)
+		if err := s.Set(ASStorage{AS: "1", IPv4: mustParsePrefixes("192.0.2.0/24", "198.51.100.0/24"), FetchedIPv4: true}); err != nil {
+			t.Fatal(err)
+		}
+
+		log, err := s.Changes("1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(log.Changes) != 1 || !log.Start.After(before) {
+			t.Fatalf("%s: got %+v starting at %s, expected the first fetch to be pruned", name, log.Changes, log.Start)
+		}
+		if want := mustParsePrefixes("192.0.2.0/24", "198.51.100.0/24"); !reflect.DeepEqual(log.Present, want) {
+			t.Errorf("%s: got present prefixes %v, expected %v", name, log.Present, want)
+		}
+		if _, _, _, ok := log.Since(before); ok {
+			t.Errorf("%s: got changes since %s, expected the log to start after it", name, before)
+		}
+		added, _, from, ok := log.Since(log.Start)
+		if !ok || !from.Equal(log.Start) || !reflect.DeepEqual(added, mustParsePrefixes("198.51.100.0/24")) {
+			t.Errorf("%s: got %v added from %s, expected 198.51.100.0/24 added", name, added, from)
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package storage
+
+import (
+	"sort"
+	"strconv"
+)
+
+// ListStorage is implemented by storages able to list all cached AS numbers, e.g. to inspect,
+// export or copy the cache.
+type ListStorage interface {
+	Storage
+	// List returns all unexpired entries in numerical order of their AS number. Unlike Get
+	// it does not count cache hits.
+	List() ([]ASStorage, error)
+}
+
+// sortEntries orders entries by their AS number.
+func sortEntries(entries []ASStorage) {
+	sort.Slice(entries, func(i, j int) bool {
+		a, _ := strconv.ParseUint(entries[i].AS, 10, 32)
+		b, _ := strconv.ParseUint(entries[j].AS, 10, 32)
+		if a != b {
+			return a < b
+		}
+		return entries[i].AS < entries[j].AS
+	})
+}
@@ -1,49 +1,317 @@
 package storage
 
 import (
+	"container/list"
+	"net/netip"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
+type memoryEntry struct {
+	as  ASStorage
+	ttl time.Time
+}
+
 type memory struct {
-	stor   map[string]ASStorage
-	ttl    map[string]time.Time
-	maxTTL time.Duration
+	// mu guards all fields below, Get needs a write lock as it updates the lru list
+	mu         sync.Mutex
+	stor       map[string]*list.Element
+	lru        *list.List
+	snapshots  map[string][]Snapshot
+	history    map[string]map[string]*PrefixHistory
+	changes    map[string][]PrefixChange
+	present    map[string]map[netip.Prefix]bool
+	starts     map[string]time.Time
+	opts       StorageOptions
+	maxEntries int
+	evictions  uint64
+	expired    uint64
+	hits       uint64
+	misses     uint64
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+
+	// ttls are changed atomically, without holding mu
+	*ttls
 }
 
 func newMemory(opts StorageOptions) (Storage, error) {
-	return &memory{
-		stor:   map[string]ASStorage{},
-		ttl:    map[string]time.Time{},
-		maxTTL: opts.TTL,
-	}, nil
+	m := &memory{
+		stor:       map[string]*list.Element{},
+		lru:        list.New(),
+		snapshots:  map[string][]Snapshot{},
+		history:    map[string]map[string]*PrefixHistory{},
+		changes:    map[string][]PrefixChange{},
+		present:    map[string]map[netip.Prefix]bool{},
+		starts:     map[string]time.Time{},
+		opts:       opts,
+		ttls:       newTTLs(opts),
+		maxEntries: opts.MaxEntries,
+		stop:       make(chan struct{}),
+	}
+	if opts.SweepInterval > 0 {
+		m.wg.Add(1)
+		go m.sweeper(opts.SweepInterval)
+	}
+	return m, nil
 }
 
 func (m *memory) Get(as string) (ASStorage, error) {
-	logrus.WithFields(logrus.Fields{"asn": as}).Debugln("trying to fetch asn from cache")
-	v, ok := m.stor[as]
+	m.opts.Logger.WithFields(logrus.Fields{"asn": as}).Debugln("trying to fetch asn from cache")
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	elem, ok := m.stor[as]
 	if !ok {
-		logrus.WithFields(logrus.Fields{"asn": as}).Debugln("cache missed for asn")
+		m.opts.Logger.WithFields(logrus.Fields{"asn": as}).Debugln("cache missed for asn")
+		m.misses++
 		return ASStorage{}, ErrASNotCached
 	}
-	ttl, ok := m.ttl[as]
-	if !ok {
-		logrus.WithFields(logrus.Fields{"asn": as}).Warnln("no ttl found for asn")
-		delete(m.stor, as)
+	entry := elem.Value.(*memoryEntry)
+	if m.isExpired(entry) {
+		m.opts.Logger.WithFields(logrus.Fields{"asn": as, "ttl": entry.ttl}).Infoln("ttl expired for asn")
+		m.remove(elem)
+		m.expired++
+		m.misses++
 		return ASStorage{}, ErrASNotCached
 	}
-	if time.Since(ttl) > m.maxTTL {
-		logrus.WithFields(logrus.Fields{"asn": as, "ttl": ttl}).Infoln("ttl expired for asn")
-		delete(m.stor, as)
-		delete(m.ttl, as)
-		return ASStorage{}, ErrASNotCached
+	m.lru.MoveToFront(elem)
+	m.hits++
+	r := entry.as
+	r.Expires = entry.ttl.Add(m.ttls.of(entry.as))
+	r.Stored = entry.ttl
+	return r, nil
+}
+
+func (m *memory) List() ([]ASStorage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entries := make([]ASStorage, 0, len(m.stor))
+	for _, elem := range m.stor {
+		entry := elem.Value.(*memoryEntry)
+		if m.isExpired(entry) {
+			continue
+		}
+		r := entry.as
+		r.Expires = entry.ttl.Add(m.ttls.of(entry.as))
+		r.Stored = entry.ttl
+		entries = append(entries, r)
 	}
-	return v, nil
+	sortEntries(entries)
+	return entries, nil
 }
 
 func (m *memory) Set(as ASStorage) error {
-	m.stor[as.AS] = as
-	m.ttl[as.AS] = time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.snapshot(as)
+	m.record(as)
+
+	if elem, ok := m.stor[as.AS]; ok {
+		elem.Value = &memoryEntry{as: as, ttl: time.Now()}
+		m.lru.MoveToFront(elem)
+		return nil
+	}
+
+	m.stor[as.AS] = m.lru.PushFront(&memoryEntry{as: as, ttl: time.Now()})
+	for m.maxEntries > 0 && m.lru.Len() > m.maxEntries {
+		oldest := m.lru.Back()
+		m.remove(oldest)
+		// unlike expired entries, snapshots and history of evicted entries are dropped to bound memory usage
+		delete(m.snapshots, oldest.Value.(*memoryEntry).as.AS)
+		delete(m.history, oldest.Value.(*memoryEntry).as.AS)
+		delete(m.changes, oldest.Value.(*memoryEntry).as.AS)
+		delete(m.present, oldest.Value.(*memoryEntry).as.AS)
+		delete(m.starts, oldest.Value.(*memoryEntry).as.AS)
+		m.evictions++
+		m.opts.Logger.WithFields(logrus.Fields{"asn": oldest.Value.(*memoryEntry).as.AS, "evictions": m.evictions}).Debugln("evicted least recently used asn")
+	}
+	return nil
+}
+
+func (m *memory) Delete(as string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if elem, ok := m.stor[as]; ok {
+		m.remove(elem)
+	}
+	return nil
+}
+
+func (m *memory) Clear() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.stor = map[string]*list.Element{}
+	m.lru.Init()
+	return nil
+}
+
+// snapshot records as if it changed since the last snapshot.
+func (m *memory) snapshot(as ASStorage) {
+	if m.opts.Snapshots <= 0 {
+		return
+	}
+	var last *Snapshot
+	if snaps := m.snapshots[as.AS]; len(snaps) > 0 {
+		last = &snaps[len(snaps)-1]
+	}
+	snap, ok := takeSnapshot(last, as, time.Now())
+	if !ok {
+		return
+	}
+	snaps := append(m.snapshots[as.AS], snap)
+	if len(snaps) > m.opts.Snapshots {
+		snaps = append([]Snapshot{}, snaps[len(snaps)-m.opts.Snapshots:]...)
+	}
+	m.snapshots[as.AS] = snaps
+}
+
+func (m *memory) Snapshots(as string, since time.Time) ([]Snapshot, error) {
+	if m.opts.Snapshots <= 0 {
+		return nil, ErrSnapshotsDisabled
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return snapshotsSince(m.snapshots[as], since), nil
+}
+
+// record updates the prefix history and change log of as.
+func (m *memory) record(as ASStorage) {
+	if !m.opts.History {
+		return
+	}
+	now := time.Now()
+	history, ok := m.history[as.AS]
+	if !ok {
+		history = map[string]*PrefixHistory{}
+		m.history[as.AS] = history
+	}
+	for _, n := range as.IPAddresses() {
+		if h, ok := history[n.String()]; ok {
+			h.LastSeen = now
+		} else {
+			history[n.String()] = &PrefixHistory{Prefix: n, FirstSeen: now, LastSeen: now}
+		}
+	}
+	present, ok := m.present[as.AS]
+	if !ok {
+		present = map[netip.Prefix]bool{}
+		m.present[as.AS] = present
+	}
+	log := m.changes[as.AS]
+	for _, c := range changes(present, as, now) {
+		log = append(log, c)
+		if c.Added {
+			present[c.Prefix] = true
+		} else {
+			delete(present, c.Prefix)
+		}
+	}
+	if m.opts.HistoryRetention > 0 {
+		cutoff := now.Add(-m.opts.HistoryRetention)
+		if i := sort.Search(len(log), func(i int) bool { return !log[i].Time.Before(cutoff) }); i > 0 {
+			log = append([]PrefixChange{}, log[i:]...)
+			m.starts[as.AS] = cutoff
+		}
+	}
+	m.changes[as.AS] = log
+}
+
+func (m *memory) History(as string) ([]PrefixHistory, error) {
+	if !m.opts.History {
+		return nil, ErrHistoryDisabled
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	history := make([]PrefixHistory, 0, len(m.history[as]))
+	for _, h := range m.history[as] {
+		history = append(history, *h)
+	}
+	sortHistory(history)
+	return history, nil
+}
+
+func (m *memory) Changes(as string) (ChangeLog, error) {
+	if !m.opts.History {
+		return ChangeLog{}, ErrHistoryDisabled
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	present := make([]netip.Prefix, 0, len(m.present[as]))
+	for n := range m.present[as] {
+		present = append(present, n)
+	}
+	return newChangeLog(m.starts[as], append([]PrefixChange{}, m.changes[as]...), present), nil
+}
+
+func (m *memory) isExpired(entry *memoryEntry) bool {
+	return time.Since(entry.ttl) > m.ttls.of(entry.as)
+}
+
+func (m *memory) remove(elem *list.Element) {
+	m.lru.Remove(elem)
+	delete(m.stor, elem.Value.(*memoryEntry).as.AS)
+}
+
+func (m *memory) sweeper(interval time.Duration) {
+	defer m.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+		}
+
+		if purged := m.sweep(); purged > 0 {
+			m.opts.Logger.WithFields(logrus.Fields{"purged": purged}).Infoln("purged expired asns from cache")
+		}
+	}
+}
+
+// sweep removes all expired entries and returns how many were removed.
+func (m *memory) sweep() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	purged := 0
+	for elem := m.lru.Front(); elem != nil; {
+		next := elem.Next()
+		if m.isExpired(elem.Value.(*memoryEntry)) {
+			m.remove(elem)
+			purged++
+		}
+		elem = next
+	}
+	m.expired += uint64(purged)
+	return purged
+}
+
+func (m *memory) Stats() (Stats, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ages := make(map[string]time.Duration, len(m.stor))
+	for as, elem := range m.stor {
+		ages[as] = time.Since(elem.Value.(*memoryEntry).ttl)
+	}
+	return Stats{
+		Entries:   m.lru.Len(),
+		Evictions: m.evictions,
+		Expired:   m.expired,
+		Hits:      m.hits,
+		Misses:    m.misses,
+		Ages:      ages,
+	}, nil
+}
+
+func (m *memory) Close() error {
+	close(m.stop)
+	m.wg.Wait()
 	return nil
 }
@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// TestMemoryConcurrent uses the memory storage from many goroutines, run it with -race.
+func TestMemoryConcurrent(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	s, err := NewStorage(StorageOptions{
+		Name:          "memory",
+		TTL:           time.Millisecond,
+		MaxEntries:    16,
+		SweepInterval: time.Millisecond,
+		Snapshots:     2,
+		History:       true,
+		Logger:        logger,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	m := s.(*memory)
+
+	var wg sync.WaitGroup
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 2000; i++ {
+				as := fmt.Sprint(i % 32)
+				entry := ASStorage{
+					AS:          as,
+					IPv4:        []netip.Prefix{netip.PrefixFrom(netip.AddrFrom4([4]byte{10, byte(g), byte(i), 0}), 24)},
+					FetchedIPv4: true,
+				}
+				switch i % 6 {
+				case 0, 1:
+					if err := m.Set(entry); err != nil {
+						t.Error(err)
+					}
+				case 2:
+					if _, err := m.Get(as); err != nil && err != ErrASNotCached {
+						t.Error(err)
+					}
+				case 3:
+					if err := m.Delete(as); err != nil {
+						t.Error(err)
+					}
+				case 4:
+					m.sweep()
+					if _, err := m.Changes(as); err != nil {
+						t.Error(err)
+					}
+				case 5:
+					if i%30 == 5 {
+						if err := m.Clear(); err != nil {
+							t.Error(err)
+						}
+					}
+					if _, err := m.Stats(); err != nil {
+						t.Error(err)
+					}
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	// the sweeper is still running
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if entries := m.lru.Len(); entries > 16 || entries != len(m.stor) {
+		t.Errorf("got %d entries in lru list and %d in map, expected the same number of at most 16", entries, len(m.stor))
+	}
+}
@@ -0,0 +1,524 @@
+package storage
+
+import (
+	"database/sql"
+	"net/netip"
+	"sync/atomic"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// postgres keeps every prefix ever seen for an ASN together with the time it was first and
+// last seen. The current prefix set of an ASN are all prefixes seen at its last update.
+// Additions and removals of prefixes are logged in asn2ip_prefix_changes and applied to the
+// present flag of asn2ip_prefixes, asn2ip_change_logs holds the time logs were pruned at.
+// The present flag is derived from the change log once when it is added.
+const postgresSchema = `
+CREATE TABLE IF NOT EXISTS asn2ip_asns (
+	asn          TEXT PRIMARY KEY,
+	fetched_ipv4 BOOLEAN NOT NULL,
+	fetched_ipv6 BOOLEAN NOT NULL,
+	updated_at   TIMESTAMPTZ NOT NULL
+);
+ALTER TABLE asn2ip_asns ADD COLUMN IF NOT EXISTS not_found BOOLEAN NOT NULL DEFAULT false;
+CREATE TABLE IF NOT EXISTS asn2ip_prefixes (
+	asn        TEXT NOT NULL,
+	prefix     CIDR NOT NULL,
+	first_seen TIMESTAMPTZ NOT NULL,
+	last_seen  TIMESTAMPTZ NOT NULL,
+	PRIMARY KEY (asn, prefix)
+);
+CREATE INDEX IF NOT EXISTS asn2ip_prefixes_last_seen ON asn2ip_prefixes (asn, last_seen);
+CREATE TABLE IF NOT EXISTS asn2ip_snapshots (
+	asn      TEXT NOT NULL,
+	taken_at TIMESTAMPTZ NOT NULL,
+	ipv4     CIDR[] NOT NULL,
+	ipv6     CIDR[] NOT NULL,
+	PRIMARY KEY (asn, taken_at)
+);
+CREATE TABLE IF NOT EXISTS asn2ip_prefix_changes (
+	id         BIGSERIAL PRIMARY KEY,
+	asn        TEXT NOT NULL,
+	prefix     CIDR NOT NULL,
+	changed_at TIMESTAMPTZ NOT NULL,
+	added      BOOLEAN NOT NULL
+);
+CREATE INDEX IF NOT EXISTS asn2ip_prefix_changes_asn ON asn2ip_prefix_changes (asn, changed_at);
+CREATE TABLE IF NOT EXISTS asn2ip_change_logs (
+	asn   TEXT PRIMARY KEY,
+	start TIMESTAMPTZ NOT NULL
+);
+DO $$
+BEGIN
+	IF NOT EXISTS (
+		SELECT 1 FROM information_schema.columns
+		WHERE table_name = 'asn2ip_prefixes' AND column_name = 'present'
+	) THEN
+		ALTER TABLE asn2ip_prefixes ADD COLUMN present BOOLEAN NOT NULL DEFAULT false;
+		UPDATE asn2ip_prefixes p SET present = true FROM (
+			SELECT DISTINCT ON (asn, prefix) asn, prefix, added FROM asn2ip_prefix_changes
+			ORDER BY asn, prefix, id DESC
+		) c WHERE c.asn = p.asn AND c.prefix = p.prefix AND c.added;
+	END IF;
+END $$;
+`
+
+type postgres struct {
+	db     *sql.DB
+	opts   StorageOptions
+	hits   uint64
+	misses uint64
+
+	*ttls
+}
+
+func newPostgres(opts StorageOptions) (Storage, error) {
+	dsn := opts.DSN
+	if dsn == "" {
+		dsn = opts.String("dsn", "")
+	}
+	if dsn == "" {
+		return nil, errors.New("postgres storage requires a dsn")
+	}
+	maxOpen, err := opts.Int("max-open-conns", 0)
+	if err != nil {
+		return nil, err
+	}
+	maxIdle, err := opts.Int("max-idle-conns", 2)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open postgres connection")
+	}
+	db.SetMaxOpenConns(maxOpen)
+	db.SetMaxIdleConns(maxIdle)
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "failed to connect to postgres")
+	}
+	if _, err := db.Exec(postgresSchema); err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "failed to create postgres schema")
+	}
+
+	return &postgres{db: db, opts: opts, ttls: newTTLs(opts)}, nil
+}
+
+func (p *postgres) Get(as string) (ASStorage, error) {
+	p.opts.Logger.WithFields(logrus.Fields{"asn": as}).Debugln("trying to fetch asn from cache")
+
+	r := ASStorage{AS: as, IPv4: []netip.Prefix{}, IPv6: []netip.Prefix{}}
+	var updatedAt time.Time
+	err := p.db.QueryRow(
+		`SELECT fetched_ipv4, fetched_ipv6, not_found, updated_at FROM asn2ip_asns WHERE asn = $1`, as,
+	).Scan(&r.FetchedIPv4, &r.FetchedIPv6, &r.NotFound, &updatedAt)
+	if err == sql.ErrNoRows {
+		p.opts.Logger.WithFields(logrus.Fields{"asn": as}).Debugln("cache missed for asn")
+		atomic.AddUint64(&p.misses, 1)
+		return ASStorage{}, ErrASNotCached
+	} else if err != nil {
+		return ASStorage{}, errors.Wrapf(err, "failed to query asn %s", as)
+	}
+	if time.Since(updatedAt) > p.ttls.of(r) {
+		p.opts.Logger.WithFields(logrus.Fields{"asn": as, "ttl": updatedAt}).Infoln("ttl expired for asn")
+		atomic.AddUint64(&p.misses, 1)
+		return ASStorage{}, ErrASNotCached
+	}
+	atomic.AddUint64(&p.hits, 1)
+	r.Expires = updatedAt.Add(p.ttls.of(r))
+	r.Stored = updatedAt
+
+	rows, err := p.db.Query(
+		`SELECT prefix::text FROM asn2ip_prefixes WHERE asn = $1 AND last_seen = $2`, as, updatedAt,
+	)
+	if err != nil {
+		return ASStorage{}, errors.Wrapf(err, "failed to query prefixes of asn %s", as)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var prefix string
+		if err := rows.Scan(&prefix); err != nil {
+			return ASStorage{}, errors.Wrapf(err, "failed to read prefix of asn %s", as)
+		}
+		network, err := parsePrefix(prefix)
+		if err != nil {
+			return ASStorage{}, err
+		}
+		if network.Addr().Is4() {
+			r.IPv4 = append(r.IPv4, network)
+		} else {
+			r.IPv6 = append(r.IPv6, network)
+		}
+	}
+	return r, errors.Wrapf(rows.Err(), "failed to read prefixes of asn %s", as)
+}
+
+func (p *postgres) List() ([]ASStorage, error) {
+	rows, err := p.db.Query(`SELECT asn, fetched_ipv4, fetched_ipv6, not_found, updated_at FROM asn2ip_asns`)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to query asns")
+	}
+	defer rows.Close()
+	entries := map[string]*ASStorage{}
+	for rows.Next() {
+		r := &ASStorage{IPv4: []netip.Prefix{}, IPv6: []netip.Prefix{}}
+		if err := rows.Scan(&r.AS, &r.FetchedIPv4, &r.FetchedIPv6, &r.NotFound, &r.Stored); err != nil {
+			return nil, errors.Wrap(err, "failed to read asn")
+		}
+		if time.Since(r.Stored) > p.ttls.of(*r) {
+			continue
+		}
+		r.Expires = r.Stored.Add(p.ttls.of(*r))
+		entries[r.AS] = r
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to read asns")
+	}
+
+	prefixes, err := p.db.Query(`
+		SELECT p.asn, p.prefix::text FROM asn2ip_prefixes p
+		JOIN asn2ip_asns a ON a.asn = p.asn AND p.last_seen = a.updated_at`)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to query prefixes")
+	}
+	defer prefixes.Close()
+	for prefixes.Next() {
+		var as, prefix string
+		if err := prefixes.Scan(&as, &prefix); err != nil {
+			return nil, errors.Wrap(err, "failed to read prefix")
+		}
+		r, ok := entries[as]
+		if !ok {
+			continue
+		}
+		network, err := parsePrefix(prefix)
+		if err != nil {
+			return nil, err
+		}
+		if network.Addr().Is4() {
+			r.IPv4 = append(r.IPv4, network)
+		} else {
+			r.IPv6 = append(r.IPv6, network)
+		}
+	}
+	if err := prefixes.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to read prefixes")
+	}
+
+	list := make([]ASStorage, 0, len(entries))
+	for _, r := range entries {
+		list = append(list, *r)
+	}
+	sortEntries(list)
+	return list, nil
+}
+
+func (p *postgres) Set(as ASStorage) error {
+	// postgres stores timestamps with microsecond precision
+	now := time.Now().UTC().Truncate(time.Microsecond)
+
+	tx, err := p.db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "failed to begin transaction")
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT INTO asn2ip_asns (asn, fetched_ipv4, fetched_ipv6, not_found, updated_at) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (asn) DO UPDATE SET
+			fetched_ipv4 = EXCLUDED.fetched_ipv4,
+			fetched_ipv6 = EXCLUDED.fetched_ipv6,
+			not_found = EXCLUDED.not_found,
+			updated_at = EXCLUDED.updated_at`,
+		as.AS, as.FetchedIPv4, as.FetchedIPv6, as.NotFound, now)
+	if err != nil {
+		return errors.Wrapf(err, "failed to update asn %s", as.AS)
+	}
+
+	// the change log is diffed against the prefixes present before this update
+	if err := p.recordChanges(tx, as, now); err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare(`
+		INSERT INTO asn2ip_prefixes (asn, prefix, first_seen, last_seen, present) VALUES ($1, $2, $3, $3, true)
+		ON CONFLICT (asn, prefix) DO UPDATE SET last_seen = EXCLUDED.last_seen, present = true`)
+	if err != nil {
+		return errors.Wrap(err, "failed to prepare prefix statement")
+	}
+	defer stmt.Close()
+
+	for _, n := range as.IPAddresses() {
+		if _, err := stmt.Exec(as.AS, n.String(), now); err != nil {
+			return errors.Wrapf(err, "failed to update prefix %s of asn %s", n, as.AS)
+		}
+	}
+
+	if err := p.snapshot(tx, as, now); err != nil {
+		return err
+	}
+
+	return errors.Wrapf(tx.Commit(), "failed to commit asn %s", as.AS)
+}
+
+// snapshot records as if it changed since the last snapshot.
+func (p *postgres) snapshot(tx *sql.Tx, as ASStorage, now time.Time) error {
+	if p.opts.Snapshots <= 0 {
+		return nil
+	}
+	var last *Snapshot
+	rows, err := tx.Query(`
+		SELECT taken_at, ipv4::text[], ipv6::text[] FROM asn2ip_snapshots
+		WHERE asn = $1 ORDER BY taken_at DESC LIMIT 1`, as.AS)
+	if err != nil {
+		return errors.Wrapf(err, "failed to query last snapshot of asn %s", as.AS)
+	}
+	snaps, err := scanSnapshots(as.AS, rows)
+	if err != nil {
+		return err
+	}
+	if len(snaps) > 0 {
+		last = &snaps[0]
+	}
+
+	snap, ok := takeSnapshot(last, as, now)
+	if !ok {
+		return nil
+	}
+	_, err = tx.Exec(`INSERT INTO asn2ip_snapshots (asn, taken_at, ipv4, ipv6) VALUES ($1, $2, $3::cidr[], $4::cidr[])`,
+		as.AS, now, pq.Array(encodeNets(snap.IPv4)), pq.Array(encodeNets(snap.IPv6)))
+	if err != nil {
+		return errors.Wrapf(err, "failed to store snapshot of asn %s", as.AS)
+	}
+	_, err = tx.Exec(`
+		DELETE FROM asn2ip_snapshots WHERE asn = $1 AND taken_at NOT IN (
+			SELECT taken_at FROM asn2ip_snapshots WHERE asn = $1 ORDER BY taken_at DESC LIMIT $2
+		)`, as.AS, p.opts.Snapshots)
+	return errors.Wrapf(err, "failed to drop old snapshots of asn %s", as.AS)
+}
+
+// History returns the prefix history postgres always records.
+func (p *postgres) History(as string) ([]PrefixHistory, error) {
+	rows, err := p.db.Query(`
+		SELECT prefix::text, first_seen, last_seen FROM asn2ip_prefixes
+		WHERE asn = $1 ORDER BY first_seen, prefix`, as)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to query history of asn %s", as)
+	}
+	defer rows.Close()
+
+	history := []PrefixHistory{}
+	for rows.Next() {
+		var (
+			prefix string
+			h      PrefixHistory
+		)
+		if err := rows.Scan(&prefix, &h.FirstSeen, &h.LastSeen); err != nil {
+			return nil, errors.Wrapf(err, "failed to read history of asn %s", as)
+		}
+		if h.Prefix, err = parsePrefix(prefix); err != nil {
+			return nil, err
+		}
+		history = append(history, h)
+	}
+	return history, errors.Wrapf(rows.Err(), "failed to read history of asn %s", as)
+}
+
+// recordChanges appends the prefixes added to or removed from as to its change log, marks
+// removed prefixes as no longer present and drops changes older than the history retention.
+func (p *postgres) recordChanges(tx *sql.Tx, as ASStorage, now time.Time) error {
+	rows, err := tx.Query(`SELECT prefix::text FROM asn2ip_prefixes WHERE asn = $1 AND present`, as.AS)
+	if err != nil {
+		return errors.Wrapf(err, "failed to query prefixes of asn %s", as.AS)
+	}
+	nets, err := scanNets(as.AS, rows)
+	if err != nil {
+		return err
+	}
+	present := map[netip.Prefix]bool{}
+	for _, n := range nets {
+		present[n] = true
+	}
+	for _, c := range changes(present, as, now) {
+		_, err := tx.Exec(`INSERT INTO asn2ip_prefix_changes (asn, prefix, changed_at, added) VALUES ($1, $2, $3, $4)`,
+			as.AS, c.Prefix.String(), c.Time, c.Added)
+		if err != nil {
+			return errors.Wrapf(err, "failed to record change of prefix %s of asn %s", c.Prefix, as.AS)
+		}
+		if c.Added {
+			continue
+		}
+		_, err = tx.Exec(`UPDATE asn2ip_prefixes SET present = false WHERE asn = $1 AND prefix = $2`, as.AS, c.Prefix.String())
+		if err != nil {
+			return errors.Wrapf(err, "failed to remove prefix %s of asn %s", c.Prefix, as.AS)
+		}
+	}
+
+	if p.opts.HistoryRetention <= 0 {
+		return nil
+	}
+	cutoff := now.Add(-p.opts.HistoryRetention)
+	res, err := tx.Exec(`DELETE FROM asn2ip_prefix_changes WHERE asn = $1 AND changed_at < $2`, as.AS, cutoff)
+	if err != nil {
+		return errors.Wrapf(err, "failed to drop old changes of asn %s", as.AS)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return errors.Wrapf(err, "failed to drop old changes of asn %s", as.AS)
+	} else if n == 0 {
+		return nil
+	}
+	_, err = tx.Exec(`
+		INSERT INTO asn2ip_change_logs (asn, start) VALUES ($1, $2)
+		ON CONFLICT (asn) DO UPDATE SET start = EXCLUDED.start`, as.AS, cutoff)
+	return errors.Wrapf(err, "failed to update change log of asn %s", as.AS)
+}
+
+// Changes returns the change log postgres always records.
+func (p *postgres) Changes(as string) (ChangeLog, error) {
+	var start time.Time
+	err := p.db.QueryRow(`SELECT start FROM asn2ip_change_logs WHERE asn = $1`, as).Scan(&start)
+	if err != nil && err != sql.ErrNoRows {
+		return ChangeLog{}, errors.Wrapf(err, "failed to query change log of asn %s", as)
+	}
+	rows, err := p.db.Query(`
+		SELECT prefix::text, changed_at, added FROM asn2ip_prefix_changes
+		WHERE asn = $1 ORDER BY id`, as)
+	if err != nil {
+		return ChangeLog{}, errors.Wrapf(err, "failed to query changes of asn %s", as)
+	}
+	log, err := scanChanges(as, rows)
+	if err != nil {
+		return ChangeLog{}, err
+	}
+	rows, err = p.db.Query(`SELECT prefix::text FROM asn2ip_prefixes WHERE asn = $1 AND present`, as)
+	if err != nil {
+		return ChangeLog{}, errors.Wrapf(err, "failed to query prefixes of asn %s", as)
+	}
+	present, err := scanNets(as, rows)
+	if err != nil {
+		return ChangeLog{}, err
+	}
+	return newChangeLog(start, log, present), nil
+}
+
+func scanNets(as string, rows *sql.Rows) ([]netip.Prefix, error) {
+	defer rows.Close()
+	nets := []netip.Prefix{}
+	for rows.Next() {
+		var prefix string
+		if err := rows.Scan(&prefix); err != nil {
+			return nil, errors.Wrapf(err, "failed to read prefixes of asn %s", as)
+		}
+		n, err := parsePrefix(prefix)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, errors.Wrapf(rows.Err(), "failed to read prefixes of asn %s", as)
+}
+
+func scanChanges(as string, rows *sql.Rows) ([]PrefixChange, error) {
+	defer rows.Close()
+	log := []PrefixChange{}
+	for rows.Next() {
+		var (
+			prefix string
+			c      PrefixChange
+		)
+		if err := rows.Scan(&prefix, &c.Time, &c.Added); err != nil {
+			return nil, errors.Wrapf(err, "failed to read changes of asn %s", as)
+		}
+		var err error
+		if c.Prefix, err = parsePrefix(prefix); err != nil {
+			return nil, err
+		}
+		log = append(log, c)
+	}
+	return log, errors.Wrapf(rows.Err(), "failed to read changes of asn %s", as)
+}
+
+func (p *postgres) Snapshots(as string, since time.Time) ([]Snapshot, error) {
+	if p.opts.Snapshots <= 0 {
+		return nil, ErrSnapshotsDisabled
+	}
+	rows, err := p.db.Query(`
+		SELECT taken_at, ipv4::text[], ipv6::text[] FROM asn2ip_snapshots
+		WHERE asn = $1 AND taken_at >= COALESCE(
+			(SELECT max(taken_at) FROM asn2ip_snapshots WHERE asn = $1 AND taken_at <= $2), $2
+		) ORDER BY taken_at`, as, since)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to query snapshots of asn %s", as)
+	}
+	return scanSnapshots(as, rows)
+}
+
+func scanSnapshots(as string, rows *sql.Rows) ([]Snapshot, error) {
+	defer rows.Close()
+	snaps := []Snapshot{}
+	for rows.Next() {
+		var (
+			takenAt    time.Time
+			ipv4, ipv6 []string
+		)
+		if err := rows.Scan(&takenAt, pq.Array(&ipv4), pq.Array(&ipv6)); err != nil {
+			return nil, errors.Wrapf(err, "failed to read snapshot of asn %s", as)
+		}
+		snap := Snapshot{AS: as, Time: takenAt}
+		var err error
+		if snap.IPv4, err = decodeNets(ipv4); err != nil {
+			return nil, err
+		}
+		if snap.IPv6, err = decodeNets(ipv6); err != nil {
+			return nil, err
+		}
+		snaps = append(snaps, snap)
+	}
+	return snaps, errors.Wrapf(rows.Err(), "failed to read snapshots of asn %s", as)
+}
+
+// Delete removes as from cache, its prefix history is kept.
+func (p *postgres) Delete(as string) error {
+	_, err := p.db.Exec(`DELETE FROM asn2ip_asns WHERE asn = $1`, as)
+	return errors.Wrapf(err, "failed to delete asn %s", as)
+}
+
+// Clear removes all ASNs from cache, the prefix history is kept.
+func (p *postgres) Clear() error {
+	_, err := p.db.Exec(`DELETE FROM asn2ip_asns`)
+	return errors.Wrap(err, "failed to delete asns")
+}
+
+func (p *postgres) Stats() (Stats, error) {
+	stats := Stats{
+		Hits:   atomic.LoadUint64(&p.hits),
+		Misses: atomic.LoadUint64(&p.misses),
+		Ages:   map[string]time.Duration{},
+	}
+	rows, err := p.db.Query(`SELECT asn, updated_at FROM asn2ip_asns`)
+	if err != nil {
+		return stats, errors.Wrap(err, "failed to query asns")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			as        string
+			updatedAt time.Time
+		)
+		if err := rows.Scan(&as, &updatedAt); err != nil {
+			return stats, errors.Wrap(err, "failed to read asn")
+		}
+		stats.Entries++
+		stats.Ages[as] = time.Since(updatedAt)
+	}
+	return stats, errors.Wrap(rows.Err(), "failed to read asns")
+}
+
+func (p *postgres) Close() error { return p.db.Close() }
@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"errors"
+	"net/netip"
+	"sort"
+	"time"
+)
+
+var ErrSnapshotsDisabled = errors.New("snapshots are disabled")
+
+// Snapshot is the prefix set of an AS at a point in time.
+type Snapshot struct {
+	AS   string
+	Time time.Time
+	IPv4 []netip.Prefix
+	IPv6 []netip.Prefix
+}
+
+func (s Snapshot) IPAddresses() []netip.Prefix {
+	return append(append([]netip.Prefix{}, s.IPv4...), s.IPv6...)
+}
+
+// SnapshotStorage is implemented by storages keeping the previous prefix sets of each AS.
+// A snapshot is taken whenever Set stores a complete prefix set that differs from the last
+// snapshot. Snapshots are history rather than cache and survive Delete and Clear.
+type SnapshotStorage interface {
+	Storage
+	// Snapshots returns the snapshot in effect at since, if any, followed by all snapshots
+	// of as taken after since, oldest first.
+	Snapshots(as string, since time.Time) ([]Snapshot, error)
+}
+
+// takeSnapshot returns the snapshot to record for as, ok is false if as is not a complete
+// prefix set or did not change since last.
+func takeSnapshot(last *Snapshot, as ASStorage, now time.Time) (snap Snapshot, ok bool) {
+	if !as.FetchedIPv4 || !as.FetchedIPv6 {
+		return Snapshot{}, false
+	}
+	snap = Snapshot{AS: as.AS, Time: now, IPv4: as.IPv4, IPv6: as.IPv6}
+	if last != nil && samePrefixes(last.IPAddresses(), snap.IPAddresses()) {
+		return Snapshot{}, false
+	}
+	return snap, true
+}
+
+func samePrefixes(a, b []netip.Prefix) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	as, bs := encodeNets(a), encodeNets(b)
+	sort.Strings(as)
+	sort.Strings(bs)
+	for i := range as {
+		if as[i] != bs[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// snapshotsSince selects the snapshots returned by SnapshotStorage.Snapshots from all
+// snapshots, oldest first.
+func snapshotsSince(all []Snapshot, since time.Time) []Snapshot {
+	i := sort.Search(len(all), func(i int) bool { return all[i].Time.After(since) })
+	if i > 0 {
+		// include the snapshot in effect at since
+		i--
+	}
+	return append([]Snapshot{}, all[i:]...)
+}
@@ -2,8 +2,14 @@ package storage
 
 import (
 	"errors"
-	"net"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
+
+	"github.com/sirupsen/logrus"
 )
 
 var (
@@ -15,26 +21,144 @@ type storageFunc func(StorageOptions) (Storage, error)
 
 var storages = map[string]storageFunc{
 	"": newMemory, "default": newMemory, "memory": newMemory,
+	"bolt": newBolt, "postgres": newPostgres,
 }
 
 type ASStorage struct {
 	AS          string
-	IPv4        []*net.IPNet
-	IPv6        []*net.IPNet
+	IPv4        []netip.Prefix
+	IPv6        []netip.Prefix
 	FetchedIPv4 bool
 	FetchedIPv6 bool
+	// NotFound marks an AS the whois server had no networks for.
+	NotFound bool
+	// Expires is the time the entry expires at, set by Get and ignored by Set.
+	Expires time.Time
+	// Stored is the time the entry was stored at, set by Get and ignored by Set.
+	Stored time.Time
 }
 
-func (s ASStorage) IPAddresses() []*net.IPNet { return append(s.IPv4, s.IPv6...) }
+func (s ASStorage) IPAddresses() []netip.Prefix { return append(s.IPv4, s.IPv6...) }
+
+type Stats struct {
+	// Entries is the number of cached ASNs, including expired ones not yet purged.
+	Entries int
+	// Evictions counts entries dropped to stay within the configured size.
+	Evictions uint64
+	// Expired counts entries removed after their ttl expired.
+	Expired uint64
+	// Hits and Misses count Get calls answered from cache or not.
+	Hits   uint64
+	Misses uint64
+	// Ages is the time since each cached AS was stored.
+	Ages map[string]time.Duration
+}
 
 type Storage interface {
 	Get(as string) (ASStorage, error)
 	Set(as ASStorage) error
+	Delete(as string) error
+	Clear() error
+	Stats() (Stats, error)
+	Close() error
 }
 
 type StorageOptions struct {
 	Name string
 	TTL  time.Duration
+	// NegativeTTL is the ttl for ASNs which were not found.
+	NegativeTTL time.Duration
+	// MaxEntries limits the number of cached ASNs for in-memory backends, 0 is unlimited.
+	MaxEntries int
+	// SweepInterval is the interval expired entries are purged at by in-memory backends, 0 disables it.
+	SweepInterval time.Duration
+	// Snapshots is the number of previous prefix sets kept per AS, 0 disables snapshots.
+	Snapshots int
+	// History records when each prefix was first and last seen, always enabled for postgres.
+	History bool
+	// HistoryRetention is how long prefix changes are kept in the history, 0 keeps them forever.
+	HistoryRetention time.Duration
+	// Path is the database file for file based backends.
+	Path string
+	// DSN is the connection string for database backends.
+	DSN string
+	// Options holds backend specific settings.
+	Options map[string]string
+	// Logger receives the messages of the storage, defaults to the standard logger of logrus.
+	Logger logrus.FieldLogger
+}
+
+// ParseOptions parses a list of key=value pairs into a map suitable for StorageOptions.Options.
+func ParseOptions(pairs []string) (map[string]string, error) {
+	opts := map[string]string{}
+	for _, pair := range pairs {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, fmt.Errorf("invalid storage option %q, expected key=value", pair)
+		}
+		opts[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return opts, nil
+}
+
+func (o StorageOptions) String(key, def string) string {
+	if v, ok := o.Options[key]; ok {
+		return v
+	}
+	return def
+}
+
+func (o StorageOptions) Int(key string, def int) (int, error) {
+	v, ok := o.Options[key]
+	if !ok {
+		return def, nil
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("storage option %s must be an integer", key)
+	}
+	return i, nil
+}
+
+func (o StorageOptions) Duration(key string, def time.Duration) (time.Duration, error) {
+	v, ok := o.Options[key]
+	if !ok {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("storage option %s must be a duration", key)
+	}
+	return d, nil
+}
+
+// TTLStorage is implemented by storages whose ttls can be changed while they are in use, e.g.
+// when the configuration is reloaded. The new ttls apply to all entries, including stored ones.
+type TTLStorage interface {
+	SetTTL(ttl, negativeTTL time.Duration)
+}
+
+// ttls holds the ttls of a storage, embedded by all backends to implement TTLStorage.
+type ttls struct {
+	// ttl and negative are accessed atomically
+	ttl, negative int64
+}
+
+func newTTLs(opts StorageOptions) *ttls {
+	return &ttls{ttl: int64(opts.TTL), negative: int64(opts.NegativeTTL)}
+}
+
+// of returns the ttl of as.
+func (t *ttls) of(as ASStorage) time.Duration {
+	if as.NotFound {
+		return time.Duration(atomic.LoadInt64(&t.negative))
+	}
+	return time.Duration(atomic.LoadInt64(&t.ttl))
+}
+
+func (t *ttls) SetTTL(ttl, negativeTTL time.Duration) {
+	atomic.StoreInt64(&t.ttl, int64(ttl))
+	atomic.StoreInt64(&t.negative, int64(negativeTTL))
 }
 
 func NewStorage(opts StorageOptions) (Storage, error) {
@@ -42,5 +166,8 @@ func NewStorage(opts StorageOptions) (Storage, error) {
 	if !ok {
 		return nil, ErrStorageNotFound
 	}
+	if opts.Logger == nil {
+		opts.Logger = logrus.StandardLogger()
+	}
 	return v(opts)
 }